@@ -8,15 +8,15 @@ import (
 	"os"
 	"rangeexpr"
 	"rangestore"
-	"rangestore/etcdstore"
-	"rangestore/filestore"
+	_ "rangestore/stores"
 )
 
 func main() {
 	if len(os.Args) < 3 {
 		name := os.Args[0]
 		fmt.Printf("Usage: %v \"STORE\" \"EXPRESSION\"\n", name)
-		fmt.Printf("Example: %v file \"%%RANGE\n", name)
+		fmt.Printf("Example: %v filestore \"%%RANGE\n", name)
+		fmt.Printf("Example: %v \"plugin:///usr/local/bin/yarge-cmdb?arg=--region&arg=emea\" \"%%RANGE\"\n", name)
 		os.Exit(1)
 	}
 	store := os.Args[1]
@@ -32,30 +32,23 @@ func main() {
 	// build AST
 	r.Execute()
 
-	var _store interface{}
-	var err error
-	switch store {
-	case "teststore":
-		_store, err = rangestore.ConnectTestStore("Test Store") // this can never return error
-	case "filestore":
-		var path = "../rangestore/filestore/t"
-		var depth = -1
-		var fast = false
-		_store, err = filestore.ConnectFileStore(path, depth, fast)
-	case "etcdstore":
-		var hosts = []string{"http://127.0.0.1:13824"}
-		var roptimize = false
-		var fast = false
-		var node = ""
-		_store, err = etcdstore.ConnectEtcdStore(hosts, roptimize, fast, node)
-	default:
-		log.Fatalf(`Unknown store [%s] (Supports only "filestore", "teststore", "etcdstore"\n`, store)
+	// the stores by their names, or any spec (see rangestore.Open)
+	var specs = map[string]string{
+		"teststore": "test:",
+		"filestore": "file:../rangestore/filestore/t",
+		"etcdstore": "etcd://127.0.0.1:13824",
 	}
+	var spec = store
+	if s, ok := specs[store]; ok {
+		spec = s
+	}
+	_store, err := rangestore.Open(spec)
 	// if error, exit
 	if err != nil {
-		log.Fatalf("Error in Connecting to Store", err)
+		log.Fatalf("Error in Connecting to Store (Error: %s)", err)
 		return
 	}
+	defer _store.Close()
 	// evaluate AST
 	res, errs := r.Evaluate(_store)
 	// print the result
@@ -0,0 +1,32 @@
+// Serves a fake etcd (in-process, see rangestore/etcdstore/etcdtest) on
+// the port of the test etcd, to try out the programs without an etcd.
+// It starts empty, load it with yarge-sync, eg,
+//   go run fakeetcd.go &
+//   go run yarge-sync.go --from file:../rangestore/filestore/t --to "etcd://127.0.0.1:13824?lazy=1"
+//   go run example.go etcdstore "%RANGE"
+// NOTE: the data is lost when it exits
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"rangestore/etcdstore/etcdtest"
+	"syscall"
+)
+
+func main() {
+	log.SetFlags(log.Lshortfile)
+	server, err := etcdtest.NewServerAt("127.0.0.1:13824")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer server.Close()
+	log.Printf("Serving a Fake Etcd [%s]", server.URL)
+
+	var signals = make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	return
+}
@@ -0,0 +1,56 @@
+// Checks the reverse index in etcd against the cluster data, and repairs
+// the index if asked to. This is also the way to build the index for an
+// attribute on an already loaded etcd.
+// eg, go run rindexcheck.go --rindex AUTHORS,QAFOR --repair
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"rangestore/etcdstore"
+	"strings"
+)
+
+// globals
+var hosts string    // etcd hosts, comma separated
+var etcdroot string // where does the yarge root start in etcd
+var rindex string   // attributes having a reverse index
+var repair bool     // repair the drifted entries
+
+func main() {
+	log.SetFlags(log.Lshortfile)
+	flag.StringVar(&hosts, "hosts", "http://127.0.0.1:13824", "Etcd Hosts (comma separated)")
+	flag.StringVar(&etcdroot, "etcdroot", "", "Root for Range in Etcd Cluster")
+	flag.StringVar(&rindex, "rindex", "", "Attributes having a Reverse Index (comma separated)")
+	flag.BoolVar(&repair, "repair", false, "Repair the drifted entries")
+	flag.Parse()
+
+	if rindex == "" {
+		log.Fatal("Please give the attributes to check (--rindex)")
+	}
+
+	store, err := etcdstore.ConnectEtcdStore(strings.Split(hosts, ","), false, false, etcdroot)
+	if err != nil {
+		log.Fatal("Error in Connecting to Store ", err)
+	}
+	defer store.DisconnectEtcdStore()
+	store.RIndex = strings.Split(rindex, ",")
+
+	drifts, err := store.CheckReverseIndex(repair)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, drift := range drifts {
+		fmt.Printf("%s=%s index: %v actual: %v\n", drift.Attr, drift.Value, drift.Indexed, drift.Actual)
+	}
+	log.Printf("%d drifted entries (repaired: %t)", len(drifts), repair)
+
+	// non zero exit if the index is not consistent
+	if len(drifts) > 0 && !repair {
+		os.Exit(1)
+	}
+	return
+}
@@ -0,0 +1,84 @@
+// Copies a store into another (eg, the filestore kept in git into etcd),
+// the stores are given by their specs (see README). Only the clusters and
+// the keys which differ are written, so it can be run again and again to
+// keep the destination in sync with the source. Once synced, the indexes
+// of the destination (eg, the reverse indexes of etcd) are rebuilt.
+// eg,
+//   go run yarge-sync.go --from file:../rangestore/filestore/t --to "etcd://127.0.0.1:13824?lazy=1&rindex=AUTHORS"
+//   go run yarge-sync.go --from ... --to ... --dry-run
+// An empty etcd is not loaded yet, so it is opened lazy (lazy=1), it can
+// be served once synced.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"rangestore"
+	_ "rangestore/stores"
+)
+
+// globals
+var from string  // spec of the source
+var to string    // spec of the destination
+var dryRun bool  // only show the changes
+var prune bool   // delete what is not in the source
+var reindex bool // rebuild the indexes of the destination
+
+func main() {
+	log.SetFlags(log.Lshortfile)
+	flag.StringVar(&from, "from", "", "Spec of the Source Store (eg, file:///var/yarge)")
+	flag.StringVar(&to, "to", "", "Spec of the Destination Store (eg, etcd://127.0.0.1:4001)")
+	flag.BoolVar(&dryRun, "dry-run", false, "Show the Changes, without writing them")
+	flag.BoolVar(&prune, "prune", false, "Delete the Clusters and the Keys which are not in the Source")
+	flag.BoolVar(&reindex, "reindex", true, "Rebuild the Indexes of the Destination once synced")
+	flag.Parse()
+
+	if from == "" || to == "" {
+		log.Fatal("Please give the stores to sync (--from and --to)")
+	}
+
+	source, err := rangestore.Open(from)
+	if err != nil {
+		log.Fatal("Error in Opening the Source ", err)
+	}
+	defer source.Close()
+	destination, err := rangestore.Open(to)
+	if err != nil {
+		log.Fatal("Error in Opening the Destination ", err)
+	}
+	defer destination.Close()
+	// before anything is read, even a dry run is of a store we can write to
+	writable, ok := destination.(rangestore.WritableStore)
+	if !ok {
+		log.Fatalf("Destination [%s] is not Writable", to)
+	}
+
+	changes, err := rangestore.Sync(source, writable, prune, dryRun)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// like diff, non zero exit if the stores are not in sync
+	if dryRun {
+		log.Printf("%d changes (dry run, not written)", len(changes))
+		if len(changes) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	log.Printf("%d changes written", len(changes))
+
+	if reindexer, ok := destination.(rangestore.Reindexer); ok && reindex {
+		if err = reindexer.Reindex(); err != nil {
+			log.Fatal("Error in Rebuilding the Indexes ", err)
+		}
+		log.Println("Indexes rebuilt")
+	}
+	return
+}
@@ -3,32 +3,53 @@
 package main
 
 import (
-	"errors"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	// our packages
-	"rangeexpr"
+	"rangeserver"
 	"rangestore"
-	"rangestore/etcdstore"
-	"rangestore/filestore"
+	_ "rangestore/stores"
 )
 
 // globals
-var store string      // name of the store
-var params string     // path for filestore, server string for etcd, etc
-var slowlog int       // in ms, log queries slower than these
-var etcdroot string   // where does the yarge root start in etcd (useful for shared cluster)
-var serveraddr string // server address
-var fast bool         // is fast lookup okay
-var roptimize bool    // do we have reverse lookup optimization
-var debug bool        // debug
-var help bool         // help
+var configfile string           // config file (yaml), the flags below are ignored if set
+var store string                // name of the store
+var params string               // path for filestore, server string for etcd, etc
+var slowlog int                 // in ms, log queries slower than these
+var etcdroot string             // where does the yarge root start in etcd (useful for shared cluster)
+var serveraddr string           // server address
+var fast bool                   // is fast lookup okay
+var roptimize bool              // do we have reverse lookup optimization
+var mirror bool                 // serve lookups from a local mirror of the store
+var rindex string               // attributes having a reverse index (comma separated)
+var writable bool               // serve the REST endpoints to edit the store
+var ephemeral bool              // hosts can register themselves with a ttl
+var batchparallel int           // queries of a batch expanded at a time
+var readyinterval time.Duration // how often the store is checked for the readiness
+var maxresults int              // results of a lookup (or a part of a query)
+var maxcalls int                // store calls of a query
+var timeout time.Duration       // wall clock time of a query
+var maxconcurrent int           // requests at a time per client
+var proxies string              // addresses of the proxies in front of the server (comma separated)
+var cachettl time.Duration      // how long the lookups are cached
+var cachesize int               // lookups cached
+var stale bool                  // serve the last good answers when the store is unavailable
+var snapshot string             // file the last good answers are saved to
+var stalesize int               // last good answers kept
+var stalemaxage time.Duration   // age of the last good answers served
+var debug bool                  // debug
+var help bool                   // help
 
 // future need to closure the function with more data to be passed?
 func genericHandlerV1(fn func(http.ResponseWriter, *http.Request, interface{}), s interface{}) http.HandlerFunc {
@@ -41,18 +62,17 @@ func genericHandlerV1(fn func(http.ResponseWriter, *http.Request, interface{}),
 // * log the request
 // * log slow queries (clientip will the key to track a request)
 func requestHandler(w http.ResponseWriter, r *http.Request, s interface{}) {
-	var query string
-	var err error
-
 	var remoteaddr = fmt.Sprintf("%s:%s", r.Header.Get("X-Real-IP"), r.Header.Get("X-Real-Port"))
 	if remoteaddr == ":" {
 		remoteaddr = r.RemoteAddr
 	}
 
-	query, err = url.QueryUnescape(r.URL.RawQuery)
+	query, options, err := rangeserver.ParseQuery(r)
 	if err != nil {
 		log.Println("EROR> [%s] Request: [%s] Error: %s", remoteaddr, r.URL.RawQuery, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		w.Header().Set("Range-Err-Count", "1")
+		w.Header().Set("Range-Err-Code", rangeserver.CodeParse)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -61,37 +81,59 @@ func requestHandler(w http.ResponseWriter, r *http.Request, s interface{}) {
 	}
 
 	// exapand the query
-	var results *[]string
-	var errs []error
-
-	defer func() {
-		if _r := recover(); _r != nil {
-			errs = append(errs, errors.New(fmt.Sprintf("[%s] %s [Panicked while Expanding Query]", remoteaddr, query)))
-			results = &[]string{}
-			log.Printf("[%s] %s [Panicked while Expanding Query]", remoteaddr, query)
-		}
-	}()
-
-	// measure how long it took
-	t0 := time.Now()
-	// do the expand
-	results, errs = expandQuery(query, s)
-	t1 := time.Now()
-
-	timetaken := time.Duration(t1.Sub(t0)) / time.Microsecond
+	// partial=true returns the results along with the errors of the
+	// lookups, if the results could be evaluated (see rangeexpr.ExpandPartial)
+	var partial = options.Get("partial") == "true"
+	response, usable := rangeserver.Expand(query, s, partial)
+	var results = &response.Results
+	timetaken := time.Duration(response.TimingUs)
 
 	// set header with time taken to process thne request
 	w.Header().Set("Range-Expand-Microsecond", fmt.Sprintf("%d", timetaken))
+	// the store served stale answers to this query
+	rangeserver.SetStale(w, response)
+
+	// the status (and Range-Err-Code) tells what kind of error it was,
+	// eg, 404 for a missing cluster, 503 if the store is down
+	status, code := rangeserver.Status(response.Errors)
+	if len(response.Errors) > 0 {
+		w.Header().Set("Range-Err-Count", fmt.Sprintf("%d", len(response.Errors)))
+		w.Header().Set("Range-Err-Code", code)
+	}
+	// the limit the query went over
+	for _, e := range response.Errors {
+		if e.Limit != "" {
+			w.Header().Set("Range-Limit", e.Limit)
+		}
+	}
+	// partial results, the errors go in the headers (one per failed
+	// sub expression)
+	if len(response.Errors) > 0 && usable {
+		status = http.StatusOK
+		w.Header().Set("Range-Partial", "true")
+		for _, e := range response.Errors {
+			w.Header().Add("Range-Err", fmt.Sprintf("%s [%s] %s", e.Code, e.SubExpr, e.Message))
+		}
+	}
+
+	// json has both the results and the errors
+	if rangeserver.WantsJSON(r, options) {
+		err = rangeserver.WriteJSON(w, status, response)
+		if err != nil {
+			log.Printf("ERROR> [%s] %s (Writing back to Client Failed [Reason: %s])\n", remoteaddr, query, err)
+		}
+		logQuery(remoteaddr, query, results, timetaken)
+		return
+	}
 
 	// return the results to the client
-	// set the headers if we have errors
-	if len(errs) > 0 {
-		w.Header().Set("Range-Err-Count", fmt.Sprintf("%d", len(errs)))
+	// if we have errors, return them instead
+	if !usable {
 		var _errs = make([]string, 0)
-		for _, i := range errs {
-			_errs = append(_errs, fmt.Sprintf("%s", i))
+		for _, i := range response.Errors {
+			_errs = append(_errs, i.Message)
 		}
-		http.Error(w, strings.Join(_errs, ","), http.StatusInternalServerError)
+		http.Error(w, strings.Join(_errs, ","), status)
 		return
 	}
 
@@ -101,6 +143,13 @@ func requestHandler(w http.ResponseWriter, r *http.Request, s interface{}) {
 		log.Printf("ERROR> [%s] %s (Writing back to Client Failed [Reason: %s])\n", remoteaddr, query, err)
 	}
 
+	logQuery(remoteaddr, query, results, timetaken)
+	return
+}
+
+// log slow queries (and all when debugging)
+func logQuery(remoteaddr string, query string, results *[]string, timetaken time.Duration) {
+	var slowlog = current.Load().(*generation).config.Server.SlowLog
 	isSlow := timetaken > time.Duration(slowlog)*time.Microsecond
 	//	log.Println(timetaken, time.Duration(slowlog)*time.Microsecond)
 	if debug || isSlow {
@@ -114,33 +163,321 @@ func requestHandler(w http.ResponseWriter, r *http.Request, s interface{}) {
 	return
 }
 
-func expandQuery(query string, s interface{}) (*[]string, []error) {
-	// parse the query
-	var yr *rangeexpr.RangeExpr
+// what is being served, a generation is replaced by the next one when the
+// config is reloaded (SIGHUP). The requests being served hold it (read
+// lock) so that its stores are closed only after they are done.
+type generation struct {
+	sync.RWMutex
+	config   *rangeserver.Config
+	handler  http.Handler
+	clients  *rangeserver.ClientLimiter // requests at a time per client
+	readies  []*rangeserver.Readiness
+	closers  []func() // close the stores, etc
+	closed   bool
+	replaced chan bool // closed once the next generation is served
+}
+
+// the generation being served (*generation)
+var current atomic.Value
+
+// the certificate being served (*tls.Certificate), if https
+var certificate atomic.Value
 
-	yr = &rangeexpr.RangeExpr{Buffer: query}
-	// initialize
-	yr.Init()
-	yr.Expression.Init(query)
-	// parse the query
-	if err := yr.Parse(); err != nil {
-		return &[]string{}, []error{errors.New("Parse Error")}
+// serve the request with the current generation, if the generation got
+// closed while we waited for it, the request waits for the next one (on
+// shutdown, there is none)
+func serve(w http.ResponseWriter, r *http.Request) {
+	for {
+		var g = current.Load().(*generation)
+		g.RLock()
+		if !g.closed {
+			defer g.RUnlock()
+			g.handler.ServeHTTP(w, r)
+			return
+		}
+		g.RUnlock()
+		<-g.replaced
+	}
+}
+
+func startServer(config *rangeserver.Config) {
+	var server = &http.Server{Addr: config.Server.Listen, Handler: http.HandlerFunc(serve)}
+	if config.Server.TLS.Cert != "" {
+		if err := loadCertificate(config.Server.TLS); err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certificate.Load().(*tls.Certificate), nil
+		}}
+		log.Printf("Range WebServer Started [https://%s]", config.Server.Listen)
+		log.Fatal("ListenAndServeTLS: ", server.ListenAndServeTLS("", ""))
+	}
+	log.Printf("Range WebServer Started [%s]", config.Server.Listen)
+	log.Fatal("ListenAndServe: ", server.ListenAndServe())
+}
+
+// the handlers of the mounts, along with the ones of the server
+func newGeneration(config *rangeserver.Config) (g *generation, err error) {
+	g = &generation{config: config, replaced: make(chan bool)}
+	defer func() {
+		if err != nil {
+			g.close()
+		}
+	}()
+	if g.clients, err = rangeserver.NewClientLimiter(config.Server.Limits.MaxConcurrent, config.Server.Proxies); err != nil {
+		return g, err
+	}
+	var stores = make(map[string]rangestore.Store)
+	for _, name := range config.StoreNames() {
+		if _, err = openStore(g, config, name, stores); err != nil {
+			return g, fmt.Errorf("Error in Connecting to Store [%s] (Error: %w)", name, err)
+		}
 	}
-	// build AST
-	yr.Execute()
 
-	// evaluate AST
-	return yr.Evaluate(s)
+	var mux = http.NewServeMux()
+	// prometheus metrics
+	mux.Handle(rangeserver.MetricsPath, rangeserver.DefaultMetrics)
+	// liveness
+	mux.Handle(rangeserver.HealthPath, rangeserver.HealthHandler())
+	for _, m := range config.Mounts {
+		var store rangestore.Store
+		if m.Store != "" {
+			store = stores[m.Store]
+		} else {
+			var namespaces = make(map[string]rangestore.Store)
+			for namespace, name := range m.Namespaces {
+				namespaces[namespace] = stores[name]
+			}
+			store = rangestore.NewMountStore(namespaces)
+		}
+		var handler = mountHandler(g, m, store)
+		if m.Prefix == "/" {
+			mux.Handle("/", handler)
+		} else {
+			mux.Handle(m.Prefix, http.StripPrefix(strings.TrimSuffix(m.Prefix, "/"), handler))
+		}
+		log.Printf("Store Mounted [%s] (Store: %s, Namespaces: %v)", m.Prefix, m.Store, m.Namespaces)
+	}
+	// readiness of the server, all the mounts are ready
+	mux.Handle(rangeserver.ReadyPath, rangeserver.ReadyHandler(g.readies...))
+	g.handler = mux
+	return g, nil
 }
 
-func startServer(store interface{}) {
+// the endpoints of a mounted store
+func mountHandler(g *generation, m rangeserver.MountConfig, store rangestore.Store) http.Handler {
+	var mux = http.NewServeMux()
+	// the lookups of the queries are counted in the metrics, and the
+	// queries are within the limits
+	var instrumented = rangeserver.DefaultMetrics.InstrumentStore(store)
+	var limited = rangestore.WithLimits(instrumented, g.config.Server.Limits.Query())
 	// handling range requests
-	http.HandleFunc("/v1/range/", genericHandlerV1(requestHandler, store))
-	log.Printf("Range WebServer Started [%s]", serveraddr)
-	if err := http.ListenAndServe(serveraddr, nil); err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	mux.Handle("/v1/range/", g.clients.Limit(genericHandlerV1(requestHandler, limited)))
+	// libcrange compatible, /range/list? and /range/expand?
+	mux.Handle(rangeserver.CompatPrefix, g.clients.Limit(rangeserver.CompatHandler(limited)))
+	// many queries in one request
+	mux.Handle(rangeserver.BatchPath, g.clients.Limit(rangeserver.BatchHandler(limited, g.config.Server.Limits.BatchParallel)))
+	// readiness (store is up and loaded) and what the store has
+	var ready = rangeserver.NewReadiness(store, g.config.Server.ReadyInterval)
+	g.readies = append(g.readies, ready)
+	mux.Handle(rangeserver.ReadyPath, ready)
+	// the status and the edits are of the store, not of its cache
+	var backend = rangestore.Backend(store)
+	mux.Handle(rangeserver.StatusPath, rangeserver.StatusHandler(backend, ready))
+	// edits, if the store can be written to
+	if options, ok := g.config.Stores[m.Store]; ok && options.Writable {
+		var s = backend.(rangestore.WritableStore)
+		var r = registrar(g, s, options.Ephemeral)
+		mux.Handle(rangeserver.WritePrefix, rangeserver.WriteHandler(s, r))
+		log.Printf("Write Endpoints Enabled [%s]", path.Join(m.Prefix, rangeserver.WritePrefix)+"/")
 	}
-	return
+	return mux
+}
+
+// connect to the store (and the stores of a composite), the stores
+// already connected are in stores
+func openStore(g *generation, config *rangeserver.Config, name string, stores map[string]rangestore.Store) (rangestore.Store, error) {
+	if s, ok := stores[name]; ok {
+		return s, nil
+	}
+	var options = config.Stores[name]
+	var store rangestore.Store
+	if options.Type == rangeserver.StoreComposite {
+		var parts = make([]rangestore.Store, 0)
+		for _, part := range options.Stores {
+			s, err := openStore(g, config, part, stores)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, s)
+		}
+		var c = rangestore.NewCompositeStore(parts...)
+		c.Union = options.Union
+		store = c
+	} else {
+		spec, err := options.Spec()
+		if err != nil {
+			return nil, err
+		}
+		s, err := rangestore.Open(spec)
+		if err != nil {
+			return nil, err
+		}
+		g.closers = append(g.closers, s.Close)
+		// the caches of the store itself (eg, the mirror of etcd)
+		if c, ok := s.(rangestore.Cache); ok {
+			var cache = fmt.Sprintf("store-%s", name)
+			rangeserver.DefaultMetrics.AddCache(cache, c)
+			g.closers = append(g.closers, func() { rangeserver.DefaultMetrics.RemoveCache(cache, c) })
+		}
+		store = s
+	}
+	if _, ok := store.(rangestore.WritableStore); options.Writable && !ok {
+		return nil, fmt.Errorf("Store does not support writes (writable)")
+	}
+	if options.Stale.Enabled {
+		s, err := rangestore.NewStaleStore(store, options.Stale.Snapshot, options.Stale.Interval, options.Stale.Size, options.Stale.MaxAge)
+		if err != nil {
+			return nil, err
+		}
+		g.closers = append(g.closers, s.Close)
+		rangeserver.DefaultMetrics.AddStale(name, s)
+		g.closers = append(g.closers, func() { rangeserver.DefaultMetrics.RemoveStale(name, s) })
+		store = s
+	}
+	if options.Cache.TTL > 0 {
+		var c = rangestore.NewCachingStore(store, options.Cache.TTL, options.Cache.Size)
+		g.closers = append(g.closers, c.Close)
+		var cache = fmt.Sprintf("cache-%s", name)
+		rangeserver.DefaultMetrics.AddCache(cache, c)
+		g.closers = append(g.closers, func() { rangeserver.DefaultMetrics.RemoveCache(cache, c) })
+		store = c
+	}
+	stores[name] = store
+	return store, nil
+}
+
+// who handles the registrations of the hosts, etcd expires them
+// itself, for the other stores we sweep them
+func registrar(g *generation, s rangestore.WritableStore, ephemeral bool) rangestore.Registrar {
+	if !ephemeral {
+		return nil
+	}
+	if r, ok := s.(rangestore.Registrar); ok {
+		return r
+	}
+	var sweeper = rangestore.NewSweeper(s, time.Second)
+	g.closers = append(g.closers, sweeper.Stop)
+	return sweeper
+}
+
+// stop the readiness checks and close the stores, once the requests
+// being served are done
+func (g *generation) close() {
+	g.Lock()
+	defer g.Unlock()
+	g.closed = true
+	for _, r := range g.readies {
+		r.Stop()
+	}
+	for i := len(g.closers) - 1; i >= 0; i-- {
+		g.closers[i]()
+	}
+}
+
+// reload the config on SIGHUP, the connections are kept (only the
+// handlers are replaced). If the new config is not good, the current
+// one stays
+func reloadOnHangup() {
+	var hangup = make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		log.Printf("Reloading Config [%s]", configfile)
+		config, err := rangeserver.LoadConfig(configfile)
+		if err != nil {
+			log.Printf("EROR> Reload Failed, Serving the Current Config (Error: %s)", err)
+			continue
+		}
+		var old = current.Load().(*generation)
+		if config.Server.Listen != old.config.Server.Listen || (config.Server.TLS.Cert == "") != (old.config.Server.TLS.Cert == "") {
+			log.Printf("EROR> Listen Address and TLS (on/off) Changes need a Restart, Ignoring them")
+			config.Server.Listen, config.Server.TLS = old.config.Server.Listen, old.config.Server.TLS
+		}
+		if config.Server.TLS.Cert != "" {
+			if err = loadCertificate(config.Server.TLS); err != nil {
+				log.Printf("EROR> Reload Failed, Serving the Current Config (Error: %s)", err)
+				continue
+			}
+		}
+		g, err := newGeneration(config)
+		if err != nil {
+			log.Printf("EROR> Reload Failed, Serving the Current Config (Error: %s)", err)
+			continue
+		}
+		current.Store(g)
+		close(old.replaced)
+		go old.close()
+		log.Printf("Config Reloaded [%s]", configfile)
+	}
+}
+
+func loadCertificate(c rangeserver.TLSConfig) error {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return fmt.Errorf("Loading the Certificate [%s] Failed (Error: %s)", c.Cert, err)
+	}
+	certificate.Store(&cert)
+	return nil
+}
+
+// the config of the flags, a single store mounted at /
+func flagsConfig() (*rangeserver.Config, error) {
+	var options = rangeserver.StoreConfig{Fast: fast, Writable: writable, Ephemeral: ephemeral}
+	options.Cache = rangeserver.CacheConfig{TTL: cachettl, Size: cachesize}
+	options.Stale = rangeserver.StaleConfig{Enabled: stale, Snapshot: snapshot, Interval: time.Minute, Size: stalesize, MaxAge: stalemaxage}
+	var name = store
+	switch store {
+	case "teststore":
+		options.Type = rangeserver.StoreTest
+	case "filestore":
+		options.Type, options.Path = rangeserver.StoreFile, params
+	case "etcdstore":
+		options.Type, options.Hosts, options.Root = rangeserver.StoreEtcd, []string{params}, etcdroot
+		options.ROptimize, options.Mirror = roptimize, mirror
+		if rindex != "" {
+			options.RIndex = strings.Split(rindex, ",")
+		}
+	case "httpstore":
+		options.Type, options.Hosts = rangeserver.StoreHTTP, strings.Split(params, ",")
+	case "pluginstore":
+		options.Type, options.Command = rangeserver.StorePlugin, strings.Fields(params)
+	default:
+		// or the spec of any store, eg, file:///var/yarge?fast=1
+		if !strings.Contains(store, ":") {
+			return nil, fmt.Errorf(`Unknown store [%s] (Supports only "filestore", "teststore", "etcdstore", "httpstore", "pluginstore" or a spec, eg, file:///var/yarge)`, store)
+		}
+		options.URL, name = store, "store"
+	}
+	var config = &rangeserver.Config{
+		Server: rangeserver.ServerConfig{
+			Listen:        serveraddr,
+			SlowLog:       slowlog,
+			ReadyInterval: readyinterval,
+			Limits: rangeserver.Limits{
+				BatchParallel: batchparallel,
+				MaxResults:    maxresults,
+				MaxCalls:      maxcalls,
+				Timeout:       timeout,
+				MaxConcurrent: maxconcurrent,
+			},
+		},
+		Stores: map[string]rangeserver.StoreConfig{name: options},
+		Mounts: []rangeserver.MountConfig{{Prefix: "/", Store: name}},
+	}
+	if proxies != "" {
+		config.Server.Proxies = strings.Split(proxies, ",")
+	}
+	return config, config.Validate()
 }
 
 // init function to set up whatever state is required
@@ -158,48 +495,58 @@ func init() {
 func main() {
 	// set log to get the code location
 	log.SetFlags(log.Lshortfile)
-	// create an connection to store
-	var _store interface{}
+	// the config file, or the flags
+	var config *rangeserver.Config
 	var err error
-	switch store {
-	case "teststore":
-		_store, err = rangestore.ConnectTestStore("Test Store") // this can never return error
-		defer func() {
-			_store.(*rangestore.TestStore).DisconnectTestStore()
-		}()
-	case "filestore":
-		var path = params
-		var depth = -1
-		_store, err = filestore.ConnectFileStore(path, depth, fast)
-		defer func() {
-			_store.(*filestore.FileStore).DisconnectFileStore()
-		}()
-	case "etcdstore":
-		var hosts = []string{params}
-		_store, err = etcdstore.ConnectEtcdStore(hosts, roptimize, fast, etcdroot)
-		defer func() {
-			_store.(*etcdstore.EtcdStore).DisconnectEtcdStore()
-		}()
-	default:
-		log.Fatalf(`Unknown store [%s] (Supports only "filestore", "teststore", "etcdstore"\n`, store)
+	if configfile != "" {
+		config, err = rangeserver.LoadConfig(configfile)
+	} else {
+		config, err = flagsConfig()
 	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	// create the connections to the stores
+	g, err := newGeneration(config)
 	// if error, exit
 	if err != nil {
-		log.Fatalf("Error in Connecting to Store", err)
-		return
+		log.Fatal(err)
 	}
+	current.Store(g)
+	if configfile != "" {
+		go reloadOnHangup()
+	}
+	go closeOnTerm()
 
-	startServer(_store)
+	startServer(config)
 }
 
 // parse the flags
 func parseFlags() {
+	flag.StringVar(&configfile, "config", "", "Config File (YAML), Reloaded on SIGHUP")
 	flag.StringVar(&store, "store", "teststore", "Store Name")
 	flag.StringVar(&params, "params", "", "Store Parameters")
 	flag.IntVar(&slowlog, "slowlog", 3, "Microseconds definition of Slow Query")
 	flag.StringVar(&etcdroot, "etcdroot", "", "Root for Range in Etcd Cluster")
 	flag.BoolVar(&fast, "fast", false, "Fast Lookup, return the first result")
 	flag.BoolVar(&roptimize, "roptimize", true, "Reverse Lookup Optimization")
+	flag.BoolVar(&mirror, "mirror", false, "Serve lookups from a local mirror of the store (etcdstore)")
+	flag.StringVar(&rindex, "rindex", "", "Attributes having a Reverse Index (etcdstore)")
+	flag.BoolVar(&writable, "writable", false, "Serve the REST endpoints to edit the store")
+	flag.BoolVar(&ephemeral, "ephemeral", false, "Hosts can register themselves with a TTL (registration needs --writable)")
+	flag.IntVar(&batchparallel, "batchparallel", 8, "Queries of a Batch (POST /v1/batch) Expanded Concurrently")
+	flag.IntVar(&maxresults, "maxresults", 0, "Max Results of a Lookup (or a part of the Query)")
+	flag.IntVar(&maxcalls, "maxcalls", 0, "Max Store Calls of a Query")
+	flag.DurationVar(&timeout, "timeout", 0, "Max Time a Query can Take")
+	flag.IntVar(&maxconcurrent, "maxconcurrent", 0, "Max Requests at a Time per Client")
+	flag.StringVar(&proxies, "proxies", "", "Addresses (or Networks) of the Proxies in front of the Server, their X-Real-IP is the Client")
+	flag.DurationVar(&cachettl, "cachettl", 0, "How long the Lookups are Cached (dropped sooner if the Store Changes)")
+	flag.IntVar(&cachesize, "cachesize", 100000, "Max Lookups Cached")
+	flag.BoolVar(&stale, "stale", false, "Serve the Last Good Answers when the Store is Unavailable")
+	flag.StringVar(&snapshot, "snapshot", "", "File the Last Good Answers are Saved to (every minute), Served on Restart until the Store is Back (needs --stale)")
+	flag.IntVar(&stalesize, "stalesize", 100000, "Max Last Good Answers Kept (needs --stale)")
+	flag.DurationVar(&stalemaxage, "stalemaxage", 0, "Max Age of the Last Good Answers Served (needs --stale)")
+	flag.DurationVar(&readyinterval, "readyinterval", 5*time.Second, "How often the Store is Checked for the Readiness (GET /readyz)")
 	flag.StringVar(&serveraddr, "serveraddr", "0.0.0.0:9999", "Server Address")
 	flag.BoolVar(&debug, "debug", false, "Debug")
 	flag.BoolVar(&help, "help", false, "Good Ol' Help")
@@ -210,16 +557,45 @@ func parseFlags() {
 	return
 }
 
+// close the stores (snapshots are saved, etc) before exiting, once the
+// requests being served are done
+func closeOnTerm() {
+	var term = make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	<-term
+	log.Printf("Shutting Down")
+	current.Load().(*generation).close()
+	os.Exit(0)
+}
+
 // print Help
 func printHelp() {
 	fmt.Println(
 		`Usage: rangerserver [OPTIONS]
- --store ................ Store Name, it can be "teststore", "filestore" or "etcdstore" (default: "teststore")
- --params ............... Parameters for Store, (default: filestore - /var/yarge/, etcdstore - http://127.0.0.1:4001)
- --slowlog .............. Any Query that takes more than this param in ns will be logged (default: 10ns)
+ --config ............... Config File (YAML) with the Stores, Mounts and Server Settings, Reloaded on SIGHUP (the options below are ignored)
+ --store ................ Store Name, it can be "teststore", "filestore", "etcdstore", "httpstore", "pluginstore" or the spec of a store, eg, file:///var/yarge?fast=1, etcd://h1:4001,h2:4001/yarge?roptimize=1 (default: "teststore")
+ --params ............... Parameters for Store, (default: filestore - /var/yarge/, etcdstore - http://127.0.0.1:4001, httpstore - comma separated yargeservers, eg, http://yarge1:9999,http://yarge2:9999, pluginstore - the command, eg, "/usr/local/bin/yarge-cmdb --region emea")
+ --slowlog .............. Any Query that takes more than this param in microseconds will be logged, 0 logs every query (default: 3)
  --etcdroot ............. The yarge node root in etcd, useful for shared cluster (default: "")
  --fast ................. Enable Fast Lookup, return the first result for reverse lookups
  --roptimize ............ Enable reverse lookup optimization  
+ --mirror ............... Serve lookups from a local mirror kept current by watching etcd (etcdstore only)
+ --rindex ............... Comma separated attributes having a reverse index in etcd, eg, AUTHORS,QAFOR (etcdstore only)
+ --writable ............. Serve the REST endpoints to create/delete clusters and edit keys under /v1/cluster/ (filestore, etcdstore)
+ --ephemeral ............ Hosts can register in NODES with a TTL and renew it by heartbeat, PUT /v1/cluster/<cluster>/NODES/<host>?ttl=30s (registration needs --writable)
+ --batchparallel ........ Queries of a Batch (POST /v1/batch) Expanded Concurrently (default: 8)
+ --maxresults ........... Max Results of a Lookup (or a part of the Query), 422 if more (default: 0, no limit)
+ --maxcalls ............. Max Store Calls of a Query, 422 if more (default: 0, no limit)
+ --timeout .............. Max Time a Query can Take, eg, 10s, 422 if longer (default: 0, no limit)
+ --maxconcurrent ........ Max Requests at a Time per Client (its address, or the X-Real-IP of a proxy), 429 if more (default: 0, no limit)
+ --proxies .............. Comma separated Addresses (or Networks) of the Proxies in front of the Server, eg, 10.0.0.1,10.1.0.0/16, their X-Real-IP is the Client (default: "", none)
+ --cachettl ............. How long the Lookups are Cached, eg, 30s, dropped as soon as the Store Changes (etcd watch, file events) (default: 0, no cache)
+ --cachesize ............ Max Lookups Cached, the Least Recently Used are Dropped (default: 100000)
+ --stale ................ Serve the Last Good Answers when the Store is Unavailable, marked with Range-Stale and Range-Stale-Age (seconds) headers
+ --snapshot ............. File the Last Good Answers are Saved to (every minute), a Restarted Server Serves it until the Store is Back (needs --stale)
+ --stalesize ............ Max Last Good Answers Kept, the Least Recently Used are Dropped (default: 100000, negative is no limit)
+ --stalemaxage .......... Max Age of the Last Good Answers Served, eg, 24h (default: 0, no limit)
+ --readyinterval ........ How often the Store is Checked (connectivity, _range_store) for the Readiness, GET /readyz (default: 5s)
  --serveraddr ........... Server Listening Port (default: 0.0.0.0:9999)
  --debug ................ Debug
  --help ................. Good Ol' Help`,
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -10,13 +11,27 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"rangeserver"
 	"strings"
 )
 
+// exit codes, so that the scripts can tell a missing cluster from
+// the store being down
+const (
+	exitOK          = 0
+	exitError       = 1 // any other error
+	exitParse       = 2 // query (or a name in it) is not valid
+	exitNotFound    = 3 // no such cluster or key
+	exitUnavailable = 4 // the rangeserver (or its store) is down
+	exitLimit       = 5 // query went over a limit of the rangeserver
+)
+
 //globals
 var debug bool
 var help bool
 var timing bool
+var jsonout bool
+var partial bool
 var vip string
 
 func init() {
@@ -32,6 +47,8 @@ func parseFlags() {
 	flag.BoolVar(&debug, "debug", false, "enable debug")
 	flag.BoolVar(&help, "help", false, "Help")
 	flag.BoolVar(&timing, "timing", false, "display timing")
+	flag.BoolVar(&jsonout, "json", false, "JSON output (results, errors and timing)")
+	flag.BoolVar(&partial, "partial", false, "Partial results, along with the errors of the failed lookups")
 	flag.StringVar(&vip, "vip", "localhost", "VIP endpoint")
 	flag.Parse()
 	return
@@ -43,9 +60,19 @@ func printHelp() {
 	eg: %s %%RANGE
 	--debug .................... Debug
 	--help ..................... Good Ol' Help
+	--json ..................... JSON output, has the results along with the errors (and which part of the query failed)
+	--partial .................. Partial Results, print the results in spite of the failed lookups (errors go to stderr)
 	--timing ................... Execution Time as provided by rangeserver
 	--vip ...................... Range VIP Endpoint (default: localhost:9999)
 
+Exit Codes:
+	0 .......................... Success
+	1 .......................... Error
+	2 .......................... Parse Error or Invalid Name
+	3 .......................... Cluster or Key Not Found
+	4 .......................... Rangeserver or its Store is Unavailable
+	5 .......................... Query Limit Exceeded
+
 Documentation: https://github.com/vigith/yarge
 `, os.Args[0], os.Args[0])
 	os.Exit(0)
@@ -63,16 +90,26 @@ func main() {
 	}
 
 	_url := fmt.Sprintf("http://%s/v1/range/list?%s", vip, url.QueryEscape(query))
+	if partial {
+		_url += "&partial=true"
+	}
 	if debug {
 		fmt.Println("Range URL: ", _url)
 	}
+	if jsonout {
+		os.Exit(getJSON(_url))
+	}
 	res, err := http.Get(_url)
-	// fatal out if we have error
-	if err != nil || res.StatusCode != 200 {
+	// exit if we have error
+	if err != nil {
+		_url_human, _ := url.QueryUnescape(_url)
+		log.Printf("ERROR, URL: (%s) HTTP_Errors: (%v)\n", _url_human, err)
+		os.Exit(exitUnavailable)
+	} else if res.StatusCode != 200 {
 		_url_human, _ := url.QueryUnescape(_url)
 		results, _ := ioutil.ReadAll(res.Body)
-		log.Printf("ERROR, URL: (%s) Error: (%s) HTTP_Errors: (%v)\n", _url_human, strings.TrimSuffix(string(results), "\n"), err)
-		os.Exit(1)
+		log.Printf("ERROR, URL: (%s) Error: (%s) HTTP_Status: (%s) Error_Code: (%s)\n", _url_human, strings.TrimSuffix(string(results), "\n"), res.Status, res.Header.Get("Range-Err-Code"))
+		os.Exit(exitCode(res.StatusCode))
 	}
 
 	results, err := ioutil.ReadAll(res.Body)
@@ -87,12 +124,64 @@ func main() {
 		fmt.Printf("Range-Expand-Microsecond: %s \n", res.Header.Get("Range-Expand-Microsecond"))
 	}
 
-	// if error, print the error
-	if res.Header.Get("Range-Err-Count") != "" {
-		fmt.Printf("%s", res.Header.Get("Range-Err-Count"))
-	} else { // else print the result
-		fmt.Printf("%s\n", results)
+	fmt.Printf("%s\n", results)
+
+	// partial results, exit with the code of the error
+	if res.Header.Get("Range-Partial") != "" {
+		for _, e := range res.Header.Values("Range-Err") {
+			log.Printf("ERROR, %s\n", e)
+		}
+		status, _ := rangeserver.Status([]rangeserver.QueryError{{Code: res.Header.Get("Range-Err-Code")}})
+		os.Exit(exitCode(status))
 	}
 
 	return
 }
+
+// query asking for a json response, print it as is. Returns the
+// exit code, non zero if the query had errors
+func getJSON(_url string) int {
+	req, err := http.NewRequest("GET", _url, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("ERROR, URL: (%s) HTTP_Errors: (%v)\n", _url, err)
+		return exitUnavailable
+	}
+	defer res.Body.Close()
+
+	var response rangeserver.Response
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil {
+		log.Printf("ERROR, URL: (%s) Error: (Not a JSON Response [HTTP Status: %s] %s)\n", _url, res.Status, err)
+		return exitCode(res.StatusCode)
+	}
+	out, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s\n", out)
+
+	// partial results, exit with the code of the error
+	status, _ := rangeserver.Status(response.Errors)
+	return exitCode(status)
+}
+
+// exit code for the http status of the rangeserver
+func exitCode(status int) int {
+	switch status {
+	case http.StatusOK:
+		return exitOK
+	case http.StatusBadRequest:
+		return exitParse
+	case http.StatusNotFound:
+		return exitNotFound
+	case http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return exitUnavailable
+	case http.StatusUnprocessableEntity:
+		return exitLimit
+	}
+	return exitError
+}
@@ -0,0 +1,37 @@
+package rangeexpr
+
+import (
+	"errors"
+)
+
+// returned (as a ParseError) when the query can't be parsed
+var ErrParse = errors.New("Parse Error")
+
+// EvalError is the error of a lookup, along with the sub expression
+// of the query which failed, eg, %ops-prod:NODES in %ops-prod:NODES,%data
+type EvalError struct {
+	SubExpr string // sub expression which failed
+	Err     error  // error from the store
+}
+
+func (e *EvalError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// ParseError is the error when the query is not a valid range expression
+type ParseError struct {
+	Query string // the query
+	Err   error  // error from the parser
+}
+
+func (e *ParseError) Error() string {
+	return ErrParse.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return ErrParse
+}
@@ -4,8 +4,11 @@
 package rangeexpr
 
 import (
+	"fmt"
 	"rangeops"
 	"rangestore"
+	"strings"
+	"time"
 )
 
 type Type uint8
@@ -25,6 +28,18 @@ const (
 	typeKeyReverseLookupHint
 )
 
+// names of the operations, for the shape of the query
+var typeNames = map[Type]string{
+	typeUnion:                "union",
+	typeIntersection:         "intersection",
+	typeDifference:           "difference",
+	typeClusterLookup:        "cluster",
+	typeKeyLookup:            "key",
+	typeKeyReverseLookup:     "reverse",
+	typeKeyReverseLookupAttr: "reverse_attr",
+	typeKeyReverseLookupHint: "reverse_hint",
+}
+
 // each token will be represented as a bytecode
 type ByteCode struct {
 	T     Type
@@ -34,13 +49,15 @@ type ByteCode struct {
 // each expression once parsed will be represented an array
 // of bytecodes and the number of bytecodes in the array
 type Expression struct {
-	Code []ByteCode
-	Top  int
+	Code  []ByteCode
+	Top   int
+	query string // the expression, for the errors of the whole query
 }
 
 // create a slice to hold the expression as bytecodes
 func (e *Expression) Init(expression string) {
 	e.Code = make([]ByteCode, len(expression))
+	e.query = expression
 }
 
 // add an operator on to the expression array
@@ -62,15 +79,86 @@ func (e *Expression) addValue(value string) {
 // Accepts the interface for connection to store.
 // Returns a pointer to array of strings (result) and error
 func (e *Expression) Evaluate(s interface{}) (*[]string, []error) {
+	result, errs, _ := e.evaluate(s)
+	return result, errs
+}
+
+// evaluates the expression, along with the result and the errors it
+// tells whether the result is usable even though some lookups failed.
+// A failed operand (a lookup which returned an error, or a set operation
+// on it) contributes,
+//   - to a union, an empty set (the result has the rest of the union)
+//   - to an intersection or a difference, an error (the result is empty
+//     and fails in turn), as the result could have hosts it should not
+// If the store has limits (rangestore.LimitsStore, or the store as seen
+// by the query, rangestore.LimitedStore), going over one fails the whole
+// query (no partial results).
+func (e *Expression) evaluate(s interface{}) (*[]string, []error, bool) {
 	// simplest case, no ByteCode because expr was an empty string
 	if len(e.Code) == 0 {
-		return nil, nil
+		return nil, nil, true
 	}
 
 	// typecast the store (s) to the generic store
 	var store rangestore.Store
 	store = s.(rangestore.Store)
 
+	// the store as seen by this query, if there are limits
+	if limited, ok := s.(*rangestore.LimitedStore); ok {
+		if timeout := limited.Limits().Timeout; timeout > 0 {
+			return e.runWithin(limited, timeout)
+		}
+		return e.run(limited, limited)
+	}
+	if l, ok := s.(rangestore.LimitsStore); ok {
+		var limits = l.QueryLimits()
+		var limited = rangestore.NewLimitedStore(l, limits)
+		if limits.Timeout > 0 {
+			return e.runWithin(limited, limits.Timeout)
+		}
+		return e.run(limited, limited)
+	}
+	return e.run(store, nil)
+}
+
+// evaluate in the background, so that a lookup taking long doesn't hold
+// the query past the timeout (the lookups after the timeout fail anyway,
+// and the stores give up on the ones being done, see rangestore.Tracker)
+func (e *Expression) runWithin(limited *rangestore.LimitedStore, timeout time.Duration) (*[]string, []error, bool) {
+	type evaluated struct {
+		results  *[]string
+		errs     []error
+		ok       bool
+		panicked interface{}
+	}
+	var done = make(chan evaluated, 1)
+	go func() {
+		// the panic is for the caller, as if we were not in the background
+		defer func() {
+			if r := recover(); r != nil {
+				done <- evaluated{panicked: r}
+			}
+		}()
+		results, errs, ok := e.run(limited, limited)
+		done <- evaluated{results: results, errs: errs, ok: ok}
+	}()
+
+	var timer = time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case d := <-done:
+		if d.panicked != nil {
+			panic(d.panicked)
+		}
+		return d.results, d.errs, d.ok
+	case <-timer.C:
+		var err = &rangestore.LimitError{Limit: rangestore.LimitTimeout, Value: timeout.String()}
+		return &[]string{}, []error{&EvalError{SubExpr: e.query, Err: err}}, false
+	}
+}
+
+// the evaluation, limited (if not nil) is the store with the limits
+func (e *Expression) run(store rangestore.Store, limited *rangestore.LimitedStore) (*[]string, []error, bool) {
 	// Create an array of errors
 	var errs = make([]error, 0)
 
@@ -78,6 +166,9 @@ func (e *Expression) Evaluate(s interface{}) (*[]string, []error) {
 	// to track the stack. stack pointers will undergo inplace
 	// modifications
 	stack, top := make([]*[]string, len(e.Code)), 0 // array of point to array of string
+	// the sub expression (as in the query) for each element in the stack,
+	// so that errors can tell which part of the query failed
+	exprs := make([]subExpr, len(e.Code))
 	// Rules:
 	// =====
 	// Rule 0: Follow the my basic rules, we will get our AST processed in
@@ -107,6 +198,7 @@ func (e *Expression) Evaluate(s interface{}) (*[]string, []error) {
 		case typeData:
 			// convert the data as an array string
 			stack[top] = &[]string{code.Value}
+			exprs[top] = subExpr{text: code.Value}
 			top++
 
 		// Cluster Lookup
@@ -140,9 +232,11 @@ func (e *Expression) Evaluate(s interface{}) (*[]string, []error) {
 			result, err := store.ClusterLookup(stack[top-1])
 			// store the addr of the result
 			stack[top-1] = result
+			exprs[top-1] = subExpr{text: "%" + exprs[top-1].group(), err: exprs[top-1].err}
 			// append the errors
 			if err != nil {
-				errs = append(errs, err)
+				exprs[top-1].err = &EvalError{SubExpr: exprs[top-1].text, Err: err}
+				errs = append(errs, exprs[top-1].err)
 			}
 
 		case typeKeyLookup:
@@ -157,13 +251,15 @@ func (e *Expression) Evaluate(s interface{}) (*[]string, []error) {
 				rangeops.ArrayToSet(result)
 				stack[top-2] = result
 			}
+			exprs[top-2] = subExpr{text: "%" + exprs[top-2].group() + ":" + exprs[top-1].text, err: exprs[top-2].err}
 			// reset top to nil, that value is no more useful to us
 			stack[top-1] = nil
 			// binary operator, pops of 2 elements to produce a result
 			top--
 			// append the errors
 			if err != nil {
-				errs = append(errs, err)
+				exprs[top-1].err = &EvalError{SubExpr: exprs[top-1].text, Err: err}
+				errs = append(errs, exprs[top-1].err)
 			}
 
 		// Reverse Lookup
@@ -200,9 +296,11 @@ func (e *Expression) Evaluate(s interface{}) (*[]string, []error) {
 			result, err := store.KeyReverseLookup((*stack[top-1])[0])
 			// store the addr of the result
 			stack[top-1] = result
+			exprs[top-1] = subExpr{text: "*" + exprs[top-1].text, err: exprs[top-1].err}
 			// append the errors
 			if err != nil {
-				errs = append(errs, err)
+				exprs[top-1].err = &EvalError{SubExpr: exprs[top-1].text, Err: err}
+				errs = append(errs, exprs[top-1].err)
 			}
 
 		case typeKeyReverseLookupAttr:
@@ -214,19 +312,22 @@ func (e *Expression) Evaluate(s interface{}) (*[]string, []error) {
 			result, err := store.KeyReverseLookupAttr((*stack[top-2])[0], (*stack[top-1])[0])
 			// store the addr of the result
 			stack[top-2] = result
+			exprs[top-2] = subExpr{text: "*" + exprs[top-2].text + ";" + exprs[top-1].text, err: exprs[top-2].err}
 			// reset top to nil, that value is no more useful to us
 			stack[top-1] = nil
 			// binary operator, pops of 2 elements to produce a result
 			top--
 			// append the errors
 			if err != nil {
-				errs = append(errs, err)
+				exprs[top-1].err = &EvalError{SubExpr: exprs[top-1].text, Err: err}
+				errs = append(errs, exprs[top-1].err)
 			}
 
 		case typeKeyReverseLookupHint:
 			result, err := store.KeyReverseLookupHint((*stack[top-3])[0], (*stack[top-2])[0], (*stack[top-1])[0])
 			// store the addr of the result
 			stack[top-3] = result
+			exprs[top-3] = subExpr{text: "*" + exprs[top-3].text + ";" + exprs[top-2].text + ":" + exprs[top-1].text, err: exprs[top-3].err}
 			// reset top to nil, that value is no more useful to us
 			stack[top-2] = nil
 			// reset top most to nil, that value is no more useful to us
@@ -236,7 +337,8 @@ func (e *Expression) Evaluate(s interface{}) (*[]string, []error) {
 			top--
 			// append the errors
 			if err != nil {
-				errs = append(errs, err)
+				exprs[top-1].err = &EvalError{SubExpr: exprs[top-1].text, Err: err}
+				errs = append(errs, exprs[top-1].err)
 			}
 
 		// Range Set Operations
@@ -248,6 +350,13 @@ func (e *Expression) Evaluate(s interface{}) (*[]string, []error) {
 			rangeops.Union(stack[top-2], stack[top-1], &result)
 			// store the addr of the result
 			stack[top-2] = &result
+			// a failed operand is an empty set, the union fails only if
+			// both did
+			var failed error
+			if exprs[top-2].err != nil && exprs[top-1].err != nil {
+				failed = exprs[top-2].err
+			}
+			exprs[top-2] = subExpr{text: exprs[top-2].group() + "," + exprs[top-1].text, compound: true, err: failed}
 			// reset top to nil, that value is no more useful to us
 			stack[top-1] = nil
 			top-- // merged two values to 1
@@ -255,21 +364,142 @@ func (e *Expression) Evaluate(s interface{}) (*[]string, []error) {
 		case typeIntersection:
 			var result = make([]string, 0)
 			rangeops.Intersection(stack[top-2], stack[top-1], &result)
+			var expr = subExpr{text: exprs[top-2].group() + ",&" + exprs[top-1].text, compound: true}
+			// a failed operand fails the intersection
+			if expr.err = operandFailed(expr, exprs[top-2], exprs[top-1]); expr.err != nil {
+				result = []string{}
+				errs = append(errs, expr.err)
+			}
 			// store the addr of the result
 			stack[top-2] = &result
+			exprs[top-2] = expr
 			top-- // merged two values to 1
 
 		case typeDifference:
 			var result = make([]string, 0)
 			rangeops.Difference(stack[top-2], stack[top-1], &result)
+			var expr = subExpr{text: exprs[top-2].group() + ",-" + exprs[top-1].text, compound: true}
+			// a failed operand fails the difference
+			if expr.err = operandFailed(expr, exprs[top-2], exprs[top-1]); expr.err != nil {
+				result = []string{}
+				errs = append(errs, expr.err)
+			}
 			// store the addr of the result
 			stack[top-2] = &result
+			exprs[top-2] = expr
 			top-- // merged two values to 1
 
 		} // switch
 
+		// a limit hit (here or in the store) fails the whole query
+		if limited != nil {
+			if err := limited.CheckResults(len(*stack[top-1])); err != nil {
+				return &[]string{}, []error{&EvalError{SubExpr: exprs[top-1].text, Err: err}}, false
+			}
+		}
+
 		ptr++
 	}
 
-	return stack[0], errs
+	return stack[0], errs, exprs[0].err == nil
+}
+
+// error of the set operation (expr) if either of its operands failed,
+// nil otherwise
+func operandFailed(expr subExpr, left subExpr, right subExpr) error {
+	var failed, operand = left.err, left.text
+	if failed == nil {
+		failed, operand = right.err, right.text
+	}
+	if failed == nil {
+		return nil
+	}
+	return &EvalError{SubExpr: expr.text, Err: fmt.Errorf("Operand [%s] Failed (Error: %w)", operand, failed)}
+}
+
+// Expand parses the query and evaluates it against the store
+func Expand(query string, s interface{}) (*[]string, []error) {
+	results, errs, _ := ExpandPartial(query, s)
+	return results, errs
+}
+
+// ExpandPartial is Expand, which also tells whether the results can be
+// used in spite of the errors, ie, the failed lookups were only in unions
+// (see evaluate)
+func ExpandPartial(query string, s interface{}) (*[]string, []error, bool) {
+	results, errs, ok, _ := ExpandShape(query, s)
+	return results, errs, ok
+}
+
+// ExpandShape is ExpandPartial, which also tells the shape of the query
+// (see Shape) without parsing it again
+func ExpandShape(query string, s interface{}) (*[]string, []error, bool, string) {
+	var yr = &RangeExpr{Buffer: query}
+	// initialize
+	yr.Init()
+	yr.Expression.Init(query)
+	// parse the query
+	if err := yr.Parse(); err != nil {
+		return &[]string{}, []error{&ParseError{Query: query, Err: err}}, false, "invalid"
+	}
+	// build AST
+	yr.Execute()
+	var shape = yr.shape()
+
+	// evaluate AST
+	results, errs, ok := yr.evaluate(s)
+	// empty query
+	if results == nil {
+		results = &[]string{}
+	}
+	return results, errs, ok, shape
+}
+
+// Shape of the query, the operations it has (in a fixed order, joined by
+// +), eg, union+cluster+key for %ops:NODES,%data. The shape of an empty
+// query is "empty" and of one which doesn't parse is "invalid"
+func Shape(query string) string {
+	var yr = &RangeExpr{Buffer: query}
+	yr.Init()
+	yr.Expression.Init(query)
+	if err := yr.Parse(); err != nil {
+		return "invalid"
+	}
+	yr.Execute()
+	return yr.shape()
+}
+
+// shape of the parsed query (see Shape)
+func (e *Expression) shape() string {
+	var seen = make(map[Type]bool)
+	for _, code := range e.Code[:e.Top] {
+		seen[code.T] = true
+	}
+	var ops = make([]string, 0)
+	for t := typeUnion; t <= typeKeyReverseLookupHint; t++ {
+		if seen[t] {
+			ops = append(ops, typeNames[t])
+		}
+	}
+	if len(ops) == 0 {
+		return "empty"
+	}
+	return strings.Join(ops, "+")
+}
+
+// sub expression of the query, compound if it is a set operation.
+// err is set if the sub expression failed
+type subExpr struct {
+	text     string
+	compound bool
+	err      error
+}
+
+// the sub expression as an operand, set operations need brackets
+// (the set operations are right associative, so only when on the left)
+func (s subExpr) group() string {
+	if s.compound {
+		return "(" + s.text + ")"
+	}
+	return s.text
 }
@@ -65,3 +65,12 @@ func BenchmarkKeyReverseAttr(b *testing.B) {
 func BenchmarkKeyReverseHint(b *testing.B) {
 	benchMark("Ops;AUTHORS:ops", b)
 }
+
+// the same as a reverse lookup (*), these walk the leaf clusters
+func BenchmarkKeyReverseAttrStar(b *testing.B) {
+	benchMark("*Ops;AUTHORS", b)
+}
+
+func BenchmarkKeyReverseHintStar(b *testing.B) {
+	benchMark("*Ops;AUTHORS:ops", b)
+}
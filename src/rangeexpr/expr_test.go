@@ -8,12 +8,15 @@
 package rangeexpr
 
 import (
+	"errors"
 	"log"
 	"os"
 	"rangestore"
 	"rangestore/etcdstore"
+	"rangestore/etcdstore/etcdtest"
 	"rangestore/filestore"
 	"testing"
+	"time"
 )
 
 var store interface{}
@@ -53,21 +56,33 @@ func TestMain(m *testing.M) {
 		os.Exit(status)
 	}
 
-	// etcdstore
-	var hosts = []string{"http://127.0.0.1:13824"}
+	// etcdstore, on a fake etcd loaded with the fixture
+	var server = etcdtest.NewServer()
+	fixture, err := filestore.ConnectFileStore(dir, -1, fast)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var loader = etcdstore.NewEtcdStore(server.Machines(), false, false, "")
+	if _, err = rangestore.Sync(fixture, loader, false, false); err == nil {
+		err = loader.Reindex()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	var hosts = server.Machines()
 	var roptimize = false
 	var efast = false
 	var node = ""
 	store, err = etcdstore.ConnectEtcdStore(hosts, roptimize, efast, node)
 	if err != nil {
-		// lets die more gracefully!
-		log.Println("NOT Testing using EtcdStore")
-		os.Exit(0)
+		log.Fatal(err)
 	}
 	log.Println("Testing using EtcdStore")
 
 	// run all the test with store == EtcdStore
 	status = m.Run()
+	// os.Exit doesn't run the defers
+	server.Close()
 
 	if status != 0 {
 		os.Exit(status)
@@ -114,7 +129,7 @@ func TestParsing02(t *testing.T) {
 	r.Execute()
 	result, errs := r.Evaluate(store)
 	if len(errs) != 0 || !compare(*result, []string{"a"}) {
-		t.Errorf("Expected NO Evaluate Error, (Query: %s) should BE %s [Got: %s]", []string{"ops"}, *result)
+		t.Errorf("Expected NO Evaluate Error, (Query: %s) should BE %s [Got: %s]", q, []string{"a"}, *result)
 	}
 }
 
@@ -198,7 +213,7 @@ func TestParsing08(t *testing.T) {
 	r.Expression.Init(q)
 	err := r.Parse()
 	if err != nil {
-		t.Errorf("Expected NO Error, (Query: %s) should BE parsed [Top Level Lookup, %, %% etc]", q)
+		t.Errorf("Expected NO Error, (Query: %s) should BE parsed [Top Level Lookup, %%, %%%% etc]", q)
 	}
 	r.Execute()
 	result, errs := r.Evaluate(store)
@@ -217,7 +232,7 @@ func TestParsing09(t *testing.T) {
 	r.Expression.Init(q)
 	err := r.Parse()
 	if err != nil {
-		t.Errorf("Expected NO Error, (Query: %s) should BE parsed [Top Level Lookup, %, %% etc]", q)
+		t.Errorf("Expected NO Error, (Query: %s) should BE parsed [Top Level Lookup, %%, %%%% etc]", q)
 	}
 
 	r.Execute()
@@ -712,6 +727,116 @@ func TestRevParsing07(t *testing.T) {
 	}
 }
 
+// errors tell which sub expression failed
+func TestEvalErrorSubExpr(t *testing.T) {
+	var q = "%ops,(%nosuch-cluster:NODES ,& %nosuch-cluster)"
+	_, errs := Expand(q, store)
+	// the intersection fails along with its operands
+	var expected = []string{"%nosuch-cluster", "%nosuch-cluster:NODES", "%nosuch-cluster:NODES,&%nosuch-cluster"}
+	var subexprs = make([]string, 0)
+	for _, err := range errs {
+		var evalErr *EvalError
+		if !errors.As(err, &evalErr) {
+			t.Fatalf("Expected EvalError, (Query: %s) Got: %T %s", q, err, err)
+		}
+		subexprs = append(subexprs, evalErr.SubExpr)
+	}
+	if !compare(subexprs, expected) || len(subexprs) != 3 {
+		t.Errorf("Expected errors for %s, (Query: %s) Got: %s", expected, q, subexprs)
+	}
+
+	q = "%ops,,"
+	_, errs = Expand(q, store)
+	if len(errs) != 1 || !errors.Is(errs[0], ErrParse) {
+		t.Errorf("Expected Parse Error, (Query: %s) Got: %s", q, errs)
+	}
+}
+
+// a failed lookup is an empty set in a union, fails an intersection
+// or a difference
+func TestExpandPartial(t *testing.T) {
+	var nodes = []string{"range1001.ops.example.com", "range1002.ops.example.com", "range1003.ops.example.com"}
+	var cases = []struct {
+		query   string
+		results []string
+		errs    int
+		ok      bool
+	}{
+		{"%ops-prod-vpc1-range,%nosuch-cluster", nodes, 1, true},
+		{"%nosuch-cluster,%ops-prod-vpc1-range", nodes, 1, true},
+		{"%nosuch-cluster,%nosuch-cluster:NODES", []string{}, 2, false},
+		{"%ops-prod-vpc1-range,&%nosuch-cluster", []string{}, 2, false},
+		{"%ops-prod-vpc1-range,-%nosuch-cluster", []string{}, 2, false},
+		{"%nosuch-cluster,-%ops-prod-vpc1-range", []string{}, 2, false},
+		{"%ops-prod-vpc1-range,(%ops-prod-vpc1-range,&%nosuch-cluster)", nodes, 2, true},
+		{"%ops-prod-vpc1-range,&(%ops-prod-vpc1-range,%nosuch-cluster)", nodes, 1, true},
+	}
+	for _, c := range cases {
+		results, errs, ok := ExpandPartial(c.query, store)
+		if ok != c.ok || len(errs) != c.errs || !compare(*results, c.results) {
+			t.Errorf("Expected %s, %d errors (usable: %v), (Query: %s) Got: %s, %s (usable: %v)", c.results, c.errs, c.ok, c.query, *results, errs, ok)
+		}
+	}
+}
+
+func TestShape(t *testing.T) {
+	var cases = map[string]string{
+		"":                       "empty",
+		"foo":                    "empty",
+		"%ops":                   "cluster",
+		"%ops:NODES,%data":       "union+cluster+key",
+		"%ops,&%data,-foo":       "intersection+difference+cluster",
+		"*foo.example.com;A:ops": "reverse+reverse_attr+reverse_hint",
+		"%ops,,":                 "invalid",
+	}
+	for query, expected := range cases {
+		if shape := Shape(query); shape != expected {
+			t.Errorf("Expected Shape %s, (Query: %s) Got: %s", expected, query, shape)
+		}
+		// the same from the parse of the expansion
+		if _, _, _, shape := ExpandShape(query, store); shape != expected {
+			t.Errorf("Expected ExpandShape %s, (Query: %s) Got: %s", expected, query, shape)
+		}
+	}
+}
+
+// a store taking its time for the cluster lookups
+type slowStore struct {
+	rangestore.Store
+}
+
+func (s slowStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	time.Sleep(100 * time.Millisecond)
+	return s.Store.ClusterLookup(cluster)
+}
+
+// a limit hit fails the whole query, even in a union
+func TestLimits(t *testing.T) {
+	var cases = []struct {
+		query  string
+		store  rangestore.Store
+		limits rangestore.Limits
+		limit  string // hit, if any
+	}{
+		{"%ops-prod-vpc1-range", store.(rangestore.Store), rangestore.Limits{MaxResults: 3, MaxCalls: 1}, ""},
+		{"%ops-prod-vpc1-range", store.(rangestore.Store), rangestore.Limits{MaxResults: 2}, rangestore.LimitResults},
+		{"%ops-prod-vpc1-mon,%ops-prod-vpc1-range", store.(rangestore.Store), rangestore.Limits{MaxResults: 3}, rangestore.LimitResults},
+		{"%ops-prod-vpc1-mon,%ops-prod-vpc1-range,%nosuch", store.(rangestore.Store), rangestore.Limits{MaxCalls: 2}, rangestore.LimitCalls},
+		{"%%ops-prod", store.(rangestore.Store), rangestore.Limits{MaxCalls: 2}, rangestore.LimitCalls},
+		{"%ops-prod-vpc1-range", slowStore{store.(rangestore.Store)}, rangestore.Limits{Timeout: 10 * time.Millisecond}, rangestore.LimitTimeout},
+		{"%ops-prod-vpc1-range", slowStore{store.(rangestore.Store)}, rangestore.Limits{Timeout: time.Second}, ""},
+	}
+	for _, c := range cases {
+		results, errs, ok := ExpandPartial(c.query, rangestore.WithLimits(c.store, c.limits))
+		var limitErr *rangestore.LimitError
+		if c.limit == "" && (!ok || len(errs) != 0 || len(*results) == 0) {
+			t.Errorf("Expected NO Error, (Query: %s, Limits: %+v) Got: %s, %s", c.query, c.limits, *results, errs)
+		} else if c.limit != "" && (ok || len(errs) != 1 || len(*results) != 0 || !errors.As(errs[0], &limitErr) || limitErr.Limit != c.limit || !errors.Is(errs[0], rangestore.ErrLimit)) {
+			t.Errorf("Expected Limit %s, (Query: %s) Got: %s, %v (usable: %v)", c.limit, c.query, *results, errs, ok)
+		}
+	}
+}
+
 // Internal Function
 
 // Compare 2 Arrays, items need not be in correct order
@@ -0,0 +1,102 @@
+package rangeops
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hostname split as prefix, number and the domain, eg,
+// range1001.ops.example.com => range, 1001, .ops.example.com
+var numbered = regexp.MustCompile(`^([^.]*?)([0-9]+)(\..*)?$`)
+
+// compress the nodes into a range expression (the way libcrange does),
+// consecutive numbers with the same prefix and domain become a range, eg,
+// range1001.ops.example.com, range1002.ops.example.com, foo
+// => foo,range1001..1002.ops.example.com
+func Compress(nodes *[]string) string {
+	var sorted = append([]string{}, *nodes...)
+	ArrayToSet(&sorted)
+	SortNodes(&sorted)
+
+	var parts = make([]string, 0)
+	for i := 0; i < len(sorted); {
+		var first = splitNode(sorted[i])
+		var last = first
+		var j = i + 1
+		// extend the run as long as the numbers are consecutive
+		for ; j < len(sorted) && first.numbered; j++ {
+			var next = splitNode(sorted[j])
+			if !next.follows(last) {
+				break
+			}
+			last = next
+		}
+		if j-i == 1 {
+			parts = append(parts, sorted[i])
+		} else {
+			parts = append(parts, first.prefix+first.digits+".."+last.digits+first.domain)
+		}
+		i = j
+	}
+	return strings.Join(parts, ",")
+}
+
+// sort the nodes by prefix, domain and then the number, so that the
+// nodes of a range are together and in order (range9 before range10)
+func SortNodes(nodes *[]string) {
+	sort.SliceStable(*nodes, func(i, j int) bool {
+		var a, b = splitNode((*nodes)[i]), splitNode((*nodes)[j])
+		switch {
+		case a.prefix != b.prefix:
+			return a.prefix < b.prefix
+		case a.domain != b.domain:
+			return a.domain < b.domain
+		case a.number != b.number:
+			return a.number < b.number
+		}
+		return (*nodes)[i] < (*nodes)[j]
+	})
+	return
+}
+
+///////////////////////
+// Internal Fuctions //
+///////////////////////
+
+type node struct {
+	prefix   string
+	digits   string // the number as in the node, with the zero padding
+	number   uint64
+	domain   string
+	numbered bool // false if the node has no number to compress
+}
+
+func splitNode(name string) node {
+	var match = numbered.FindStringSubmatch(name)
+	if match == nil {
+		return node{prefix: name}
+	}
+	number, err := strconv.ParseUint(match[2], 10, 64)
+	if err != nil {
+		return node{prefix: name}
+	}
+	return node{prefix: match[1], digits: match[2], number: number, domain: match[3], numbered: true}
+}
+
+// whether n comes right after the node in a range, zero padded
+// numbers have to be of the same width (web09, web10 but not web9, web010)
+func (n node) follows(last node) bool {
+	if !n.numbered || n.prefix != last.prefix || n.domain != last.domain || n.number != last.number+1 {
+		return false
+	}
+	if padded(n.digits) || padded(last.digits) {
+		return len(n.digits) == len(last.digits)
+	}
+	return true
+}
+
+func padded(digits string) bool {
+	return len(digits) > 1 && digits[0] == '0'
+}
@@ -0,0 +1,39 @@
+package rangeops
+
+import "testing"
+
+func TestCompress01(t *testing.T) {
+	var cases = []struct {
+		nodes    []string
+		expected string
+	}{
+		{[]string{}, ""},
+		{[]string{"foo"}, "foo"},
+		{[]string{"range1001.ops.example.com", "range1003.ops.example.com", "range1002.ops.example.com"}, "range1001..1003.ops.example.com"},
+		{[]string{"range1001.ops.example.com", "range1002.ops.example.com", "range1004.ops.example.com"}, "range1001..1002.ops.example.com,range1004.ops.example.com"},
+		// different domains and prefixes are different ranges
+		{[]string{"web1.a.com", "web2.a.com", "web1.b.com", "web2.b.com", "db1.a.com"}, "db1.a.com,web1..2.a.com,web1..2.b.com"},
+		{[]string{"web10", "web9", "web11", "foo", "web9"}, "foo,web9..11"},
+		// zero padded numbers keep their width
+		{[]string{"web08", "web09", "web10", "web011"}, "web08..10,web011"},
+		{[]string{"web9", "web010"}, "web9,web010"},
+		{[]string{"Vigith Maurice", "a.b.c"}, "Vigith Maurice,a.b.c"},
+	}
+	for _, c := range cases {
+		if result := Compress(&c.nodes); result != c.expected {
+			t.Errorf("Compress %s, Expected: %s Got: %s", c.nodes, c.expected, result)
+		}
+	}
+}
+
+func TestSortNodes01(t *testing.T) {
+	var nodes = []string{"range10.ops", "range9.ops", "range1.data", "foo"}
+	var expected = []string{"foo", "range1.data", "range9.ops", "range10.ops"}
+	SortNodes(&nodes)
+	for i := range nodes {
+		if nodes[i] != expected[i] {
+			t.Errorf("SortNodes Expected: %s Got: %s", expected, nodes)
+			break
+		}
+	}
+}
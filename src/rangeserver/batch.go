@@ -0,0 +1,237 @@
+// Batch of queries in one request, for the fan-out tools which otherwise
+// call /v1/range/ once per query. POST a JSON body,
+//   {"queries": ["%ops-prod", "%data-prod:NODES"], "partial": false}
+// the response has a result (the JSON response of the query, along with
+// the query) per query, in the same order.
+// The queries are expanded concurrently, and the lookups are done only
+// once for the whole batch (most queries of a fan-out look at the same
+// clusters).
+
+package rangeserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"rangestore"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// where the batch endpoint is
+const BatchPath = "/v1/batch"
+
+// BatchRequest is the body of a batch request
+type BatchRequest struct {
+	Queries []string `json:"queries"`
+	Partial bool     `json:"partial"` // partial results (see Expand)
+}
+
+// BatchResponse has the result of each query, in the order of the request
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// BatchResult is the response of a query along with the query
+type BatchResult struct {
+	Query string `json:"query"`
+	*Response
+}
+
+type batchHandler struct {
+	store    rangestore.Store
+	parallel int                   // queries expanded at a time
+	stats    rangestore.CacheStats // lookups shared (hits) or done (misses), of all the batches
+}
+
+// BatchHandler serves the batch endpoint, parallel is the number of
+// queries of a batch expanded at a time. The lookups shared by the
+// queries of a batch are counted in DefaultMetrics as the "batch" cache.
+func BatchHandler(store rangestore.Store, parallel int) http.Handler {
+	if parallel < 1 {
+		parallel = 1
+	}
+	var h = &batchHandler{store: store, parallel: parallel}
+	DefaultMetrics.AddCache("batch", h)
+	return h
+}
+
+func (h *batchHandler) CacheStats() rangestore.CacheStats {
+	return rangestore.CacheStats{Hits: atomic.LoadUint64(&h.stats.Hits), Misses: atomic.LoadUint64(&h.stats.Misses)}
+}
+
+func (h *batchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request BatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, _maxBody)).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("Expected {\"queries\": [...]} (Error: %s)", err), http.StatusBadRequest)
+		return
+	}
+
+	var response = BatchResponse{Results: make([]BatchResult, len(request.Queries))}
+	var store rangestore.Store = newBatchStore(h.store, &h.stats)
+	// the limits are on each query of the batch
+	if l, ok := h.store.(rangestore.LimitsStore); ok {
+		store = rangestore.WithLimits(store, l.QueryLimits())
+	}
+	var wg sync.WaitGroup
+	var slots = make(chan bool, h.parallel)
+	for i, query := range request.Queries {
+		wg.Add(1)
+		slots <- true
+		go func(i int, query string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result, _ := Expand(query, store, request.Partial)
+			response.Results[i] = BatchResult{Query: query, Response: result}
+		}(i, strings.TrimSpace(query))
+	}
+	wg.Wait()
+
+	var responses = make([]*Response, 0, len(response.Results))
+	for _, result := range response.Results {
+		responses = append(responses, result.Response)
+	}
+	SetStale(w, responses...)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&response); err != nil {
+		log.Printf("EROR> [%s] %s %s (Writing back to Client Failed [Reason: %s])", r.RemoteAddr, r.Method, r.URL, err)
+	}
+}
+
+// the store as seen by a batch, a lookup is done once and the result
+// is shared by the queries of the batch (even the concurrent ones)
+type batchStore struct {
+	store   rangestore.Store
+	mu      sync.Mutex
+	lookups map[string]*lookup
+	stats   *rangestore.CacheStats
+}
+
+// a lookup, done is closed once the result is there
+type lookup struct {
+	done   chan bool
+	result []string
+	err    error
+	stale  bool          // the answer is stale (see rangestore.StaleStore)
+	age    time.Duration // of the stale answer
+}
+
+func newBatchStore(store rangestore.Store, stats *rangestore.CacheStats) *batchStore {
+	return &batchStore{store: store, lookups: make(map[string]*lookup), stats: stats}
+}
+
+// Scope is the batch as seen by a query, the lookups it does are done by
+// the store scoped to it
+func (b *batchStore) Scope(t rangestore.Tracker) rangestore.Store {
+	return &batchView{batch: b, tracker: t}
+}
+
+func (b *batchStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	return b.Scope(nil).ClusterLookup(cluster)
+}
+
+func (b *batchStore) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	return b.Scope(nil).KeyLookup(cluster, key)
+}
+
+func (b *batchStore) KeyReverseLookup(key string) (*[]string, error) {
+	return b.Scope(nil).KeyReverseLookup(key)
+}
+
+func (b *batchStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return b.Scope(nil).KeyReverseLookupAttr(key, attr)
+}
+
+func (b *batchStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return b.Scope(nil).KeyReverseLookupHint(key, attr, hint)
+}
+
+// the batch as seen by a query, tracker is nil if not scoped to one
+type batchView struct {
+	batch   *batchStore
+	tracker rangestore.Tracker
+}
+
+func (v *batchView) ClusterLookup(cluster *[]string) (*[]string, error) {
+	return v.batch.do(v.tracker, fmt.Sprintf("C\x00%s", strings.Join(*cluster, "\x00")), func(s rangestore.Store) (*[]string, error) {
+		return s.ClusterLookup(cluster)
+	})
+}
+
+func (v *batchView) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	return v.batch.do(v.tracker, fmt.Sprintf("K\x00%s\x00%s", key, strings.Join(*cluster, "\x00")), func(s rangestore.Store) (*[]string, error) {
+		return s.KeyLookup(cluster, key)
+	})
+}
+
+func (v *batchView) KeyReverseLookup(key string) (*[]string, error) {
+	return v.batch.do(v.tracker, fmt.Sprintf("R\x00%s", key), func(s rangestore.Store) (*[]string, error) {
+		return s.KeyReverseLookup(key)
+	})
+}
+
+func (v *batchView) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return v.batch.do(v.tracker, fmt.Sprintf("A\x00%s\x00%s", key, attr), func(s rangestore.Store) (*[]string, error) {
+		return s.KeyReverseLookupAttr(key, attr)
+	})
+}
+
+func (v *batchView) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return v.batch.do(v.tracker, fmt.Sprintf("H\x00%s\x00%s\x00%s", key, attr, hint), func(s rangestore.Store) (*[]string, error) {
+		return s.KeyReverseLookupHint(key, attr, hint)
+	})
+}
+
+// do the lookup on the store scoped to t, unless it is done (or being
+// done), the result is a copy as the evaluation modifies it in place. A
+// lookup failing on the limits of the query doing it is not shared, the
+// others do it on their own. The others are told when it was answered
+// stale
+func (b *batchStore) do(t rangestore.Tracker, key string, fn func(rangestore.Store) (*[]string, error)) (*[]string, error) {
+	b.mu.Lock()
+	l, seen := b.lookups[key]
+	if !seen {
+		l = &lookup{done: make(chan bool)}
+		b.lookups[key] = l
+	}
+	b.mu.Unlock()
+
+	if seen {
+		atomic.AddUint64(&b.stats.Hits, 1)
+		<-l.done
+		if errors.Is(l.err, rangestore.ErrLimit) {
+			return fn(rangestore.Scope(b.store, t))
+		}
+		if l.stale && t != nil {
+			t.MarkStale(l.age)
+		}
+	} else {
+		atomic.AddUint64(&b.stats.Misses, 1)
+		// the waiting queries see an error if the lookup panics
+		l.err = fmt.Errorf("Lookup [%s] Panicked", strings.Replace(key, "\x00", " ", -1))
+		defer close(l.done)
+		var recorder = &rangestore.StaleRecorder{Tracker: t}
+		result, err := fn(rangestore.Scope(b.store, recorder))
+		if result != nil {
+			l.result = *result
+		}
+		l.err = err
+		l.stale, l.age = recorder.Stale()
+		if errors.Is(err, rangestore.ErrLimit) {
+			b.mu.Lock()
+			delete(b.lookups, key)
+			b.mu.Unlock()
+		}
+	}
+	var result = append([]string{}, l.result...)
+	return &result, l.err
+}
@@ -0,0 +1,101 @@
+package rangeserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rangestore"
+	"rangestore/filestore"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// counts the lookups which reach the store
+type countingStore struct {
+	rangestore.Store
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (c *countingStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	c.mu.Lock()
+	c.calls[strings.Join(*cluster, ",")]++
+	c.mu.Unlock()
+	return c.Store.ClusterLookup(cluster)
+}
+
+func TestBatchHandler(t *testing.T) {
+	store, err := filestore.ConnectFileStore("../rangestore/filestore/t", -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	var counting = &countingStore{Store: store, calls: make(map[string]int)}
+	var server = httptest.NewServer(BatchHandler(counting, 4))
+	defer server.Close()
+
+	var body = `{"queries": ["%ops-prod-vpc1-range", "%ops-prod-vpc1-range,%ops-prod-vpc1-mon", "%nosuch", "%ops-prod-vpc1-range,&%ops-prod-vpc1-range", "%ops,,"]}`
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response BatchResponse
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 with JSON, Got: %d (Error: %v)", resp.StatusCode, err)
+	}
+
+	var nodes = []string{"range1001.ops.example.com", "range1002.ops.example.com", "range1003.ops.example.com"}
+	var expected = []struct {
+		query   string
+		results []string
+		code    string
+	}{
+		{"%ops-prod-vpc1-range", nodes, ""},
+		{"%ops-prod-vpc1-range,%ops-prod-vpc1-mon", append([]string{"mon1001.ops.example.com"}, nodes...), ""},
+		{"%nosuch", []string{}, CodeNotFound},
+		{"%ops-prod-vpc1-range,&%ops-prod-vpc1-range", nodes, ""},
+		{"%ops,,", []string{}, CodeParse},
+	}
+	if len(response.Results) != len(expected) {
+		t.Fatalf("Expected %d results, Got: %d", len(expected), len(response.Results))
+	}
+	for i, e := range expected {
+		var result = response.Results[i]
+		var code string
+		if len(result.Errors) > 0 {
+			code = result.Errors[0].Code
+		}
+		if result.Query != e.query || !compare(result.Results, e.results) || code != e.code {
+			t.Errorf("Expected [%s] %s [%s], Got: [%s] %s %v", e.query, e.results, e.code, result.Query, result.Results, result.Errors)
+		}
+	}
+	// the lookups shared by the queries are done once
+	if n := counting.calls["ops-prod-vpc1-range"]; n != 1 {
+		t.Errorf("Expected ops-prod-vpc1-range to be looked up once, Got: %d", n)
+	}
+
+	if resp, _ := http.Get(server.URL); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, GET, Got: %d", resp.StatusCode)
+	}
+	if resp, _ := http.Post(server.URL, "application/json", strings.NewReader(`["%ops"]`)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400, Not a BatchRequest, Got: %d", resp.StatusCode)
+	}
+}
+
+// Compare 2 Arrays, items need not be in correct order
+func compare(arr1, arr2 []string) bool {
+	if len(arr1) != len(arr2) {
+		return false
+	}
+	var seen = make(map[string]bool)
+	for _, value := range arr1 {
+		seen[value] = true
+	}
+	for _, value := range arr2 {
+		if !seen[value] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+// libcrange (mod_ranged) compatible endpoints, so that the existing range
+// clients (er, the perl and python clients, etc) can talk to yarge as is.
+//   /range/list?<query>   results one per line
+//   /range/expand?<query> results compressed as a range expression
+// As with mod_ranged, the response is always 200 with whatever could be
+// expanded, the errors go in the RangeException header.
+
+package rangeserver
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"rangeexpr"
+	"rangeops"
+	"strings"
+)
+
+// where the endpoints are
+const CompatPrefix = "/range/"
+
+type compatHandler struct {
+	store interface{}
+}
+
+// CompatHandler serves the libcrange endpoints under CompatPrefix
+func CompatHandler(store interface{}) http.Handler {
+	return &compatHandler{store: store}
+}
+
+func (h *compatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var endpoint = strings.TrimPrefix(r.URL.Path, CompatPrefix)
+	if endpoint != "list" && endpoint != "expand" {
+		http.Error(w, fmt.Sprintf("Expected %slist? or %sexpand?", CompatPrefix, CompatPrefix), http.StatusNotFound)
+		return
+	}
+
+	query, _, err := ParseQuery(r)
+	if err != nil {
+		h.rangeException(w, r, []QueryError{NewQueryError(r.URL.RawQuery, &rangeexpr.ParseError{Query: r.URL.RawQuery, Err: err})})
+		return
+	}
+	response, _ := Expand(query, h.store, true)
+	var results = &response.Results
+	SetStale(w, response)
+	if len(response.Errors) > 0 {
+		h.rangeException(w, r, response.Errors)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if endpoint == "expand" {
+		if len(*results) > 0 {
+			fmt.Fprintf(w, "%s\n", rangeops.Compress(results))
+		}
+		return
+	}
+	rangeops.SortNodes(results)
+	for _, result := range *results {
+		fmt.Fprintf(w, "%s\n", result)
+	}
+}
+
+// errors go in the header, the way libcrange clients expect them
+func (h *compatHandler) rangeException(w http.ResponseWriter, r *http.Request, errs []QueryError) {
+	var messages = make([]string, 0)
+	for _, e := range errs {
+		messages = append(messages, fmt.Sprintf("%s: %s", e.SubExpr, e.Message))
+	}
+	var exception = strings.Join(messages, "; ")
+	log.Printf("EROR> [%s] %s %s Failed (Error: %s)", r.RemoteAddr, r.Method, r.URL, exception)
+	// as is, some old clients match the header case sensitively
+	w.Header()["RangeException"] = []string{exception}
+}
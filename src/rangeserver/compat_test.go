@@ -0,0 +1,60 @@
+package rangeserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"rangestore/filestore"
+	"testing"
+)
+
+// a server with the libcrange endpoints on the filestore test data
+func compatServer(t *testing.T) *httptest.Server {
+	store, err := filestore.ConnectFileStore("../rangestore/filestore/t", -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	var mux = http.NewServeMux()
+	mux.Handle(CompatPrefix, CompatHandler(store))
+	var server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// get the url, returns the status, RangeException and body
+func get(t *testing.T, url string) (int, string, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get("RangeException"), string(content)
+}
+
+func TestCompatHandler(t *testing.T) {
+	var server = compatServer(t)
+	var cases = []struct {
+		url       string
+		body      string
+		exception bool
+	}{
+		{"/range/list?%25ops-prod-vpc1-range", "range1001.ops.example.com\nrange1002.ops.example.com\nrange1003.ops.example.com\n", false},
+		{"/range/expand?%25ops-prod-vpc1-range", "range1001..1003.ops.example.com\n", false},
+		{"/range/list?%25ops-prod-vpc1", "ops-prod-vpc1-mon\nops-prod-vpc1-range\n", false},
+		// whatever could be expanded, along with the exception
+		{"/range/expand?%25ops-prod-vpc1-range,%25nosuch", "range1001..1003.ops.example.com\n", true},
+		{"/range/list?%25ops-prod-vpc1-range,&%25nosuch", "", true},
+		{"/range/list?%25ops,,", "", true},
+	}
+	for _, c := range cases {
+		status, exception, body := get(t, server.URL+c.url)
+		if status != http.StatusOK || body != c.body || (exception != "") != c.exception {
+			t.Errorf("Expected 200 [%q] (RangeException: %v), URL: %s, Got: %d [%q] (RangeException: %s)", c.body, c.exception, c.url, status, body, exception)
+		}
+	}
+
+	if status, _, _ := get(t, server.URL+"/range/count?%25ops"); status != http.StatusNotFound {
+		t.Errorf("Expected 404, Unknown endpoint, Got: %d", status)
+	}
+}
@@ -0,0 +1,425 @@
+// Config of the server, a YAML file declaring the stores and where they are
+// mounted, along with the server settings. eg,
+//
+//   server:
+//     listen: 0.0.0.0:9999
+//     slowlog: 3             # microseconds, 0 logs every query
+//     readyinterval: 5s
+//     limits:
+//       batchparallel: 8
+//       maxresults: 100000   # results of a lookup (or a part of the query)
+//       maxcalls: 1000       # store calls of a query
+//       timeout: 10s         # of a query
+//       maxconcurrent: 16    # requests at a time per client
+//     proxies: [10.0.0.0/8]  # in front of the server, their X-Real-IP is the client
+//     tls:                   # https, if set
+//       cert: /etc/yarge/cert.pem
+//       key: /etc/yarge/key.pem
+//   stores:
+//     prod:
+//       type: etcd
+//       hosts: ["http://127.0.0.1:4001"]
+//       root: /yarge
+//       roptimize: true
+//       mirror: true
+//       cache:               # lookups cached, dropped on the changes of etcd
+//         ttl: 30s
+//         size: 100000       # lookups, least recently used dropped first
+//       stale:               # last good answers served while etcd is down
+//         enabled: true
+//         snapshot: /var/lib/yarge/prod.json  # served on restart until etcd is back
+//         size: 100000       # answers kept, least recently used dropped first
+//         maxage: 24h        # answers older are not served
+//         interval: 1m       # how often the snapshot is saved
+//     overrides:
+//       type: file
+//       path: /var/yarge
+//       writable: true
+//     emea:
+//       type: http           # another yargeserver (eg, of another region)
+//       hosts: ["http://yarge1.emea:9999", "http://yarge2.emea:9999"]
+//       timeout: 2s          # of a request, the next host is tried if it fails
+//       retries: 1           # hosts tried after the first one (default all of them)
+//       cache:               # responses cached (the upstream doesn't tell it changed)
+//         ttl: 30s
+//     cmdb:
+//       type: plugin         # an executable answering the lookups (see pluginstore)
+//       command: [/usr/local/bin/yarge-cmdb, --region, emea]
+//       timeout: 2s          # of a lookup, the plugin is restarted if it exits
+//     inventory:
+//       url: plugin:///usr/local/bin/yarge-inventory?timeout=2s  # or any store by its spec (see rangestore.Open)
+//     all:
+//       type: composite      # lookups on all the stores, listings merged
+//       stores: [overrides, prod]  # a key has the value of the first store having it,
+//       union: [NODES]       # unless it is here, then the values of all are merged
+//   mounts:
+//     - prefix: /            # /v1/range/, /range/, /v1/batch, etc
+//       store: all
+//     - prefix: /overrides/  # /overrides/v1/range/, etc
+//       store: overrides
+//     - prefix: /global/     # %aws-ops-prod is ops-prod of prod
+//       namespaces:
+//         aws: prod
+//         local: overrides
+
+package rangeserver
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"rangestore"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// types of the stores
+const (
+	StoreFile      = "file"
+	StoreEtcd      = "etcd"
+	StoreComposite = "composite"
+	StoreHTTP      = "http"
+	StorePlugin    = "plugin"
+	StoreTest      = "test"
+)
+
+// Config of the server (see LoadConfig)
+type Config struct {
+	Server ServerConfig           `yaml:"server"`
+	Stores map[string]StoreConfig `yaml:"stores"`
+	Mounts []MountConfig          `yaml:"mounts"`
+}
+
+// ServerConfig are the settings of the server
+type ServerConfig struct {
+	Listen        string        `yaml:"listen"`        // address to listen on
+	SlowLog       int           `yaml:"slowlog"`       // queries slower than this (microseconds) are logged, 3 if not set
+	ReadyInterval time.Duration `yaml:"readyinterval"` // how often the stores are checked for the readiness
+	Limits        Limits        `yaml:"limits"`
+	Proxies       []string      `yaml:"proxies"` // addresses (or networks) of the proxies in front of the server
+	TLS           TLSConfig     `yaml:"tls"`
+}
+
+// Limits on what a request can do, zero is no limit
+type Limits struct {
+	BatchParallel int           `yaml:"batchparallel"` // queries of a batch expanded at a time
+	MaxResults    int           `yaml:"maxresults"`    // results of a lookup (or a part of the query)
+	MaxCalls      int           `yaml:"maxcalls"`      // store calls of a query
+	Timeout       time.Duration `yaml:"timeout"`       // wall clock time of a query
+	MaxConcurrent int           `yaml:"maxconcurrent"` // requests at a time per client
+}
+
+// Query are the limits on the cost of a query
+func (l Limits) Query() rangestore.Limits {
+	return rangestore.Limits{MaxResults: l.MaxResults, MaxCalls: l.MaxCalls, Timeout: l.Timeout}
+}
+
+// TLSConfig is the certificate and its key, the server is https if set
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// StoreConfig is a store and its options, the options not of its type
+// are ignored
+type StoreConfig struct {
+	Type string `yaml:"type"` // file, etcd, composite, http, plugin or test
+	URL  string `yaml:"url"`  // or the spec of the store, instead of the type and its options (see rangestore.Open)
+
+	Path string `yaml:"path"` // file
+
+	Hosts     []string `yaml:"hosts"`     // etcd and http, the endpoints
+	Root      string   `yaml:"root"`      // etcd, where the store is in etcd
+	ROptimize bool     `yaml:"roptimize"` // etcd, reverse lookup optimization
+	Mirror    bool     `yaml:"mirror"`    // etcd, lookups from a local mirror
+	RIndex    []string `yaml:"rindex"`    // etcd, attributes having a reverse index
+	Ephemeral bool     `yaml:"ephemeral"` // etcd, hosts can register with a ttl
+
+	Fast     bool `yaml:"fast"`     // file and etcd, the first result of the reverse lookups
+	Writable bool `yaml:"writable"` // file and etcd, serve the endpoints to edit the store
+
+	Stores []string `yaml:"stores"` // composite, the stores in it (in order of priority)
+	Union  []string `yaml:"union"`  // composite, keys having the values of all the stores
+
+	Timeout time.Duration `yaml:"timeout"` // http and plugin, of a request to an endpoint (or a lookup of the plugin)
+	Retries int           `yaml:"retries"` // http, endpoints tried after the first one fails
+
+	Command []string `yaml:"command"` // plugin, the executable and its arguments
+
+	Cache CacheConfig `yaml:"cache"` // any, the lookups are cached if set
+	Stale StaleConfig `yaml:"stale"` // any, the last good answers are served when the store is unavailable
+}
+
+// Spec is the spec of the store (see rangestore.Open), either its url or
+// the one of its type and options. A composite has none (it is made of
+// the other stores)
+func (s StoreConfig) Spec() (string, error) {
+	if s.URL != "" {
+		return s.URL, nil
+	}
+	var u = url.URL{Scheme: s.Type}
+	var q = make(url.Values)
+	var flag = func(name string, set bool) {
+		if set {
+			q.Set(name, "1")
+		}
+	}
+	switch s.Type {
+	case StoreTest:
+	case StoreFile:
+		u.Path, u.Opaque = pathOrOpaque(s.Path)
+		flag("fast", s.Fast)
+	case StoreEtcd:
+		hosts, scheme, _, err := splitHosts(s.Hosts)
+		if err != nil {
+			return "", err
+		}
+		u.Host, u.Path = hosts, s.Root
+		flag("tls", scheme == "https")
+		flag("roptimize", s.ROptimize)
+		flag("fast", s.Fast)
+		flag("mirror", s.Mirror)
+		flag("ephemeral", s.Ephemeral)
+		// a snapshot is served until etcd is back
+		flag("lazy", s.Stale.Enabled && s.Stale.Snapshot != "")
+		if len(s.RIndex) > 0 {
+			q.Set("rindex", strings.Join(s.RIndex, ","))
+		}
+	case StoreHTTP:
+		hosts, scheme, path, err := splitHosts(s.Hosts)
+		if err != nil {
+			return "", err
+		}
+		u.Scheme, u.Host, u.Path = scheme, hosts, path
+		if s.Timeout > 0 {
+			q.Set("timeout", s.Timeout.String())
+		}
+		if s.Retries != 0 {
+			q.Set("retries", strconv.Itoa(s.Retries))
+		}
+	case StorePlugin:
+		u.Path, u.Opaque = pathOrOpaque(s.Command[0])
+		q["arg"] = s.Command[1:]
+		if s.Timeout > 0 {
+			q.Set("timeout", s.Timeout.String())
+		}
+	default:
+		return "", fmt.Errorf("Store of type [%s] has no spec", s.Type)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// CacheConfig is the cache of the lookups of a store (see
+// rangestore.CachingStore), zero ttl is no cache
+type CacheConfig struct {
+	TTL  time.Duration `yaml:"ttl"`  // how long a lookup is cached (if the store doesn't tell it changed)
+	Size int           `yaml:"size"` // lookups cached, zero is no bound
+}
+
+// MountConfig is where a store is served, either a store or namespaces
+// (a store per namespace, see rangestore.MountStore)
+type MountConfig struct {
+	Prefix     string            `yaml:"prefix"`     // URL prefix, "/" by default
+	Store      string            `yaml:"store"`      // name of the store
+	Namespaces map[string]string `yaml:"namespaces"` // namespace -> name of the store
+}
+
+// StaleConfig is the stale-on-error mode of a store (see
+// rangestore.StaleStore)
+type StaleConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Snapshot string        `yaml:"snapshot"` // file the answers are saved to, none if ""
+	Interval time.Duration `yaml:"interval"` // how often the snapshot is saved
+	Size     int           `yaml:"size"`     // answers kept, 100000 if not set, negative is no bound
+	MaxAge   time.Duration `yaml:"maxage"`   // answers older are not served, zero is no cutoff
+}
+
+// LoadConfig reads the config file, the settings not set get the defaults
+func LoadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// slowlog 0 is set (log every query), negative is not
+	var config = Config{Server: ServerConfig{SlowLog: -1}}
+	if err = yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("Config [%s] is not valid YAML (Error: %s)", path, err)
+	}
+	config.setDefaults()
+	if err = config.Validate(); err != nil {
+		return nil, fmt.Errorf("Config [%s] is not valid (Error: %s)", path, err)
+	}
+	return &config, nil
+}
+
+// Validate checks the proxies are addresses, the stores are known and
+// the mounts are of the stores
+func (c *Config) Validate() error {
+	if _, err := ParseProxies(c.Server.Proxies); err != nil {
+		return err
+	}
+	for _, name := range c.StoreNames() {
+		var s = c.Stores[name]
+		if s.URL != "" {
+			if s.Type != "" {
+				return fmt.Errorf("Store [%s] has both a type and a url", name)
+			} else if u, err := url.Parse(s.URL); err != nil || u.Scheme == "" {
+				return fmt.Errorf("Store [%s] has an invalid url [%s] (eg, file:///var/yarge)", name, s.URL)
+			}
+			continue
+		}
+		switch s.Type {
+		case StoreFile:
+			if s.Path == "" {
+				return fmt.Errorf("Store [%s] has no path", name)
+			}
+		case StoreEtcd, StoreHTTP:
+			if len(s.Hosts) == 0 {
+				return fmt.Errorf("Store [%s] has no hosts", name)
+			}
+		case StoreComposite:
+			if err := c.checkComposite(name, map[string]bool{}); err != nil {
+				return err
+			}
+			for _, key := range s.Union {
+				if !rangestore.ValidKeyName(key) {
+					return fmt.Errorf("Composite store [%s] has an invalid key [%s] in union", name, key)
+				}
+			}
+		case StorePlugin:
+			if len(s.Command) == 0 {
+				return fmt.Errorf("Store [%s] has no command", name)
+			}
+		case StoreTest:
+		default:
+			return fmt.Errorf("Store [%s] is of unknown type [%s] (Supports only %q, %q, %q, %q, %q, %q)", name, s.Type, StoreFile, StoreEtcd, StoreComposite, StoreHTTP, StorePlugin, StoreTest)
+		}
+	}
+
+	if len(c.Mounts) == 0 {
+		return fmt.Errorf("No store is mounted")
+	}
+	var prefixes = make(map[string]bool)
+	for _, m := range c.Mounts {
+		if !strings.HasPrefix(m.Prefix, "/") || !strings.HasSuffix(m.Prefix, "/") {
+			return fmt.Errorf("Mount prefix [%s] should start and end with /", m.Prefix)
+		} else if prefixes[m.Prefix] {
+			return fmt.Errorf("Mount prefix [%s] is used more than once", m.Prefix)
+		}
+		prefixes[m.Prefix] = true
+		if (m.Store == "") == (len(m.Namespaces) == 0) {
+			return fmt.Errorf("Mount [%s] should have either a store or namespaces", m.Prefix)
+		}
+		if m.Store != "" {
+			if _, ok := c.Stores[m.Store]; !ok {
+				return fmt.Errorf("Mount [%s] is of an unknown store [%s]", m.Prefix, m.Store)
+			}
+		}
+		for namespace, store := range m.Namespaces {
+			if !rangestore.ValidClusterName(namespace) || strings.ContainsAny(namespace, "-.") {
+				return fmt.Errorf("Mount [%s] has an invalid namespace [%s]", m.Prefix, namespace)
+			} else if _, ok := c.Stores[store]; !ok {
+				return fmt.Errorf("Mount [%s] has namespace [%s] of an unknown store [%s]", m.Prefix, namespace, store)
+			}
+		}
+	}
+	return nil
+}
+
+// StoreNames are the names of the stores, sorted
+func (c *Config) StoreNames() []string {
+	var names = make([]string, 0, len(c.Stores))
+	for name := range c.Stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+func (c *Config) setDefaults() {
+	if c.Server.Listen == "" {
+		c.Server.Listen = "0.0.0.0:9999"
+	}
+	if c.Server.SlowLog < 0 {
+		c.Server.SlowLog = 3
+	}
+	if c.Server.ReadyInterval == 0 {
+		c.Server.ReadyInterval = 5 * time.Second
+	}
+	if c.Server.Limits.BatchParallel == 0 {
+		c.Server.Limits.BatchParallel = 8
+	}
+	for name, s := range c.Stores {
+		if s.Stale.Interval == 0 {
+			s.Stale.Interval = time.Minute
+		}
+		if s.Stale.Size == 0 {
+			s.Stale.Size = 100000
+		}
+		c.Stores[name] = s
+	}
+	for i := range c.Mounts {
+		if c.Mounts[i].Prefix == "" {
+			c.Mounts[i].Prefix = "/"
+		}
+	}
+}
+
+// the path of the spec, or the opaque part if it is relative (eg,
+// file:relative/path)
+func pathOrOpaque(path string) (string, string) {
+	if filepath.IsAbs(path) {
+		return path, ""
+	}
+	return "", path
+}
+
+// the hosts of the spec (eg, h1:4001,h2:4001) along with their scheme and
+// path, which have to be the same for all
+func splitHosts(endpoints []string) (hosts string, scheme string, path string, err error) {
+	var list = make([]string, 0)
+	for i, e := range endpoints {
+		u, err := url.Parse(e)
+		if err != nil || u.Host == "" {
+			return "", "", "", fmt.Errorf("Host [%s] is not a URL (eg, http://127.0.0.1:4001)", e)
+		} else if i > 0 && (u.Scheme != scheme || strings.TrimSuffix(u.Path, "/") != path) {
+			return "", "", "", fmt.Errorf("Hosts %q differ in the scheme or the path", endpoints)
+		}
+		scheme, path = u.Scheme, strings.TrimSuffix(u.Path, "/")
+		list = append(list, u.Host)
+	}
+	return strings.Join(list, ","), scheme, path, nil
+}
+
+// the stores of the composite are known, and it doesn't have itself
+// (even through other composites)
+func (c *Config) checkComposite(name string, seen map[string]bool) error {
+	if seen[name] {
+		return fmt.Errorf("Composite store [%s] has itself", name)
+	}
+	seen[name] = true
+	defer delete(seen, name)
+	if len(c.Stores[name].Stores) == 0 {
+		return fmt.Errorf("Composite store [%s] has no stores", name)
+	}
+	for _, s := range c.Stores[name].Stores {
+		inner, ok := c.Stores[s]
+		if !ok {
+			return fmt.Errorf("Composite store [%s] has an unknown store [%s]", name, s)
+		} else if inner.Type == StoreComposite {
+			if err := c.checkComposite(s, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package rangeserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	var path = filepath.Join(t.TempDir(), "yarge.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := LoadConfig(writeConfig(t, `
+server:
+  readyinterval: 1s
+  tls: {cert: cert.pem, key: key.pem}
+stores:
+  local: {type: file, path: /var/yarge, writable: true}
+  prod: {type: etcd, hosts: ["http://127.0.0.1:4001"], root: /yarge, mirror: true}
+  all: {type: composite, stores: [local, prod]}
+mounts:
+  - store: all
+  - prefix: /global/
+    namespaces: {aws: prod, dc1: local}
+`))
+	if err != nil {
+		t.Fatal("LoadConfig ", err)
+	}
+	if config.Server.Listen != "0.0.0.0:9999" || config.Server.SlowLog != 3 || config.Server.ReadyInterval != time.Second || config.Server.Limits.BatchParallel != 8 || config.Server.TLS.Cert != "cert.pem" {
+		t.Errorf("Expected the defaults along with the settings, Got: %+v", config.Server)
+	}
+	if names := strings.Join(config.StoreNames(), ","); names != "all,local,prod" {
+		t.Errorf("Expected all,local,prod, Got: %s", names)
+	}
+	if config.Mounts[0].Prefix != "/" || config.Stores["prod"].Root != "/yarge" || !config.Stores["local"].Writable {
+		t.Errorf("Expected the stores and mounts, Got: %+v", config)
+	}
+	if stale := config.Stores["prod"].Stale; stale.Interval != time.Minute || stale.Size != 100000 {
+		t.Errorf("Expected the defaults of the stale answers, Got: %+v", stale)
+	}
+	// 0 logs every query
+	if config, err = LoadConfig(writeConfig(t, "{server: {slowlog: 0}, stores: {a: {type: test}}, mounts: [{store: a}]}")); err != nil || config.Server.SlowLog != 0 {
+		t.Errorf("Expected slowlog 0, Got: %+v (Error: %v)", config, err)
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "nosuch.yaml")); !os.IsNotExist(err) {
+		t.Errorf("Expected NotExist, Got: %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	var cases = []struct {
+		config   string
+		expected string
+	}{
+		{`stores: {a: {type: nosuch}}`, "unknown type"},
+		{`stores: {a: {type: file}}`, "no path"},
+		{`stores: {a: {type: etcd}}`, "no hosts"},
+		{`stores: {a: {type: http, timeout: 2s}}`, "no hosts"},
+		{`stores: {a: {type: plugin}}`, "no command"},
+		{`stores: {a: {type: file, url: "file:///var/yarge"}}`, "both a type and a url"},
+		{`stores: {a: {url: /var/yarge}}`, "invalid url"},
+		{`stores: {a: {type: composite, stores: [b]}, b: {type: composite, stores: [a]}}`, "has itself"},
+		{`stores: {a: {type: composite, stores: [c]}}`, "unknown store [c]"},
+		{`stores: {a: {type: composite, stores: [a1], union: [nodes]}, a1: {type: test}}`, "invalid key [nodes]"},
+		{`stores: {a: {type: test}}`, "No store is mounted"},
+		{`{stores: {a: {type: test}}, mounts: [{prefix: /a, store: a}]}`, "start and end with /"},
+		{`{stores: {a: {type: test}}, mounts: [{store: a}, {prefix: /, store: a}]}`, "more than once"},
+		{`{stores: {a: {type: test}}, mounts: [{store: a, namespaces: {x: a}}]}`, "either a store or namespaces"},
+		{`{stores: {a: {type: test}}, mounts: [{store: b}]}`, "unknown store [b]"},
+		{`{stores: {a: {type: test}}, mounts: [{namespaces: {x-y: a}}]}`, "invalid namespace"},
+	}
+	for _, c := range cases {
+		if _, err := LoadConfig(writeConfig(t, c.config)); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("Config %s, Expected Error: %s, Got: %v", c.config, c.expected, err)
+		}
+	}
+}
+
+func TestStoreConfigSpec(t *testing.T) {
+	var cases = []struct {
+		store    StoreConfig
+		expected string
+	}{
+		{StoreConfig{Type: StoreTest}, "test:"},
+		{StoreConfig{Type: StoreFile, Path: "/var/yarge", Fast: true}, "file:///var/yarge?fast=1"},
+		{StoreConfig{Type: StoreFile, Path: "t"}, "file:t"},
+		{StoreConfig{Type: StoreEtcd, Hosts: []string{"http://h1:4001", "http://h2:4001"}, Root: "/yarge", ROptimize: true, RIndex: []string{"AUTHORS", "QAFOR"}},
+			"etcd://h1:4001,h2:4001/yarge?rindex=AUTHORS%2CQAFOR&roptimize=1"},
+		{StoreConfig{Type: StoreEtcd, Hosts: []string{"https://h1:4001"}, Stale: StaleConfig{Enabled: true, Snapshot: "/tmp/s.json"}}, "etcd://h1:4001?lazy=1&tls=1"},
+		{StoreConfig{Type: StoreHTTP, Hosts: []string{"http://y1:9999/global/", "http://y2:9999/global"}, Timeout: 2 * time.Second}, "http://y1:9999,y2:9999/global?timeout=2s"},
+		{StoreConfig{Type: StoreHTTP, Hosts: []string{"http://y1:9999/global/", "http://y2:9999/global/"}}, "http://y1:9999,y2:9999/global"},
+		{StoreConfig{Type: StorePlugin, Command: []string{"/bin/cmdb", "--region", "emea"}}, "plugin:///bin/cmdb?arg=--region&arg=emea"},
+		{StoreConfig{Type: StoreFile, URL: "file:///srv/yarge?fast=1"}, "file:///srv/yarge?fast=1"},
+	}
+	for _, c := range cases {
+		if spec, err := c.store.Spec(); err != nil || spec != c.expected {
+			t.Errorf("Expected %s, Got: %s (Error: %v)", c.expected, spec, err)
+		}
+	}
+	if _, err := (StoreConfig{Type: StoreEtcd, Hosts: []string{"http://h1:4001", "https://h2:4001"}}).Spec(); err == nil {
+		t.Errorf("Expected an Error for the hosts of different schemes, Got: nil")
+	}
+	if _, err := (StoreConfig{Type: StoreComposite}).Spec(); err == nil {
+		t.Errorf("Expected an Error for a composite, Got: nil")
+	}
+}
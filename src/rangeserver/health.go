@@ -0,0 +1,163 @@
+// Health of the server, for the load balancers and the orchestrators.
+//   /healthz   200 as long as the server is up (liveness)
+//   /readyz    200 if the store can serve, 503 otherwise (readiness)
+//   /v1/status what the store has, along with the readiness
+// The readiness is checked every interval (see rangestore.Pinger),
+// the store could go down or be reloaded long after we connected to it.
+
+package rangeserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"rangestore"
+	"sync"
+	"time"
+)
+
+// where the endpoints are
+const HealthPath = "/healthz"
+const ReadyPath = "/readyz"
+const StatusPath = "/v1/status"
+
+// Readiness of the store, as of the last check
+type Readiness struct {
+	store   rangestore.Pinger // nil if the store can't tell, always ready
+	mu      sync.RWMutex
+	err     error     // why the store is not ready
+	checked time.Time // time of the last check
+	stop    chan bool // closed to stop checking
+}
+
+// StatusResponse is the response of the status endpoint
+type StatusResponse struct {
+	rangestore.StoreStatus
+	Ready   bool      `json:"ready"`
+	Error   string    `json:"error,omitempty"` // why the store is not ready
+	Checked time.Time `json:"checked"`         // time of the last readiness check
+}
+
+// NewReadiness checks the store now and then every interval, until Stop
+func NewReadiness(store interface{}, interval time.Duration) *Readiness {
+	var r = &Readiness{stop: make(chan bool)}
+	r.store, _ = store.(rangestore.Pinger)
+	r.check()
+	if r.store != nil && interval > 0 {
+		go r.follow(interval)
+	}
+	return r
+}
+
+// Ready is nil if the store could serve as of the last check
+func (r *Readiness) Ready() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.err
+}
+
+// Checked is the time of the last check
+func (r *Readiness) Checked() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.checked
+}
+
+// Stop checking the store
+func (r *Readiness) Stop() {
+	close(r.stop)
+}
+
+// serves the readiness endpoint
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if err := r.Ready(); err != nil {
+		http.Error(w, fmt.Sprintf("NOT READY (Error: %s)", err), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "READY")
+}
+
+// ReadyHandler serves the readiness endpoint of many stores, it is ready
+// if all of them are
+func ReadyHandler(readies ...*Readiness) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, r := range readies {
+			if r.Ready() != nil {
+				r.ServeHTTP(w, req)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, "READY")
+	})
+}
+
+// HealthHandler serves the liveness endpoint, the server is up if it
+// can answer
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, "OK")
+	})
+}
+
+// StatusHandler serves the status endpoint, the store is walked for every
+// request (it is not meant to be polled)
+func StatusHandler(store interface{}, ready *Readiness) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, ok := store.(rangestore.StatusStore)
+		if !ok {
+			http.Error(w, "Store does not report its status", http.StatusNotImplemented)
+			return
+		}
+		status, err := s.Status()
+		if err != nil {
+			log.Printf("EROR> [%s] %s %s Failed (Error: %s)", r.RemoteAddr, r.Method, r.URL, err)
+			http.Error(w, err.Error(), StatusOf(err))
+			return
+		}
+		var response = StatusResponse{StoreStatus: status, Ready: true, Checked: ready.Checked()}
+		if err := ready.Ready(); err != nil {
+			response.Ready, response.Error = false, err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&response); err != nil {
+			log.Printf("EROR> [%s] %s %s (Writing back to Client Failed [Reason: %s])", r.RemoteAddr, r.Method, r.URL, err)
+		}
+	})
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+func (r *Readiness) follow(interval time.Duration) {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.check()
+		}
+	}
+}
+
+// ping the store, the changes of the readiness are logged
+func (r *Readiness) check() {
+	var err error
+	if r.store != nil {
+		err = r.store.Ping()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil && r.err == nil {
+		log.Printf("EROR> Store is NOT READY (Error: %s)", err)
+	} else if err == nil && r.err != nil {
+		log.Printf("Store is READY again")
+	}
+	r.err, r.checked = err, time.Now()
+}
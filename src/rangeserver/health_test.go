@@ -0,0 +1,90 @@
+package rangeserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"rangestore"
+	"rangestore/filestore"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a store which can be taken down
+type flakyStore struct {
+	*filestore.FileStore
+	mu   sync.Mutex
+	down bool
+}
+
+func (f *flakyStore) Ping() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return fmt.Errorf("down, %w", rangestore.ErrUnavailable)
+	}
+	return f.FileStore.Ping()
+}
+
+func TestReadiness(t *testing.T) {
+	store, err := filestore.ConnectFileStore("../rangestore/filestore/t", -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	var flaky = &flakyStore{FileStore: store}
+	var ready = NewReadiness(flaky, 10*time.Millisecond)
+	defer ready.Stop()
+
+	var readyz = func() int {
+		var w = httptest.NewRecorder()
+		ready.ServeHTTP(w, httptest.NewRequest("GET", ReadyPath, nil))
+		return w.Code
+	}
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("Expected 200, Store is up, Got: %d", code)
+	}
+	// the store going down is seen by the next check
+	flaky.mu.Lock()
+	flaky.down = true
+	flaky.mu.Unlock()
+	var waitFor = func(code int) bool {
+		for i := 0; i < 100; i++ {
+			if readyz() == code {
+				return true
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return false
+	}
+	if !waitFor(http.StatusServiceUnavailable) {
+		t.Errorf("Expected 503, Store is down")
+	}
+
+	// the status has the counts, and tells the store is not ready
+	var w = httptest.NewRecorder()
+	StatusHandler(flaky, ready).ServeHTTP(w, httptest.NewRequest("GET", StatusPath, nil))
+	var status StatusResponse
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with JSON, Got: %d (Error: %v)", w.Code, err)
+	}
+	if status.Type != "filestore" || status.Leaves != 7 || status.Ready || status.Error == "" {
+		t.Errorf("Expected filestore with 7 leaves, NOT ready, Got: %+v", status)
+	}
+
+	flaky.mu.Lock()
+	flaky.down = false
+	flaky.mu.Unlock()
+	if !waitFor(http.StatusOK) {
+		t.Errorf("Expected 200, Store is up again")
+	}
+
+	// stores which can't tell are always ready, but have no status
+	w = httptest.NewRecorder()
+	var test, _ = rangestore.ConnectTestStore("Test Store")
+	StatusHandler(test, NewReadiness(test, 0)).ServeHTTP(w, httptest.NewRequest("GET", StatusPath, nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501, TestStore, Got: %d", w.Code)
+	}
+}
@@ -0,0 +1,125 @@
+// Per client cap on the requests being served at a time, so that a client
+// (eg, a runaway fan-out) can't hold all of the server. The client is the
+// address it connects from, or the X-Real-IP set by a proxy of ours (any
+// client can set the header, only the proxies configured are believed).
+// The requests over the cap are refused with 429 and a Retry-After, the
+// client can come back once its other requests are done.
+
+package rangeserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"rangestore"
+	"sync"
+)
+
+// how long a client refused is told to wait (seconds)
+const _retryAfter = "1"
+
+// ClientLimiter counts the requests being served for each client
+type ClientLimiter struct {
+	max     int          // requests at a time per client, no cap if zero
+	proxies []*net.IPNet // the X-Real-IP of these is the client
+	mu      sync.Mutex
+	clients map[string]int
+}
+
+// proxies are the addresses (or networks, eg, 10.0.0.0/8) of the proxies
+// in front of the server
+func NewClientLimiter(max int, proxies []string) (*ClientLimiter, error) {
+	networks, err := ParseProxies(proxies)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientLimiter{max: max, proxies: networks, clients: make(map[string]int)}, nil
+}
+
+// ParseProxies are the networks of the proxies, an address is a network
+// of its own
+func ParseProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks = make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		var cidr = p
+		if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else if ip != nil {
+			cidr += "/128"
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Proxy [%s] is not an address or a network (eg, 10.0.0.1 or 10.0.0.0/8)", p)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Limit serves the requests of a client only while it is under the cap
+func (c *ClientLimiter) Limit(handler http.Handler) http.Handler {
+	if c.max <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var client = c.clientOf(r)
+		if !c.acquire(client) {
+			var err = &rangestore.LimitError{Limit: rangestore.LimitConcurrent, Value: fmt.Sprintf("%d", c.max)}
+			log.Printf("EROR> [%s] %s %s Refused (Error: %s)", client, r.Method, r.URL, err)
+			w.Header().Set("Range-Err-Count", "1")
+			w.Header().Set("Range-Err-Code", CodeLimit)
+			w.Header().Set("Range-Limit", err.Limit)
+			w.Header().Set("Retry-After", _retryAfter)
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer c.release(client)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+func (c *ClientLimiter) acquire(client string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clients[client] >= c.max {
+		return false
+	}
+	c.clients[client]++
+	return true
+}
+
+func (c *ClientLimiter) release(client string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clients[client]--; c.clients[client] <= 0 {
+		delete(c.clients, client)
+	}
+}
+
+// the address of the client, without the port. The X-Real-IP is the
+// client only if the request comes from one of the proxies
+func (c *ClientLimiter) clientOf(r *http.Request) string {
+	var addr = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		addr = host
+	}
+	if ip := r.Header.Get("X-Real-IP"); ip != "" && c.proxied(addr) {
+		return ip
+	}
+	return addr
+}
+
+func (c *ClientLimiter) proxied(addr string) bool {
+	var ip = net.ParseIP(addr)
+	for _, network := range c.proxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package rangeserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"rangestore"
+	"testing"
+)
+
+func TestClientLimiter(t *testing.T) {
+	var release = make(chan bool)
+	var started = make(chan bool)
+	// the requests come from 192.0.2.1 (see httptest.NewRequest)
+	limiter, err := NewClientLimiter(1, []string{"192.0.2.1"})
+	if err != nil {
+		t.Fatal("NewClientLimiter ", err)
+	}
+	var handler = limiter.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	}))
+	var request = func(ip string) *httptest.ResponseRecorder {
+		var w = httptest.NewRecorder()
+		var r = httptest.NewRequest("GET", "/v1/range/list?%25ops", nil)
+		r.Header.Set("X-Real-IP", ip)
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	var done = make(chan *httptest.ResponseRecorder)
+	var async = func(ip string) {
+		go func() { done <- request(ip) }()
+		<-started
+	}
+
+	async("10.0.0.1")
+	// the client is at its cap, the others are not
+	if w := request("10.0.0.1"); w.Code != http.StatusTooManyRequests || w.Header().Get("Range-Limit") != rangestore.LimitConcurrent || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 (maxconcurrent) with a Retry-After, Got: %d %s", w.Code, w.Header())
+	}
+	async("10.0.0.2")
+	for i := 0; i < 2; i++ {
+		release <- true
+		if w := <-done; w.Code != http.StatusOK {
+			t.Errorf("Expected 200, Got: %d", w.Code)
+		}
+	}
+	// and once done, the client can come back
+	async("10.0.0.1")
+	release <- true
+	if w := <-done; w.Code != http.StatusOK {
+		t.Errorf("Expected 200, Got: %d", w.Code)
+	}
+}
+
+func TestClientLimiterProxies(t *testing.T) {
+	limiter, err := NewClientLimiter(1, []string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal("NewClientLimiter ", err)
+	}
+	var cases = []struct {
+		remote   string
+		realIP   string
+		expected string
+	}{
+		{"10.1.2.3:4000", "192.0.2.7", "192.0.2.7"},
+		{"[::1]:4000", "192.0.2.7", "192.0.2.7"},
+		{"192.0.2.1:4000", "192.0.2.7", "192.0.2.1"}, // not a proxy, anyone can set the header
+		{"10.1.2.3:4000", "", "10.1.2.3"},
+	}
+	for _, c := range cases {
+		var r = httptest.NewRequest("GET", "/v1/range/list?%25ops", nil)
+		r.RemoteAddr = c.remote
+		if c.realIP != "" {
+			r.Header.Set("X-Real-IP", c.realIP)
+		}
+		if client := limiter.clientOf(r); client != c.expected {
+			t.Errorf("%s (X-Real-IP: %s): Expected %s, Got: %s", c.remote, c.realIP, c.expected, client)
+		}
+	}
+	if _, err = NewClientLimiter(1, []string{"proxy1"}); err == nil {
+		t.Errorf("Expected an Error for a Proxy not an Address, Got: nil")
+	}
+}
+
+func TestQueryErrorLimit(t *testing.T) {
+	var store = rangestore.WithLimits(&rangestore.TestStore{}, rangestore.Limits{MaxResults: 1})
+	response, usable := Expand("%ops-prod-vpc1-range", store, true)
+	if usable || len(response.Errors) != 1 || response.Errors[0].Limit != rangestore.LimitResults {
+		t.Fatalf("Expected maxresults to be hit, Got: %+v", response)
+	}
+	if status, code := Status(response.Errors); status != http.StatusUnprocessableEntity || code != CodeLimit {
+		t.Errorf("Expected 422 %s, Got: %d %s", CodeLimit, status, code)
+	}
+}
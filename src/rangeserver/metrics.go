@@ -0,0 +1,318 @@
+// Metrics of the server in the Prometheus text format (served at
+// MetricsPath), so that Prometheus can scrape the server as is.
+// * queries and their latency, by the shape of the query (the operations
+//   in it, see rangeexpr.Shape)
+// * errors of the queries, by the error code
+// * calls to the store and their latency, by the method (see InstrumentStore)
+// * hits and misses of the caches (see AddCache)
+// * stores serving stale answers and how old they are (see AddStale)
+
+package rangeserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"rangestore"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// where the metrics are served
+const MetricsPath = "/metrics"
+
+// upper bounds (in seconds) of the latency histograms
+var _buckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Metrics of the queries and the store
+type Metrics struct {
+	sync.Mutex
+	queries    map[string]*histogram // latency of the queries by shape
+	errors     map[string]uint64     // errors of the queries by code
+	calls      map[string]*histogram // latency of the store calls by method
+	callErrors map[string]uint64     // errors of the store calls by method
+	caches     map[string]rangestore.Cache
+	stales     map[string]rangestore.Staler
+}
+
+// DefaultMetrics has the queries expanded by Expand
+var DefaultMetrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		queries:    make(map[string]*histogram),
+		errors:     make(map[string]uint64),
+		calls:      make(map[string]*histogram),
+		callErrors: make(map[string]uint64),
+		caches:     make(map[string]rangestore.Cache),
+		stales:     make(map[string]rangestore.Staler),
+	}
+}
+
+// ObserveQuery counts the query (by the shape of its response), its
+// latency and its errors
+func (m *Metrics) ObserveQuery(response *Response) {
+	m.Lock()
+	defer m.Unlock()
+	observe(m.queries, response.Shape, time.Duration(response.TimingUs)*time.Microsecond)
+	for _, e := range response.Errors {
+		m.errors[e.Code]++
+	}
+}
+
+// AddCache has the hits and misses of the cache in the metrics
+func (m *Metrics) AddCache(name string, cache rangestore.Cache) {
+	m.Lock()
+	defer m.Unlock()
+	m.caches[name] = cache
+}
+
+// AddStale has whether the store serves stale answers (and how old they
+// are) in the metrics
+func (m *Metrics) AddStale(name string, stale rangestore.Staler) {
+	m.Lock()
+	defer m.Unlock()
+	m.stales[name] = stale
+}
+
+// RemoveCache takes the cache out of the metrics (eg, its store is
+// closed), unless another cache was added by the name since
+func (m *Metrics) RemoveCache(name string, cache rangestore.Cache) {
+	m.Lock()
+	defer m.Unlock()
+	if m.caches[name] == cache {
+		delete(m.caches, name)
+	}
+}
+
+// RemoveStale takes the store out of the metrics, unless another store
+// was added by the name since
+func (m *Metrics) RemoveStale(name string, stale rangestore.Staler) {
+	m.Lock()
+	defer m.Unlock()
+	if m.stales[name] == stale {
+		delete(m.stales, name)
+	}
+}
+
+// InstrumentStore counts the calls to the store, along with their latency
+// and errors
+func (m *Metrics) InstrumentStore(store rangestore.Store) rangestore.Store {
+	return &instrumentedStore{store: store, metrics: m}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	var b strings.Builder
+
+	header(&b, "yarge_queries_total", "counter", "Queries expanded, by the operations in the query")
+	for _, shape := range histogramLabels(m.queries) {
+		fmt.Fprintf(&b, "yarge_queries_total{shape=%s} %d\n", quote(shape), m.queries[shape].count)
+	}
+	header(&b, "yarge_query_duration_seconds", "histogram", "Time taken to expand the queries, by the operations in the query")
+	for _, shape := range histogramLabels(m.queries) {
+		m.queries[shape].write(&b, "yarge_query_duration_seconds", "shape", shape)
+	}
+	header(&b, "yarge_query_errors_total", "counter", "Errors of the queries, by the error code")
+	for _, code := range counterLabels(m.errors) {
+		fmt.Fprintf(&b, "yarge_query_errors_total{code=%s} %d\n", quote(code), m.errors[code])
+	}
+
+	header(&b, "yarge_store_calls_total", "counter", "Calls to the store, by the method")
+	for _, method := range histogramLabels(m.calls) {
+		fmt.Fprintf(&b, "yarge_store_calls_total{method=%s} %d\n", quote(method), m.calls[method].count)
+	}
+	header(&b, "yarge_store_call_errors_total", "counter", "Calls to the store which failed, by the method")
+	for _, method := range histogramLabels(m.calls) {
+		fmt.Fprintf(&b, "yarge_store_call_errors_total{method=%s} %d\n", quote(method), m.callErrors[method])
+	}
+	header(&b, "yarge_store_call_duration_seconds", "histogram", "Time taken by the calls to the store, by the method")
+	for _, method := range histogramLabels(m.calls) {
+		m.calls[method].write(&b, "yarge_store_call_duration_seconds", "method", method)
+	}
+
+	var caches = make([]string, 0, len(m.caches))
+	var stats = make(map[string]rangestore.CacheStats)
+	for name, cache := range m.caches {
+		caches = append(caches, name)
+		stats[name] = cache.CacheStats()
+	}
+	sort.Strings(caches)
+	header(&b, "yarge_cache_hits_total", "counter", "Lookups served from the cache")
+	for _, name := range caches {
+		fmt.Fprintf(&b, "yarge_cache_hits_total{cache=%s} %d\n", quote(name), stats[name].Hits)
+	}
+	header(&b, "yarge_cache_misses_total", "counter", "Lookups the cache could not serve")
+	for _, name := range caches {
+		fmt.Fprintf(&b, "yarge_cache_misses_total{cache=%s} %d\n", quote(name), stats[name].Misses)
+	}
+	header(&b, "yarge_cache_hit_ratio", "gauge", "Hits over the lookups of the cache (since start)")
+	for _, name := range caches {
+		var ratio float64
+		if total := stats[name].Hits + stats[name].Misses; total > 0 {
+			ratio = float64(stats[name].Hits) / float64(total)
+		}
+		fmt.Fprintf(&b, "yarge_cache_hit_ratio{cache=%s} %s\n", quote(name), float(ratio))
+	}
+
+	var stales = make([]string, 0, len(m.stales))
+	for name := range m.stales {
+		stales = append(stales, name)
+	}
+	sort.Strings(stales)
+	header(&b, "yarge_store_stale", "gauge", "Whether the store is unavailable and stale answers are served")
+	for _, name := range stales {
+		var stale, _ = m.stales[name].Stale()
+		var value = 0
+		if stale {
+			value = 1
+		}
+		fmt.Fprintf(&b, "yarge_store_stale{store=%s} %d\n", quote(name), value)
+	}
+	header(&b, "yarge_store_data_age_seconds", "gauge", "Time since the store last answered (the age of the stale answers)")
+	for _, name := range stales {
+		var _, age = m.stales[name].Stale()
+		fmt.Fprintf(&b, "yarge_store_data_age_seconds{store=%s} %s\n", quote(name), float(age.Seconds()))
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+////////////////////////
+// Instrumented Store //
+////////////////////////
+
+type instrumentedStore struct {
+	store   rangestore.Store
+	metrics *Metrics
+}
+
+func (s *instrumentedStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	var t0 = time.Now()
+	result, err := s.store.ClusterLookup(cluster)
+	return result, s.observe("ClusterLookup", t0, err)
+}
+
+func (s *instrumentedStore) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	var t0 = time.Now()
+	result, err := s.store.KeyLookup(cluster, key)
+	return result, s.observe("KeyLookup", t0, err)
+}
+
+func (s *instrumentedStore) KeyReverseLookup(key string) (*[]string, error) {
+	var t0 = time.Now()
+	result, err := s.store.KeyReverseLookup(key)
+	return result, s.observe("KeyReverseLookup", t0, err)
+}
+
+func (s *instrumentedStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	var t0 = time.Now()
+	result, err := s.store.KeyReverseLookupAttr(key, attr)
+	return result, s.observe("KeyReverseLookupAttr", t0, err)
+}
+
+func (s *instrumentedStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	var t0 = time.Now()
+	result, err := s.store.KeyReverseLookupHint(key, attr, hint)
+	return result, s.observe("KeyReverseLookupHint", t0, err)
+}
+
+func (s *instrumentedStore) Scope(t rangestore.Tracker) rangestore.Store {
+	return &instrumentedStore{store: rangestore.Scope(s.store, t), metrics: s.metrics}
+}
+
+// count the call to the method which started at t0, the error is
+// passed through
+func (s *instrumentedStore) observe(method string, t0 time.Time, err error) error {
+	var took = time.Since(t0)
+	s.metrics.Lock()
+	defer s.metrics.Unlock()
+	observe(s.metrics.calls, method, took)
+	if err != nil {
+		s.metrics.callErrors[method]++
+	}
+	return err
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// latencies (and the count) of the observations
+type histogram struct {
+	buckets []uint64 // observations <= _buckets[i]
+	count   uint64
+	sum     float64 // in seconds
+}
+
+// add the observation to the histogram of the label
+func observe(histograms map[string]*histogram, label string, took time.Duration) {
+	var h, ok = histograms[label]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(_buckets))}
+		histograms[label] = h
+	}
+	var seconds = took.Seconds()
+	for i, le := range _buckets {
+		if seconds <= le {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// the histogram in the text format (the buckets are cumulative)
+func (h *histogram) write(b *strings.Builder, name string, label string, value string) {
+	for i, le := range _buckets {
+		fmt.Fprintf(b, "%s_bucket{%s=%s,le=\"%s\"} %d\n", name, label, quote(value), float(le), h.buckets[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{%s=%s,le=\"+Inf\"} %d\n", name, label, quote(value), h.count)
+	fmt.Fprintf(b, "%s_sum{%s=%s} %s\n", name, label, quote(value), float(h.sum))
+	fmt.Fprintf(b, "%s_count{%s=%s} %d\n", name, label, quote(value), h.count)
+}
+
+func header(b *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// label value, quoted and escaped
+func quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func float(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sorted labels of the histograms, so that the output is stable
+func histogramLabels(histograms map[string]*histogram) []string {
+	var labels = make([]string, 0, len(histograms))
+	for label := range histograms {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// sorted labels of the counters
+func counterLabels(counters map[string]uint64) []string {
+	var labels = make([]string, 0, len(counters))
+	for label := range counters {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
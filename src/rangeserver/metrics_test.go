@@ -0,0 +1,76 @@
+package rangeserver
+
+import (
+	"net/http/httptest"
+	"rangestore"
+	"rangestore/filestore"
+	"strings"
+	"testing"
+)
+
+type fixedCache rangestore.CacheStats
+
+func (c fixedCache) CacheStats() rangestore.CacheStats {
+	return rangestore.CacheStats(c)
+}
+
+func TestMetrics(t *testing.T) {
+	store, err := filestore.ConnectFileStore("../rangestore/filestore/t", -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	var m = NewMetrics()
+	var instrumented = m.InstrumentStore(store)
+	for _, query := range []string{"%ops-prod-vpc1-range", "%ops-prod-vpc1-range:NODES", "%nosuch"} {
+		response, _ := Expand(query, instrumented, false)
+		m.ObserveQuery(response)
+	}
+	m.AddCache("test", fixedCache{Hits: 3, Misses: 1})
+
+	var w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", MetricsPath, nil))
+	var body = w.Body.String()
+	for _, expected := range []string{
+		"# TYPE yarge_queries_total counter\n",
+		`yarge_queries_total{shape="cluster"} 2` + "\n",
+		`yarge_queries_total{shape="cluster+key"} 1` + "\n",
+		`yarge_query_duration_seconds_bucket{shape="cluster",le="+Inf"} 2` + "\n",
+		`yarge_query_duration_seconds_count{shape="cluster+key"} 1` + "\n",
+		`yarge_query_errors_total{code="NOT_FOUND"} 1` + "\n",
+		`yarge_store_calls_total{method="ClusterLookup"} 2` + "\n",
+		`yarge_store_calls_total{method="KeyLookup"} 1` + "\n",
+		`yarge_store_call_errors_total{method="ClusterLookup"} 1` + "\n",
+		`yarge_cache_hits_total{cache="test"} 3` + "\n",
+		`yarge_cache_hit_ratio{cache="test"} 0.75` + "\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in the metrics, Got:\n%s", expected, body)
+		}
+	}
+}
+
+// a cache is removed only if it is the one added by the name
+func TestMetricsRemoveCache(t *testing.T) {
+	var m = NewMetrics()
+	var old, next = &fixedCache{Hits: 1}, &fixedCache{Hits: 2}
+	m.AddCache("test", old)
+	m.AddCache("test", next)
+	m.RemoveCache("test", old)
+	var b strings.Builder
+	m.WriteTo(&b)
+	if !strings.Contains(b.String(), `yarge_cache_hits_total{cache="test"} 2`) {
+		t.Errorf("Expected the cache added last, Got:\n%s", b.String())
+	}
+	m.RemoveCache("test", next)
+	b.Reset()
+	m.WriteTo(&b)
+	if strings.Contains(b.String(), `cache="test"`) {
+		t.Errorf("Expected the cache to be removed, Got:\n%s", b.String())
+	}
+}
+
+func TestQuote(t *testing.T) {
+	if q := quote("a\"b\\c\nd"); q != `"a\"b\\c\nd"` {
+		t.Errorf("Expected escaped label, Got: %s", q)
+	}
+}
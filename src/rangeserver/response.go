@@ -0,0 +1,222 @@
+// JSON response of a query. The plain text response has the results one
+// per line (or the errors in the body), the JSON response has both, so the
+// client can tell partial results from a total failure and which part of
+// the query failed.
+// It is chosen with "Accept: application/json" or with "format=json" before
+// or after the query, eg, ?format=json&%ops (the query string is the range
+// expression itself, so the options are taken off its ends)
+
+package rangeserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"rangeexpr"
+	"rangestore"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// error codes in the JSON response (and the Range-Err-Code header)
+const (
+	CodeParse       = "PARSE_ERROR"    // query is not a valid range expression
+	CodeInvalidName = "INVALID_NAME"   // cluster or key name is not valid
+	CodeNotFound    = "NOT_FOUND"      // no such cluster or key
+	CodeUnavailable = "UNAVAILABLE"    // the store can't be reached
+	CodeLimit       = "LIMIT_EXCEEDED" // query went over a limit of the server
+	CodeLookup      = "LOOKUP_ERROR"   // a lookup in the store failed
+	CodePanic       = "PANIC"          // the server panicked while expanding
+)
+
+// http status of each error code, the most severe one is the status
+// of the response (see Status)
+var codeStatus = []struct {
+	code   string
+	status int
+}{
+	{CodeUnavailable, http.StatusServiceUnavailable},
+	{CodePanic, http.StatusInternalServerError},
+	{CodeLookup, http.StatusInternalServerError},
+	{CodeLimit, http.StatusUnprocessableEntity},
+	{CodeNotFound, http.StatusNotFound},
+	{CodeInvalidName, http.StatusBadRequest},
+	{CodeParse, http.StatusBadRequest},
+}
+
+// Response is the JSON response of a query
+type Response struct {
+	Results  []string     `json:"results"`
+	Errors   []QueryError `json:"errors"`
+	TimingUs int64        `json:"timing_us"`
+	Count    int          `json:"count"`
+
+	Stale    bool          `json:"-"` // some answers of the store were stale (see SetStale)
+	StaleAge time.Duration `json:"-"` // of the oldest of them
+	Shape    string        `json:"-"` // of the query (see rangeexpr.Shape)
+}
+
+// QueryError is an error in the JSON response
+type QueryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	SubExpr string `json:"subexpr"`         // part of the query which failed
+	Limit   string `json:"limit,omitempty"` // limit hit, if LIMIT_EXCEEDED
+}
+
+// Expand evaluates the query against the store and builds its response.
+// The results are dropped if there are errors, unless partial results
+// were asked for and the results can be used in spite of the errors (see
+// rangeexpr.ExpandPartial), usable tells whether the results were kept.
+// The response tells whether the store answered stale for this query.
+// The query is counted in DefaultMetrics.
+func Expand(query string, store interface{}, partial bool) (response *Response, usable bool) {
+	var t0 = time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("EROR> %s [Panicked while Expanding Query: %v]", query, r)
+			response = NewResponse(query, nil, []error{fmt.Errorf("%s [Panicked while Expanding Query]", query)}, time.Since(t0))
+			usable = false
+		}
+		if response.Shape == "" {
+			response.Shape = rangeexpr.Shape(query)
+		}
+		DefaultMetrics.ObserveQuery(response)
+	}()
+	// the store as seen by this query, within its limits (if any)
+	var limits rangestore.Limits
+	if l, ok := store.(rangestore.LimitsStore); ok {
+		limits = l.QueryLimits()
+	}
+	var limited = rangestore.NewLimitedStore(store.(rangestore.Store), limits)
+	results, errs, ok, shape := rangeexpr.ExpandShape(query, limited)
+	usable = len(errs) == 0 || (partial && ok)
+	if !usable {
+		results = &[]string{}
+	}
+	response = NewResponse(query, *results, errs, time.Since(t0))
+	response.Stale, response.StaleAge = limited.Stale()
+	response.Shape = shape
+	return response, usable
+}
+
+// NewResponse builds the response of a query
+func NewResponse(query string, results []string, errs []error, took time.Duration) *Response {
+	if results == nil {
+		results = []string{}
+	}
+	var response = &Response{Results: results, Errors: make([]QueryError, 0), TimingUs: int64(took / time.Microsecond), Count: len(results)}
+	for _, err := range errs {
+		response.Errors = append(response.Errors, NewQueryError(query, err))
+	}
+	return response
+}
+
+// NewQueryError tells what kind of error it is and which part of the
+// query failed
+func NewQueryError(query string, err error) QueryError {
+	var evalErr *rangeexpr.EvalError
+	var parseErr *rangeexpr.ParseError
+	switch {
+	case errors.As(err, &parseErr):
+		return QueryError{Code: CodeParse, Message: err.Error(), SubExpr: parseErr.Query}
+	case errors.As(err, &evalErr):
+		var e = QueryError{Code: ErrorCode(err), Message: err.Error(), SubExpr: evalErr.SubExpr}
+		var limitErr *rangestore.LimitError
+		if errors.As(err, &limitErr) {
+			e.Limit = limitErr.Limit
+		}
+		return e
+	}
+	return QueryError{Code: CodePanic, Message: err.Error(), SubExpr: query}
+}
+
+// ErrorCode tells what kind of error it is, the errors of the stores are
+// told apart using the errors of rangestore
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, rangeexpr.ErrParse):
+		return CodeParse
+	case errors.Is(err, rangestore.ErrInvalidName):
+		return CodeInvalidName
+	case errors.Is(err, rangestore.ErrNotFound):
+		return CodeNotFound
+	case errors.Is(err, rangestore.ErrUnavailable):
+		return CodeUnavailable
+	case errors.Is(err, rangestore.ErrLimit):
+		return CodeLimit
+	}
+	return CodeLookup
+}
+
+// Status is the http status of a response with these errors along with
+// the code of the error which decided it, 200 if there are no errors.
+// When the errors are of different kinds, the most severe one wins (the
+// store being down over the query being bad)
+func Status(errs []QueryError) (int, string) {
+	if len(errs) == 0 {
+		return http.StatusOK, ""
+	}
+	for _, cs := range codeStatus {
+		for _, e := range errs {
+			if e.Code == cs.code {
+				return cs.status, cs.code
+			}
+		}
+	}
+	return http.StatusInternalServerError, errs[0].Code
+}
+
+// StatusOf is the http status of the error
+func StatusOf(err error) int {
+	status, _ := Status([]QueryError{{Code: ErrorCode(err)}})
+	return status
+}
+
+// options which can go with the query, eg, %ops&format=json
+var queryOption = regexp.MustCompile(`^(format|partial)=([a-z]+)$`)
+
+// ParseQuery splits the raw query string of the request into the range
+// expression and the options appended to it
+func ParseQuery(r *http.Request) (string, url.Values, error) {
+	var options = make(url.Values)
+	var parts = strings.Split(r.URL.RawQuery, "&")
+	// options can be before or after the expression
+	for len(parts) > 0 {
+		if option := queryOption.FindStringSubmatch(parts[0]); option != nil {
+			options.Add(option[1], option[2])
+			parts = parts[1:]
+		} else if option := queryOption.FindStringSubmatch(parts[len(parts)-1]); option != nil {
+			options.Add(option[1], option[2])
+			parts = parts[:len(parts)-1]
+		} else {
+			break
+		}
+	}
+	query, err := url.QueryUnescape(strings.Join(parts, "&"))
+	return query, options, err
+}
+
+// WantsJSON tells whether the client asked for a JSON response
+func WantsJSON(r *http.Request, options url.Values) bool {
+	if options.Get("format") == "json" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.Split(accept, ";")[0]) == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteJSON writes the response with the status
+func WriteJSON(w http.ResponseWriter, status int, response *Response) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(response)
+}
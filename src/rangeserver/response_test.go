@@ -0,0 +1,92 @@
+package rangeserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"rangeexpr"
+	"rangestore"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	var cases = map[string][]string{
+		"/v1/range/list?%25ops":                      {"%ops", ""},
+		"/v1/range/list?%25ops&format=json":          {"%ops", "json"},
+		"/v1/range/list?format=json&%25ops":          {"%ops", "json"},
+		"/v1/range/list?%25ops,&%25data&format=json": {"%ops,&%data", "json"},
+		"/v1/range/list?format=json":                 {"", "json"},
+		"/v1/range/list?%25ops%2C%26format%3Djson":   {"%ops,&format=json", ""},
+	}
+	for target, expected := range cases {
+		var r = httptest.NewRequest("GET", target, nil)
+		query, options, err := ParseQuery(r)
+		if err != nil || query != expected[0] || options.Get("format") != expected[1] {
+			t.Errorf("Expected [%s] format [%s], (URL: %s) Got: [%s] format [%s] (Error: %v)", expected[0], expected[1], target, query, options.Get("format"), err)
+		}
+	}
+
+	var r = httptest.NewRequest("GET", "/v1/range/list?partial=true&%25ops,%25data&format=json", nil)
+	if query, options, _ := ParseQuery(r); query != "%ops,%data" || options.Get("partial") != "true" || options.Get("format") != "json" {
+		t.Errorf("Expected [%%ops,%%data] with partial and format, Got: [%s] %v", query, options)
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	var r = httptest.NewRequest("GET", "/v1/range/list?%25ops", nil)
+	_, options, _ := ParseQuery(r)
+	if WantsJSON(r, options) {
+		t.Errorf("Expected plain text, without Accept or format")
+	}
+	r.Header.Set("Accept", "text/plain, application/json;q=0.9")
+	if !WantsJSON(r, options) {
+		t.Errorf("Expected JSON, with Accept: %s", r.Header.Get("Accept"))
+	}
+}
+
+func TestNewResponse(t *testing.T) {
+	var errs = []error{
+		&rangeexpr.EvalError{SubExpr: "%nosuch:NODES", Err: errors.New("No Such Cluster [nosuch]")},
+		&rangeexpr.ParseError{Query: "%ops,,"},
+	}
+	response := NewResponse("%ops,%nosuch:NODES", []string{"ops-prod"}, errs, 1500*time.Microsecond)
+	if response.Count != 1 || response.TimingUs != 1500 || len(response.Errors) != 2 {
+		t.Fatalf("Expected 1 result, 1500us and 2 errors, Got: %+v", response)
+	}
+	if e := response.Errors[0]; e.Code != CodeLookup || e.SubExpr != "%nosuch:NODES" || e.Message != "No Such Cluster [nosuch]" {
+		t.Errorf("Expected LOOKUP_ERROR on %%nosuch:NODES, Got: %+v", e)
+	}
+	if e := response.Errors[1]; e.Code != CodeParse || e.SubExpr != "%ops,," {
+		t.Errorf("Expected PARSE_ERROR, Got: %+v", e)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	var lookupErr = func(err error) error {
+		return &rangeexpr.EvalError{SubExpr: "%ops-prod", Err: fmt.Errorf("KeyLookup Failed (Error: %w)", err)}
+	}
+	var cases = []struct {
+		errs   []error
+		status int
+		code   string
+	}{
+		{[]error{}, http.StatusOK, ""},
+		{[]error{&rangeexpr.ParseError{Query: "%ops,,"}}, http.StatusBadRequest, CodeParse},
+		{[]error{lookupErr(rangestore.ErrInvalidName)}, http.StatusBadRequest, CodeInvalidName},
+		{[]error{lookupErr(rangestore.ErrNotFound)}, http.StatusNotFound, CodeNotFound},
+		{[]error{lookupErr(rangestore.ErrUnavailable)}, http.StatusServiceUnavailable, CodeUnavailable},
+		{[]error{lookupErr(rangestore.ErrLimit)}, http.StatusUnprocessableEntity, CodeLimit},
+		{[]error{lookupErr(errors.New("yaml: line 2"))}, http.StatusInternalServerError, CodeLookup},
+		// the store being down wins over a missing cluster
+		{[]error{lookupErr(rangestore.ErrNotFound), lookupErr(rangestore.ErrUnavailable)}, http.StatusServiceUnavailable, CodeUnavailable},
+		{[]error{lookupErr(rangestore.ErrNotFound), lookupErr(rangestore.ErrLimit)}, http.StatusUnprocessableEntity, CodeLimit},
+	}
+	for _, c := range cases {
+		status, code := Status(NewResponse("%ops-prod", nil, c.errs, 0).Errors)
+		if status != c.status || code != c.code {
+			t.Errorf("Expected %d [%s], Errors: %v, Got: %d [%s]", c.status, c.code, c.errs, status, code)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+// Stale answers, when the store is unavailable and serves the last good
+// answers instead (see rangestore.StaleStore) the responses of the queries
+// it answered so say so:
+//   Range-Stale: true
+//   Range-Stale-Age: 42    seconds since the store last answered
+
+package rangeserver
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SetStale marks the response as stale if the store answered stale for
+// any of the queries, the age is of the oldest answer
+func SetStale(w http.ResponseWriter, responses ...*Response) {
+	var stale bool
+	var age time.Duration
+	for _, r := range responses {
+		if r.Stale && (!stale || r.StaleAge > age) {
+			stale, age = true, r.StaleAge
+		}
+	}
+	if stale {
+		w.Header().Set("Range-Stale", "true")
+		w.Header().Set("Range-Stale-Age", fmt.Sprintf("%d", int64(age/time.Second)))
+	}
+}
@@ -0,0 +1,54 @@
+package rangeserver
+
+import (
+	"net/http/httptest"
+	"rangestore"
+	"rangestore/filestore"
+	"testing"
+	"time"
+)
+
+// answers stale, as the stale store does when the backend is down
+type staleStore struct {
+	rangestore.Store
+	age time.Duration
+}
+
+func (s *staleStore) Scope(t rangestore.Tracker) rangestore.Store {
+	t.MarkStale(s.age)
+	return s
+}
+
+func TestSetStale(t *testing.T) {
+	var cases = []struct {
+		responses []*Response
+		stale     string
+		age       string
+	}{
+		{[]*Response{{}}, "", ""},
+		{[]*Response{{Stale: true, StaleAge: 90 * time.Second}}, "true", "90"},
+		{[]*Response{{}, {Stale: true, StaleAge: 30 * time.Second}, {Stale: true, StaleAge: 90 * time.Second}}, "true", "90"},
+	}
+	for _, c := range cases {
+		var w = httptest.NewRecorder()
+		SetStale(w, c.responses...)
+		if w.Header().Get("Range-Stale") != c.stale || w.Header().Get("Range-Stale-Age") != c.age {
+			t.Errorf("Expected Range-Stale [%s] and Range-Stale-Age [%s], Got: %s", c.stale, c.age, w.Header())
+		}
+	}
+}
+
+func TestExpandStale(t *testing.T) {
+	store, err := filestore.ConnectFileStore("../rangestore/filestore/t", -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	// only the queries answered stale are stale
+	if response, _ := Expand("%ops-prod", store, false); response.Stale {
+		t.Errorf("Expected the response NOT to be stale")
+	}
+	response, _ := Expand("%ops-prod", &staleStore{Store: store, age: 90 * time.Second}, false)
+	if !response.Stale || response.StaleAge != 90*time.Second || len(response.Results) != 2 {
+		t.Errorf("Expected the stale results, Got: %+v", response)
+	}
+}
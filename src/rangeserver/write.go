@@ -0,0 +1,289 @@
+// REST endpoints to edit a writable store. The cluster is in the path and the
+// cluster version (rangestore.WritableStore) is sent as the ETag, an edit can
+// be made conditional by sending the ETag back in If-Match.
+//
+//   GET    /v1/cluster/<cluster>               cluster config (yaml), ETag
+//   PUT    /v1/cluster/<cluster>               create the leaf cluster
+//   POST   /v1/cluster/<cluster>?rename=<to>   rename the leaf cluster
+//   DELETE /v1/cluster/<cluster>               delete the cluster
+//   GET    /v1/cluster/<cluster>/<KEY>         values of the key, ETag
+//   PUT    /v1/cluster/<cluster>/<KEY>         set the values (one per line in body)
+//   POST   /v1/cluster/<cluster>/<KEY>         append the values (one per line in body)
+//   DELETE /v1/cluster/<cluster>/<KEY>         delete the key
+//   DELETE /v1/cluster/<cluster>/<KEY>?value=v remove the values from the key
+//   PUT    /v1/cluster/<cluster>/NODES/<node>?ttl=30s  register the node (heartbeat)
+//   DELETE /v1/cluster/<cluster>/NODES/<node>          deregister the node
+//
+// Bad names are 400, a missing cluster or key is 404, an edit conflicting
+// with another edit is 409 (412 if the If-Match did not match) and an
+// existing cluster is 409.
+
+package rangeserver
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"rangestore"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// where the write endpoints are mounted
+const WritePrefix = "/v1/cluster/"
+
+// limit on the request body (values of a key)
+const _maxBody = 1 << 20
+
+type writeHandler struct {
+	store     rangestore.WritableStore
+	registrar rangestore.Registrar // nil if nodes can't register
+}
+
+// WriteHandler serves the REST endpoints (mounted under WritePrefix)
+// to edit the store, registrar (if not nil) handles the registration
+// of nodes
+func WriteHandler(store rangestore.WritableStore, registrar rangestore.Registrar) http.Handler {
+	return &writeHandler{store: store, registrar: registrar}
+}
+
+func (h *writeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var parts = strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, WritePrefix), "/"), "/")
+	if len(parts) == 3 && parts[1] == "NODES" && parts[0] != "" {
+		h.registration(w, r, parts[0], parts[2])
+		return
+	}
+	if parts[0] == "" || len(parts) > 2 {
+		http.Error(w, fmt.Sprintf("Expected %s<cluster>[/<KEY>]", WritePrefix), http.StatusNotFound)
+		return
+	}
+	var cluster = parts[0]
+	if !rangestore.ValidClusterName(cluster) {
+		http.Error(w, fmt.Sprintf("Invalid Cluster Name [%s]", cluster), http.StatusBadRequest)
+		return
+	}
+	if len(parts) == 2 && !rangestore.ValidKeyName(parts[1]) {
+		http.Error(w, fmt.Sprintf("Invalid Key Name [%s]", parts[1]), http.StatusBadRequest)
+		return
+	}
+
+	var version = ifMatch(r)
+	var current string // the version made by the edit
+	var err error
+	var status = http.StatusOK
+	if len(parts) == 1 {
+		switch r.Method {
+		case "GET", "HEAD":
+			h.getCluster(w, r, cluster)
+			return
+		case "PUT":
+			current, err = h.store.CreateCluster(cluster)
+			status = http.StatusCreated
+		case "POST":
+			var to = r.FormValue("rename")
+			if to == "" {
+				http.Error(w, "Expected rename=<cluster>", http.StatusBadRequest)
+				return
+			}
+			current, err = h.store.RenameCluster(cluster, to, version)
+		case "DELETE":
+			if err = h.store.DeleteCluster(cluster, version); err == nil {
+				w.WriteHeader(http.StatusNoContent)
+				log.Printf("INFO> [%s] Deleted Cluster [%s]", r.RemoteAddr, cluster)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	} else {
+		var key = parts[1]
+		switch r.Method {
+		case "GET", "HEAD":
+			h.getKey(w, r, cluster, key)
+			return
+		case "PUT", "POST":
+			var values []string
+			values, err = readValues(w, r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if r.Method == "PUT" {
+				current, err = h.store.SetKey(cluster, key, values, version)
+			} else {
+				current, err = h.store.AddKeyValues(cluster, key, values, version)
+			}
+		case "DELETE":
+			if err = r.ParseForm(); err == nil {
+				if values, ok := r.Form["value"]; ok {
+					current, err = h.store.RemoveKeyValues(cluster, key, values, version)
+				} else {
+					current, err = h.store.DeleteKey(cluster, key, version)
+				}
+			}
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	}
+
+	if err != nil {
+		writeError(w, r, err, version != "")
+		return
+	}
+	log.Printf("INFO> [%s] %s %s", r.RemoteAddr, r.Method, r.URL)
+
+	// the version made by the edit, so the client can chain edits (a
+	// version read now could be of another edit)
+	w.Header().Set("ETag", etag(current))
+	w.WriteHeader(status)
+}
+
+// register (or renew) and deregister a node
+func (h *writeHandler) registration(w http.ResponseWriter, r *http.Request, cluster string, node string) {
+	if h.registrar == nil {
+		http.Error(w, "Node Registration is NOT enabled", http.StatusNotFound)
+		return
+	}
+	if !rangestore.ValidClusterName(cluster) {
+		http.Error(w, fmt.Sprintf("Invalid Cluster Name [%s]", cluster), http.StatusBadRequest)
+		return
+	}
+	var err error
+	switch r.Method {
+	case "PUT":
+		var ttl time.Duration
+		ttl, err = parseTTL(r.FormValue("ttl"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = h.registrar.Register(cluster, node, ttl)
+	case "DELETE":
+		err = h.registrar.Deregister(cluster, node)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err, false)
+		return
+	}
+	// heartbeats are not logged, they are too many
+	w.WriteHeader(http.StatusOK)
+}
+
+// cluster config as yaml, the way the filestore has it
+func (h *writeHandler) getCluster(w http.ResponseWriter, r *http.Request, cluster string) {
+	version, err := h.store.ClusterVersion(cluster)
+	if err != nil {
+		http.Error(w, err.Error(), StatusOf(err))
+		return
+	}
+	keys, err := h.store.KeyLookup(&[]string{cluster}, "KEYS")
+	if err != nil {
+		http.Error(w, err.Error(), StatusOf(err))
+		return
+	}
+	var config = make(map[string][]string)
+	for _, key := range *keys {
+		values, err := h.store.KeyLookup(&[]string{cluster}, key)
+		if err != nil {
+			http.Error(w, err.Error(), StatusOf(err))
+			return
+		}
+		config[key] = *values
+	}
+	content, err := yaml.Marshal(config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.Write(content)
+}
+
+// values of the key, one per line
+func (h *writeHandler) getKey(w http.ResponseWriter, r *http.Request, cluster string, key string) {
+	version, err := h.store.ClusterVersion(cluster)
+	if err != nil {
+		http.Error(w, err.Error(), StatusOf(err))
+		return
+	}
+	values, err := h.store.KeyLookup(&[]string{cluster}, key)
+	if err != nil {
+		http.Error(w, err.Error(), StatusOf(err))
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	fmt.Fprintf(w, "%s", strings.Join(*values, "\n"))
+}
+
+// map the store error to the status code
+func writeError(w http.ResponseWriter, r *http.Request, err error, conditional bool) {
+	var status int
+	switch {
+	case errors.Is(err, rangestore.ErrExists):
+		status = http.StatusConflict
+	case errors.Is(err, rangestore.ErrConflict) && conditional:
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, rangestore.ErrConflict):
+		status = http.StatusConflict
+	default:
+		status = StatusOf(err)
+	}
+	log.Printf("EROR> [%s] %s %s Failed (Status: %d, Error: %s)", r.RemoteAddr, r.Method, r.URL, status, err)
+	http.Error(w, err.Error(), status)
+}
+
+// the version the client has seen, "" if it doesn't care
+func ifMatch(r *http.Request) string {
+	var version = strings.TrimSpace(r.Header.Get("If-Match"))
+	if version == "*" {
+		return ""
+	}
+	return strings.Trim(strings.TrimPrefix(version, "W/"), `"`)
+}
+
+func etag(version string) string {
+	return fmt.Sprintf(`"%s"`, version)
+}
+
+// ttl is in seconds, or a duration (eg, 30s, 5m)
+func parseTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, errors.New("Expected ttl=<seconds|duration>")
+	}
+	if seconds, err := strconv.Atoi(ttl); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid ttl [%s] (Error: %s)", ttl, err))
+	}
+	return d, nil
+}
+
+// values are sent one per line in the body, empty lines are skipped
+func readValues(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, _maxBody))
+	if err != nil {
+		return []string{}, err
+	}
+	var values = make([]string, 0)
+	for _, line := range strings.Split(string(body), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			values = append(values, line)
+		}
+	}
+	return values, nil
+}
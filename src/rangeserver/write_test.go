@@ -0,0 +1,184 @@
+package rangeserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"rangestore"
+	"rangestore/filestore"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a write server on a copy of the filestore test data
+func writeServer(t *testing.T) *httptest.Server {
+	var src = "../rangestore/filestore/t"
+	var dir = t.TempDir()
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if fi.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0755)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dir, rel), content, 0644)
+	})
+	if err != nil {
+		t.Fatal("Copying the Test Store ", err)
+	}
+	store, err := filestore.ConnectFileStore(dir, -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	var sweeper = rangestore.NewSweeper(store, 10*time.Millisecond)
+	var mux = http.NewServeMux()
+	mux.Handle(WritePrefix, WriteHandler(store, sweeper))
+	var server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	t.Cleanup(sweeper.Stop)
+	return server
+}
+
+// do the request, returns the status, etag and body
+func do(t *testing.T, method, url, body, match string) (int, string, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match != "" {
+		req.Header.Set("If-Match", match)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get("ETag"), string(content)
+}
+
+func TestWriteHandler(t *testing.T) {
+	var server = writeServer(t)
+	var cluster = server.URL + WritePrefix + "ops-prod-vpc9-web"
+
+	if status, _, body := do(t, "PUT", cluster, "", ""); status != http.StatusCreated {
+		t.Errorf("Expected 201, Creating cluster, Got: %d (%s)", status, body)
+	}
+	if status, _, _ := do(t, "PUT", cluster, "", ""); status != http.StatusConflict {
+		t.Errorf("Expected 409, Creating existing cluster, Got: %d", status)
+	}
+
+	// register hosts as they boot
+	status, tag, body := do(t, "POST", cluster+"/NODES", "web9001.ops.example.com\n", "")
+	if status != http.StatusOK || tag == "" {
+		t.Errorf("Expected 200 with ETag, Appending NODES, Got: %d [%s] (%s)", status, tag, body)
+	}
+	do(t, "POST", cluster+"/NODES", "web9002.ops.example.com\nweb9003.ops.example.com\n", "")
+	status, _, body = do(t, "GET", cluster+"/NODES", "", "")
+	if status != http.StatusOK || body != "web9001.ops.example.com\nweb9002.ops.example.com\nweb9003.ops.example.com" {
+		t.Errorf("Expected 3 NODES, Got: %d (%s)", status, body)
+	}
+
+	if status, _, _ = do(t, "DELETE", cluster+"/NODES?value=web9002.ops.example.com", "", ""); status != http.StatusOK {
+		t.Errorf("Expected 200, Removing a value, Got: %d", status)
+	}
+	if _, _, body = do(t, "GET", cluster+"/NODES", "", ""); body != "web9001.ops.example.com\nweb9003.ops.example.com" {
+		t.Errorf("Expected 2 NODES, Got: %s", body)
+	}
+
+	// ETag/If-Match
+	_, tag, _ = do(t, "GET", cluster, "", "")
+	status, edited, _ := do(t, "PUT", cluster+"/QAFOR", "qa1", tag)
+	if status != http.StatusOK {
+		t.Errorf("Expected 200, SetKey with current ETag, Got: %d", status)
+	}
+	if status, _, _ = do(t, "PUT", cluster+"/QAFOR", "qa2", tag); status != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412, SetKey with stale ETag, Got: %d", status)
+	}
+	// the ETag of the edit is good for the next one
+	if status, _, _ = do(t, "PUT", cluster+"/QAFOR", "qa2", edited); status != http.StatusOK {
+		t.Errorf("Expected 200, SetKey with the ETag of the edit, Got: %d", status)
+	}
+	if status, _, _ = do(t, "DELETE", cluster+"/QAFOR", "", ""); status != http.StatusOK {
+		t.Errorf("Expected 200, DeleteKey, Got: %d", status)
+	}
+
+	// bad names and missing clusters
+	if status, _, _ = do(t, "PUT", server.URL+WritePrefix+"Ops-prod", "", ""); status != http.StatusBadRequest {
+		t.Errorf("Expected 400, Bad cluster name, Got: %d", status)
+	}
+	if status, _, _ = do(t, "PUT", cluster+"/nodes", "x", ""); status != http.StatusBadRequest {
+		t.Errorf("Expected 400, Bad key name, Got: %d", status)
+	}
+	if status, _, _ = do(t, "POST", server.URL+WritePrefix+"ops-prod-vpc8-web/NODES", "x", ""); status != http.StatusNotFound {
+		t.Errorf("Expected 404, Missing cluster, Got: %d", status)
+	}
+
+	if status, _, _ = do(t, "POST", cluster+"?rename=ops-prod-vpc9-app", "", ""); status != http.StatusOK {
+		t.Errorf("Expected 200, Rename, Got: %d", status)
+	}
+	if status, _, _ = do(t, "DELETE", server.URL+WritePrefix+"ops-prod-vpc9", "", ""); status != http.StatusConflict {
+		t.Errorf("Expected 409, Deleting cluster with children, Got: %d", status)
+	}
+	if status, _, _ = do(t, "DELETE", server.URL+WritePrefix+"ops-prod-vpc9-app", "", ""); status != http.StatusNoContent {
+		t.Errorf("Expected 204, Deleting cluster, Got: %d", status)
+	}
+}
+
+// nodes register with a ttl and go away if they stop the heartbeat
+func TestRegistration(t *testing.T) {
+	var server = writeServer(t)
+	var cluster = server.URL + WritePrefix + "ops-prod-vpc1-range"
+
+	if status, _, body := do(t, "PUT", cluster+"/NODES/range1009.ops.example.com?ttl=100ms", "", ""); status != http.StatusOK {
+		t.Fatalf("Expected 200, Register, Got: %d (%s)", status, body)
+	}
+	if status, _, body := do(t, "PUT", cluster+"/NODES/range1010.ops.example.com?ttl=30", "", ""); status != http.StatusOK {
+		t.Fatalf("Expected 200, Register, Got: %d (%s)", status, body)
+	}
+	// a node in NODES already never expires
+	if status, _, body := do(t, "PUT", cluster+"/NODES/range1001.ops.example.com?ttl=1ms", "", ""); status != http.StatusOK {
+		t.Fatalf("Expected 200, Register, Got: %d (%s)", status, body)
+	}
+	var expected = "range1001.ops.example.com\nrange1002.ops.example.com\nrange1003.ops.example.com\nrange1009.ops.example.com\nrange1010.ops.example.com"
+	if _, _, body := do(t, "GET", cluster+"/NODES", "", ""); body != expected {
+		t.Errorf("Expected registered NODES, Got: %s", body)
+	}
+
+	// heartbeat keeps it
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		do(t, "PUT", cluster+"/NODES/range1009.ops.example.com?ttl=100ms", "", "")
+	}
+	if _, _, body := do(t, "GET", cluster+"/NODES", "", ""); body != expected {
+		t.Errorf("Expected heartbeat to keep the node, Got: %s", body)
+	}
+
+	// no heartbeat
+	time.Sleep(300 * time.Millisecond)
+	expected = "range1001.ops.example.com\nrange1002.ops.example.com\nrange1003.ops.example.com\nrange1010.ops.example.com"
+	if _, _, body := do(t, "GET", cluster+"/NODES", "", ""); body != expected {
+		t.Errorf("Expected expired node to go away, Got: %s", body)
+	}
+
+	if status, _, _ := do(t, "DELETE", cluster+"/NODES/range1010.ops.example.com", "", ""); status != http.StatusOK {
+		t.Errorf("Expected 200, Deregister, Got: %d", status)
+	}
+	if status, _, _ := do(t, "DELETE", cluster+"/NODES/range1010.ops.example.com", "", ""); status != http.StatusNotFound {
+		t.Errorf("Expected 404, Deregister again, Got: %d", status)
+	}
+	if status, _, _ := do(t, "PUT", cluster+"/NODES/range1011.ops.example.com", "", ""); status != http.StatusBadRequest {
+		t.Errorf("Expected 400, Register without ttl, Got: %d", status)
+	}
+	if status, _, _ := do(t, "PUT", server.URL+WritePrefix+"ops-prod-vpc8-web/NODES/range1011.ops.example.com?ttl=10", "", ""); status != http.StatusNotFound {
+		t.Errorf("Expected 404, Register in missing cluster, Got: %d", status)
+	}
+}
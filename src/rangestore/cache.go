@@ -0,0 +1,14 @@
+package rangestore
+
+// CacheStats are the lookups served from a cache (hits) and the ones
+// which went to the store (misses)
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// a store (or a part of it) which caches the lookups, eg, the mirror of
+// the EtcdStore. Used for the metrics
+type Cache interface {
+	CacheStats() CacheStats
+}
@@ -0,0 +1,272 @@
+package rangestore
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a store which tells when it has changed (eg, the watch of etcd), so that
+// the caches of its lookups can be dropped
+type Notifier interface {
+	// calls changed after the store changed, until stop is closed.
+	// The changes could be coalesced, and a change could be told more
+	// than once (eg, when the watch is lost, we can't tell what we missed)
+	Notify(changed func(), stop chan bool) error
+}
+
+// CachingStore caches the lookups of any store, by method and arguments.
+// * the lookups expire after the ttl and the least recently used ones are
+//   dropped once there are more than size of them (zero is no bound)
+// * concurrent lookups of the same thing go to the store only once
+// * the cache is dropped whenever the store tells it changed (see Notifier),
+//   without it the lookups are as stale as the ttl
+// Not found is cached too, the other errors are not (the store could be
+// back for the next lookup), nor are the stale answers
+type CachingStore struct {
+	store Store
+	ttl   time.Duration
+	size  int
+	stats CacheStats
+	stop  chan bool // closed to stop listening to the store
+
+	mu         sync.Mutex
+	entries    map[string]*list.Element // of *cacheEntry, most recently used first
+	lru        *list.List
+	calls      map[string]*cacheCall // lookups being done
+	generation uint64                // bumped on every invalidation
+}
+
+type cacheEntry struct {
+	key     string
+	result  []string
+	err     error
+	expires time.Time
+}
+
+// a lookup being done, done is closed once the result is there
+type cacheCall struct {
+	done   chan bool
+	result []string
+	err    error
+	stale  bool          // the answer is stale (see StaleStore)
+	age    time.Duration // of the stale answer
+}
+
+// NewCachingStore caches the lookups of the store, if the store is a
+// Notifier the cache is invalidated on its changes (until Close)
+func NewCachingStore(store Store, ttl time.Duration, size int) *CachingStore {
+	var c = &CachingStore{
+		store:   store,
+		ttl:     ttl,
+		size:    size,
+		stop:    make(chan bool),
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		calls:   make(map[string]*cacheCall),
+	}
+	if n, ok := store.(Notifier); ok {
+		if err := n.Notify(c.Invalidate, c.stop); err != nil {
+			log.Printf("ERROR: Cache can't follow the changes of the store, lookups could be stale for %s (Error: %s)\n", ttl, err)
+		}
+	}
+	return c
+}
+
+// Close stops following the changes of the store
+func (c *CachingStore) Close() {
+	close(c.stop)
+}
+
+// Invalidate drops the cache, the lookups being done are not cached (nor
+// joined by the lookups after this)
+func (c *CachingStore) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.calls = make(map[string]*cacheCall)
+	c.generation++
+}
+
+// Unwrap is the store being cached
+func (c *CachingStore) Unwrap() Store {
+	return c.store
+}
+
+// Len is the count of the lookups cached (expired or not)
+func (c *CachingStore) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *CachingStore) CacheStats() CacheStats {
+	return CacheStats{Hits: atomic.LoadUint64(&c.stats.Hits), Misses: atomic.LoadUint64(&c.stats.Misses)}
+}
+
+// the store can serve (the cache could, but would go stale)
+func (c *CachingStore) Ping() error {
+	return pingAll([]Store{c.store})
+}
+
+// Scope is the cache as seen by a query, the lookups missing are done by
+// the store scoped to the query (see Tracker)
+func (c *CachingStore) Scope(t Tracker) Store {
+	return &cacheView{cache: c, tracker: t}
+}
+
+////////////////////
+// LOOKUP CLUSTER //
+////////////////////
+
+func (c *CachingStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	return c.Scope(nil).ClusterLookup(cluster)
+}
+
+func (c *CachingStore) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	return c.Scope(nil).KeyLookup(cluster, key)
+}
+
+////////////////////
+// LOOKUP REVERSE //
+////////////////////
+
+func (c *CachingStore) KeyReverseLookup(key string) (*[]string, error) {
+	return c.Scope(nil).KeyReverseLookup(key)
+}
+
+func (c *CachingStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return c.Scope(nil).KeyReverseLookupAttr(key, attr)
+}
+
+func (c *CachingStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return c.Scope(nil).KeyReverseLookupHint(key, attr, hint)
+}
+
+////////////////
+// CACHE VIEW //
+////////////////
+
+// the cache as seen by a query, tracker is nil if not scoped to one
+type cacheView struct {
+	cache   *CachingStore
+	tracker Tracker
+}
+
+func (v *cacheView) ClusterLookup(cluster *[]string) (*[]string, error) {
+	return v.cache.do(v.tracker, lookupKey("C", *cluster...), func(s Store) (*[]string, error) {
+		return s.ClusterLookup(cluster)
+	})
+}
+
+func (v *cacheView) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	return v.cache.do(v.tracker, lookupKey("K", append([]string{key}, *cluster...)...), func(s Store) (*[]string, error) {
+		return s.KeyLookup(cluster, key)
+	})
+}
+
+func (v *cacheView) KeyReverseLookup(key string) (*[]string, error) {
+	return v.cache.do(v.tracker, lookupKey("R", key), func(s Store) (*[]string, error) {
+		return s.KeyReverseLookup(key)
+	})
+}
+
+func (v *cacheView) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return v.cache.do(v.tracker, lookupKey("A", key, attr), func(s Store) (*[]string, error) {
+		return s.KeyReverseLookupAttr(key, attr)
+	})
+}
+
+func (v *cacheView) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return v.cache.do(v.tracker, lookupKey("H", key, attr, hint), func(s Store) (*[]string, error) {
+		return s.KeyReverseLookupHint(key, attr, hint)
+	})
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// the cached lookup, else the lookup being done, else do the lookup on
+// the store scoped to t. The lookup being done fails on the limits of the
+// query doing it, the others waiting for it do it on their own. The ones
+// waiting are told when it was answered stale.
+// The result is a copy as the evaluation modifies it in place
+func (c *CachingStore) do(t Tracker, key string, lookup func(Store) (*[]string, error)) (*[]string, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		var entry = e.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(e)
+			c.mu.Unlock()
+			atomic.AddUint64(&c.stats.Hits, 1)
+			return copyResult(entry.result), entry.err
+		}
+		c.remove(e)
+	}
+	atomic.AddUint64(&c.stats.Misses, 1)
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		if errors.Is(call.err, ErrLimit) {
+			return lookup(Scope(c.store, t))
+		}
+		if call.stale && t != nil {
+			t.MarkStale(call.age)
+		}
+		return copyResult(call.result), call.err
+	}
+	var call = &cacheCall{done: make(chan bool)}
+	var generation = c.generation
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	// the waiting lookups see an error if the lookup panics
+	call.err = fmt.Errorf("Lookup [%s] Panicked", strings.Replace(key, "\x00", " ", -1))
+	defer func() {
+		c.mu.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		// the store changed while looking up, the result could be stale
+		if generation == c.generation && !call.stale && (call.err == nil || errors.Is(call.err, ErrNotFound)) {
+			c.add(key, call)
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	var recorder = &StaleRecorder{Tracker: t}
+	result, err := lookup(Scope(c.store, recorder))
+	call.stale, call.age = recorder.Stale()
+	call.result, call.err = nil, err
+	if result != nil {
+		call.result = *result
+	}
+	return copyResult(call.result), call.err
+}
+
+// cache the result of the call, dropping the least recently used lookups
+// if over the size (called with the lock held)
+func (c *CachingStore) add(key string, call *cacheCall) {
+	var entry = &cacheEntry{key: key, result: call.result, err: call.err, expires: time.Now().Add(c.ttl)}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.size > 0 && c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *CachingStore) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
+
+func copyResult(result []string) *[]string {
+	var copied = append([]string{}, result...)
+	return &copied
+}
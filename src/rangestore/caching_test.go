@@ -0,0 +1,159 @@
+package rangestore_test
+
+import (
+	"errors"
+	"rangestore"
+	"rangestore/filestore"
+	"rangestore/storetest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func fixture(t *testing.T) rangestore.Store {
+	store, err := filestore.ConnectFileStore("filestore/t", -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	return store
+}
+
+func sorted(results *[]string) string {
+	var s = append([]string{}, *results...)
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+// counts the lookups, which wait for release (if set)
+type countingStore struct {
+	rangestore.Store
+	calls   int32
+	release chan bool
+}
+
+func (s *countingStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	atomic.AddInt32(&s.calls, 1)
+	if s.release != nil {
+		<-s.release
+	}
+	return s.Store.ClusterLookup(cluster)
+}
+
+func (s *countingStore) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return s.Store.KeyLookup(cluster, key)
+}
+
+func TestCachingStore(t *testing.T) {
+	var store = &countingStore{Store: fixture(t)}
+	var c = rangestore.NewCachingStore(store, time.Minute, 2)
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		results, err := c.ClusterLookup(&[]string{"ops-prod"})
+		if err != nil || sorted(results) != "ops-prod-vpc1,ops-prod-vpc2" {
+			t.Fatalf("Expected ops-prod-vpc1,ops-prod-vpc2, Got: %v (Error: %v)", results, err)
+		}
+		// the evaluation modifies the results in place
+		(*results)[0] = "modified"
+	}
+	if store.calls != 1 || c.CacheStats().Hits != 2 || c.CacheStats().Misses != 1 {
+		t.Errorf("Expected 1 lookup and 2 hits, Got: %d lookups %+v", store.calls, c.CacheStats())
+	}
+
+	// not found is cached too
+	for i := 0; i < 2; i++ {
+		if _, err := c.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "NOPE"); !errors.Is(err, rangestore.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, Got: %v", err)
+		}
+	}
+	if store.calls != 2 {
+		t.Errorf("Expected the not found to be cached, Got: %d lookups", store.calls)
+	}
+
+	// over the size, the least recently used is dropped
+	c.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "AUTHORS")
+	if c.Len() != 2 {
+		t.Errorf("Expected 2 lookups cached, Got: %d", c.Len())
+	}
+	c.ClusterLookup(&[]string{"ops-prod"})
+	if store.calls != 4 {
+		t.Errorf("Expected ops-prod to be dropped, Got: %d lookups", store.calls)
+	}
+
+	c.Invalidate()
+	if c.Len() != 0 {
+		t.Errorf("Expected nothing cached once invalidated, Got: %d", c.Len())
+	}
+}
+
+func TestCachingStoreTTL(t *testing.T) {
+	var store = &countingStore{Store: fixture(t)}
+	var c = rangestore.NewCachingStore(store, time.Millisecond, 0)
+	defer c.Close()
+	c.ClusterLookup(&[]string{"ops-prod"})
+	time.Sleep(5 * time.Millisecond)
+	c.ClusterLookup(&[]string{"ops-prod"})
+	if store.calls != 2 {
+		t.Errorf("Expected the lookup to expire, Got: %d lookups", store.calls)
+	}
+}
+
+func TestCachingStoreSingleflight(t *testing.T) {
+	var store = &countingStore{Store: fixture(t), release: make(chan bool)}
+	var c = rangestore.NewCachingStore(store, time.Minute, 0)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if results, err := c.ClusterLookup(&[]string{"ops-prod"}); err != nil || sorted(results) != "ops-prod-vpc1,ops-prod-vpc2" {
+				t.Errorf("Expected ops-prod-vpc1,ops-prod-vpc2, Got: %v (Error: %v)", results, err)
+			}
+		}()
+	}
+	// let them all wait on the first one
+	for c.CacheStats().Misses != 10 {
+		time.Sleep(time.Millisecond)
+	}
+	close(store.release)
+	wg.Wait()
+	if store.calls != 1 {
+		t.Errorf("Expected 1 lookup, Got: %d", store.calls)
+	}
+}
+
+// a lookup over the limits of its query is neither cached nor shared
+func TestCachingStoreScope(t *testing.T) {
+	var c = rangestore.NewCachingStore(fixture(t), time.Minute, 0)
+	defer c.Close()
+
+	var limited = rangestore.NewLimitedStore(c, rangestore.Limits{MaxCalls: 2})
+	if _, err := limited.KeyReverseLookupAttr("Ops", "AUTHORS"); !errors.Is(err, rangestore.ErrLimit) {
+		t.Errorf("Expected maxcalls to be hit, Got: %v", err)
+	}
+	if results, err := c.KeyReverseLookupAttr("Ops", "AUTHORS"); err != nil || sorted(results) != "ops-prod-vpc1-mon,ops-prod-vpc2-mon" {
+		t.Errorf("Expected ops-prod-vpc1-mon,ops-prod-vpc2-mon, Got: %v (Error: %v)", results, err)
+	}
+	// once cached, it is not walked again
+	limited = rangestore.NewLimitedStore(c, rangestore.Limits{MaxCalls: 2})
+	if results, err := limited.KeyReverseLookupAttr("Ops", "AUTHORS"); err != nil || len(*results) != 2 {
+		t.Errorf("Expected ops-prod-vpc1-mon,ops-prod-vpc2-mon, Got: %v (Error: %v)", results, err)
+	}
+}
+
+func TestCachingStoreConformance(t *testing.T) {
+	store, err := filestore.ConnectFileStore(storetest.Fixture(), -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	var cache = rangestore.NewCachingStore(store, time.Minute, 0)
+	// twice, the second time from the cache
+	storetest.Run(t, cache)
+	storetest.Run(t, cache)
+}
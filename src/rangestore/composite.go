@@ -0,0 +1,191 @@
+package rangestore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// a store made of other stores queried as one tree (eg, a filestore in git
+// for the static clusters over the etcdstore of the autoscaled hosts). The
+// stores are in order of priority and the lookups are done on all of them
+// at once.
+// * the listings of the clusters (and KEYS) are merged
+// * a key has the value of the first store having it, unless the key is
+//   in Union, then the values of all the stores are merged
+// * the reverse lookups are merged
+// A cluster or a key missing from some of the stores is fine, it is not
+// found only if none of the stores has it.
+type CompositeStore struct {
+	Union  []string // keys having the values of all the stores (eg, NODES)
+	stores []Store
+}
+
+func NewCompositeStore(stores ...Store) *CompositeStore {
+	return &CompositeStore{stores: stores}
+}
+
+// all the stores can serve
+func (c *CompositeStore) Ping() error {
+	return pingAll(c.stores)
+}
+
+// Scope is the store as seen by a query, each store is scoped to it
+func (c *CompositeStore) Scope(t Tracker) Store {
+	var scoped = &CompositeStore{Union: c.Union, stores: make([]Store, 0, len(c.stores))}
+	for _, s := range c.stores {
+		scoped.stores = append(scoped.stores, Scope(s, t))
+	}
+	return scoped
+}
+
+////////////////////
+// LOOKUP CLUSTER //
+////////////////////
+
+// a leaf cluster has the nodes (NODES, as any other key), the others have
+// the clusters under them in any of the stores
+func (c *CompositeStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	var results = make([]string, 0)
+	for _, elem := range *cluster {
+		var result *[]string
+		var err error
+		if elem != "RANGE" && !c.union("NODES") {
+			result, err = c.first(func(s Store) (*[]string, error) { return s.KeyLookup(&[]string{elem}, "NODES") })
+			if err == nil {
+				results = append(results, *result...)
+				continue
+			} else if !errors.Is(err, ErrNotFound) {
+				return &[]string{}, err
+			}
+		}
+		result, err = c.merge(func(s Store) (*[]string, error) { return s.ClusterLookup(&[]string{elem}) })
+		if err != nil {
+			return &[]string{}, err
+		}
+		results = append(results, *result...)
+	}
+	return &results, nil
+}
+
+func (c *CompositeStore) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	var results = make([]string, 0)
+	for _, elem := range *cluster {
+		var lookup = func(s Store) (*[]string, error) { return s.KeyLookup(&[]string{elem}, key) }
+		var result *[]string
+		var err error
+		if key == "KEYS" || c.union(key) {
+			result, err = c.merge(lookup)
+		} else {
+			result, err = c.first(lookup)
+		}
+		if err != nil {
+			return &[]string{}, err
+		}
+		results = append(results, *result...)
+	}
+	return &results, nil
+}
+
+////////////////////
+// LOOKUP REVERSE //
+////////////////////
+
+func (c *CompositeStore) KeyReverseLookup(key string) (*[]string, error) {
+	return c.merge(func(s Store) (*[]string, error) { return s.KeyReverseLookup(key) })
+}
+
+func (c *CompositeStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return c.merge(func(s Store) (*[]string, error) { return s.KeyReverseLookupAttr(key, attr) })
+}
+
+func (c *CompositeStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return c.merge(func(s Store) (*[]string, error) { return s.KeyReverseLookupHint(key, attr, hint) })
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// result of the lookup on a store
+type storeResult struct {
+	result *[]string
+	err    error
+}
+
+// the values of the key are the ones of all the stores
+func (c *CompositeStore) union(key string) bool {
+	for _, k := range c.Union {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// the lookup on all the stores at once, the results are in the order
+// of the stores
+func fanOut(stores []Store, lookup func(Store) (*[]string, error)) []storeResult {
+	var results = make([]storeResult, len(stores))
+	var wg sync.WaitGroup
+	for i, s := range stores {
+		wg.Add(1)
+		go func(i int, s Store) {
+			defer wg.Done()
+			result, err := lookup(s)
+			if result == nil {
+				result = &[]string{}
+			}
+			results[i] = storeResult{result: result, err: err}
+		}(i, s)
+	}
+	wg.Wait()
+	return results
+}
+
+// union of the results of the stores (in the order of the stores), any
+// error other than not found fails the lookup
+func (c *CompositeStore) merge(lookup func(Store) (*[]string, error)) (*[]string, error) {
+	var results = make([]string, 0)
+	var seen = make(map[string]bool)
+	var found bool
+	var notFound error
+	for _, r := range fanOut(c.stores, lookup) {
+		if errors.Is(r.err, ErrNotFound) {
+			notFound = r.err
+			continue
+		} else if r.err != nil {
+			return &[]string{}, r.err
+		}
+		found = true
+		for _, result := range *r.result {
+			if !seen[result] {
+				seen[result] = true
+				results = append(results, result)
+			}
+		}
+	}
+	if !found && notFound != nil {
+		return &[]string{}, fmt.Errorf("Not Found in any Store (Error: %w)", notFound)
+	}
+	return &results, nil
+}
+
+// result of the first store having it, the errors of the stores after it
+// don't matter
+func (c *CompositeStore) first(lookup func(Store) (*[]string, error)) (*[]string, error) {
+	var notFound error
+	for _, r := range fanOut(c.stores, lookup) {
+		if errors.Is(r.err, ErrNotFound) {
+			notFound = r.err
+			continue
+		} else if r.err != nil {
+			return &[]string{}, r.err
+		}
+		return r.result, nil
+	}
+	if notFound == nil {
+		notFound = ErrNotFound
+	}
+	return &[]string{}, fmt.Errorf("Not Found in any Store (Error: %w)", notFound)
+}
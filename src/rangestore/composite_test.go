@@ -0,0 +1,92 @@
+package rangestore_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"rangestore"
+	"rangestore/filestore"
+	"rangestore/storetest"
+	"testing"
+)
+
+// a store of overrides, ops-prod-vpc1-mon has other nodes and authors and
+// ops-prod-vpc3-web is only in it
+func overrides(t *testing.T) rangestore.Store {
+	var dir = t.TempDir()
+	var clusters = map[string]string{
+		"ops/prod/vpc1/mon": "AUTHORS:\n  - Overrides\nNODES:\n  - mon9001.ops.example.com\n",
+		"ops/prod/vpc3/web": "NODES:\n  - web3001.ops.example.com\n",
+	}
+	for cluster, content := range clusters {
+		if err := os.MkdirAll(filepath.Join(dir, cluster), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, cluster, "cluster.yaml"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := filestore.ConnectFileStore(dir, -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	return store
+}
+
+func TestCompositeStore(t *testing.T) {
+	var c = rangestore.NewCompositeStore(overrides(t), fixture(t))
+	var cases = []struct {
+		lookup   func() (*[]string, error)
+		expected string
+	}{
+		// listings are merged
+		{func() (*[]string, error) { return c.ClusterLookup(&[]string{"ops-prod"}) }, "ops-prod-vpc1,ops-prod-vpc2,ops-prod-vpc3"},
+		{func() (*[]string, error) { return c.ClusterLookup(&[]string{"ops-prod-vpc3"}) }, "ops-prod-vpc3-web"},
+		// the first store has precedence
+		{func() (*[]string, error) { return c.ClusterLookup(&[]string{"ops-prod-vpc1-mon"}) }, "mon9001.ops.example.com"},
+		{func() (*[]string, error) { return c.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "AUTHORS") }, "Overrides"},
+		// the key only in the second store
+		{func() (*[]string, error) { return c.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "VERSION") }, "1.0.0.1"},
+		{func() (*[]string, error) { return c.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "KEYS") }, "AUTHORS,NODES,VERSION"},
+		// reverse lookups are merged
+		{func() (*[]string, error) { return c.KeyReverseLookupAttr("Ops", "AUTHORS") }, "ops-prod-vpc1-mon,ops-prod-vpc2-mon"},
+		{func() (*[]string, error) { return c.KeyReverseLookup("mon9001.ops.example.com") }, "ops-prod-vpc1-mon"},
+	}
+	for i, cs := range cases {
+		if results, err := cs.lookup(); err != nil || sorted(results) != cs.expected {
+			t.Errorf("Case %d, Expected: %s, Got: %v (Error: %v)", i, cs.expected, results, err)
+		}
+	}
+	if _, err := c.ClusterLookup(&[]string{"nosuch"}); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, in No Store, Got: %v", err)
+	}
+	if _, err := c.KeyLookup(&[]string{"ops-prod-vpc3-web"}, "AUTHORS"); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, in No Store, Got: %v", err)
+	}
+}
+
+func TestCompositeStoreUnion(t *testing.T) {
+	var c = rangestore.NewCompositeStore(overrides(t), fixture(t))
+	c.Union = []string{"NODES", "AUTHORS"}
+	if results, err := c.ClusterLookup(&[]string{"ops-prod-vpc1-mon"}); err != nil || sorted(results) != "mon1001.ops.example.com,mon9001.ops.example.com" {
+		t.Errorf("Expected the nodes of both the stores, Got: %v (Error: %v)", results, err)
+	}
+	if results, err := c.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "AUTHORS"); err != nil || sorted(results) != "Ops,Overrides" {
+		t.Errorf("Expected the authors of both the stores, Got: %v (Error: %v)", results, err)
+	}
+	// with a namespace, the reverse lookups are of both
+	c = rangestore.NewCompositeStore(fixture(t), rangestore.NewMountStore(map[string]rangestore.Store{"aws": fixture(t)}))
+	if results, err := c.KeyReverseLookup("mon1001.ops.example.com"); err != nil || sorted(results) != "aws-ops-prod-vpc1-mon,ops-prod-vpc1-mon" {
+		t.Errorf("Expected the clusters of both the stores, Got: %v (Error: %v)", results, err)
+	}
+}
+
+// a store over the fixture alone is the fixture
+func TestCompositeStoreConformance(t *testing.T) {
+	store, err := filestore.ConnectFileStore(storetest.Fixture(), -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	storetest.Run(t, rangestore.NewCompositeStore(store))
+}
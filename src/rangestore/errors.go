@@ -0,0 +1,16 @@
+package rangestore
+
+import (
+	"errors"
+)
+
+// errors the stores return (wrapped with the details), so that the callers
+// can tell what went wrong using errors.Is
+var (
+	ErrConflict    = errors.New("Conflicting Edit")       // cluster was modified by someone else
+	ErrInvalidName = errors.New("Invalid Name")           // cluster or key name is not valid
+	ErrExists      = errors.New("Cluster Already Exists") // cluster being created exists
+	ErrNotFound    = errors.New("Not Found")              // no such cluster, key or node
+	ErrUnavailable = errors.New("Store Unavailable")      // backend can't be reached or isn't ready
+	ErrLimit       = errors.New("Limit Exceeded")         // query went over a limit of the server
+)
@@ -0,0 +1,310 @@
+// Ephemeral nodes (rangestore.Registrar). A host registers itself in a leaf
+// cluster with a TTL, the registration is a key with an etcd TTL under
+// <storenode>/_ephemeral/<cluster>/<node>, so etcd expires it for us if the
+// host stops its heartbeat. When Ephemeral is set, the lookups of NODES
+// merge in the registered nodes.
+// The registered nodes are also added to the reverse lookup optimization
+// (and index), the reaper watches the registrations and takes the nodes
+// out of it when they expire. The reaper rebuilds them from the live
+// registrations when it starts and when it can't tell what expired.
+
+package etcdstore
+
+import (
+	"errors"
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	"log"
+	"math"
+	"net/url"
+	"path"
+	"rangestore"
+	"strings"
+	"time"
+)
+
+const _ephemeral = "/_ephemeral"
+
+// register the node in NODES of the leaf cluster for ttl, registering
+// again renews it
+func (e *EtcdStore) Register(cluster string, node string, ttl time.Duration) error {
+	if !e.Ephemeral {
+		return errors.New(fmt.Sprintf("Register [%s] in [%s] Failed (Error: Ephemeral Nodes are NOT enabled)", node, cluster))
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("Register [%s] in [%s] Failed (Error: ttl %v is not positive, %w)", node, cluster, ttl, rangestore.ErrInvalidName)
+	}
+	if err := rangestore.ValidKeyValues("NODES", []string{node}); err != nil {
+		return fmt.Errorf("Register [%s] in [%s] Failed (Error: %w)", node, cluster, err)
+	}
+	if isLeaf, err := e.checkIsLeafNode(cluster); err != nil {
+		return err
+	} else if !isLeaf {
+		return fmt.Errorf("cluster [%s] is NOT a LeafNode in EtcdStore, %w", cluster, rangestore.ErrNotFound)
+	}
+
+	var key = e.ephemeralPath(cluster, node)
+	var seconds = uint64(math.Ceil(ttl.Seconds()))
+	// heartbeat
+	_, err := e.client.Update(key, cluster, seconds)
+	if errorCode(err) != 100 {
+		return err
+	}
+	// first registration
+	_, err = e.client.Create(key, cluster, seconds)
+	if errorCode(err) == 105 { // raced with another registration
+		_, err = e.client.Update(key, cluster, seconds)
+		return err
+	} else if err != nil {
+		return err
+	}
+	return e.updateReverseIndex(cluster, "NODES", []string{}, []string{node})
+}
+
+// remove the registration of the node
+func (e *EtcdStore) Deregister(cluster string, node string) error {
+	_, err := e.client.Delete(e.ephemeralPath(cluster, node), false)
+	if errorCode(err) == 100 {
+		return fmt.Errorf("Deregister [%s] in [%s] Failed (Error: Node is NOT Registered, %w)", node, cluster, rangestore.ErrNotFound)
+	} else if err != nil {
+		return err
+	}
+	return e.unindexNode(cluster, node)
+}
+
+// StartReaper watches the registrations in the background and takes
+// the expired nodes out of the reverse lookups, until the store is
+// disconnected
+func (e *EtcdStore) StartReaper() {
+	if e.reaper != nil {
+		return
+	}
+	e.reaper = make(chan bool)
+	go e.reap(e.reaper)
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// the registration of the node
+func (e *EtcdStore) ephemeralPath(cluster string, node string) string {
+	return fmt.Sprintf("%s%s/%s/%s", e.storenode, _ephemeral, cluster, url.PathEscape(node))
+}
+
+// the nodes registered in the cluster
+func (e *EtcdStore) ephemeralNodes(cluster string) ([]string, error) {
+	var nodes = make([]string, 0)
+	response, _, _, found, err := e.retrieveFromEtcd(fmt.Sprintf("%s%s/%s", e.storenode, _ephemeral, cluster), true, false)
+	if err != nil || !found {
+		return nodes, err
+	}
+	for _, n := range response.Node.Nodes {
+		if !n.Dir {
+			nodes = append(nodes, unescapeNode(n.Key))
+		}
+	}
+	return nodes, nil
+}
+
+// the clusters where the node is registered, hint limits the result
+// to the clusters under hint
+func (e *EtcdStore) ephemeralReverseLookup(node string, hint string) ([]string, error) {
+	var clusters = make([]string, 0)
+	response, _, _, found, err := e.retrieveFromEtcd(fmt.Sprintf("%s%s", e.storenode, _ephemeral), true, true)
+	if err != nil || !found {
+		return clusters, err
+	}
+	for _, dir := range response.Node.Nodes {
+		var cluster = path.Base(dir.Key)
+		if hint != "" && cluster != hint && !strings.HasPrefix(cluster, hint+"-") {
+			continue
+		}
+		for _, n := range dir.Nodes {
+			if unescapeNode(n.Key) == node {
+				clusters = append(clusters, cluster)
+				break
+			}
+		}
+	}
+	return clusters, nil
+}
+
+// the nodes registered (and not expired), by cluster
+func (e *EtcdStore) registeredNodes() (map[string][]string, error) {
+	var registered = make(map[string][]string)
+	response, err := e.client.Get(fmt.Sprintf("%s%s", e.storenode, _ephemeral), false, true)
+	if errorCode(err) == 100 {
+		return registered, nil
+	} else if err != nil {
+		return registered, err
+	}
+	for _, dir := range response.Node.Nodes {
+		var cluster = path.Base(dir.Key)
+		for _, n := range dir.Nodes {
+			registered[cluster] = append(registered[cluster], unescapeNode(n.Key))
+		}
+	}
+	return registered, nil
+}
+
+// drop the registrations of the cluster (deleted or renamed) and take them
+// out of its reverse lookups. If to is set, the ones alive are registered
+// in it for the rest of their ttl
+func (e *EtcdStore) moveRegistrations(cluster string, to string) error {
+	var dir = fmt.Sprintf("%s%s/%s", e.storenode, _ephemeral, cluster)
+	response, err := e.client.Get(dir, false, false)
+	if errorCode(err) == 100 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var nodes, moved = make([]string, 0), make([]string, 0)
+	for _, n := range response.Node.Nodes {
+		if n.Dir {
+			continue
+		}
+		var node = unescapeNode(n.Key)
+		nodes = append(nodes, node)
+		if to == "" || n.TTL <= 0 {
+			continue
+		}
+		if _, err = e.client.Set(e.ephemeralPath(to, node), to, uint64(n.TTL)); err != nil {
+			return err
+		}
+		moved = append(moved, node)
+	}
+	if _, err = e.client.Delete(dir, true); err != nil && errorCode(err) != 100 {
+		return err
+	}
+	if err = e.updateReverseIndex(cluster, "NODES", nodes, []string{}); err != nil {
+		return err
+	}
+	return e.updateReverseIndex(to, "NODES", []string{}, moved)
+}
+
+// NODES of the leaf cluster along with the registered nodes, found is
+// false if the cluster has neither
+func (e *EtcdStore) withEphemeral(cluster string, nodes []string, found bool) ([]string, bool, error) {
+	registered, err := e.ephemeralNodes(cluster)
+	if err != nil {
+		return nodes, found, err
+	}
+	var merged = append([]string{}, nodes...)
+	for _, node := range registered {
+		var seen bool
+		for _, n := range nodes {
+			if n == node {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			merged = append(merged, node)
+		}
+	}
+	return merged, found || len(registered) > 0, nil
+}
+
+// take the node out of the reverse lookups of the cluster, unless it
+// is in NODES by other means
+func (e *EtcdStore) unindexNode(cluster string, node string) error {
+	response, err := e.client.Get(fmt.Sprintf("%s/NODES", e.clusterToPath(cluster)), false, false)
+	if err == nil {
+		for _, n := range splitValue(response.Node.Value) {
+			if n == node {
+				return nil
+			}
+		}
+	} else if errorCode(err) != 100 {
+		return err
+	}
+	return e.updateReverseIndex(cluster, "NODES", []string{node}, []string{})
+}
+
+// follow the registrations and unindex the expired ones, until stopped.
+// The registrations which expired while nobody watched (before the start,
+// or when the watch fell behind) are only seen by rebuilding the reverse
+// lookups from the live ones, the watch is from before the rebuild
+func (e *EtcdStore) reap(stop chan bool) {
+	var prefix = fmt.Sprintf("%s%s", e.storenode, _ephemeral)
+	var waitIndex uint64
+	var resync = true
+	for {
+		if resync {
+			index, err := e.currentIndex(prefix)
+			if err == nil {
+				err = e.reindex()
+			}
+			if err != nil {
+				log.Printf("ERROR: Reaper of [%s] could not rebuild the reverse lookups, retrying (Error: %s)\n", prefix, err)
+				select {
+				case <-stop:
+					return
+				case <-time.After(_rewatch):
+				}
+				continue
+			}
+			waitIndex, resync = index+1, false
+		}
+		var receiver = make(chan *etcd.Response)
+		var done = make(chan error, 1)
+		go func(waitIndex uint64) {
+			_, err := e.client.Watch(prefix, waitIndex, true, receiver, stop)
+			done <- err
+		}(waitIndex)
+		for response := range receiver {
+			waitIndex = response.Node.ModifiedIndex + 1
+			if response.Action == "expire" {
+				e.reaped(prefix, response.Node.Key)
+			}
+		}
+		err := <-done
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if errorCode(err) == _indexCleared {
+			log.Printf("WARN: Reaper of [%s] fell behind, rebuilding the reverse lookups\n", prefix)
+			resync = true
+			continue
+		}
+		log.Printf("ERROR: Reaper of [%s] lost its watch, retrying (Error: %s)\n", prefix, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(_rewatch):
+		}
+	}
+}
+
+// the registration has expired
+func (e *EtcdStore) reaped(prefix string, key string) {
+	rel, ok := relativeKey(prefix, cleanKey(key))
+	var parts = strings.Split(rel, "/")
+	if !ok || len(parts) != 2 {
+		return
+	}
+	var cluster, node = parts[0], unescapeNode(key)
+	// registered again in the meantime
+	if _, err := e.client.Get(key, false, false); err == nil {
+		return
+	}
+	if err := e.unindexNode(cluster, node); err != nil {
+		log.Printf("ERROR: Removing expired [%s] of [%s] from reverse lookups Failed (Error: %s)\n", node, cluster, err)
+		return
+	}
+	log.Printf("INFO: Registration of [%s] in [%s] expired\n", node, cluster)
+}
+
+// node name from its registration key
+func unescapeNode(key string) string {
+	node, err := url.PathUnescape(path.Base(key))
+	if err != nil {
+		return path.Base(key)
+	}
+	return node
+}
@@ -7,7 +7,12 @@ import (
 	"fmt"
 	"github.com/coreos/go-etcd/etcd"
 	"log"
+	"net/url"
+	"path"
+	"rangestore"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const _leaf = "_leaf"
@@ -17,9 +22,15 @@ const _roptimize = "/_roptimize"
 type EtcdStore struct {
 	hosts      []string     // http://host1:port,..
 	ROptimize  bool         // reverse lookup optimization
+	RIndex     []string     // attributes having a reverse index (under /_rindex)
+	Ephemeral  bool         // merge the registered nodes (under /_ephemeral) into NODES
 	FastLookup bool         // fast return, will return the first match
 	client     *etcd.Client // etcd connection object
 	storenode  string       // path to where the range store is etcd
+	mirrors    []*mirror    // local mirrors, if lookups are served from memory
+	reaper     chan bool    // closed to stop the reaper of expired registrations
+
+	tracker rangestore.Tracker // the query the lookups are for, nil if none (see Scope)
 }
 
 // Connect to the Etcd Store
@@ -27,39 +38,71 @@ type EtcdStore struct {
 // 2. check whether _range_store value is set to 'loaded'
 // 3. create the interface for client connections
 func ConnectEtcdStore(hosts []string, roptimize, fast bool, node string) (e *EtcdStore, err error) {
+	e = NewEtcdStore(hosts, roptimize, fast, node)
+	// test the consistency of etcd store
+	if err = e.checkLoaded(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// the store without checking etcd, the lookups fail (ErrUnavailable)
+// until etcd is up and loaded. Used to serve the stale answers of a
+// snapshot when etcd is down (see rangestore.StaleStore)
+func NewEtcdStore(hosts []string, roptimize, fast bool, node string) *EtcdStore {
 	if len(node) > 0 && node[len(node)-1] == '/' {
 		node = node[:len(node)-1]
 	}
 	client := etcd.NewClient(hosts)
-	e = &EtcdStore{hosts: hosts, ROptimize: roptimize, FastLookup: fast, client: client, storenode: node}
-	// test the consistency of etcd store
+	return &EtcdStore{hosts: hosts, ROptimize: roptimize, FastLookup: fast, client: client, storenode: node}
+}
+
+// the etcd store is reachable and _range_store is set to 'loaded'
+// (asks etcd, never the mirror)
+func (e *EtcdStore) checkLoaded() error {
 	var obj = fmt.Sprintf("%s/%s", e.storenode, "_range_store")
-	var response *etcd.Response
-	response, err = client.Get(obj, false, false)
+	response, err := e.client.Get(obj, false, false)
 	// we have to make sure we have a clean etcd store
-	if err != nil && err.(*etcd.EtcdError).ErrorCode == 100 {
+	if err != nil && errorCode(err) == 100 {
 		log.Printf("ERROR: Looks like the etcd-store is not loaded with data to serve as rangestore [Key: %s, Value: NOT FOUND]\n", obj)
-		return nil, errors.New("ERROR: etcd-store is NOT LOADED with data")
+		return fmt.Errorf("ERROR: etcd-store is NOT LOADED with data, %w", rangestore.ErrUnavailable)
 	} else if err != nil {
 		log.Println("ERROR: Etcd Store Returned Error")
 		log.Println(err)
-		return nil, err
+		return storeError(err)
 	} else if err == nil {
 		// if we get no error, it means key if present. We need to make sure it is set to 'loaded'
 		if response.Node.Value != "loaded" {
 			log.Printf("ERROR: Looks like the etcd-store is not ready to serve as rangestore [Key: %s, Value: %s]\n", response.Node.Key, response.Node.Value)
-			return nil, errors.New("ERROR: etcd-store is NOT READY to serve")
+			return fmt.Errorf("ERROR: etcd-store is NOT READY to serve, %w", rangestore.ErrUnavailable)
 		}
 	}
+	return nil
+}
 
-	return e, nil
+// Scope is the store doing the lookups of a query, the leaf clusters
+// walked by the reverse lookups are counted and the requests to etcd are
+// given up at the deadline of the query
+func (e *EtcdStore) Scope(t rangestore.Tracker) rangestore.Store {
+	var scoped = *e
+	scoped.tracker = t
+	return &scoped
 }
 
 func (e *EtcdStore) DisconnectEtcdStore() {
+	e.stopMirrors()
+	if e.reaper != nil {
+		close(e.reaper)
+	}
 	e.client.Close()
 	return
 }
 
+func (e *EtcdStore) Close() {
+	e.DisconnectEtcdStore()
+}
+
 ////////////////////
 // LOOKUP CLUSTER //
 ////////////////////
@@ -67,12 +110,13 @@ func (e *EtcdStore) DisconnectEtcdStore() {
 // LOGIC
 // -----
 // * for the first element in cluster create results array
-//   * check whether the cluster is a leaf node
-//   * if yes, call KeyLookup, with key == NODES
-//   * if not, call listClusters
-// * if more elements are there, repeat the above
-//   (unlike, filestore we don't call ArrayToSet since etcd
-//   is populated by a program, not by morals)
+//   - get the cluster dir (single request, the listing has the values
+//     of the keys in the dir)
+//   - if it is a leaf node, return the value of NODES from the listing
+//   - if not, return the children
+//   - if more elements are there, repeat the above
+//     (unlike, filestore we don't call ArrayToSet since etcd
+//     is populated by a program, not by morals)
 func (e *EtcdStore) ClusterLookup(cluster *[]string) (*[]string, error) {
 	// store the resuls
 	var results = make([]string, 0)
@@ -83,25 +127,34 @@ func (e *EtcdStore) ClusterLookup(cluster *[]string) (*[]string, error) {
 		if elem == "RANGE" {
 			elem = "/"
 		}
-		var err error
-		isLeaf, err := e.checkIsLeafNode(elem)
+		var dir = e.clusterToPath(elem)
+		response, _, _, found, err := e.retrieveFromEtcd(dir, false, false)
+		if err != nil {
+			return &[]string{}, err
+		} else if !found || !response.Node.Dir {
+			return &[]string{}, fmt.Errorf("No Such Cluster [%s], %w", elem, rangestore.ErrNotFound)
+		}
+		isLeaf, err := e.isLeafDir(response.Node)
 		if err != nil {
 			return &[]string{}, err
 		}
-		// if it is a leaf node, we need do a KeyLookup (NODES)
+		// if it is a leaf node, NODES is one of the children
 		if isLeaf {
-			// by default, lookup for NODES
-			result, err := e.KeyLookup(&[]string{elem}, "NODES")
-			if err != nil {
-				return &[]string{}, err
+			value, found := childValue(response.Node, "NODES")
+			var nodes = splitValue(value)
+			if e.Ephemeral {
+				if nodes, found, err = e.withEphemeral(elem, nodes, found); err != nil {
+					return &[]string{}, err
+				}
+			}
+			if !found {
+				return &[]string{}, fmt.Errorf("KeyLookup for [%s:NODES] Failed (Error: No KEY Found, %w)", elem, rangestore.ErrNotFound)
 			}
-			results = append(results, *result...)
+			results = append(results, nodes...)
 		} else { // we need to return the children
-			result, err := e.listClusters(elem)
-			if err != nil {
-				return &[]string{}, err
+			for _, n := range response.Node.Nodes {
+				results = append(results, e.pathToCluster(n.Key))
 			}
-			results = append(results, result...)
 		}
 
 	}
@@ -124,15 +177,21 @@ func (e *EtcdStore) KeyLookup(cluster *[]string, key string) (*[]string, error)
 			if err != nil { // got error
 				return &[]string{}, err
 			} else if !found { // key not found
-				return &[]string{}, errors.New(fmt.Sprintf("KeyLookup for [%s:%s] Failed (Error: No KEY Found)", elem, key))
+				return &[]string{}, fmt.Errorf("KeyLookup for [%s:%s] Failed (Error: No KEY Found, %w)", elem, key, rangestore.ErrNotFound)
 			}
 
 			// if response is NOT for a dir
 			if !response.Node.Dir {
 				var _err = fmt.Sprintf("Expected value of lookup [%s] to be a dir, recieved a leaf file", dir)
-				log.Printf(_err)
+				log.Print(_err)
 				return &[]string{}, errors.New(_err)
 			}
+			// only the leaf clusters have KEYS (the others have clusters)
+			if isLeaf, err := e.isLeafDir(response.Node); err != nil {
+				return &[]string{}, err
+			} else if !isLeaf {
+				return &[]string{}, fmt.Errorf("KeyLookup for [%s:%s] Failed (Error: Not a Leaf Cluster, %w)", elem, key, rangestore.ErrNotFound)
+			}
 
 			for _, n := range response.Node.Nodes {
 				// replace '/' with '-', also root will always be '/'
@@ -141,16 +200,27 @@ func (e *EtcdStore) KeyLookup(cluster *[]string, key string) (*[]string, error)
 					result = append(result, _node[len(_node)-1])
 				}
 			}
+			// a cluster with only registered nodes still has NODES
+			if _, found := childValue(response.Node, "NODES"); e.Ephemeral && !found {
+				if _, found, err = e.withEphemeral(elem, []string{}, false); err != nil {
+					return &[]string{}, err
+				} else if found {
+					result = append(result, "NODES")
+				}
+			}
 		} else {
 			// 1. read the key in etcd
 			// 2. append the result
 			_, _, value, found, err := e.retrieveFromEtcd(node, false, false)
+			result = splitValue(value)
+			if err == nil && e.Ephemeral && key == "NODES" {
+				result, found, err = e.withEphemeral(elem, result, found)
+			}
 			if err != nil {
-				return &[]string{}, errors.New(fmt.Sprintf("KeyLookup for [%s:%s] Failed (Error: %s)", elem, key, err))
+				return &[]string{}, fmt.Errorf("KeyLookup for [%s:%s] Failed (Error: %w)", elem, key, err)
 			} else if !found {
-				return &[]string{}, errors.New(fmt.Sprintf("KeyLookup for [%s:%s] Failed (Error: No KEY Found)", elem, key))
+				return &[]string{}, fmt.Errorf("KeyLookup for [%s:%s] Failed (Error: No KEY Found, %w)", elem, key, rangestore.ErrNotFound)
 			}
-			result = strings.Split(value, _sep)
 		}
 		// append the result with results
 		results = append(results, result...)
@@ -172,44 +242,72 @@ func (e *EtcdStore) KeyReverseLookup(key string) (*[]string, error) {
 func (e *EtcdStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
 	// optimization, for nodes don't do the tough thing
 	if e.ROptimize && attr == "NODES" {
-		return e.optimizedNodeReverseLookup(key)
+		results, err := e.optimizedNodeReverseLookup(key)
+		// a node in no cluster is not an error
+		if errors.Is(err, rangestore.ErrNotFound) {
+			return &[]string{}, nil
+		}
+		return results, err
 	}
 	return e.KeyReverseLookupHint(key, attr, "")
 }
 
 // given a key, it will search for the cluster where the attr has that key,
-// hint is to limit the scope of search
+// hint is to limit the scope of search. The whole subtree under hint is
+// fetched in a single request and the values are matched locally
 func (e *EtcdStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
-	var clusters *[]string
+	// optimization, use the reverse index if we have one for attr
+	if e.indexed(attr) {
+		return e.indexedReverseLookup(key, attr, hint)
+	}
+
 	var err error
 	var results = make([]string, 0)
-	var seen bool
+	var leaves []*etcd.Node
 
-	clusters, err = e.getAllLeafNodes(hint)
-	if err != nil {
+	leaves, err = e.getLeafNodeTree(hint)
+	// a hint not in the store has no clusters, any other error fails the lookup
+	if errors.Is(err, rangestore.ErrNotFound) {
 		return &results, nil
+	} else if err != nil {
+		return &results, storeError(err)
 	}
 
-	for _, elem := range *clusters {
+	for _, leaf := range leaves {
+		if err = e.visit(1); err != nil {
+			return &[]string{}, err
+		}
+		value, found := childValue(leaf, attr)
+		if !found {
+			continue
+		}
+		for _, i := range strings.Split(value, _sep) {
+			if i == key {
+				results = append(results, e.pathToCluster(leaf.Key))
+				break
+			}
+		}
+		if len(results) > 0 && e.FastLookup {
+			return &results, nil
+		}
+	}
 
-		// 1. read the key in etcd
-		// 2. append the result
-		_, _, value, found, err := e.retrieveFromEtcd(fmt.Sprintf("%s/%s", e.clusterToPath(elem), attr), false, false)
+	// the registered nodes are not in the tree
+	if e.Ephemeral && attr == "NODES" {
+		registered, err := e.ephemeralReverseLookup(key, hint)
 		if err != nil {
-			return &[]string{}, errors.New(fmt.Sprintf("KeyLookup for [%s:%s] Failed (Error: %s)", elem, key, err))
-		} else if !found {
-			continue
-		} else {
-			result := strings.Split(value, _sep)
-			for _, i := range result {
-				if i == key {
-					results = append(results, elem)
-					seen = true
-					break
-				}
+			return &results, err
+		}
+		for _, cluster := range registered {
+			var seen bool
+			for _, r := range results {
+				seen = seen || r == cluster
+			}
+			if !seen {
+				results = append(results, cluster)
 			}
-			if seen && e.FastLookup {
-				return &results, nil
+			if e.FastLookup {
+				break
 			}
 		}
 	}
@@ -226,65 +324,96 @@ func (e *EtcdStore) clusterToPath(cluster string) string {
 	return fmt.Sprintf("%s/%s", e.storenode, strings.Replace(cluster, "-", "/", -1))
 }
 
+// given a key in etcd, it will convert to cluster name
+func (e *EtcdStore) pathToCluster(key string) string {
+	key = strings.TrimPrefix(cleanKey(key), cleanKey(e.storenode))
+	return strings.Replace(strings.Trim(key, "/"), "/", "-", -1)
+}
+
 // Get all the leaf cluster nodes for a given dir
-// it is not efficient since we have to walk down all the path
 func (e *EtcdStore) getAllLeafNodes(root string) (*[]string, error) {
 	var results = make([]string, 0)
-	var err error
 
-	// root a leaf node
-	isleaf, err := e.checkIsLeafNode(root)
+	leaves, err := e.getLeafNodeTree(root)
 	if err != nil {
 		return &[]string{}, err
 	}
-	if isleaf {
-		return &[]string{root}, nil
-	}
-
-	err = e._getAllLeafNodes(e.clusterToPath(root), &results)
 
-	if err != nil {
-		return &[]string{}, err
-	}
-
-	// fix the results in place
-	for i := 0; i < len(results); i++ {
-		results[i] = strings.Replace(strings.Trim(results[i], "/"), "/", "-", -1)
+	for _, leaf := range leaves {
+		results = append(results, e.pathToCluster(leaf.Key))
 	}
 
 	return &results, nil
 }
 
-// the function that really does the work
-func (e *EtcdStore) _getAllLeafNodes(root string, results *[]string) error {
-	response, _, _, found, err := e.retrieveFromEtcd(root, false, false)
+// fetch the whole tree under root in a single request and return the
+// leaf dirs in it, each leaf has its key/value nodes as children
+func (e *EtcdStore) getLeafNodeTree(root string) ([]*etcd.Node, error) {
+	var dir = e.clusterToPath(root)
+	response, _, _, found, err := e.retrieveFromEtcd(dir, true, true)
 	// if there is an error, return err
 	if err != nil { // got error
-		return err
+		return []*etcd.Node{}, err
 	} else if !found { // key not found
-		return errors.New(fmt.Sprintf("DirLookup for [%s] Failed (Error: No DIR Found)", root))
+		return []*etcd.Node{}, fmt.Errorf("DirLookup for [%s] Failed (Error: No DIR Found, %w)", dir, rangestore.ErrNotFound)
 	}
 
 	// if response is NOT for a dir
 	if !response.Node.Dir {
-		var _err = fmt.Sprintf("Expected value of lookup [%s] to be a dir, recieved a leaf file", root)
-		log.Printf(_err)
-		return errors.New(_err)
+		var _err = fmt.Sprintf("Expected value of lookup [%s] to be a dir, recieved a leaf file", dir)
+		log.Print(_err)
+		return []*etcd.Node{}, errors.New(_err)
 	}
 
-	for _, n := range response.Node.Nodes {
-		status, err := e.checkIsLeafNode(n.Key)
-		if err != nil {
-			return err
+	var leaves = make([]*etcd.Node, 0)
+	err = e.collectLeafNodes(response.Node, &leaves)
+	return leaves, err
+}
+
+// walk the tree (locally) and collect the leaf dirs
+func (e *EtcdStore) collectLeafNodes(node *etcd.Node, leaves *[]*etcd.Node) error {
+	isLeaf, err := e.isLeafDir(node)
+	if err != nil {
+		return err
+	}
+	if isLeaf {
+		*leaves = append(*leaves, node)
+		return nil
+	}
+	for _, n := range node.Nodes {
+		if n.Dir {
+			if err := e.collectLeafNodes(n, leaves); err != nil {
+				return err
+			}
 		}
-		if status {
-			*results = append(*results, n.Key)
-		} else {
-			_ = e._getAllLeafNodes(n.Key, results)
+	}
+	return nil
+}
+
+// Checks whether the dir (as returned by etcd) is a leaf. etcd doesn't list
+// the hidden _leaf marker, but a leaf dir has keys while a cluster dir has
+// only dirs. If the dir is empty we have to ask etcd for the marker
+func (e *EtcdStore) isLeafDir(node *etcd.Node) (bool, error) {
+	for _, n := range node.Nodes {
+		if !n.Dir {
+			return true, nil
 		}
 	}
+	if len(node.Nodes) > 0 {
+		return false, nil
+	}
+	_, _, _, found, err := e.retrieveFromEtcd(fmt.Sprintf("%s/%s", cleanKey(node.Key), _leaf), false, false)
+	return found, err
+}
 
-	return nil
+// value of a key in the leaf dir (as returned by etcd)
+func childValue(node *etcd.Node, key string) (string, bool) {
+	for _, n := range node.Nodes {
+		if !n.Dir && path.Base(n.Key) == key {
+			return n.Value, true
+		}
+	}
+	return "", false
 }
 
 // reads the child clusters of this cluster.
@@ -300,20 +429,18 @@ func (e *EtcdStore) listClusters(cluster string) ([]string, error) {
 	if err != nil { // got error
 		return []string{}, err
 	} else if !found { // key not found
-		return []string{}, errors.New(fmt.Sprintf("No Such Cluster [%s]", cluster))
+		return []string{}, fmt.Errorf("No Such Cluster [%s], %w", cluster, rangestore.ErrNotFound)
 	}
 
 	// if response is NOT for a dir
 	if !response.Node.Dir {
 		var _err = fmt.Sprintf("Expected value of lookup [%s] to be a dir, recieved a leaf file", dir)
-		log.Printf(_err)
+		log.Print(_err)
 		return []string{}, errors.New(_err)
 	}
 
 	for _, n := range response.Node.Nodes {
-		// replace '/' with '-', also root will always be '/'
-		_node := strings.Replace(n.Key[1:], "/", "-", -1)
-		children = append(children, _node)
+		children = append(children, e.pathToCluster(n.Key))
 	}
 
 	return children, nil
@@ -331,27 +458,71 @@ func (e *EtcdStore) checkIsLeafNode(cluster string) (found bool, err error) {
 
 // given a object, return the response from the etcd cluster
 func (e *EtcdStore) retrieveFromEtcd(object string, sort, recursive bool) (response *etcd.Response, key string, value string, found bool, err error) {
-	response, err = e.client.Get(object, sort, recursive)
+	// serve from the mirror if we have one
+	if m := e.mirrorFor(object); m != nil {
+		var ok bool
+		response, found, ok = m.get(object, sort, recursive)
+		m.count(ok)
+		if ok && !found {
+			return response, object, "", false, nil
+		} else if ok {
+			return response, response.Node.Key, response.Node.Value, true, nil
+		}
+	}
+
+	response, err = e.get(object, sort, recursive)
 
 	// Check whether the error is Key NOT Found
-	if err != nil && err.(*etcd.EtcdError).ErrorCode == 100 {
+	if err != nil && errorCode(err) == 100 {
 		return response, object, "", false, nil
 	} else if err != nil { // error could be cluster is unreachble, etc..
 		log.Printf("ERROR: Etcd Store Returned Error: %s\n", err)
-		return response, object, "", false, err
+		return response, object, "", false, storeError(err)
 	}
 
 	// if all is good
 	return response, response.Node.Key, response.Node.Value, true, nil
 }
 
+// the Get of the client, given up at the deadline of the query (if any)
+// with the limit it hit
+func (e *EtcdStore) get(object string, sort, recursive bool) (*etcd.Response, error) {
+	if e.tracker == nil || e.tracker.Deadline().IsZero() {
+		return e.client.Get(object, sort, recursive)
+	}
+	var cancel = make(chan bool)
+	var timer = time.AfterFunc(time.Until(e.tracker.Deadline()), func() { close(cancel) })
+	defer timer.Stop()
+	// as the client does it for a Get (the consistency is the default one)
+	var p = strings.Replace(url.QueryEscape(path.Join("keys", object)), "%2F", "/", -1)
+	var options = url.Values{"recursive": {strconv.FormatBool(recursive)}, "sorted": {strconv.FormatBool(sort)}}
+	raw, err := e.client.SendRequest(etcd.NewRawRequest("GET", p+"?"+options.Encode(), nil, cancel))
+	if err == etcd.ErrRequestCancelled {
+		if limitErr := e.tracker.Visit(0); limitErr != nil {
+			return nil, limitErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return raw.Unmarshal()
+}
+
+// count the clusters walked for the query (if any)
+func (e *EtcdStore) visit(clusters int) error {
+	if e.tracker == nil {
+		return nil
+	}
+	return e.tracker.Visit(clusters)
+}
+
 // same as KeyReverseLookupAttr where attr == NODES and hint == ""
 func (e *EtcdStore) optimizedNodeReverseLookup(key string) (*[]string, error) {
 	_, _, value, found, err := e.retrieveFromEtcd(fmt.Sprintf("%s/%s", _roptimize, key), false, false)
-	if !found {
-		return &[]string{}, errors.New(fmt.Sprintf("Key NOT Found [%s]", key))
-	} else if err != nil {
+	if err != nil {
 		return &[]string{}, err
+	} else if !found {
+		return &[]string{}, fmt.Errorf("Key NOT Found [%s], %w", key, rangestore.ErrNotFound)
 	}
 	values := strings.Split(value, _sep)
 	return &values, nil
@@ -1,20 +1,36 @@
 package etcdstore
 
 import (
+	"errors"
+	"github.com/coreos/go-etcd/etcd"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"rangestore"
+	"rangestore/etcdstore/etcdtest"
+	"rangestore/filestore"
+	"rangestore/storetest"
 	"testing"
+	"time"
 )
 
 var e *EtcdStore
 
 // This is for setup and tear down.
+// the etcd is a fake (in-process) loaded with the fixture, as
+// yarge-sync does
 func TestMain(m *testing.M) {
 	var err error
 	var status int
 
+	var server = etcdtest.NewServer()
+	if err = load(server); err != nil {
+		log.Fatal("Loading the Fake Etcd ", err)
+	}
+
 	// etcdstore
-	var hosts = []string{"http://127.0.0.1:13824"}
+	var hosts = server.Machines()
 	var roptimize = false
 	var efast = false
 	var node = ""
@@ -27,10 +43,25 @@ func TestMain(m *testing.M) {
 
 	// we have tear down
 	e.DisconnectEtcdStore()
+	server.Close()
 
 	os.Exit(status)
 }
 
+// copy the fixture into the etcd
+func load(server *etcdtest.Server) error {
+	fixture, err := filestore.ConnectFileStore(storetest.Fixture(), -1, false)
+	if err != nil {
+		return err
+	}
+	var loader = NewEtcdStore(server.Machines(), false, false, "")
+	defer loader.DisconnectEtcdStore()
+	if _, err = rangestore.Sync(fixture, loader, false, false); err != nil {
+		return err
+	}
+	return loader.Reindex()
+}
+
 // optimizedNodeReverseLookup
 func TestOptimizedNodeReverseLookup(t *testing.T) {
 	e.ROptimize = true
@@ -220,6 +251,40 @@ func TestClusterLookup(t *testing.T) {
 	}
 }
 
+// missing clusters and keys are rangestore.ErrNotFound, etcd being
+// down is rangestore.ErrUnavailable
+func TestTypedErrors(t *testing.T) {
+	if _, err := e.ClusterLookup(&[]string{"ops-prod-vpc1-foobar"}); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, Cluster: ops-prod-vpc1-foobar, Got: %v", err)
+	}
+	if _, err := e.KeyLookup(&[]string{"ops-prod-vpc1-range"}, "FOOBAR"); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, Key: FOOBAR, Got: %v", err)
+	}
+	if _, err := ConnectEtcdStore([]string{"http://127.0.0.1:1"}, false, false, ""); !errors.Is(err, rangestore.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, etcd is NOT reachable, Got: %v", err)
+	}
+	var down = &EtcdStore{client: etcd.NewClient([]string{"http://127.0.0.1:1"})}
+	if _, err := down.KeyReverseLookupAttr("Ops", "AUTHORS"); !errors.Is(err, rangestore.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, etcd is NOT reachable, Got: %v", err)
+	}
+}
+
+// same counts as the filestore the store was loaded from
+func TestStatus(t *testing.T) {
+	if err := e.Ping(); err != nil {
+		t.Errorf("Expected Ping to succeed, Got: %s", err)
+	}
+	status, err := e.Status()
+	var expected = rangestore.StoreStatus{Type: "etcdstore", Root: "/", Clusters: 18, Leaves: 7, Nodes: 17, Keys: 16}
+	if err != nil || status != expected {
+		t.Errorf("Expected %+v, Got: %+v (Error: %s)", expected, status, err)
+	}
+	var down = &EtcdStore{client: etcd.NewClient([]string{"http://127.0.0.1:1"})}
+	if err := down.Ping(); !errors.Is(err, rangestore.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, etcd is NOT reachable, Got: %v", err)
+	}
+}
+
 // test listClusters
 func TestListClusters(t *testing.T) {
 	var result []string
@@ -264,8 +329,255 @@ func TestCheckIsLeafNode(t *testing.T) {
 	}
 }
 
+// pathToCluster
+func TestPathToCluster(t *testing.T) {
+	var store = &EtcdStore{storenode: "/yarge"}
+	for key, expected := range map[string]string{"/yarge/ops/prod": "ops-prod", "/yarge/ops/prod/vpc1/": "ops-prod-vpc1", "/yarge": ""} {
+		if result := store.pathToCluster(key); result != expected {
+			t.Errorf("Expected NO ERROR, (Key: %s) Expected: %s, Got: %s", key, expected, result)
+		}
+	}
+	if result := e.pathToCluster("/ops/prod"); result != "ops-prod" {
+		t.Errorf("Expected NO ERROR, (Key: /ops/prod) Expected: ops-prod, Got: %s", result)
+	}
+}
+
+// reverse index, built by the checker and used for the lookups
+func TestReverseIndex(t *testing.T) {
+	e.RIndex = []string{"AUTHORS"}
+	// start with no index (the loader could have built one)
+	_, _ = e.client.Delete(_rindex, true)
+	defer func() {
+		e.RIndex = nil
+		e.client.Delete(_rindex, true)
+	}()
+
+	// nothing is indexed yet, so everything has drifted
+	drifts, err := e.CheckReverseIndex(true)
+	if err != nil || len(drifts) != 4 {
+		t.Errorf("Expected NO ERROR, Expected 4 drifts, Got: %v (Error: %s)", drifts, err)
+	}
+	drifts, err = e.CheckReverseIndex(false)
+	if err != nil || len(drifts) != 0 {
+		t.Errorf("Expected NO ERROR, Expected no drifts after repair, Got: %v (Error: %s)", drifts, err)
+	}
+
+	var key, attr, hint = "data@example.com", "AUTHORS", ""
+	var expected = []string{"data-prod-vpc1-log", "data-prod-vpc2-log", "data-prod-vpc3-log"}
+	results, err := e.KeyReverseLookupAttr(key, attr)
+	if err != nil || !compare(*results, expected) {
+		t.Errorf("Expected NO ERROR, (Key: %s, Attr: %s) Expected: %s, Got: %s (Error: %s)", key, attr, expected, *results, err)
+	}
+
+	key, attr, hint = "Ops", "AUTHORS", "ops-prod-vpc2"
+	expected = []string{"ops-prod-vpc2-mon"}
+	results, err = e.KeyReverseLookupHint(key, attr, hint)
+	if err != nil || !compare(*results, expected) {
+		t.Errorf("Expected NO ERROR, (Key: %s, Attr: %s, Hint: %s) Expected: %s, Got: %s (Error: %s)", key, attr, hint, expected, *results, err)
+	}
+
+	key, attr, hint = "Vigith Maurice", "AUTHORS", "data"
+	expected = []string{}
+	results, err = e.KeyReverseLookupHint(key, attr, hint)
+	if err != nil || !compare(*results, expected) {
+		t.Errorf("Expected NO ERROR, (Key: %s, Attr: %s, Hint: %s) Expected: %s, Got: %s (Error: %s)", key, attr, hint, expected, *results, err)
+	}
+
+	// drift the index, the checker should find and repair it
+	_, _ = e.client.Set(e.indexPath("AUTHORS", "Ops"), "ops-prod-vpc1-mon", 0)
+	_, _ = e.client.Set(e.indexPath("AUTHORS", "nobody@example.com"), "data-qa-vpc5-log", 0)
+	drifts, err = e.CheckReverseIndex(true)
+	if err != nil || len(drifts) != 2 || drifts[0].Value != "Ops" || drifts[1].Value != "nobody@example.com" {
+		t.Errorf("Expected NO ERROR, Expected 2 drifts, Got: %v (Error: %s)", drifts, err)
+	}
+	drifts, err = e.CheckReverseIndex(false)
+	if err != nil || len(drifts) != 0 {
+		t.Errorf("Expected NO ERROR, Expected no drifts after repair, Got: %v (Error: %s)", drifts, err)
+	}
+
+	// updates keep the index consistent
+	err = e.updateReverseIndex("data-qa-vpc5-log", "AUTHORS", []string{"qa@example.com"}, []string{"qa@example.com", "data@example.com"})
+	results, _ = e.KeyReverseLookupAttr("data@example.com", "AUTHORS")
+	if err != nil || len(*results) != 4 {
+		t.Errorf("Expected NO ERROR, Expected data-qa-vpc5-log to be indexed, Got: %s (Error: %s)", *results, err)
+	}
+	err = e.updateReverseIndex("data-qa-vpc5-log", "AUTHORS", []string{"qa@example.com", "data@example.com"}, []string{})
+	results, _ = e.KeyReverseLookupAttr("qa@example.com", "AUTHORS")
+	if err != nil || len(*results) != 0 {
+		t.Errorf("Expected NO ERROR, Expected qa@example.com to be removed from index, Got: %s (Error: %s)", *results, err)
+	}
+}
+
+// an etcd synced from empty is served once reindexed, reindexing repairs
+// the reverse lookups
+func TestReindex(t *testing.T) {
+	var server = etcdtest.NewServer()
+	defer server.Close()
+	fixture, err := filestore.ConnectFileStore(storetest.Fixture(), -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	var s = NewEtcdStore(server.Machines(), true, false, "")
+	defer s.DisconnectEtcdStore()
+	s.RIndex = []string{"AUTHORS"}
+	changes, err := rangestore.Sync(fixture, s, false, false)
+	if err != nil || len(changes) != 7+16 {
+		t.Fatalf("Expected the 7 clusters and their 16 keys to be created, Got: %d (Error: %v)", len(changes), err)
+	}
+	if _, err = ConnectEtcdStore(server.Machines(), false, false, ""); !errors.Is(err, rangestore.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, Etcd is not Reindexed, Got: %v", err)
+	}
+
+	// drift the reverse lookups
+	_, _ = s.client.Set(_roptimize+"/nosuch.example.com", "ops-prod-vpc1-mon", 0)
+	_, _ = s.client.Delete(_roptimize+"/mon1001.ops.example.com", false)
+	_, _ = s.client.Delete(s.indexPath("AUTHORS", "Ops"), false)
+	if err = s.Reindex(); err != nil {
+		t.Fatal("Reindex ", err)
+	}
+	if _, err = ConnectEtcdStore(server.Machines(), false, false, ""); err != nil {
+		t.Errorf("Expected the Etcd to be served once Reindexed, Got: %v", err)
+	}
+	if drifts, err := s.CheckReverseIndex(false); err != nil || len(drifts) != 0 {
+		t.Errorf("Expected no drifts, Got: %v (Error: %v)", drifts, err)
+	}
+	if results, err := s.optimizedNodeReverseLookup("nosuch.example.com"); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, Got: %v (Error: %v)", *results, err)
+	}
+	storetest.Run(t, s)
+
+	// in sync, nothing to do
+	if changes, err = rangestore.Sync(fixture, s, true, false); err != nil || len(changes) != 0 {
+		t.Errorf("Expected no changes, Got: %v (Error: %v)", changes, err)
+	}
+}
+
+// an edit made while the reverse lookups are rebuilt is not undone by
+// the rebuild
+func TestReindexConcurrentEdit(t *testing.T) {
+	var server = etcdtest.NewServer()
+	defer server.Close()
+	var s = NewEtcdStore(server.Machines(), false, false, "")
+	defer s.DisconnectEtcdStore()
+	s.RIndex = []string{"NODES"}
+	var cluster = "ops-prod-vpc9-web"
+	if _, err := s.CreateCluster(cluster); err != nil {
+		t.Fatalf("Expected NO ERROR, Creating [%s] Got: %s", cluster, err)
+	}
+	if _, err := s.SetKey(cluster, "NODES", []string{"web9001.ops.example.com"}, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, SetKey Got: %s", err)
+	}
+
+	// the edit lands right after the rebuild read the cluster data
+	var edited bool
+	var proxy = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if edited || r.Method != "GET" || r.URL.Path != "/v2/keys/" {
+			server.ServeHTTP(w, r)
+			return
+		}
+		edited = true
+		var recorder = httptest.NewRecorder()
+		server.ServeHTTP(recorder, r)
+		if _, err := s.AddKeyValues(cluster, "NODES", []string{"web9002.ops.example.com"}, ""); err != nil {
+			t.Errorf("Expected NO ERROR, AddKeyValues Got: %s", err)
+		}
+		for k, v := range recorder.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+	}))
+	defer proxy.Close()
+	var rebuilder = NewEtcdStore([]string{proxy.URL}, false, false, "")
+	defer rebuilder.DisconnectEtcdStore()
+	rebuilder.RIndex = s.RIndex
+	if err := rebuilder.reindex(); err != nil {
+		t.Fatal("reindex ", err)
+	}
+	if !edited {
+		t.Fatalf("Expected the edit to be made during the rebuild")
+	}
+	if results, err := s.optimizedNodeReverseLookup("web9002.ops.example.com"); err != nil || !compare(*results, []string{cluster}) {
+		t.Errorf("Expected [%s] in _roptimize, Got: %v (Error: %v)", cluster, results, err)
+	}
+	if results, err := s.KeyReverseLookupAttr("web9002.ops.example.com", "NODES"); err != nil || !compare(*results, []string{cluster}) {
+		t.Errorf("Expected [%s] in the reverse index, Got: %v (Error: %v)", cluster, results, err)
+	}
+}
+
+// mirror, lookups served from memory should be same as from etcd and
+// should follow the changes made in etcd
+func TestMirror(t *testing.T) {
+	m, err := ConnectEtcdStore(e.hosts, false, false, "")
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, ConnectEtcdStore (Error: %s)", err)
+	}
+	defer m.DisconnectEtcdStore()
+	err = m.StartMirror()
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, StartMirror (Error: %s)", err)
+	}
+
+	var cluster = []string{"ops-prod-vpc1"}
+	expected, _ := e.ClusterLookup(&cluster)
+	result, err := m.ClusterLookup(&cluster)
+	if err != nil || !compare(*result, *expected) {
+		t.Errorf("Expected NO ERROR, Cluster: %s, Expected: %s, Got: %s (Error: %s)", cluster, *expected, *result, err)
+	}
+
+	cluster = []string{"data-qa-vpc5-log"}
+	expected, _ = e.KeyLookup(&cluster, "KEYS")
+	result, err = m.KeyLookup(&cluster, "KEYS")
+	if err != nil || !compare(*result, *expected) {
+		t.Errorf("Expected NO ERROR, (Cluster: %s, Key: KEYS) Expected: %s, Got: %s (Error: %s)", cluster, *expected, *result, err)
+	}
+
+	expected, _ = e.KeyReverseLookupHint("data@example.com", "AUTHORS", "data")
+	result, err = m.KeyReverseLookupHint("data@example.com", "AUTHORS", "data")
+	if err != nil || !compare(*result, *expected) {
+		t.Errorf("Expected NO ERROR, (Key: data@example.com, Attr: AUTHORS, Hint: data) Expected: %s, Got: %s (Error: %s)", *expected, *result, err)
+	}
+
+	// a new cluster in etcd should show up in the mirror
+	_, err = e.client.Set("/ops/prod/vpc9/mirror/NODES", "mirror9001.ops.example.com", 0)
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, Set (Error: %s)", err)
+	}
+	_, _ = e.client.Set("/ops/prod/vpc9/mirror/_leaf", "_leaf", 0)
+	defer e.client.Delete("/ops/prod/vpc9", true)
+
+	cluster = []string{"ops-prod-vpc9-mirror"}
+	expected = &[]string{"mirror9001.ops.example.com"}
+	if !waitFor(func() bool { result, err = m.ClusterLookup(&cluster); return err == nil && compare(*result, *expected) }) {
+		t.Errorf("Expected NO ERROR, Cluster: %s, Expected: %s, Got: %s (Error: %s)", cluster, *expected, *result, err)
+	}
+
+	// and go away when deleted
+	_, _ = e.client.Delete("/ops/prod/vpc9", true)
+	if !waitFor(func() bool { _, err = m.ClusterLookup(&cluster); return err != nil }) {
+		t.Errorf("Expected ERROR, Cluster: %s was deleted", cluster)
+	}
+
+	for _, status := range m.MirrorStatus() {
+		if status.Index == 0 || status.Stale != 0 {
+			t.Errorf("Expected mirror of [%s] to be current, Got: %+v", status.Prefix, status)
+		}
+	}
+}
+
 // Internal Functions
 
+// poll for the condition to be true, the mirror follows etcd asynchronously
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
 // Compare 2 Arrays, items need not be in correct order
 func compare(arr1, arr2 []string) bool {
 	if len(arr1) != len(arr2) {
@@ -290,3 +602,35 @@ func compare(arr1, arr2 []string) bool {
 
 	return true
 }
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, e)
+	// the reverse lookups of the nodes are done on the index
+	optimized, err := ConnectEtcdStore(e.hosts, true, false, "")
+	if err != nil {
+		t.Fatal("ConnectEtcdStore ", err)
+	}
+	defer optimized.DisconnectEtcdStore()
+	storetest.Run(t, optimized)
+	fast, err := ConnectEtcdStore(e.hosts, false, true, "")
+	if err != nil {
+		t.Fatal("ConnectEtcdStore ", err)
+	}
+	defer fast.DisconnectEtcdStore()
+	storetest.RunFast(t, fast)
+}
+
+// the store scoped to a query, the leaf clusters walked by a reverse lookup
+// are store calls and the requests (given up at the deadline) answer the same
+func TestScope(t *testing.T) {
+	var limited = rangestore.NewLimitedStore(e, rangestore.Limits{MaxCalls: 4})
+	var limitErr *rangestore.LimitError
+	if _, err := limited.KeyReverseLookupAttr("Ops", "AUTHORS"); !errors.As(err, &limitErr) || limitErr.Limit != rangestore.LimitCalls {
+		t.Errorf("Expected maxcalls to be hit, Got: %v", err)
+	}
+	limited = rangestore.NewLimitedStore(e, rangestore.Limits{MaxCalls: 4})
+	if results, err := limited.KeyReverseLookupHint("Ops", "AUTHORS", "ops-prod-vpc1"); err != nil || len(*results) != 1 {
+		t.Errorf("Expected ops-prod-vpc1-mon, Got: %v (Error: %v)", results, err)
+	}
+	storetest.Run(t, rangestore.NewLimitedStore(e, rangestore.Limits{Timeout: time.Minute}))
+}
@@ -0,0 +1,692 @@
+// An in-process fake of the etcd v2 keys API, so that EtcdStore (and the
+// programs loading data into etcd) can be tested without running a real
+// etcd. Only the subset go-etcd uses is implemented, ie, get/set/delete,
+// dirs, recursive listing, compare-and-swap/delete, TTLs and watches.
+//
+// Usage:
+//   s := etcdtest.NewServer()
+//   defer s.Close()
+//   client := etcd.NewClient(s.Machines())
+
+package etcdtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etcd error codes we emulate
+const (
+	ecodeKeyNotFound       = 100
+	ecodeTestFailed        = 101
+	ecodeNotFile           = 102
+	ecodeNotDir            = 104
+	ecodeNodeExist         = 105
+	ecodeRootROnly         = 107
+	ecodeDirNotEmpty       = 108
+	ecodeTTLNaN            = 202
+	ecodeIndexNaN          = 203
+	ecodeEventIndexCleared = 401
+)
+
+var errorMessages = map[int]string{
+	ecodeKeyNotFound:       "Key not found",
+	ecodeTestFailed:        "Compare failed",
+	ecodeNotFile:           "Not a file",
+	ecodeNotDir:            "Not a directory",
+	ecodeNodeExist:         "Key already exists",
+	ecodeRootROnly:         "Root is read only",
+	ecodeDirNotEmpty:       "Directory not empty",
+	ecodeTTLNaN:            "The given TTL in POST form is not a number",
+	ecodeIndexNaN:          "The given index in POST form is not a number",
+	ecodeEventIndexCleared: "The event in requested index is outdated and cleared",
+}
+
+// same mapping etcd does from error codes to http status
+var errorStatus = map[int]int{
+	ecodeKeyNotFound: http.StatusNotFound,
+	ecodeNotFile:     http.StatusForbidden,
+	ecodeDirNotEmpty: http.StatusForbidden,
+	ecodeRootROnly:   http.StatusForbidden,
+	ecodeTestFailed:  http.StatusPreconditionFailed,
+	ecodeNodeExist:   http.StatusPreconditionFailed,
+}
+
+// number of events kept for watchers asking for an older index
+const defaultHistory = 1000
+
+type Server struct {
+	URL         string // http://127.0.0.1:port of the fake
+	HistorySize int    // number of events kept for watches (default: 1000)
+
+	server   *httptest.Server
+	mu       sync.Mutex
+	index    uint64
+	root     *node
+	history  []*event
+	watchers map[*watcher]bool
+	stop     chan bool
+}
+
+type node struct {
+	key        string
+	value      string
+	dir        bool
+	children   map[string]*node
+	created    uint64
+	modified   uint64
+	expiration *time.Time
+}
+
+// json representation, field names are the same as etcd's
+type jsonNode struct {
+	Key           string      `json:"key,omitempty"`
+	Value         string      `json:"value,omitempty"`
+	Dir           bool        `json:"dir,omitempty"`
+	Expiration    *time.Time  `json:"expiration,omitempty"`
+	TTL           int64       `json:"ttl,omitempty"`
+	Nodes         []*jsonNode `json:"nodes,omitempty"`
+	ModifiedIndex uint64      `json:"modifiedIndex,omitempty"`
+	CreatedIndex  uint64      `json:"createdIndex,omitempty"`
+}
+
+type event struct {
+	Action   string    `json:"action"`
+	Node     *jsonNode `json:"node"`
+	PrevNode *jsonNode `json:"prevNode,omitempty"`
+	index    uint64
+}
+
+type etcdError struct {
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+	Cause     string `json:"cause,omitempty"`
+	Index     uint64 `json:"index"`
+}
+
+type watcher struct {
+	key       string
+	recursive bool
+	waitIndex uint64
+	events    chan *event
+}
+
+// starts a fake etcd listening on a random local port
+func NewServer() *Server {
+	s := newServer()
+	s.server = httptest.NewServer(s)
+	s.start()
+	return s
+}
+
+// starts a fake etcd listening on addr (eg, 127.0.0.1:13824), for the
+// programs to try out
+func NewServerAt(addr string) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := newServer()
+	s.server = httptest.NewUnstartedServer(s)
+	s.server.Listener.Close()
+	s.server.Listener = l
+	s.server.Start()
+	s.start()
+	return s, nil
+}
+
+func newServer() *Server {
+	return &Server{
+		HistorySize: defaultHistory,
+		root:        &node{key: "/", dir: true, children: make(map[string]*node)},
+		watchers:    make(map[*watcher]bool),
+		stop:        make(chan bool),
+	}
+}
+
+func (s *Server) start() {
+	s.URL = s.server.URL
+	go s.expireLoop()
+}
+
+// list of machines to be passed to etcd.NewClient
+func (s *Server) Machines() []string {
+	return []string{s.URL}
+}
+
+// current etcd index
+func (s *Server) Index() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index
+}
+
+// forget the event history, watches asking for an index before
+// the current one will be told the index is cleared (error 401)
+func (s *Server) Compact() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = s.history[:0]
+}
+
+// stop the server, pending watches are released first
+func (s *Server) Close() {
+	close(s.stop)
+	s.server.Close()
+}
+
+// handler for the keys api
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v2/machines":
+		fmt.Fprint(w, s.URL)
+		return
+	case r.URL.Path == "/version":
+		fmt.Fprint(w, "etcd 2.0.0 (etcdtest)")
+		return
+	case !strings.HasPrefix(r.URL.Path, "/v2/keys"):
+		http.NotFound(w, r)
+		return
+	}
+
+	key := cleanKey(strings.TrimPrefix(r.URL.Path, "/v2/keys"))
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if r.Form.Get("wait") == "true" {
+			s.watch(w, r, key)
+			return
+		}
+		s.get(w, r, key)
+	case "PUT":
+		s.put(w, r, key)
+	case "POST":
+		s.post(w, r, key)
+	case "DELETE":
+		s.delete(w, r, key)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+//////////////
+// HANDLERS //
+//////////////
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+
+	n := s.lookup(key)
+	if n == nil {
+		s.writeError(w, s.index, ecodeKeyNotFound, key)
+		return
+	}
+	recursive := r.Form.Get("recursive") == "true"
+	sorted := r.Form.Get("sorted") == "true"
+	s.writeEvent(w, http.StatusOK, s.index, &event{Action: "get", Node: n.repr(true, recursive, sorted)})
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.expire(now)
+
+	if key == "/" {
+		s.writeError(w, s.index, ecodeRootROnly, key)
+		return
+	}
+
+	expiration, ok := parseTTL(r.Form.Get("ttl"), now)
+	if !ok {
+		s.writeError(w, s.index, ecodeTTLNaN, key)
+		return
+	}
+	var prevIndex uint64
+	if i := r.Form.Get("prevIndex"); i != "" {
+		var err error
+		if prevIndex, err = strconv.ParseUint(i, 10, 64); err != nil {
+			s.writeError(w, s.index, ecodeIndexNaN, key)
+			return
+		}
+	}
+	prevValue := r.Form.Get("prevValue")
+	prevExist := r.Form.Get("prevExist")
+	dir := r.Form.Get("dir") == "true"
+	value := r.Form.Get("value")
+
+	existing := s.lookup(key)
+	var prev *jsonNode
+	if existing != nil {
+		prev = existing.repr(false, false, false)
+	}
+
+	// compare and swap
+	if prevValue != "" || prevIndex != 0 {
+		if existing == nil {
+			s.writeError(w, s.index, ecodeKeyNotFound, key)
+			return
+		}
+		if existing.dir {
+			s.writeError(w, s.index, ecodeNotFile, key)
+			return
+		}
+		if (prevValue != "" && prevValue != existing.value) || (prevIndex != 0 && prevIndex != existing.modified) {
+			s.writeError(w, s.index, ecodeTestFailed, fmt.Sprintf("[%s != %s] [%d != %d]", prevValue, existing.value, prevIndex, existing.modified))
+			return
+		}
+		s.index++
+		existing.value = value
+		existing.modified = s.index
+		existing.expiration = expiration
+		s.writeEvent(w, http.StatusOK, s.index, s.record(&event{Action: "compareAndSwap", Node: existing.repr(false, false, false), PrevNode: prev}))
+		return
+	}
+
+	switch prevExist {
+	case "false":
+		if existing != nil {
+			s.writeError(w, s.index, ecodeNodeExist, key)
+			return
+		}
+	case "true":
+		if existing == nil {
+			s.writeError(w, s.index, ecodeKeyNotFound, key)
+			return
+		}
+		if existing.dir != dir {
+			s.writeError(w, s.index, ecodeNotFile, key)
+			return
+		}
+		// update
+		s.index++
+		existing.value = value
+		existing.modified = s.index
+		existing.expiration = expiration
+		s.writeEvent(w, http.StatusOK, s.index, s.record(&event{Action: "update", Node: existing.repr(false, false, false), PrevNode: prev}))
+		return
+	}
+
+	// set or create
+	if existing != nil && existing.dir {
+		s.writeError(w, s.index, ecodeNotFile, key)
+		return
+	}
+	parent, code := s.mkdirs(path.Dir(key))
+	if code != 0 {
+		s.writeError(w, s.index, code, key)
+		return
+	}
+	s.index++
+	n := &node{key: key, value: value, dir: dir, created: s.index, modified: s.index, expiration: expiration}
+	if dir {
+		n.value = ""
+		n.children = make(map[string]*node)
+	}
+	parent.children[path.Base(key)] = n
+
+	var action = "set"
+	if prevExist == "false" {
+		action = "create"
+	}
+	var status = http.StatusCreated
+	if existing != nil {
+		status = http.StatusOK
+	}
+	s.writeEvent(w, status, s.index, s.record(&event{Action: action, Node: n.repr(false, false, false), PrevNode: prev}))
+}
+
+// in order keys
+func (s *Server) post(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.expire(now)
+
+	expiration, ok := parseTTL(r.Form.Get("ttl"), now)
+	if !ok {
+		s.writeError(w, s.index, ecodeTTLNaN, key)
+		return
+	}
+	parent, code := s.mkdirs(key)
+	if code != 0 {
+		s.writeError(w, s.index, code, key)
+		return
+	}
+	s.index++
+	name := fmt.Sprintf("%020d", s.index)
+	n := &node{key: path.Join(key, name), value: r.Form.Get("value"), created: s.index, modified: s.index, expiration: expiration}
+	parent.children[name] = n
+	s.writeEvent(w, http.StatusCreated, s.index, s.record(&event{Action: "create", Node: n.repr(false, false, false)}))
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+
+	if key == "/" {
+		s.writeError(w, s.index, ecodeRootROnly, key)
+		return
+	}
+	n := s.lookup(key)
+	if n == nil {
+		s.writeError(w, s.index, ecodeKeyNotFound, key)
+		return
+	}
+
+	var prevIndex uint64
+	if i := r.Form.Get("prevIndex"); i != "" {
+		var err error
+		if prevIndex, err = strconv.ParseUint(i, 10, 64); err != nil {
+			s.writeError(w, s.index, ecodeIndexNaN, key)
+			return
+		}
+	}
+	prevValue := r.Form.Get("prevValue")
+	recursive := r.Form.Get("recursive") == "true"
+	dir := r.Form.Get("dir") == "true"
+
+	var action = "delete"
+	if prevValue != "" || prevIndex != 0 {
+		if n.dir {
+			s.writeError(w, s.index, ecodeNotFile, key)
+			return
+		}
+		if (prevValue != "" && prevValue != n.value) || (prevIndex != 0 && prevIndex != n.modified) {
+			s.writeError(w, s.index, ecodeTestFailed, fmt.Sprintf("[%s != %s] [%d != %d]", prevValue, n.value, prevIndex, n.modified))
+			return
+		}
+		action = "compareAndDelete"
+	}
+
+	if n.dir {
+		if !dir && !recursive {
+			s.writeError(w, s.index, ecodeNotFile, key)
+			return
+		}
+		if !recursive && len(n.children) > 0 {
+			s.writeError(w, s.index, ecodeDirNotEmpty, key)
+			return
+		}
+	}
+
+	prev := n.repr(false, false, false)
+	s.remove(key)
+	s.index++
+	s.writeEvent(w, http.StatusOK, s.index, s.record(&event{Action: action, Node: &jsonNode{Key: key, Dir: n.dir, ModifiedIndex: s.index, CreatedIndex: n.created}, PrevNode: prev}))
+}
+
+// wait for a change on the key (or below it, when recursive)
+func (s *Server) watch(w http.ResponseWriter, r *http.Request, key string) {
+	wt := &watcher{key: key, recursive: r.Form.Get("recursive") == "true", events: make(chan *event, 1)}
+
+	s.mu.Lock()
+	s.expire(time.Now())
+	var index = s.index
+	if i := r.Form.Get("waitIndex"); i != "" {
+		var err error
+		if wt.waitIndex, err = strconv.ParseUint(i, 10, 64); err != nil {
+			s.mu.Unlock()
+			s.writeError(w, index, ecodeIndexNaN, key)
+			return
+		}
+	}
+	// the event could have happened already
+	if wt.waitIndex > 0 && wt.waitIndex <= s.index {
+		if s.oldest() > wt.waitIndex {
+			var cause = fmt.Sprintf("the requested history has been cleared [%d/%d]", s.oldest(), wt.waitIndex)
+			s.mu.Unlock()
+			s.writeError(w, index, ecodeEventIndexCleared, cause)
+			return
+		}
+		for _, e := range s.history {
+			if wt.matches(e) {
+				s.mu.Unlock()
+				s.writeEvent(w, http.StatusOK, index, e)
+				return
+			}
+		}
+	}
+	s.watchers[wt] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, wt)
+		s.mu.Unlock()
+	}()
+
+	select {
+	case e := <-wt.events:
+		s.writeEvent(w, http.StatusOK, e.index, e)
+	case <-r.Context().Done():
+	case <-s.stop:
+	}
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// walk down the tree, nil if the key does not exist
+func (s *Server) lookup(key string) *node {
+	n := s.root
+	if key == "/" {
+		return n
+	}
+	for _, part := range strings.Split(key[1:], "/") {
+		if !n.dir {
+			return nil
+		}
+		child, ok := n.children[part]
+		if !ok {
+			return nil
+		}
+		n = child
+	}
+	return n
+}
+
+// create all the dirs in the path, returns the last one
+func (s *Server) mkdirs(dir string) (*node, int) {
+	n := s.root
+	if dir == "/" {
+		return n, 0
+	}
+	for _, part := range strings.Split(dir[1:], "/") {
+		child, ok := n.children[part]
+		if !ok {
+			s.index++
+			child = &node{key: path.Join(n.key, part), dir: true, children: make(map[string]*node), created: s.index, modified: s.index}
+			n.children[part] = child
+		} else if !child.dir {
+			return nil, ecodeNotDir
+		}
+		n = child
+	}
+	return n, 0
+}
+
+// unlink the node from its parent
+func (s *Server) remove(key string) {
+	if parent := s.lookup(path.Dir(key)); parent != nil {
+		delete(parent.children, path.Base(key))
+	}
+}
+
+// remove the expired nodes, generating expire events
+func (s *Server) expire(now time.Time) {
+	var expired = make([]*node, 0)
+	var walk func(n *node)
+	walk = func(n *node) {
+		for _, child := range n.children {
+			if child.expiration != nil && !child.expiration.After(now) {
+				expired = append(expired, child)
+				continue
+			}
+			if child.dir {
+				walk(child)
+			}
+		}
+	}
+	walk(s.root)
+	for _, n := range expired {
+		prev := n.repr(false, false, false)
+		s.remove(n.key)
+		s.index++
+		s.record(&event{Action: "expire", Node: &jsonNode{Key: n.key, Dir: n.dir, ModifiedIndex: s.index, CreatedIndex: n.created}, PrevNode: prev})
+	}
+}
+
+// expire the TTLs in the background, so that watchers are told
+func (s *Server) expireLoop() {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			s.expire(now)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// keep the event in the history and tell the watchers
+func (s *Server) record(e *event) *event {
+	e.index = s.index
+	s.history = append(s.history, e)
+	if size := s.HistorySize; size > 0 && len(s.history) > size {
+		s.history = s.history[len(s.history)-size:]
+	}
+	for wt := range s.watchers {
+		if wt.matches(e) {
+			select {
+			case wt.events <- e:
+			default: // already notified
+			}
+			delete(s.watchers, wt)
+		}
+	}
+	return e
+}
+
+// oldest index we still have in the history
+func (s *Server) oldest() uint64 {
+	if len(s.history) == 0 {
+		return s.index + 1
+	}
+	return s.history[0].index
+}
+
+// whether this event is for the watcher. Like etcd, changes to hidden
+// nodes (names starting with '_') are not seen by recursive watchers
+// on a parent
+func (wt *watcher) matches(e *event) bool {
+	if e.index < wt.waitIndex {
+		return false
+	}
+	if e.Node.Key == wt.key {
+		return true
+	}
+	if !wt.recursive {
+		return false
+	}
+	prefix := wt.key
+	if prefix != "/" {
+		prefix += "/"
+	}
+	if !strings.HasPrefix(e.Node.Key, prefix) {
+		return false
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(e.Node.Key, prefix), "/") {
+		if strings.HasPrefix(part, "_") {
+			return false
+		}
+	}
+	return true
+}
+
+// json representation of the node, hidden children are not listed
+func (n *node) repr(top, recursive, sorted bool) *jsonNode {
+	j := &jsonNode{Key: n.key, Value: n.value, Dir: n.dir, ModifiedIndex: n.modified, CreatedIndex: n.created}
+	if n.key == "/" {
+		j.Key = ""
+	}
+	if n.expiration != nil {
+		j.Expiration = n.expiration
+		j.TTL = int64(n.expiration.Sub(time.Now())/time.Second) + 1
+	}
+	if !n.dir || !(top || recursive) {
+		return j
+	}
+	for name, child := range n.children {
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		j.Nodes = append(j.Nodes, child.repr(false, recursive, sorted))
+	}
+	if sorted {
+		sort.Slice(j.Nodes, func(a, b int) bool { return j.Nodes[a].Key < j.Nodes[b].Key })
+	}
+	return j
+}
+
+func (s *Server) writeEvent(w http.ResponseWriter, status int, index uint64, e *event) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", fmt.Sprintf("%d", index))
+	w.Header().Set("X-Raft-Index", fmt.Sprintf("%d", index))
+	w.Header().Set("X-Raft-Term", "1")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, index uint64, code int, cause string) {
+	status, ok := errorStatus[code]
+	if !ok {
+		status = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", fmt.Sprintf("%d", index))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&etcdError{ErrorCode: code, Message: errorMessages[code], Cause: cause, Index: index})
+}
+
+// keys are always absolute and without trailing '/'
+func cleanKey(key string) string {
+	return path.Clean("/" + key)
+}
+
+// ttl in seconds, empty means no ttl
+func parseTTL(ttl string, now time.Time) (*time.Time, bool) {
+	if ttl == "" {
+		return nil, true
+	}
+	seconds, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil || seconds < 0 {
+		return nil, false
+	}
+	if seconds == 0 {
+		return nil, true
+	}
+	expiration := now.Add(time.Duration(seconds) * time.Second)
+	return &expiration, true
+}
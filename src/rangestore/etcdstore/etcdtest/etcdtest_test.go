@@ -0,0 +1,140 @@
+package etcdtest
+
+import (
+	"github.com/coreos/go-etcd/etcd"
+	"testing"
+	"time"
+)
+
+func connect(t *testing.T) (*Server, *etcd.Client) {
+	var s = NewServer()
+	t.Cleanup(s.Close)
+	var client = etcd.NewClient(s.Machines())
+	t.Cleanup(client.Close)
+	return s, client
+}
+
+func code(err error) int {
+	if e, ok := err.(*etcd.EtcdError); ok {
+		return e.ErrorCode
+	}
+	return 0
+}
+
+func TestKeys(t *testing.T) {
+	_, client := connect(t)
+
+	if _, err := client.Set("/ops/prod/NODES", "mon1001", 0); err != nil {
+		t.Fatal("Set ", err)
+	}
+	if _, err := client.Set("/ops/prod/_leaf", "_leaf", 0); err != nil {
+		t.Fatal("Set ", err)
+	}
+	response, err := client.Get("/ops/prod/NODES", false, false)
+	if err != nil || response.Node.Value != "mon1001" {
+		t.Errorf("Expected mon1001, Got: %v (Error: %v)", response, err)
+	}
+	// the dirs on the way are created, the hidden nodes are not listed
+	response, err = client.Get("/", true, true)
+	if err != nil || len(response.Node.Nodes) != 1 || len(response.Node.Nodes[0].Nodes) != 1 || len(response.Node.Nodes[0].Nodes[0].Nodes) != 1 {
+		t.Errorf("Expected /ops/prod/NODES alone, Got: %+v (Error: %v)", response, err)
+	}
+	if _, err = client.Get("/ops/prod/_leaf", false, false); err != nil {
+		t.Errorf("Expected the hidden node, Got: %v", err)
+	}
+
+	if _, err = client.Create("/ops/prod/NODES", "mon1002", 0); code(err) != ecodeNodeExist {
+		t.Errorf("Expected Node Exist, Got: %v", err)
+	}
+	if _, err = client.CreateDir("/ops/prod/NODES/x", 0); code(err) != ecodeNotDir {
+		t.Errorf("Expected Not a Dir, Got: %v", err)
+	}
+	if _, err = client.DeleteDir("/ops"); code(err) != ecodeDirNotEmpty {
+		t.Errorf("Expected Dir Not Empty, Got: %v", err)
+	}
+	if _, err = client.Delete("/ops", true); err != nil {
+		t.Errorf("Expected the recursive Delete, Got: %v", err)
+	}
+	if _, err = client.Get("/ops/prod/NODES", false, false); code(err) != ecodeKeyNotFound {
+		t.Errorf("Expected Key Not Found, Got: %v", err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	_, client := connect(t)
+
+	response, err := client.Set("/ops/VERSION", "1", 0)
+	if err != nil {
+		t.Fatal("Set ", err)
+	}
+	var index = response.Node.ModifiedIndex
+	if _, err = client.CompareAndSwap("/ops/VERSION", "2", 0, "", index); err != nil {
+		t.Errorf("Expected the swap on the index, Got: %v", err)
+	}
+	if _, err = client.CompareAndSwap("/ops/VERSION", "3", 0, "", index); code(err) != ecodeTestFailed {
+		t.Errorf("Expected Compare Failed on the old index, Got: %v", err)
+	}
+	if _, err = client.CompareAndSwap("/ops/VERSION", "3", 0, "2", 0); err != nil {
+		t.Errorf("Expected the swap on the value, Got: %v", err)
+	}
+	if _, err = client.CompareAndDelete("/ops/VERSION", "2", 0); code(err) != ecodeTestFailed {
+		t.Errorf("Expected Compare Failed on the old value, Got: %v", err)
+	}
+	if _, err = client.CompareAndDelete("/ops/VERSION", "3", 0); err != nil {
+		t.Errorf("Expected the delete on the value, Got: %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	_, client := connect(t)
+
+	if _, err := client.Set("/_ephemeral/ops/web1001", "ops", 1); err != nil {
+		t.Fatal("Set ", err)
+	}
+	response, err := client.Get("/_ephemeral/ops/web1001", false, false)
+	if err != nil || response.Node.TTL < 1 || response.Node.Expiration == nil {
+		t.Errorf("Expected the TTL, Got: %+v (Error: %v)", response, err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, err = client.Get("/_ephemeral/ops/web1001", false, false); code(err) != ecodeKeyNotFound {
+		t.Errorf("Expected the key to expire, Got: %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s, client := connect(t)
+
+	// an event which happened already
+	if _, err := client.Set("/ops/prod/NODES", "mon1001", 0); err != nil {
+		t.Fatal("Set ", err)
+	}
+	response, err := client.Watch("/ops", s.Index(), true, nil, nil)
+	if err != nil || response.Action != "set" || response.Node.Key != "/ops/prod/NODES" {
+		t.Errorf("Expected the set of /ops/prod/NODES, Got: %+v (Error: %v)", response, err)
+	}
+
+	// an event to come, the hidden nodes are not seen
+	var next = s.Index() + 1
+	var received = make(chan *etcd.Response, 1)
+	go func() {
+		response, _ := client.Watch("/ops", next, true, nil, nil)
+		received <- response
+	}()
+	time.Sleep(100 * time.Millisecond)
+	client.Set("/ops/prod/_leaf", "_leaf", 0)
+	client.Delete("/ops/prod/NODES", false)
+	select {
+	case response := <-received:
+		if response == nil || response.Action != "delete" || response.Node.Key != "/ops/prod/NODES" {
+			t.Errorf("Expected the delete of /ops/prod/NODES, Got: %+v", response)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected the delete of /ops/prod/NODES, Got: nothing")
+	}
+
+	// the history is gone
+	s.Compact()
+	if _, err = client.Watch("/ops", 1, true, nil, nil); code(err) != ecodeEventIndexCleared {
+		t.Errorf("Expected Event Index Cleared, Got: %v", err)
+	}
+}
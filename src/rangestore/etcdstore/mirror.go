@@ -0,0 +1,434 @@
+// A local mirror of the etcd store. The mirror is bootstrapped with a
+// recursive Get and kept current with a recursive Watch, lookups are then
+// served from memory instead of doing a round-trip per Get.
+
+// NOTE:
+// etcd does not return hidden nodes (names starting with '_') in listings,
+// nor does it tell a recursive watcher about them. This means we never
+// see the _leaf markers, so a dir is considered a leaf when it holds
+// key/value nodes and a non-leaf when it holds only dirs. For an empty dir
+// we can't tell and such lookups are passed through to etcd.
+
+package etcdstore
+
+import (
+	"github.com/coreos/go-etcd/etcd"
+	"log"
+	"path"
+	"rangestore"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long to wait before re-establishing a failed watch
+const _rewatch = time.Second
+
+// etcd error code when the index we watch from is no more in etcd's history
+const _indexCleared = 401
+
+// MirrorStatus tells how current a mirror is
+type MirrorStatus struct {
+	Prefix  string        // etcd dir being mirrored
+	Index   uint64        // etcd index the mirror has applied
+	Synced  time.Time     // last time the mirror did a full sync
+	Stale   time.Duration // how long the mirror has not been following etcd (0 if it is)
+	Behind  uint64        // number of etcd events missed before the last resync
+	Resyncs int           // number of times the mirror had to resync
+}
+
+type mirror struct {
+	sync.RWMutex
+	prefix  string       // etcd dir being mirrored
+	client  *etcd.Client // etcd connection object
+	root    *mirrorNode  // the tree under prefix
+	index   uint64       // etcd index the mirror has applied
+	synced  time.Time    // last full sync
+	broken  time.Time    // when did the watch fail, zero if it is healthy
+	behind  uint64       // events missed before the last resync
+	resyncs int          // number of resyncs
+	stop    chan bool    // closed to stop watching
+	hits    uint64       // lookups served from the mirror (atomic)
+	misses  uint64       // lookups the mirror couldn't serve (atomic)
+}
+
+type mirrorNode struct {
+	value    string
+	dir      bool
+	modified uint64
+	created  uint64
+	children map[string]*mirrorNode
+}
+
+// StartMirror bootstraps a local mirror of the store (and of the reverse
+// lookup optimization and index, and the registered nodes) and keeps it
+// current in the background.
+// Once started, all the lookups are served from memory.
+func (e *EtcdStore) StartMirror() error {
+	var prefixes = []string{e.storenode, _roptimize, e.storenode + _rindex, e.storenode + _ephemeral}
+	for _, prefix := range prefixes {
+		m := newMirror(e.client, prefix)
+		if err := m.sync(); err != nil {
+			e.stopMirrors()
+			return err
+		}
+		go m.follow()
+		e.mirrors = append(e.mirrors, m)
+	}
+	return nil
+}
+
+// MirrorStatus reports how current each of the mirrors is, empty if
+// the store is not mirrored
+func (e *EtcdStore) MirrorStatus() []MirrorStatus {
+	var status = make([]MirrorStatus, 0)
+	for _, m := range e.mirrors {
+		status = append(status, m.status())
+	}
+	return status
+}
+
+// stop all the mirrors, lookups will go to etcd again
+func (e *EtcdStore) stopMirrors() {
+	for _, m := range e.mirrors {
+		close(m.stop)
+	}
+	e.mirrors = nil
+}
+
+// the mirror which can answer for this object, nil if none. Hidden
+// objects are not mirrored (except _leaf which is inferred)
+func (e *EtcdStore) mirrorFor(object string) *mirror {
+	var key = cleanKey(object)
+	var found *mirror
+	for _, m := range e.mirrors {
+		rel, ok := relativeKey(m.prefix, key)
+		if !ok || (found != nil && len(found.prefix) > len(m.prefix)) {
+			continue
+		}
+		var parts = strings.Split(rel, "/")
+		var hidden bool
+		for i, part := range parts {
+			if strings.HasPrefix(part, "_") && !(i == len(parts)-1 && part == _leaf) {
+				hidden = true
+				break
+			}
+		}
+		if !hidden {
+			found = m
+		}
+	}
+	return found
+}
+
+// CacheStats of the mirrors, lookups served from memory are the hits
+func (e *EtcdStore) CacheStats() rangestore.CacheStats {
+	var stats rangestore.CacheStats
+	for _, m := range e.mirrors {
+		stats.Hits += atomic.LoadUint64(&m.hits)
+		stats.Misses += atomic.LoadUint64(&m.misses)
+	}
+	return stats
+}
+
+// count the lookup as a hit (the mirror could answer) or a miss
+func (m *mirror) count(hit bool) {
+	if hit {
+		atomic.AddUint64(&m.hits, 1)
+	} else {
+		atomic.AddUint64(&m.misses, 1)
+	}
+}
+
+///////////////
+// MIRRORING //
+///////////////
+
+func newMirror(client *etcd.Client, prefix string) *mirror {
+	return &mirror{
+		prefix: cleanKey(prefix),
+		client: client,
+		root:   &mirrorNode{dir: true, children: make(map[string]*mirrorNode)},
+		stop:   make(chan bool),
+	}
+}
+
+// full sync of the mirror with a recursive Get
+func (m *mirror) sync() error {
+	var root = &mirrorNode{dir: true, children: make(map[string]*mirrorNode)}
+	var index uint64
+	response, err := m.client.Get(m.prefix, false, true)
+	if err != nil {
+		etcdErr, ok := err.(*etcd.EtcdError)
+		if !ok || etcdErr.ErrorCode != 100 {
+			return err
+		}
+		// nothing to mirror yet, we will see it come in the watch
+		index = etcdErr.Index
+	} else {
+		root = newMirrorNode(response.Node)
+		index = response.EtcdIndex
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.root = root
+	m.index = index
+	m.synced = time.Now()
+	return nil
+}
+
+// watch etcd and apply the changes to the mirror, until stopped.
+// If etcd has cleared the index we are watching from, do a resync
+func (m *mirror) follow() {
+	for {
+		var receiver = make(chan *etcd.Response)
+		var done = make(chan error, 1)
+		m.RLock()
+		var waitIndex = m.index + 1
+		m.RUnlock()
+		go func() {
+			_, err := m.client.Watch(m.prefix, waitIndex, true, receiver, m.stop)
+			done <- err
+		}()
+		for response := range receiver {
+			m.apply(response)
+		}
+		err := <-done
+
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+
+		m.Lock()
+		if m.broken.IsZero() {
+			m.broken = time.Now()
+		}
+		m.Unlock()
+
+		if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == _indexCleared {
+			m.resync(etcdErr.Index)
+			continue
+		}
+		log.Printf("ERROR: Mirror of [%s] lost its watch, retrying (Error: %s)\n", m.prefix, err)
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(_rewatch):
+		}
+	}
+}
+
+// the index we were following is gone, so we have missed changes.
+// record how far behind we were and reload everything
+func (m *mirror) resync(current uint64) {
+	m.Lock()
+	var behind uint64
+	if current > m.index {
+		behind = current - m.index
+	}
+	var stale = time.Since(m.broken)
+	m.Unlock()
+
+	log.Printf("WARN: Mirror of [%s] missed %d events and was stale for %v, resyncing\n", m.prefix, behind, stale)
+	if err := m.sync(); err != nil {
+		log.Printf("ERROR: Mirror of [%s] failed to resync (Error: %s)\n", m.prefix, err)
+		return
+	}
+
+	m.Lock()
+	m.behind = behind
+	m.resyncs++
+	m.broken = time.Time{}
+	m.Unlock()
+}
+
+// apply a change seen by the watch
+func (m *mirror) apply(response *etcd.Response) {
+	m.Lock()
+	defer m.Unlock()
+
+	// we are following again
+	m.broken = time.Time{}
+	if response.Node.ModifiedIndex > m.index {
+		m.index = response.Node.ModifiedIndex
+	}
+
+	rel, ok := relativeKey(m.prefix, cleanKey(response.Node.Key))
+	if !ok {
+		return
+	}
+
+	switch response.Action {
+	case "set", "create", "update", "compareAndSwap":
+		parent, name := m.mkdirs(rel)
+		if parent == nil {
+			return
+		}
+		node, exists := parent.children[name]
+		if response.Node.Dir {
+			if !exists || !node.dir {
+				node = &mirrorNode{dir: true, children: make(map[string]*mirrorNode)}
+				parent.children[name] = node
+			}
+		} else {
+			node = &mirrorNode{}
+			parent.children[name] = node
+		}
+		node.value = response.Node.Value
+		node.modified = response.Node.ModifiedIndex
+		node.created = response.Node.CreatedIndex
+	case "delete", "compareAndDelete", "expire":
+		if rel == "" {
+			m.root = &mirrorNode{dir: true, children: make(map[string]*mirrorNode)}
+			return
+		}
+		if parent := m.lookup(path.Dir(rel)); parent != nil && parent.dir {
+			delete(parent.children, path.Base(rel))
+		}
+	}
+}
+
+// status of the mirror
+func (m *mirror) status() MirrorStatus {
+	m.RLock()
+	defer m.RUnlock()
+	var stale time.Duration
+	if !m.broken.IsZero() {
+		stale = time.Since(m.broken)
+	}
+	return MirrorStatus{Prefix: m.prefix, Index: m.index, Synced: m.synced, Stale: stale, Behind: m.behind, Resyncs: m.resyncs}
+}
+
+// answer a Get from the mirror. ok is false if the mirror can't tell
+// and the Get has to go to etcd
+func (m *mirror) get(object string, sorted, recursive bool) (response *etcd.Response, found bool, ok bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	var key = cleanKey(object)
+	rel, _ := relativeKey(m.prefix, key)
+
+	// _leaf markers are not mirrored, infer them
+	if path.Base(rel) == _leaf {
+		var parent = m.lookup(path.Dir(rel))
+		if parent == nil || !parent.dir {
+			return nil, false, true
+		}
+		isLeaf, known := parent.isLeaf()
+		if !known {
+			return nil, false, false
+		}
+		if !isLeaf {
+			return nil, false, true
+		}
+		return &etcd.Response{Action: "get", Node: &etcd.Node{Key: key}, EtcdIndex: m.index}, true, true
+	}
+
+	var node = m.lookup(rel)
+	if node == nil {
+		return nil, false, true
+	}
+	return &etcd.Response{Action: "get", Node: node.toEtcd(key, true, recursive, sorted), EtcdIndex: m.index}, true, true
+}
+
+// walk down the mirror, nil if not there
+func (m *mirror) lookup(rel string) *mirrorNode {
+	var node = m.root
+	if rel == "" || rel == "." {
+		return node
+	}
+	for _, part := range strings.Split(rel, "/") {
+		if !node.dir {
+			return nil
+		}
+		child, ok := node.children[part]
+		if !ok {
+			return nil
+		}
+		node = child
+	}
+	return node
+}
+
+// create the parent dirs of rel, returns the parent and the name
+// of rel in it. nil parent if rel can't be created
+func (m *mirror) mkdirs(rel string) (*mirrorNode, string) {
+	if rel == "" {
+		return nil, ""
+	}
+	var parts = strings.Split(rel, "/")
+	var node = m.root
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := node.children[part]
+		if !ok {
+			child = &mirrorNode{dir: true, children: make(map[string]*mirrorNode)}
+			node.children[part] = child
+		} else if !child.dir {
+			return nil, ""
+		}
+		node = child
+	}
+	return node, parts[len(parts)-1]
+}
+
+// copy of the etcd node tree
+func newMirrorNode(n *etcd.Node) *mirrorNode {
+	var node = &mirrorNode{value: n.Value, dir: n.Dir, modified: n.ModifiedIndex, created: n.CreatedIndex}
+	if n.Dir {
+		node.children = make(map[string]*mirrorNode)
+		for _, child := range n.Nodes {
+			node.children[path.Base(child.Key)] = newMirrorNode(child)
+		}
+	}
+	return node
+}
+
+// dirs holding key/values are leaves, dirs holding only dirs
+// are not. An empty dir could be either
+func (n *mirrorNode) isLeaf() (leaf bool, known bool) {
+	for _, child := range n.children {
+		if !child.dir {
+			return true, true
+		}
+	}
+	return false, len(n.children) > 0
+}
+
+// convert back to what etcd would have returned for a Get
+func (n *mirrorNode) toEtcd(key string, top, recursive, sorted bool) *etcd.Node {
+	var node = &etcd.Node{Key: key, Value: n.value, Dir: n.dir, ModifiedIndex: n.modified, CreatedIndex: n.created}
+	if !n.dir || !(top || recursive) {
+		return node
+	}
+	for name, child := range n.children {
+		node.Nodes = append(node.Nodes, child.toEtcd(path.Join(key, name), false, recursive, sorted))
+	}
+	if sorted {
+		sort.Sort(node.Nodes)
+	}
+	return node
+}
+
+// etcd keys are absolute and have no trailing '/'
+func cleanKey(key string) string {
+	return path.Clean("/" + key)
+}
+
+// key relative to prefix, false if key is not under prefix
+func relativeKey(prefix, key string) (string, bool) {
+	if key == prefix {
+		return "", true
+	}
+	if prefix == "/" {
+		return key[1:], true
+	}
+	if strings.HasPrefix(key, prefix+"/") {
+		return key[len(prefix)+1:], true
+	}
+	return "", false
+}
@@ -0,0 +1,89 @@
+// Changes of the store, for the caches of the lookups (see
+// rangestore.CachingStore). Same as the mirror, the store is followed with
+// a recursive Watch of each of its parts.
+
+package etcdstore
+
+import (
+	"github.com/coreos/go-etcd/etcd"
+	"log"
+	"time"
+)
+
+// Notify calls changed on every change of the store (and of the reverse
+// lookup optimization and index, and the registered nodes), until stop
+// is closed. If etcd can't be reached, it is followed once it can
+func (e *EtcdStore) Notify(changed func(), stop chan bool) error {
+	var prefixes = []string{e.storenode, _roptimize, e.storenode + _rindex, e.storenode + _ephemeral}
+	for _, prefix := range prefixes {
+		index, err := e.currentIndex(prefix)
+		if err != nil {
+			log.Printf("ERROR: Can't follow the changes of [%s] yet (Error: %s)\n", cleanKey(prefix), err)
+		}
+		go e.notify(cleanKey(prefix), index, err == nil, changed, stop)
+	}
+	return nil
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// index of etcd as of now, the changes after it are watched
+func (e *EtcdStore) currentIndex(prefix string) (uint64, error) {
+	response, err := e.client.Get(cleanKey(prefix), false, false)
+	if err != nil {
+		etcdErr, ok := err.(*etcd.EtcdError)
+		if !ok || etcdErr.ErrorCode != 100 {
+			return 0, err
+		}
+		// nothing there yet, we will see it come in the watch
+		return etcdErr.Index, nil
+	}
+	return response.EtcdIndex, nil
+}
+
+// watch the prefix from the index on (known is false if we don't know
+// where etcd is), until stopped. When the watch is lost we can't tell
+// what we missed, so it is told as a change
+func (e *EtcdStore) notify(prefix string, index uint64, known bool, changed func(), stop chan bool) {
+	for {
+		if !known {
+			select {
+			case <-stop:
+				return
+			case <-time.After(_rewatch):
+			}
+			current, err := e.currentIndex(prefix)
+			if err != nil {
+				continue
+			}
+			// whatever changed while we were not watching
+			index, known = current, true
+			changed()
+		}
+
+		var receiver = make(chan *etcd.Response)
+		var done = make(chan error, 1)
+		go func() {
+			_, err := e.client.Watch(prefix, index+1, true, receiver, stop)
+			done <- err
+		}()
+		for response := range receiver {
+			if response.Node != nil && response.Node.ModifiedIndex > index {
+				index = response.Node.ModifiedIndex
+			}
+			changed()
+		}
+		err := <-done
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Printf("ERROR: Watch of [%s] for the changes was lost, retrying (Error: %s)\n", prefix, err)
+		known = false
+		changed()
+	}
+}
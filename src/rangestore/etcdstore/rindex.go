@@ -0,0 +1,404 @@
+// Reverse lookup index for attributes. ROptimize does this only for NODES
+// (under /_roptimize), the reverse index does it for any attribute listed in
+// RIndex. For each attribute and value, the index has the clusters where the
+// attribute has that value, ie, /_rindex/<KEY>/<value> = cluster1\tcluster2
+// This saves walking all the leaf nodes for a reverse lookup.
+
+package etcdstore
+
+import (
+	"errors"
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	"log"
+	"net/url"
+	"path"
+	"rangeops"
+	"sort"
+	"strings"
+)
+
+const _rindex = "/_rindex"
+
+// number of times we retry a compare-and-swap on an index entry
+const _casRetries = 10
+
+// IndexDrift is an entry of the reverse index which does not agree with
+// the cluster data
+type IndexDrift struct {
+	Attr    string   // attribute
+	Value   string   // value of the attribute
+	Indexed []string // clusters as per the index
+	Actual  []string // clusters as per the cluster data
+}
+
+// whether we have a reverse index for the attr
+func (e *EtcdStore) indexed(attr string) bool {
+	for _, i := range e.RIndex {
+		if i == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// path to the index entry
+func (e *EtcdStore) indexPath(attr string, value string) string {
+	return fmt.Sprintf("%s%s/%s/%s", e.storenode, _rindex, attr, url.PathEscape(value))
+}
+
+// reverse lookup using the index, hint limits the result to the
+// clusters under hint
+func (e *EtcdStore) indexedReverseLookup(key string, attr string, hint string) (*[]string, error) {
+	var results = make([]string, 0)
+	_, _, value, found, err := e.retrieveFromEtcd(e.indexPath(attr, key), false, false)
+	if err != nil {
+		return &[]string{}, err
+	} else if !found {
+		return &results, nil
+	}
+	for _, cluster := range strings.Split(value, _sep) {
+		if hint == "" || cluster == hint || strings.HasPrefix(cluster, hint+"-") {
+			results = append(results, cluster)
+			if e.FastLookup {
+				break
+			}
+		}
+	}
+	return &results, nil
+}
+
+// keep the indexes consistent when the values of attr in the cluster change
+// from old to new. NODES is also kept in the reverse lookup optimization
+func (e *EtcdStore) updateReverseIndex(cluster string, attr string, old []string, new []string) error {
+	var added = make([]string, 0)
+	var removed = make([]string, 0)
+	rangeops.Difference(&new, &old, &added)
+	rangeops.Difference(&old, &new, &removed)
+
+	var indexes = make([]func(string) string, 0)
+	if e.indexed(attr) {
+		indexes = append(indexes, func(value string) string { return e.indexPath(attr, value) })
+	}
+	if attr == "NODES" {
+		indexes = append(indexes, func(value string) string { return fmt.Sprintf("%s/%s", _roptimize, value) })
+	}
+
+	for _, index := range indexes {
+		for _, value := range added {
+			if err := e.indexAdd(index(value), cluster); err != nil {
+				return err
+			}
+		}
+		for _, value := range removed {
+			if err := e.indexRemove(index(value), cluster); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add the cluster to the index entry
+func (e *EtcdStore) indexAdd(entry string, cluster string) error {
+	return e.indexModify(entry, func(clusters []string) []string {
+		for _, c := range clusters {
+			if c == cluster {
+				return clusters
+			}
+		}
+		return append(clusters, cluster)
+	})
+}
+
+// remove the cluster from the index entry
+func (e *EtcdStore) indexRemove(entry string, cluster string) error {
+	return e.indexModify(entry, func(clusters []string) []string {
+		var result = make([]string, 0)
+		rangeops.Difference(&clusters, &[]string{cluster}, &result)
+		return result
+	})
+}
+
+// read-modify-write of an index entry, the write is a compare-and-swap
+// so concurrent writers don't lose each others updates
+func (e *EtcdStore) indexModify(entry string, modify func([]string) []string) error {
+	for i := 0; i < _casRetries; i++ {
+		var clusters = make([]string, 0)
+		var index uint64
+		response, err := e.client.Get(entry, false, false)
+		if err == nil {
+			clusters = strings.Split(response.Node.Value, _sep)
+			index = response.Node.ModifiedIndex
+		} else if etcdErr, ok := err.(*etcd.EtcdError); !ok || etcdErr.ErrorCode != 100 {
+			return err
+		}
+
+		var updated = modify(clusters)
+		switch {
+		case index == 0 && len(updated) == 0: // nothing to do
+			return nil
+		case index == 0:
+			_, err = e.client.Create(entry, strings.Join(updated, _sep), 0)
+		case len(updated) == 0:
+			_, err = e.client.CompareAndDelete(entry, "", index)
+		default:
+			_, err = e.client.CompareAndSwap(entry, strings.Join(updated, _sep), 0, "", index)
+		}
+		if err == nil {
+			return nil
+		}
+		// someone else modified the entry, try again
+		if etcdErr, ok := err.(*etcd.EtcdError); !ok || (etcdErr.ErrorCode != 101 && etcdErr.ErrorCode != 105 && etcdErr.ErrorCode != 100) {
+			return err
+		}
+	}
+	return errors.New(fmt.Sprintf("Updating Index [%s] Failed (Error: too many concurrent updates)", entry))
+}
+
+// rewrite the index entry as read at index (0 if it was not there) with
+// the clusters. It is a compare-and-swap, so an update made since is not
+// lost, false if there was one and the entry was left alone
+func (e *EtcdStore) indexReset(entry string, index uint64, clusters []string) (bool, error) {
+	var err error
+	switch {
+	case index == 0 && len(clusters) == 0:
+		return true, nil
+	case index == 0:
+		_, err = e.client.Create(entry, strings.Join(clusters, _sep), 0)
+	case len(clusters) == 0:
+		_, err = e.client.CompareAndDelete(entry, "", index)
+	default:
+		_, err = e.client.CompareAndSwap(entry, strings.Join(clusters, _sep), 0, "", index)
+	}
+	switch errorCode(err) {
+	case 0:
+		return true, nil
+	case 100, 101, 105:
+		return false, nil
+	}
+	return false, err
+}
+
+// CheckReverseIndex compares the reverse index with the cluster data and
+// returns the entries which have drifted. If repair is set, the drifted
+// entries are rewritten from the cluster data (this is also how the index
+// is built the first time), the ones updated meanwhile are checked again
+func (e *EtcdStore) CheckReverseIndex(repair bool) ([]IndexDrift, error) {
+	drifts, skipped, err := e.checkReverseIndex(repair)
+	for i := 0; err == nil && skipped > 0 && i < _casRetries; i++ {
+		_, skipped, err = e.checkReverseIndex(repair)
+	}
+	if err == nil && skipped > 0 {
+		err = errors.New(fmt.Sprintf("Repairing Reverse Index Failed (Error: %d entries updated while repaired)", skipped))
+	}
+	return drifts, err
+}
+
+// see CheckReverseIndex, the count of entries not repaired as they were
+// updated since read
+func (e *EtcdStore) checkReverseIndex(repair bool) ([]IndexDrift, int, error) {
+	var drifts = make([]IndexDrift, 0)
+
+	// what the index is, read before the cluster data: an edit made in
+	// between updates the entry, and the repair of it is refused
+	var indexed = make(map[string]map[string][]string)
+	var versions = make(map[string]map[string]uint64)
+	for _, attr := range e.RIndex {
+		indexed[attr] = make(map[string][]string)
+		versions[attr] = make(map[string]uint64)
+	}
+	response, _, _, found, err := e.retrieveFromEtcd(fmt.Sprintf("%s%s", e.storenode, _rindex), false, true)
+	if err != nil {
+		return drifts, 0, err
+	}
+	if found {
+		for _, dir := range response.Node.Nodes {
+			entries, ok := indexed[path.Base(dir.Key)]
+			if !ok {
+				continue
+			}
+			for _, n := range dir.Nodes {
+				value, err := url.PathUnescape(path.Base(n.Key))
+				if err != nil {
+					value = path.Base(n.Key)
+				}
+				entries[value] = strings.Split(n.Value, _sep)
+				versions[path.Base(dir.Key)][value] = n.ModifiedIndex
+			}
+		}
+	}
+
+	// what the index should be
+	leaves, err := e.getLeafNodeTree("")
+	if err != nil {
+		return drifts, 0, err
+	}
+	registered, err := e.registeredNodes()
+	if err != nil {
+		return drifts, 0, err
+	}
+	var actual = make(map[string]map[string][]string)
+	for _, attr := range e.RIndex {
+		actual[attr] = make(map[string][]string)
+	}
+	for _, leaf := range leaves {
+		var cluster = e.pathToCluster(leaf.Key)
+		for attr := range actual {
+			var values []string
+			if value, found := childValue(leaf, attr); found {
+				values = strings.Split(value, _sep)
+			}
+			// NODES has the registered nodes too
+			if attr == "NODES" {
+				values = append(values, registered[cluster]...)
+			}
+			rangeops.ArrayToSet(&values)
+			for _, v := range values {
+				actual[attr][v] = append(actual[attr][v], cluster)
+			}
+		}
+	}
+
+	// compare both ways
+	for attr := range actual {
+		var values = make(map[string]bool)
+		for v := range actual[attr] {
+			values[v] = true
+		}
+		for v := range indexed[attr] {
+			values[v] = true
+		}
+		for v := range values {
+			var want, have = actual[attr][v], indexed[attr][v]
+			if sameSet(want, have) {
+				continue
+			}
+			drifts = append(drifts, IndexDrift{Attr: attr, Value: v, Indexed: have, Actual: want})
+		}
+	}
+	sort.Slice(drifts, func(i, j int) bool {
+		if drifts[i].Attr != drifts[j].Attr {
+			return drifts[i].Attr < drifts[j].Attr
+		}
+		return drifts[i].Value < drifts[j].Value
+	})
+
+	if !repair {
+		return drifts, 0, nil
+	}
+	var skipped int
+	for _, drift := range drifts {
+		var entry = e.indexPath(drift.Attr, drift.Value)
+		done, err := e.indexReset(entry, versions[drift.Attr][drift.Value], drift.Actual)
+		if err != nil {
+			return drifts, skipped, err
+		} else if !done {
+			skipped++
+			continue
+		}
+		log.Printf("INFO: Repaired Reverse Index [%s=%s] %v -> %v\n", drift.Attr, drift.Value, drift.Indexed, drift.Actual)
+	}
+	return drifts, skipped, nil
+}
+
+// Reindex rebuilds the reverse lookup optimization (/_roptimize, along
+// with the registered nodes) and the reverse index of RIndex from the
+// cluster data, then marks the store loaded (_range_store), so an etcd
+// filled from empty (eg, by yarge-sync) can be served (rangestore.Reindexer)
+func (e *EtcdStore) Reindex() error {
+	if err := e.reindex(); err != nil {
+		return err
+	}
+	_, err := e.client.Set(fmt.Sprintf("%s/%s", e.storenode, "_range_store"), "loaded", 0)
+	return err
+}
+
+// two arrays have same elements, ignoring order and duplicates
+func sameSet(arr1, arr2 []string) bool {
+	var diff = make([]string, 0)
+	rangeops.Difference(&arr1, &arr2, &diff)
+	rangeops.Difference(&arr2, &arr1, &diff)
+	return len(diff) == 0
+}
+
+// rebuild the reverse lookup optimization and the reverse index from the
+// cluster data and the live registrations (see Reindex). The entries
+// updated meanwhile are checked again
+func (e *EtcdStore) reindex() error {
+	skipped, err := e.reoptimize()
+	for i := 0; err == nil && skipped > 0 && i < _casRetries; i++ {
+		skipped, err = e.reoptimize()
+	}
+	if err == nil && skipped > 0 {
+		err = errors.New(fmt.Sprintf("Rebuilding [%s] Failed (Error: %d entries updated while rebuilt)", _roptimize, skipped))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = e.CheckReverseIndex(true)
+	return err
+}
+
+// rewrite the drifted entries of the reverse lookup optimization, the
+// count of the ones not rewritten as they were updated since read
+func (e *EtcdStore) reoptimize() (int, error) {
+	// read before the cluster data, see checkReverseIndex
+	var indexed = make(map[string][]string)
+	var versions = make(map[string]uint64)
+	response, err := e.client.Get(_roptimize, false, false)
+	if err != nil && errorCode(err) != 100 {
+		return 0, err
+	} else if err == nil {
+		for _, n := range response.Node.Nodes {
+			indexed[path.Base(n.Key)] = strings.Split(n.Value, _sep)
+			versions[path.Base(n.Key)] = n.ModifiedIndex
+		}
+	}
+
+	leaves, err := e.getLeafNodeTree("")
+	if err != nil {
+		return 0, err
+	}
+	registered, err := e.registeredNodes()
+	if err != nil {
+		return 0, err
+	}
+	var actual = make(map[string][]string)
+	for _, leaf := range leaves {
+		value, found := childValue(leaf, "NODES")
+		if !found {
+			continue
+		}
+		var cluster, nodes = e.pathToCluster(leaf.Key), strings.Split(value, _sep)
+		rangeops.ArrayToSet(&nodes)
+		for _, node := range nodes {
+			actual[node] = append(actual[node], cluster)
+		}
+	}
+	for cluster, nodes := range registered {
+		for _, node := range nodes {
+			actual[node] = append(actual[node], cluster)
+		}
+	}
+
+	var skipped int
+	for node := range indexed {
+		if _, ok := actual[node]; !ok {
+			actual[node] = []string{}
+		}
+	}
+	for node, clusters := range actual {
+		if sameSet(clusters, indexed[node]) {
+			continue
+		}
+		rangeops.ArrayToSet(&clusters)
+		done, err := e.indexReset(fmt.Sprintf("%s/%s", _roptimize, node), versions[node], clusters)
+		if err != nil {
+			return skipped, err
+		} else if !done {
+			skipped++
+		}
+	}
+	return skipped, nil
+}
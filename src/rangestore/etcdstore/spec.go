@@ -0,0 +1,66 @@
+package etcdstore
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"rangestore"
+	"strings"
+)
+
+// etcd://h1:4001,h2:4001/yarge?roptimize=1&mirror=1, the path is the node
+// of the store in etcd
+//   roptimize  reverse lookup optimization
+//   fast       the first result of the reverse lookups
+//   mirror     lookups from a local mirror kept current by watching etcd
+//   rindex     attributes having a reverse index, eg, rindex=AUTHORS,QAFOR
+//   ephemeral  merge the registered nodes into NODES
+//   tls        the hosts are https
+//   lazy       start even if etcd is down, the lookups are unavailable until
+//              it is back (eg, to serve a snapshot, see rangestore.StaleStore)
+func init() {
+	rangestore.Register("etcd", func(spec *url.URL) (rangestore.StoreCloser, error) {
+		if spec.Host == "" {
+			return nil, fmt.Errorf("Store spec [%s] has no hosts", spec)
+		}
+		var params = rangestore.NewParams(spec)
+		var roptimize, fast, mirror = params.Bool("roptimize"), params.Bool("fast"), params.Bool("mirror")
+		var rindex, ephemeral, lazy = params.List("rindex"), params.Bool("ephemeral"), params.Bool("lazy")
+		var scheme = "http"
+		if params.Bool("tls") {
+			scheme = "https"
+		}
+		if err := params.Err(); err != nil {
+			return nil, err
+		}
+		var hosts = make([]string, 0)
+		for _, host := range strings.Split(spec.Host, ",") {
+			hosts = append(hosts, scheme+"://"+host)
+		}
+
+		e, err := ConnectEtcdStore(hosts, roptimize, fast, spec.Path)
+		if errors.Is(err, rangestore.ErrUnavailable) && lazy {
+			log.Printf("ERROR: Etcd Store %v is UNAVAILABLE, lookups fail until it is back (Error: %s)", hosts, err)
+			e, err = NewEtcdStore(hosts, roptimize, fast, spec.Path), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		e.RIndex = rindex
+		// every server merges the registered hosts, not just the writable ones
+		if ephemeral {
+			e.Ephemeral = true
+			e.StartReaper()
+		}
+		if mirror {
+			if err = e.StartMirror(); err != nil && lazy {
+				log.Printf("ERROR: Etcd Store %v is not Mirrored, lookups go to etcd (Error: %s)", hosts, err)
+			} else if err != nil {
+				e.DisconnectEtcdStore()
+				return nil, err
+			}
+		}
+		return e, nil
+	})
+}
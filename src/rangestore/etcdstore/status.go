@@ -0,0 +1,63 @@
+// status of the EtcdStore, see rangestore.StatusStore
+
+package etcdstore
+
+import (
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	"path"
+	"rangestore"
+	"strings"
+)
+
+// etcd is reachable and still has the range store loaded, it could have
+// gone down or been reloaded since we connected
+func (e *EtcdStore) Ping() error {
+	return e.checkLoaded()
+}
+
+// fetches the whole store in a single request (or from the mirror) and
+// counts the clusters, every dir is a cluster
+func (e *EtcdStore) Status() (rangestore.StoreStatus, error) {
+	var status = rangestore.StoreStatus{Type: "etcdstore", Root: e.storenode}
+	if status.Root == "" {
+		status.Root = "/"
+	}
+	response, _, _, found, err := e.retrieveFromEtcd(e.clusterToPath(""), true, true)
+	if err != nil {
+		return status, err
+	} else if !found {
+		return status, fmt.Errorf("Store Root [%s] is NOT FOUND, %w", status.Root, rangestore.ErrUnavailable)
+	}
+	err = e.countClusters(response.Node, &status, make(map[string]bool))
+	return status, err
+}
+
+// counts the clusters under the dir, hidden nodes (_range_store,
+// _roptimize, etc) are not clusters
+func (e *EtcdStore) countClusters(dir *etcd.Node, status *rangestore.StoreStatus, seen map[string]bool) error {
+	for _, n := range dir.Nodes {
+		if !n.Dir || strings.HasPrefix(path.Base(n.Key), "_") {
+			continue
+		}
+		status.Clusters++
+		isLeaf, err := e.isLeafDir(n)
+		if err != nil {
+			return err
+		}
+		if !isLeaf {
+			if err := e.countClusters(n, status, seen); err != nil {
+				return err
+			}
+			continue
+		}
+		var keys = make(map[string][]string)
+		for _, k := range n.Nodes {
+			if !k.Dir && !strings.HasPrefix(path.Base(k.Key), "_") {
+				keys[path.Base(k.Key)] = splitValue(k.Value)
+			}
+		}
+		status.AddLeaf(keys, seen)
+	}
+	return nil
+}
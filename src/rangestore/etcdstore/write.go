@@ -0,0 +1,369 @@
+// Write operations on the EtcdStore (rangestore.WritableStore).
+// The version of a leaf cluster is the modifiedIndex of its _leaf marker.
+// Every edit first claims the cluster by doing a compare-and-swap of the
+// _leaf marker on the version it read, so of two concurrent edits based on
+// the same version only one goes through. The keys themselves are also
+// written with a compare-and-swap on their own modifiedIndex, so an edit
+// never overwrites a value it has not seen. An edit returns the version
+// its compare-and-swap of the marker made.
+// Writes always go to etcd, never to the mirror (the mirror catches up
+// through its watch).
+
+package etcdstore
+
+import (
+	"errors"
+	"fmt"
+	"github.com/coreos/go-etcd/etcd"
+	"log"
+	"path"
+	"rangeops"
+	"rangestore"
+	"strconv"
+	"strings"
+)
+
+// version of a leaf cluster
+func (e *EtcdStore) ClusterVersion(cluster string) (string, error) {
+	index, err := e.leafIndex(cluster)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(index, 10), nil
+}
+
+//////////////
+// CLUSTERS //
+//////////////
+
+// creates an empty leaf cluster, the non-leaf clusters on the way are
+// created by etcd
+func (e *EtcdStore) CreateCluster(cluster string) (string, error) {
+	if !rangestore.ValidClusterName(cluster) {
+		return "", fmt.Errorf("CreateCluster for [%s] Failed (Error: %w)", cluster, rangestore.ErrInvalidName)
+	}
+	if err := e.checkCreatable(cluster); err != nil {
+		return "", fmt.Errorf("CreateCluster for [%s] Failed (Error: %w)", cluster, err)
+	}
+	var dir = e.clusterToPath(cluster)
+	if _, err := e.client.CreateDir(dir, 0); errorCode(err) == 102 || errorCode(err) == 105 {
+		return "", fmt.Errorf("CreateCluster for [%s] Failed (Error: %w)", cluster, rangestore.ErrExists)
+	} else if err != nil {
+		return "", fmt.Errorf("CreateCluster for [%s] Failed (Error: %w)", cluster, writeError(err))
+	}
+	response, err := e.client.Create(fmt.Sprintf("%s/%s", dir, _leaf), _leaf, 0)
+	if err != nil {
+		return "", fmt.Errorf("CreateCluster for [%s] Failed (Error: %w)", cluster, writeError(err))
+	}
+	return strconv.FormatUint(response.Node.ModifiedIndex, 10), nil
+}
+
+// deletes a leaf cluster, or a non-leaf cluster with no children
+func (e *EtcdStore) DeleteCluster(cluster string, version string) error {
+	if !rangestore.ValidClusterName(cluster) {
+		return fmt.Errorf("DeleteCluster for [%s] Failed (Error: %w)", cluster, rangestore.ErrInvalidName)
+	}
+	var dir = e.clusterToPath(cluster)
+	response, err := e.client.Get(dir, false, false)
+	if errorCode(err) == 100 {
+		return fmt.Errorf("No Such Cluster [%s], %w", cluster, rangestore.ErrNotFound)
+	} else if err != nil {
+		return err
+	} else if !response.Node.Dir {
+		return fmt.Errorf("No Such Cluster [%s], %w", cluster, rangestore.ErrNotFound)
+	}
+	isLeaf, err := e.isLeafDir(response.Node)
+	if err != nil {
+		return err
+	}
+	if !isLeaf {
+		if len(response.Node.Nodes) > 0 {
+			return fmt.Errorf("DeleteCluster for [%s] Failed (Error: has child clusters, %w)", cluster, rangestore.ErrConflict)
+		}
+		if _, err = e.client.DeleteDir(dir); err != nil {
+			return fmt.Errorf("DeleteCluster for [%s] Failed (Error: %w)", cluster, writeError(err))
+		}
+		return nil
+	}
+
+	index, err := e.checkVersion(cluster, version)
+	if err != nil {
+		return err
+	}
+	// the values of the version checked, an edit before it could have
+	// changed the ones read above
+	if response, err = e.client.Get(dir, false, false); err != nil {
+		return fmt.Errorf("DeleteCluster for [%s] Failed (Error: %w)", cluster, writeError(err))
+	}
+	// once the marker is gone, nobody else can edit the cluster
+	if _, err = e.client.CompareAndDelete(fmt.Sprintf("%s/%s", dir, _leaf), "", index); err != nil {
+		return fmt.Errorf("DeleteCluster for [%s] Failed (Error: %w)", cluster, writeError(err))
+	}
+	if _, err = e.client.Delete(dir, true); err != nil {
+		return fmt.Errorf("DeleteCluster for [%s] Failed (Error: %w)", cluster, writeError(err))
+	}
+	for _, n := range response.Node.Nodes {
+		if n.Dir {
+			continue
+		}
+		if err = e.updateReverseIndex(cluster, path.Base(n.Key), splitValue(n.Value), []string{}); err != nil {
+			return err
+		}
+	}
+	// the nodes registered in it go too
+	return e.moveRegistrations(cluster, "")
+}
+
+// renames a leaf cluster, the keys are copied over to the new cluster
+// before the old one is deleted
+func (e *EtcdStore) RenameCluster(cluster string, to string, version string) (string, error) {
+	if !rangestore.ValidClusterName(cluster) || !rangestore.ValidClusterName(to) {
+		return "", fmt.Errorf("RenameCluster for [%s -> %s] Failed (Error: %w)", cluster, to, rangestore.ErrInvalidName)
+	}
+	index, err := e.checkVersion(cluster, version)
+	if err != nil {
+		return "", err
+	}
+	if err = e.checkCreatable(to); err != nil {
+		return "", fmt.Errorf("RenameCluster for [%s -> %s] Failed (Error: %w)", cluster, to, err)
+	}
+	var dir, toDir = e.clusterToPath(cluster), e.clusterToPath(to)
+	response, err := e.client.Get(dir, false, false)
+	if err != nil {
+		return "", fmt.Errorf("RenameCluster for [%s -> %s] Failed (Error: %w)", cluster, to, writeError(err))
+	}
+
+	// reserve the new name, then claim the old cluster
+	if _, err = e.client.CreateDir(toDir, 0); err != nil {
+		return "", fmt.Errorf("RenameCluster for [%s -> %s] Failed (Error: %w)", cluster, to, writeError(err))
+	}
+	if _, err = e.client.CompareAndDelete(fmt.Sprintf("%s/%s", dir, _leaf), "", index); err != nil {
+		e.client.DeleteDir(toDir)
+		return "", fmt.Errorf("RenameCluster for [%s -> %s] Failed (Error: %w)", cluster, to, writeError(err))
+	}
+	// once claimed, a failure puts the old cluster back (with a new
+	// version) and drops what was copied
+	var undo = func(err error) (string, error) {
+		e.client.Delete(toDir, true)
+		if _, markErr := e.client.Create(fmt.Sprintf("%s/%s", dir, _leaf), _leaf, 0); markErr != nil {
+			log.Printf("ERROR: Restoring [%s] after a failed rename Failed, it is not a leaf cluster anymore (Error: %s)\n", cluster, markErr)
+		}
+		return "", fmt.Errorf("RenameCluster for [%s -> %s] Failed (Error: %w)", cluster, to, writeError(err))
+	}
+
+	for _, n := range response.Node.Nodes {
+		if n.Dir {
+			continue
+		}
+		if _, err = e.client.Create(fmt.Sprintf("%s/%s", toDir, path.Base(n.Key)), n.Value, 0); err != nil {
+			return undo(err)
+		}
+	}
+	leaf, err := e.client.Create(fmt.Sprintf("%s/%s", toDir, _leaf), _leaf, 0)
+	if err != nil {
+		return undo(err)
+	}
+	if _, err = e.client.Delete(dir, true); err != nil {
+		return undo(err)
+	}
+
+	for _, n := range response.Node.Nodes {
+		if n.Dir {
+			continue
+		}
+		var key, values = path.Base(n.Key), splitValue(n.Value)
+		if err = e.updateReverseIndex(cluster, key, values, []string{}); err != nil {
+			return "", err
+		}
+		if err = e.updateReverseIndex(to, key, []string{}, values); err != nil {
+			return "", err
+		}
+	}
+	// the nodes registered in it move along
+	if err = e.moveRegistrations(cluster, to); err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(leaf.Node.ModifiedIndex, 10), nil
+}
+
+//////////
+// KEYS //
+//////////
+
+// sets the values of the key (creates the key if not there)
+func (e *EtcdStore) SetKey(cluster string, key string, values []string, version string) (string, error) {
+	if err := rangestore.ValidKeyValues(key, values); err != nil {
+		return "", fmt.Errorf("SetKey for [%s:%s] Failed (Error: %w)", cluster, key, err)
+	}
+	return e.modifyKey(cluster, key, version, true, func(current []string) []string {
+		var set = append([]string{}, values...)
+		rangeops.ArrayToSet(&set)
+		return set
+	})
+}
+
+// deletes the key
+func (e *EtcdStore) DeleteKey(cluster string, key string, version string) (string, error) {
+	return e.modifyKey(cluster, key, version, false, func(current []string) []string {
+		return nil
+	})
+}
+
+// appends the values to the key (creates the key if not there)
+func (e *EtcdStore) AddKeyValues(cluster string, key string, values []string, version string) (string, error) {
+	if err := rangestore.ValidKeyValues(key, values); err != nil {
+		return "", fmt.Errorf("AddKeyValues for [%s:%s] Failed (Error: %w)", cluster, key, err)
+	}
+	return e.modifyKey(cluster, key, version, true, func(current []string) []string {
+		var set = append(current, values...)
+		rangeops.ArrayToSet(&set)
+		return set
+	})
+}
+
+// removes the values from the key, the key stays even if it has
+// no more values
+func (e *EtcdStore) RemoveKeyValues(cluster string, key string, values []string, version string) (string, error) {
+	return e.modifyKey(cluster, key, version, false, func(current []string) []string {
+		var result = make([]string, 0)
+		rangeops.Difference(&current, &values, &result)
+		return result
+	})
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// read-modify-write of a key in a leaf cluster. A nil result from modify
+// deletes the key. If create is not set, the key has to exist. Returns
+// the new version
+func (e *EtcdStore) modifyKey(cluster string, key string, version string, create bool, modify func([]string) []string) (string, error) {
+	index, err := e.checkVersion(cluster, version)
+	if err != nil {
+		return "", err
+	}
+	var node = fmt.Sprintf("%s/%s", e.clusterToPath(cluster), key)
+	var current = make([]string, 0)
+	var keyIndex uint64
+	response, err := e.client.Get(node, false, false)
+	if err == nil {
+		current = splitValue(response.Node.Value)
+		keyIndex = response.Node.ModifiedIndex
+	} else if errorCode(err) != 100 {
+		return "", fmt.Errorf("Edit of [%s:%s] Failed (Error: %w)", cluster, key, writeError(err))
+	} else if !create {
+		return "", fmt.Errorf("Edit of [%s:%s] Failed (Error: Cannot find Key [%s], %w)", cluster, key, key, rangestore.ErrNotFound)
+	}
+
+	// claim the cluster, concurrent edits on the same version will fail
+	leaf, err := e.client.CompareAndSwap(fmt.Sprintf("%s/%s", e.clusterToPath(cluster), _leaf), _leaf, 0, "", index)
+	if err != nil {
+		return "", fmt.Errorf("Edit of [%s:%s] Failed (Error: %w)", cluster, key, writeError(err))
+	}
+
+	var updated = modify(current)
+	switch {
+	case updated == nil:
+		_, err = e.client.CompareAndDelete(node, "", keyIndex)
+	case keyIndex == 0:
+		_, err = e.client.Create(node, strings.Join(updated, _sep), 0)
+	default:
+		_, err = e.client.CompareAndSwap(node, strings.Join(updated, _sep), 0, "", keyIndex)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Edit of [%s:%s] Failed (Error: %w)", cluster, key, writeError(err))
+	}
+	if err = e.updateReverseIndex(cluster, key, current, updated); err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(leaf.Node.ModifiedIndex, 10), nil
+}
+
+// modifiedIndex of the _leaf marker of the cluster
+func (e *EtcdStore) leafIndex(cluster string) (uint64, error) {
+	response, err := e.client.Get(fmt.Sprintf("%s/%s", e.clusterToPath(cluster), _leaf), false, false)
+	if errorCode(err) == 100 {
+		return 0, fmt.Errorf("cluster [%s] is NOT a LeafNode in EtcdStore, %w", cluster, rangestore.ErrNotFound)
+	} else if err != nil {
+		return 0, err
+	}
+	return response.Node.ModifiedIndex, nil
+}
+
+// make sure the cluster is still the version the edit is based on,
+// returns the current version
+func (e *EtcdStore) checkVersion(cluster string, version string) (uint64, error) {
+	index, err := e.leafIndex(cluster)
+	if err != nil {
+		return 0, err
+	}
+	if version != "" && version != strconv.FormatUint(index, 10) {
+		return 0, fmt.Errorf("Edit of [%s] Failed (Error: version is %d, not %s, %w)", cluster, index, version, rangestore.ErrConflict)
+	}
+	return index, nil
+}
+
+// a cluster can be created if it doesn't exist and none of its
+// parents are leaf clusters
+func (e *EtcdStore) checkCreatable(cluster string) error {
+	_, err := e.client.Get(e.clusterToPath(cluster), false, false)
+	if err == nil {
+		return rangestore.ErrExists
+	} else if errorCode(err) != 100 {
+		return err
+	}
+	var parts = strings.Split(cluster, "-")
+	for i := 1; i < len(parts); i++ {
+		var parent = strings.Join(parts[:i], "-")
+		_, err := e.client.Get(fmt.Sprintf("%s/%s", e.clusterToPath(parent), _leaf), false, false)
+		if err == nil {
+			return fmt.Errorf("parent [%s] is a leaf cluster, %w", parent, rangestore.ErrConflict)
+		} else if errorCode(err) != 100 {
+			return err
+		}
+	}
+	return nil
+}
+
+// values of a key as stored in etcd, an empty value has no values
+func splitValue(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, _sep)
+}
+
+// etcd error code, 0 if it is not an etcd error
+func errorCode(err error) int {
+	var etcdErr *etcd.EtcdError
+	if errors.As(err, &etcdErr) {
+		return etcdErr.ErrorCode
+	}
+	return 0
+}
+
+// errors of a failed write, the ones caused by a concurrent edit
+// are reported as such
+func writeError(err error) error {
+	switch errorCode(err) {
+	case 100, 101, 105, 108: // key not found, compare failed, node exists, dir not empty
+		return fmt.Errorf("%s, %w", err, rangestore.ErrConflict)
+	}
+	return storeError(err)
+}
+
+// errors of etcd not being reachable (or not having a leader) are
+// reported as the store being unavailable
+func storeError(err error) error {
+	if errors.Is(err, rangestore.ErrUnavailable) { // already is
+		return err
+	}
+	switch code := errorCode(err); {
+	case code == etcd.ErrCodeEtcdNotReachable, code == etcd.ErrCodeUnhandledHTTPStatus:
+		return fmt.Errorf("%s, %w", err, rangestore.ErrUnavailable)
+	case code >= 300 && code < 400: // raft errors
+		return fmt.Errorf("%s, %w", err, rangestore.ErrUnavailable)
+	}
+	return err
+}
@@ -0,0 +1,326 @@
+package etcdstore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"rangestore"
+	"rangestore/etcdstore/etcdtest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create, Rename and Delete of clusters
+func TestWriteCluster(t *testing.T) {
+	var cluster = "ops-prod-vpc9-web"
+	defer e.client.Delete("/ops/prod/vpc9", true)
+
+	if _, err := e.CreateCluster(cluster); err != nil {
+		t.Fatalf("Expected NO ERROR, Creating [%s] Got: %s", cluster, err)
+	}
+	if results, err := e.ClusterLookup(&[]string{"ops-prod-vpc9"}); err != nil || !compare(*results, []string{cluster}) {
+		t.Errorf("Expected [%s] in ops-prod-vpc9, Got: %v (Error: %s)", cluster, results, err)
+	}
+	if _, err := e.CreateCluster(cluster); !errors.Is(err, rangestore.ErrExists) {
+		t.Errorf("Expected ErrExists, Creating [%s] again, Got: %v", cluster, err)
+	}
+	// can't create under a leaf cluster
+	if _, err := e.CreateCluster(cluster + "-a"); !errors.Is(err, rangestore.ErrConflict) {
+		t.Errorf("Expected ErrConflict, Creating under a leaf, Got: %v", err)
+	}
+	if _, err := e.CreateCluster("ops-Prod"); !errors.Is(err, rangestore.ErrInvalidName) {
+		t.Errorf("Expected ErrInvalidName, Got: %v", err)
+	}
+
+	if _, err := e.SetKey(cluster, "NODES", []string{"web9001.ops.example.com"}, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, SetKey Got: %s", err)
+	}
+	var to = "ops-prod-vpc9-app"
+	version, _ := e.ClusterVersion(cluster)
+	if _, err := e.RenameCluster(cluster, to, version); err != nil {
+		t.Fatalf("Expected NO ERROR, Renaming [%s] Got: %s", cluster, err)
+	}
+	if results, err := e.KeyLookup(&[]string{to}, "NODES"); err != nil || !compare(*results, []string{"web9001.ops.example.com"}) {
+		t.Errorf("Expected keys to move to [%s], Got: %v (Error: %s)", to, results, err)
+	}
+	if found, _ := e.checkIsLeafNode(cluster); found {
+		t.Errorf("Expected [%s] to be gone after rename", cluster)
+	}
+
+	// non-leaf with children is not deleted
+	if err := e.DeleteCluster("ops-prod-vpc9", ""); !errors.Is(err, rangestore.ErrConflict) {
+		t.Errorf("Expected ErrConflict, Deleting a cluster with children, Got: %v", err)
+	}
+	if err := e.DeleteCluster(to, version); !errors.Is(err, rangestore.ErrConflict) {
+		t.Errorf("Expected ErrConflict, Deleting with a stale version, Got: %v", err)
+	}
+	version, _ = e.ClusterVersion(to)
+	if err := e.DeleteCluster(to, version); err != nil {
+		t.Errorf("Expected NO ERROR, Deleting [%s] Got: %s", to, err)
+	}
+	if err := e.DeleteCluster("ops-prod-vpc9", ""); err != nil {
+		t.Errorf("Expected NO ERROR, Deleting empty ops-prod-vpc9 Got: %s", err)
+	}
+}
+
+// Set, Add, Remove and Delete of keys, the indexes follow the edits
+func TestWriteKey(t *testing.T) {
+	var cluster = "ops-prod-vpc9-web"
+	defer e.client.Delete("/ops/prod/vpc9", true)
+	defer e.client.Delete("/_roptimize/web9001.ops.example.com", false)
+	defer e.client.Delete("/_roptimize/web9002.ops.example.com", false)
+
+	if _, err := e.CreateCluster(cluster); err != nil {
+		t.Fatalf("Expected NO ERROR, Creating [%s] Got: %s", cluster, err)
+	}
+	if _, err := e.AddKeyValues(cluster, "NODES", []string{"web9001.ops.example.com", "web9002.ops.example.com"}, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, AddKeyValues Got: %s", err)
+	}
+	if results, err := e.optimizedNodeReverseLookup("web9002.ops.example.com"); err != nil || !compare(*results, []string{cluster}) {
+		t.Errorf("Expected [%s] in _roptimize, Got: %v (Error: %s)", cluster, results, err)
+	}
+
+	if _, err := e.RemoveKeyValues(cluster, "NODES", []string{"web9002.ops.example.com"}, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, RemoveKeyValues Got: %s", err)
+	}
+	if results, err := e.ClusterLookup(&[]string{cluster}); err != nil || !compare(*results, []string{"web9001.ops.example.com"}) {
+		t.Errorf("Expected [web9001.ops.example.com], Got: %v (Error: %s)", results, err)
+	}
+	if _, err := e.optimizedNodeReverseLookup("web9002.ops.example.com"); err == nil {
+		t.Errorf("Expected web9002.ops.example.com to be removed from _roptimize")
+	}
+
+	if _, err := e.SetKey(cluster, "QAFOR", []string{"qa1", "qa2"}, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, SetKey Got: %s", err)
+	}
+	if results, err := e.KeyLookup(&[]string{cluster}, "QAFOR"); err != nil || !compare(*results, []string{"qa1", "qa2"}) {
+		t.Errorf("Expected [qa1 qa2], Got: %v (Error: %s)", results, err)
+	}
+	if _, err := e.SetKey(cluster, "QAFOR", []string{"a\tb"}, ""); !errors.Is(err, rangestore.ErrInvalidName) {
+		t.Errorf("Expected ErrInvalidName, Got: %v", err)
+	}
+	if _, err := e.DeleteKey(cluster, "QAFOR", ""); err != nil {
+		t.Fatalf("Expected NO ERROR, DeleteKey Got: %s", err)
+	}
+	if _, err := e.KeyLookup(&[]string{cluster}, "QAFOR"); err == nil {
+		t.Errorf("Expected ERROR, QAFOR was deleted")
+	}
+}
+
+// a rename failing once the old cluster is claimed puts it back
+func TestRenameClusterUndo(t *testing.T) {
+	var server = etcdtest.NewServer()
+	defer server.Close()
+	// etcd refuses the marker of the new cluster
+	var proxy = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/vpc9/app/_leaf") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errorCode":107,"message":"Root is read only","index":1}`))
+			return
+		}
+		server.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	var s = NewEtcdStore([]string{proxy.URL}, false, false, "")
+	defer s.DisconnectEtcdStore()
+
+	var cluster, to = "ops-prod-vpc9-web", "ops-prod-vpc9-app"
+	if _, err := s.CreateCluster(cluster); err != nil {
+		t.Fatalf("Expected NO ERROR, Creating [%s] Got: %s", cluster, err)
+	}
+	if _, err := s.SetKey(cluster, "NODES", []string{"web9001.ops.example.com"}, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, SetKey Got: %s", err)
+	}
+	if _, err := s.RenameCluster(cluster, to, ""); err == nil {
+		t.Fatalf("Expected ERROR, Renaming with the marker refused")
+	}
+	if results, err := s.KeyLookup(&[]string{cluster}, "NODES"); err != nil || !compare(*results, []string{"web9001.ops.example.com"}) {
+		t.Errorf("Expected [%s] back with its keys, Got: %v (Error: %v)", cluster, results, err)
+	}
+	if _, err := s.ClusterVersion(cluster); err != nil {
+		t.Errorf("Expected [%s] to be a leaf cluster again, Got: %s", cluster, err)
+	}
+	if results, err := s.ClusterLookup(&[]string{"ops-prod-vpc9"}); err != nil || !compare(*results, []string{cluster}) {
+		t.Errorf("Expected [%s] alone in ops-prod-vpc9, Got: %v (Error: %v)", cluster, results, err)
+	}
+}
+
+// an edit based on an older version is refused
+func TestWriteConflict(t *testing.T) {
+	var cluster = "ops-prod-vpc9-web"
+	defer e.client.Delete("/ops/prod/vpc9", true)
+
+	if _, err := e.CreateCluster(cluster); err != nil {
+		t.Fatalf("Expected NO ERROR, Creating [%s] Got: %s", cluster, err)
+	}
+	version, err := e.ClusterVersion(cluster)
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, ClusterVersion Got: %s", err)
+	}
+	edited, err := e.SetKey(cluster, "QAFOR", []string{"qa1"}, version)
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, SetKey Got: %s", err)
+	}
+	// version has moved on
+	if _, err = e.SetKey(cluster, "QAFOR", []string{"qa2"}, version); !errors.Is(err, rangestore.ErrConflict) {
+		t.Errorf("Expected ErrConflict, SetKey with stale version, Got: %v", err)
+	}
+	if results, _ := e.KeyLookup(&[]string{cluster}, "QAFOR"); !compare(*results, []string{"qa1"}) {
+		t.Errorf("Expected [qa1], Got: %v", *results)
+	}
+	// the version the edit made, the next edit can be based on it
+	if current, _ := e.ClusterVersion(cluster); edited != current {
+		t.Errorf("Expected the version of the edit [%s], Got: %s", current, edited)
+	}
+	if _, err = e.SetKey(cluster, "QAFOR", []string{"qa2"}, edited); err != nil {
+		t.Errorf("Expected NO ERROR, SetKey on the version of the edit Got: %s", err)
+	}
+}
+
+// registered nodes show up in lookups and go away when they expire
+func TestEphemeral(t *testing.T) {
+	var cluster = "ops-prod-vpc1-range"
+	var node = "range1009.ops.example.com"
+	defer e.client.Delete("/_ephemeral", true)
+	defer e.client.Delete("/_roptimize/"+node, false)
+
+	if err := e.Register(cluster, node, time.Second); err == nil {
+		t.Errorf("Expected ERROR, Register when Ephemeral is not enabled")
+	}
+	e.Ephemeral = true
+	defer func() { e.Ephemeral = false }()
+	e.StartReaper()
+
+	if err := e.Register(cluster, node, time.Second); err != nil {
+		t.Fatalf("Expected NO ERROR, Register Got: %s", err)
+	}
+	var expected = []string{"range1001.ops.example.com", "range1002.ops.example.com", "range1003.ops.example.com", node}
+	if results, err := e.ClusterLookup(&[]string{cluster}); err != nil || !compare(*results, expected) {
+		t.Errorf("Expected %s, Got: %v (Error: %s)", expected, results, err)
+	}
+	if results, err := e.KeyLookup(&[]string{cluster}, "NODES"); err != nil || !compare(*results, expected) {
+		t.Errorf("Expected %s, Got: %v (Error: %s)", expected, results, err)
+	}
+	if results, err := e.KeyReverseLookupHint(node, "NODES", "ops"); err != nil || !compare(*results, []string{cluster}) {
+		t.Errorf("Expected [%s], Got: %v (Error: %s)", cluster, results, err)
+	}
+	if results, err := e.optimizedNodeReverseLookup(node); err != nil || !compare(*results, []string{cluster}) {
+		t.Errorf("Expected [%s] in _roptimize, Got: %v (Error: %s)", cluster, results, err)
+	}
+	if err := e.Register(cluster, node, time.Second); err != nil {
+		t.Errorf("Expected NO ERROR, Heartbeat Got: %s", err)
+	}
+
+	// stop the heartbeat
+	expected = expected[:3]
+	if !waitFor(func() bool {
+		results, err := e.ClusterLookup(&[]string{cluster})
+		return err == nil && compare(*results, expected)
+	}) {
+		t.Errorf("Expected [%s] to expire", node)
+	}
+	if !waitFor(func() bool { _, err := e.optimizedNodeReverseLookup(node); return err != nil }) {
+		t.Errorf("Expected [%s] to be reaped from _roptimize", node)
+	}
+
+	if err := e.Deregister(cluster, node); err == nil {
+		t.Errorf("Expected ERROR, Deregister of expired node")
+	}
+}
+
+// the registrations which expired while no reaper watched are taken out
+// of the reverse lookups when the reaper starts
+func TestEphemeralReaperStart(t *testing.T) {
+	var server = etcdtest.NewServer()
+	defer server.Close()
+	var s = NewEtcdStore(server.Machines(), false, false, "")
+	defer s.DisconnectEtcdStore()
+	s.Ephemeral = true
+	var cluster = "ops-prod-vpc9-web"
+	if _, err := s.CreateCluster(cluster); err != nil {
+		t.Fatalf("Expected NO ERROR, Creating [%s] Got: %s", cluster, err)
+	}
+	if _, err := s.SetKey(cluster, "NODES", []string{"web9001.ops.example.com"}, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, SetKey Got: %s", err)
+	}
+	var node = "web9002.ops.example.com"
+	if err := s.Register(cluster, node, time.Second); err != nil {
+		t.Fatalf("Expected NO ERROR, Register Got: %s", err)
+	}
+	if !waitFor(func() bool { nodes, err := s.ephemeralNodes(cluster); return err == nil && len(nodes) == 0 }) {
+		t.Fatalf("Expected [%s] to expire", node)
+	}
+	if _, err := s.optimizedNodeReverseLookup(node); err != nil {
+		t.Fatalf("Expected [%s] to stay in _roptimize with no reaper, Got: %s", node, err)
+	}
+
+	s.StartReaper()
+	if !waitFor(func() bool { _, err := s.optimizedNodeReverseLookup(node); return err != nil }) {
+		t.Errorf("Expected [%s] to be reaped from _roptimize", node)
+	}
+	if results, err := s.optimizedNodeReverseLookup("web9001.ops.example.com"); err != nil || !compare(*results, []string{cluster}) {
+		t.Errorf("Expected [%s] in _roptimize, Got: %v (Error: %v)", cluster, results, err)
+	}
+}
+
+// the registrations of a cluster move along when it is renamed and go
+// away when it is deleted
+func TestEphemeralRenameDelete(t *testing.T) {
+	var server = etcdtest.NewServer()
+	defer server.Close()
+	var s = NewEtcdStore(server.Machines(), false, false, "")
+	defer s.DisconnectEtcdStore()
+	s.Ephemeral = true
+	var cluster, to, node = "ops-prod-vpc9-web", "ops-prod-vpc9-app", "web9002.ops.example.com"
+	if _, err := s.CreateCluster(cluster); err != nil {
+		t.Fatalf("Expected NO ERROR, Creating [%s] Got: %s", cluster, err)
+	}
+	if err := s.Register(cluster, node, time.Minute); err != nil {
+		t.Fatalf("Expected NO ERROR, Register Got: %s", err)
+	}
+
+	if _, err := s.RenameCluster(cluster, to, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, Renaming [%s] Got: %s", cluster, err)
+	}
+	if nodes, err := s.ephemeralNodes(to); err != nil || !compare(nodes, []string{node}) {
+		t.Errorf("Expected [%s] registered in [%s], Got: %v (Error: %v)", node, to, nodes, err)
+	}
+	if nodes, err := s.ephemeralNodes(cluster); err != nil || len(nodes) != 0 {
+		t.Errorf("Expected no registrations left in [%s], Got: %v (Error: %v)", cluster, nodes, err)
+	}
+	if results, err := s.optimizedNodeReverseLookup(node); err != nil || !compare(*results, []string{to}) {
+		t.Errorf("Expected [%s] in _roptimize, Got: %v (Error: %v)", to, results, err)
+	}
+
+	if err := s.DeleteCluster(to, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, Deleting [%s] Got: %s", to, err)
+	}
+	if nodes, err := s.ephemeralNodes(to); err != nil || len(nodes) != 0 {
+		t.Errorf("Expected no registrations left in [%s], Got: %v (Error: %v)", to, nodes, err)
+	}
+	if _, err := s.optimizedNodeReverseLookup(node); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected [%s] to be gone from _roptimize, Got: %v", node, err)
+	}
+}
+
+// the changes of the store are told
+func TestNotify(t *testing.T) {
+	var cluster = "ops-prod-vpc9-web"
+	defer e.client.Delete("/ops/prod/vpc9", true)
+	var changed = make(chan bool, 100)
+	var stop = make(chan bool)
+	defer close(stop)
+	if err := e.Notify(func() { changed <- true }, stop); err != nil {
+		t.Fatalf("Expected NO ERROR, Notify Got: %s", err)
+	}
+	if _, err := e.CreateCluster(cluster); err != nil {
+		t.Fatalf("Expected NO ERROR, Creating [%s] Got: %s", cluster, err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a change, Creating [%s]", cluster)
+	}
+}
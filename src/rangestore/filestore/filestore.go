@@ -17,7 +17,9 @@ import (
 	"os"
 	"path/filepath"
 	"rangeops"
+	"rangestore"
 	"strings"
+	"sync"
 )
 
 const _config = "cluster.yaml"
@@ -26,6 +28,8 @@ type FileStore struct {
 	StorePath  string // directory where yamls are stored
 	MaxDepth   int    // TODO: we could use this for reverse lookup to limit nested look down
 	FastLookup bool   // fast return, will return the first match
+
+	mu sync.Mutex // serializes the writes (see write.go)
 }
 
 // check whether the StorePath Exists, etc
@@ -53,6 +57,10 @@ func (f *FileStore) DisconnectFileStore() {
 	return
 }
 
+func (f *FileStore) Close() {
+	f.DisconnectFileStore()
+}
+
 ////////////////////
 // LOOKUP CLUSTER //
 ////////////////////
@@ -112,11 +120,11 @@ func (f *FileStore) KeyLookup(cluster *[]string, key string) (*[]string, error)
 		// 3. append the result
 		content, err := f.readClusterConfig(elem)
 		if err != nil {
-			return &[]string{}, errors.New(fmt.Sprintf("KeyLookup for [%s] Failed (Error: %s)", elem, err))
+			return &[]string{}, fmt.Errorf("KeyLookup for [%s] Failed (Error: %w)", elem, err)
 		}
 		result, err := yamlKeyLookup(content, key)
 		if err != nil {
-			return &[]string{}, errors.New(fmt.Sprintf("KeyLookup for [%s] Failed (Error: %s)", elem, err))
+			return &[]string{}, fmt.Errorf("KeyLookup for [%s] Failed (Error: %w)", elem, err)
 		}
 		results = append(results, *result...)
 	}
@@ -141,6 +149,40 @@ func (f *FileStore) KeyReverseLookupAttr(key string, attr string) (*[]string, er
 // given a key, it will search for the cluster where the attr has that key,
 // hint is to limit the scope of search
 func (f *FileStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return f.reverseLookup(key, attr, hint, nil)
+}
+
+// Scope is the store doing the lookups of a query, the leaf clusters
+// walked by the reverse lookups are counted
+func (f *FileStore) Scope(t rangestore.Tracker) rangestore.Store {
+	return &scopedStore{FileStore: f, tracker: t}
+}
+
+// the store as seen by a query
+type scopedStore struct {
+	*FileStore
+	tracker rangestore.Tracker
+}
+
+func (s *scopedStore) KeyReverseLookup(key string) (*[]string, error) {
+	return s.reverseLookup(key, "NODES", "", s.tracker)
+}
+
+func (s *scopedStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return s.reverseLookup(key, attr, "", s.tracker)
+}
+
+func (s *scopedStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return s.reverseLookup(key, attr, hint, s.tracker)
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// the reverse lookup, the leaf clusters walked are counted for the query
+// (if any)
+func (f *FileStore) reverseLookup(key string, attr string, hint string, t rangestore.Tracker) (*[]string, error) {
 	var clusters *[]string
 	var err error
 	var results = make([]string, 0)
@@ -152,10 +194,15 @@ func (f *FileStore) KeyReverseLookupHint(key string, attr string, hint string) (
 	}
 
 	for _, elem := range *clusters {
+		if t != nil {
+			if err = t.Visit(1); err != nil {
+				return &[]string{}, err
+			}
+		}
 		// get the cluster config
 		content, err := f.readClusterConfig(elem)
 		if err != nil {
-			return &[]string{}, errors.New(fmt.Sprintf("KeyLookup for [%s] Failed (Error: %s)", elem, err))
+			return &[]string{}, fmt.Errorf("KeyLookup for [%s] Failed (Error: %w)", elem, err)
 		}
 		// look whether the attr exists
 		result, err := yamlKeyLookup(content, attr)
@@ -178,10 +225,6 @@ func (f *FileStore) KeyReverseLookupHint(key string, attr string, hint string) (
 	return &results, nil
 }
 
-////////////////////////
-// Internal Functions //
-////////////////////////
-
 // given a cluster name, it will convert to cluster
 // in the file system
 func (f *FileStore) clusterToPath(cluster string) string {
@@ -221,7 +264,9 @@ func (f *FileStore) checkIsLeafNode(cluster string) (bool, error) {
 	var fi os.FileInfo
 	// check whether it is a dir
 	fi, err = os.Stat(dir)
-	if err != nil {
+	if os.IsNotExist(err) {
+		return false, fmt.Errorf("cluser [%s] is NOT FOUND in FileStore [%s w.r.t %s] (ERROR: %s, %w)", cluster, dir, f.StorePath, err, rangestore.ErrNotFound)
+	} else if err != nil {
 		return false, errors.New(fmt.Sprintf("cluser [%s] is NOT FOUND in FileStore [%s w.r.t %s] (ERROR: %s)", cluster, dir, f.StorePath, err))
 	}
 	if !fi.IsDir() {
@@ -248,7 +293,9 @@ func (f *FileStore) checkIsLeafNode(cluster string) (bool, error) {
 func (f *FileStore) readClusterConfig(cluster string) (content []byte, err error) {
 	var dir = f.clusterToPath(cluster)
 	content, err = ioutil.ReadFile(fmt.Sprintf("%s/%s", dir, _config))
-	if err != nil {
+	if os.IsNotExist(err) {
+		return []byte{}, fmt.Errorf("%s, %w", err, rangestore.ErrNotFound)
+	} else if err != nil {
 		return []byte{}, err
 	}
 
@@ -312,7 +359,7 @@ func yamlKeyLookup(content []byte, key string) (*[]string, error) {
 	// check whether the map has the key we are looking for
 	value, ok := u[key]
 	if !ok {
-		return &[]string{}, errors.New(fmt.Sprintf("Cannot find Key [%s]", key))
+		return &[]string{}, fmt.Errorf("Cannot find Key [%s], %w", key, rangestore.ErrNotFound)
 	}
 
 	// try to return result pointer to an array of strings
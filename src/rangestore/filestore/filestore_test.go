@@ -1,8 +1,11 @@
 package filestore
 
 import (
+	"errors"
 	"log"
 	"os"
+	"rangestore"
+	"rangestore/storetest"
 	"testing"
 )
 
@@ -204,6 +207,19 @@ func TestClusterLookup(t *testing.T) {
 	}
 }
 
+// missing clusters and keys are reported as rangestore.ErrNotFound
+func TestNotFound(t *testing.T) {
+	if _, err := f.ClusterLookup(&[]string{"ops-prod-vpc1-foobar"}); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, Cluster: ops-prod-vpc1-foobar, Got: %v", err)
+	}
+	if _, err := f.KeyLookup(&[]string{"ops-prod-vpc1-range"}, "FOOBAR"); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, Key: FOOBAR, Got: %v", err)
+	}
+	if _, err := f.KeyLookup(&[]string{"ops-prod-vpc1"}, "NODES"); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, KeyLookup on a Non Leaf Cluster, Got: %v", err)
+	}
+}
+
 // test yamlKeyLookup
 func TestYamlKeyLookup(t *testing.T) {
 	var content string
@@ -328,3 +344,42 @@ func compare(arr1, arr2 []string) bool {
 
 	return true
 }
+
+func TestStatus(t *testing.T) {
+	if err := f.Ping(); err != nil {
+		t.Errorf("Expected Ping to succeed, Got: %s", err)
+	}
+	status, err := f.Status()
+	var expected = rangestore.StoreStatus{Type: "filestore", Root: "./t", Clusters: 18, Leaves: 7, Nodes: 17, Keys: 16}
+	if err != nil || status != expected {
+		t.Errorf("Expected %+v, Got: %+v (Error: %s)", expected, status, err)
+	}
+	var missing = &FileStore{StorePath: "./nosuch"}
+	if err := missing.Ping(); !errors.Is(err, rangestore.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, Missing Dir, Got: %v", err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	store, err := ConnectFileStore("./t", -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	storetest.Run(t, store)
+	store.FastLookup = true
+	storetest.RunFast(t, store)
+}
+
+// the leaf clusters walked by a reverse lookup are store calls of the query
+func TestScope(t *testing.T) {
+	var limited = rangestore.NewLimitedStore(f, rangestore.Limits{MaxCalls: 4})
+	var limitErr *rangestore.LimitError
+	if _, err := limited.KeyReverseLookupAttr("Ops", "AUTHORS"); !errors.As(err, &limitErr) || limitErr.Limit != rangestore.LimitCalls {
+		t.Errorf("Expected maxcalls to be hit, Got: %v", err)
+	}
+	// the hint walks a few of them
+	limited = rangestore.NewLimitedStore(f, rangestore.Limits{MaxCalls: 4})
+	if results, err := limited.KeyReverseLookupHint("Ops", "AUTHORS", "ops-prod-vpc1"); err != nil || len(*results) != 1 {
+		t.Errorf("Expected ops-prod-vpc1-mon, Got: %v (Error: %v)", results, err)
+	}
+}
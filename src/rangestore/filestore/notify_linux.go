@@ -0,0 +1,91 @@
+// Changes of the store, for the caches of the lookups (see
+// rangestore.CachingStore). The directories of the store are watched with
+// inotify, the new directories are watched as they are created.
+
+package filestore
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// what is a change of the store
+const _inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE_SELF
+
+// Notify calls changed on every change of the files of the store, until
+// stop is closed
+func (f *FileStore) Notify(changed func(), stop chan bool) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("Watching [%s] Failed (Error: %s)", f.StorePath, err)
+	}
+	// non blocking, so that the read is given up once closed
+	var events = os.NewFile(uintptr(fd), "inotify")
+	var dirs = make(map[int32]string)
+	if err = watchTree(fd, f.StorePath, dirs); err != nil {
+		events.Close()
+		return fmt.Errorf("Watching [%s] Failed (Error: %s)", f.StorePath, err)
+	}
+	go func() {
+		<-stop
+		events.Close()
+	}()
+	go f.notify(fd, events, dirs, changed)
+	return nil
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// read the events until closed, the new directories are watched too
+// (dirs are the watched directories by their watch descriptors)
+func (f *FileStore) notify(fd int, events *os.File, dirs map[int32]string, changed func()) {
+	var buf = make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := events.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			var event = (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			var dir = event.Mask&syscall.IN_ISDIR != 0
+			if dir && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				// the name is NUL padded
+				var name = buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+				for len(name) > 0 && name[len(name)-1] == 0 {
+					name = name[:len(name)-1]
+				}
+				var path = filepath.Join(dirs[event.Wd], string(name))
+				if err := watchTree(fd, path, dirs); err != nil {
+					log.Printf("ERROR: Watching the new directory [%s] Failed (Error: %s)\n", path, err)
+				}
+			}
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+		}
+		changed()
+	}
+}
+
+// watch the directory and the directories under it, a directory
+// watched again keeps its watch descriptor
+func watchTree(fd int, dir string, dirs map[int32]string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			wd, err := syscall.InotifyAddWatch(fd, path, _inotifyMask)
+			if err != nil {
+				return err
+			}
+			dirs[int32(wd)] = path
+		}
+		return nil
+	})
+}
@@ -0,0 +1,58 @@
+//go:build !linux
+
+// Changes of the store, for the caches of the lookups (see
+// rangestore.CachingStore). Without inotify, the files of the store are
+// checked for changes every _notifyInterval.
+
+package filestore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const _notifyInterval = time.Second
+
+// Notify calls changed on every change of the files of the store, until
+// stop is closed
+func (f *FileStore) Notify(changed func(), stop chan bool) error {
+	last, err := f.fingerprint()
+	if err != nil {
+		return fmt.Errorf("Watching [%s] Failed (Error: %s)", f.StorePath, err)
+	}
+	go func() {
+		var ticker = time.NewTicker(_notifyInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if current, err := f.fingerprint(); err != nil || current != last {
+				last = current
+				changed()
+			}
+		}
+	}()
+	return nil
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// the files of the store, with their sizes and modification times
+func (f *FileStore) fingerprint() (string, error) {
+	var b []byte
+	err := filepath.Walk(f.StorePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		b = append(b, fmt.Sprintf("%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())...)
+		return nil
+	})
+	return string(b), err
+}
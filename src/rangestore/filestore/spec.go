@@ -0,0 +1,27 @@
+package filestore
+
+import (
+	"fmt"
+	"net/url"
+	"rangestore"
+)
+
+// file:///var/yarge?fast=1 (or file:relative/path)
+//   fast   the first result of the reverse lookups
+//   depth  not used yet (default -1)
+func init() {
+	rangestore.Register("file", func(spec *url.URL) (rangestore.StoreCloser, error) {
+		var dir = spec.Path
+		if spec.Opaque != "" {
+			dir = spec.Opaque
+		} else if spec.Host != "" {
+			return nil, fmt.Errorf("Store spec [%s] has a host, expected file:///abs/path or file:rel/path", spec)
+		}
+		var params = rangestore.NewParams(spec)
+		var fast, depth = params.Bool("fast"), params.Int("depth", -1)
+		if err := params.Err(); err != nil {
+			return nil, err
+		}
+		return ConnectFileStore(dir, depth, fast)
+	})
+}
@@ -0,0 +1,50 @@
+// status of the FileStore, see rangestore.StatusStore
+
+package filestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"rangestore"
+)
+
+// the store directory is still there
+func (f *FileStore) Ping() error {
+	fi, err := os.Stat(f.StorePath)
+	if err != nil {
+		return fmt.Errorf("Path [%s] is not a FileStore directory (ERROR: %s, %w)", f.StorePath, err, rangestore.ErrUnavailable)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("Path [%s] is not a directory, %w", f.StorePath, rangestore.ErrUnavailable)
+	}
+	return nil
+}
+
+// walks the store, every dir is a cluster and the ones with the cluster
+// config are the leaves
+func (f *FileStore) Status() (rangestore.StoreStatus, error) {
+	var status = rangestore.StoreStatus{Type: "filestore", Root: f.StorePath}
+	var seen = make(map[string]bool)
+	var root = filepath.Clean(f.StorePath)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && path != root {
+			status.Clusters++
+		} else if fi.Name() == _config {
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			config, err := yamlToMap(content)
+			if err != nil {
+				return fmt.Errorf("Cluster Config [%s] is not valid (Error: %s)", path, err)
+			}
+			status.AddLeaf(config, seen)
+		}
+		return nil
+	})
+	return status, err
+}
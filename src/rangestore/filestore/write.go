@@ -0,0 +1,452 @@
+// Write operations on the FileStore (rangestore.WritableStore).
+// The cluster config is always replaced atomically, ie, the new content is
+// written to a temp file in the same dir which is then renamed over the
+// cluster.yaml. The version of a cluster is the sha1 of its cluster.yaml,
+// before the rename we make sure the file is still the version we read,
+// so a concurrent edit (by another yarge or by hand) is not overwritten.
+// An edit returns the version of the config it wrote.
+// Only the keys an edit changes are rewritten, the rest of the file (the
+// comments, the order of the keys) stays as it was written by hand. A file
+// which can't be patched that way (eg, in flow style) is written out whole
+// from its keys, losing the comments.
+
+package filestore
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"rangeops"
+	"rangestore"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// version of a leaf cluster
+func (f *FileStore) ClusterVersion(cluster string) (string, error) {
+	_, version, err := f.readVersionedConfig(cluster)
+	return version, err
+}
+
+//////////////
+// CLUSTERS //
+//////////////
+
+// creates an empty leaf cluster, the non-leaf clusters on the way are
+// created if they don't exist
+func (f *FileStore) CreateCluster(cluster string) (string, error) {
+	if !rangestore.ValidClusterName(cluster) {
+		return "", fmt.Errorf("CreateCluster for [%s] Failed (Error: %w)", cluster, rangestore.ErrInvalidName)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkCreatable(cluster); err != nil {
+		return "", fmt.Errorf("CreateCluster for [%s] Failed (Error: %w)", cluster, err)
+	}
+	var dir = f.clusterToPath(cluster)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("CreateCluster for [%s] Failed (Error: %s)", cluster, err)
+	}
+	content, err := yaml.Marshal(map[string][]string{})
+	if err != nil {
+		return "", err
+	}
+	return f.writeClusterConfig(cluster, content, "")
+}
+
+// deletes a leaf cluster, or a non-leaf cluster with no children
+func (f *FileStore) DeleteCluster(cluster string, version string) error {
+	if !rangestore.ValidClusterName(cluster) {
+		return fmt.Errorf("DeleteCluster for [%s] Failed (Error: %w)", cluster, rangestore.ErrInvalidName)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	isLeaf, err := f.checkIsLeafNode(cluster)
+	if err != nil {
+		return err
+	}
+	var dir = f.clusterToPath(cluster)
+	if !isLeaf {
+		children, err := f.listClusters(cluster)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return fmt.Errorf("DeleteCluster for [%s] Failed (Error: has child clusters %s, %w)", cluster, children, rangestore.ErrConflict)
+		}
+		return os.Remove(dir)
+	}
+
+	if _, err = f.checkVersion(cluster, version); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// renames a leaf cluster, the version stays (the config is the same)
+func (f *FileStore) RenameCluster(cluster string, to string, version string) (string, error) {
+	if !rangestore.ValidClusterName(cluster) || !rangestore.ValidClusterName(to) {
+		return "", fmt.Errorf("RenameCluster for [%s -> %s] Failed (Error: %w)", cluster, to, rangestore.ErrInvalidName)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	isLeaf, err := f.checkIsLeafNode(cluster)
+	if err != nil {
+		return "", err
+	} else if !isLeaf {
+		return "", fmt.Errorf("RenameCluster for [%s -> %s] Failed (Error: not a leaf cluster, %w)", cluster, to, rangestore.ErrInvalidName)
+	}
+	if err = f.checkCreatable(to); err != nil {
+		return "", fmt.Errorf("RenameCluster for [%s -> %s] Failed (Error: %w)", cluster, to, err)
+	}
+	current, err := f.checkVersion(cluster, version)
+	if err != nil {
+		return "", err
+	}
+
+	var dir = f.clusterToPath(to)
+	if err = os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", err
+	}
+	if err = os.Rename(f.clusterToPath(cluster), dir); err != nil {
+		return "", err
+	}
+	return current, nil
+}
+
+//////////
+// KEYS //
+//////////
+
+// sets the values of the key (creates the key if not there)
+func (f *FileStore) SetKey(cluster string, key string, values []string, version string) (string, error) {
+	if err := rangestore.ValidKeyValues(key, values); err != nil {
+		return "", fmt.Errorf("SetKey for [%s:%s] Failed (Error: %w)", cluster, key, err)
+	}
+	return f.modifyCluster(cluster, version, func(config map[string][]string) error {
+		var set = append([]string{}, values...)
+		rangeops.ArrayToSet(&set)
+		config[key] = set
+		return nil
+	})
+}
+
+// deletes the key
+func (f *FileStore) DeleteKey(cluster string, key string, version string) (string, error) {
+	return f.modifyCluster(cluster, version, func(config map[string][]string) error {
+		if _, ok := config[key]; !ok {
+			return fmt.Errorf("DeleteKey for [%s:%s] Failed (Error: Cannot find Key [%s], %w)", cluster, key, key, rangestore.ErrNotFound)
+		}
+		delete(config, key)
+		return nil
+	})
+}
+
+// appends the values to the key (creates the key if not there)
+func (f *FileStore) AddKeyValues(cluster string, key string, values []string, version string) (string, error) {
+	if err := rangestore.ValidKeyValues(key, values); err != nil {
+		return "", fmt.Errorf("AddKeyValues for [%s:%s] Failed (Error: %w)", cluster, key, err)
+	}
+	return f.modifyCluster(cluster, version, func(config map[string][]string) error {
+		var set = append(config[key], values...)
+		rangeops.ArrayToSet(&set)
+		config[key] = set
+		return nil
+	})
+}
+
+// removes the values from the key, the key stays even if it has
+// no more values
+func (f *FileStore) RemoveKeyValues(cluster string, key string, values []string, version string) (string, error) {
+	return f.modifyCluster(cluster, version, func(config map[string][]string) error {
+		current, ok := config[key]
+		if !ok {
+			return fmt.Errorf("RemoveKeyValues for [%s:%s] Failed (Error: Cannot find Key [%s], %w)", cluster, key, key, rangestore.ErrNotFound)
+		}
+		var result = make([]string, 0)
+		rangeops.Difference(&current, &values, &result)
+		config[key] = result
+		return nil
+	})
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// read-modify-write of a leaf cluster config, returns the new version
+func (f *FileStore) modifyCluster(cluster string, version string, modify func(map[string][]string) error) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	content, current, err := f.readVersionedConfig(cluster)
+	if err != nil {
+		return "", err
+	}
+	if version != "" && version != current {
+		return "", fmt.Errorf("Edit of [%s] Failed (Error: version is %s, not %s, %w)", cluster, current, version, rangestore.ErrConflict)
+	}
+	config, err := yamlToMap(content)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Edit of [%s] Failed (Error: %s)", cluster, err))
+	}
+	var old = make(map[string][]string, len(config))
+	for key, values := range config {
+		old[key] = append([]string{}, values...)
+	}
+	if err = modify(config); err != nil {
+		return "", err
+	}
+	if content, err = patchConfig(content, old, config); err != nil {
+		return "", err
+	}
+	return f.writeClusterConfig(cluster, content, current)
+}
+
+// reads the config of a leaf cluster along with its version
+func (f *FileStore) readVersionedConfig(cluster string) ([]byte, string, error) {
+	isLeaf, err := f.checkIsLeafNode(cluster)
+	if err != nil {
+		return []byte{}, "", err
+	} else if !isLeaf {
+		return []byte{}, "", fmt.Errorf("cluster [%s] is NOT a LeafNode in FileStore [%s], %w", cluster, f.StorePath, rangestore.ErrNotFound)
+	}
+	content, err := f.readClusterConfig(cluster)
+	if err != nil {
+		return []byte{}, "", err
+	}
+	return content, configVersion(content), nil
+}
+
+// make sure the cluster is still the version the edit is based on,
+// returns the current version
+func (f *FileStore) checkVersion(cluster string, version string) (string, error) {
+	_, current, err := f.readVersionedConfig(cluster)
+	if err != nil {
+		return "", err
+	}
+	if version != "" && version != current {
+		return "", fmt.Errorf("Edit of [%s] Failed (Error: version is %s, not %s, %w)", cluster, current, version, rangestore.ErrConflict)
+	}
+	return current, nil
+}
+
+// a cluster can be created if it doesn't exist and none of its
+// parents are leaf clusters
+func (f *FileStore) checkCreatable(cluster string) error {
+	if _, err := os.Stat(f.clusterToPath(cluster)); err == nil {
+		return rangestore.ErrExists
+	}
+	var parts = strings.Split(cluster, "-")
+	for i := 1; i < len(parts); i++ {
+		var parent = strings.Join(parts[:i], "-")
+		if isLeaf, err := f.checkIsLeafNode(parent); err == nil && isLeaf {
+			return fmt.Errorf("parent [%s] is a leaf cluster, %w", parent, rangestore.ErrConflict)
+		}
+	}
+	return nil
+}
+
+// atomically replace the cluster config, returns its new version. If
+// version is given, the current config has to be of that version
+func (f *FileStore) writeClusterConfig(cluster string, content []byte, version string) (string, error) {
+	var dir = f.clusterToPath(cluster)
+	tmp, err := ioutil.TempFile(dir, "."+_config+".")
+	if err != nil {
+		return "", err
+	}
+	// cleanup, if the rename did not happen
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+
+	// somebody could have edited the file while we were at it
+	if version != "" {
+		current, err := f.readClusterConfig(cluster)
+		if err != nil {
+			return "", err
+		}
+		if configVersion(current) != version {
+			return "", fmt.Errorf("Edit of [%s] Failed (Error: modified concurrently, %w)", cluster, rangestore.ErrConflict)
+		}
+	}
+
+	if err = os.Rename(tmp.Name(), fmt.Sprintf("%s/%s", dir, _config)); err != nil {
+		return "", err
+	}
+	return configVersion(content), nil
+}
+
+// version of the cluster config
+func configVersion(content []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(content))
+}
+
+// the cluster config (content) with the keys changed from old to config,
+// the lines of the keys not changed are kept as they are. If the patched
+// file doesn't read back as config, it is written out from config
+func patchConfig(content []byte, old map[string][]string, config map[string][]string) ([]byte, error) {
+	var keys = make([]string, 0, len(old)+len(config))
+	for key := range old {
+		keys = append(keys, key)
+	}
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	rangeops.ArrayToSet(&keys)
+
+	var patched = string(content)
+	if strings.TrimSpace(patched) == "{}" {
+		patched = ""
+	}
+	for _, key := range keys {
+		values, ok := config[key]
+		if previous, had := old[key]; ok && had && reflect.DeepEqual(values, previous) {
+			continue
+		}
+		var block string
+		if ok {
+			encoded, err := yaml.Marshal(map[string][]string{key: values})
+			if err != nil {
+				return nil, err
+			}
+			block = string(encoded)
+		}
+		patched = patchKey(patched, key, block)
+	}
+
+	if check, err := yamlToMap([]byte(patched)); err == nil && reflect.DeepEqual(check, config) {
+		return []byte(patched), nil
+	}
+	return yaml.Marshal(config)
+}
+
+// replace the lines of the top level key with block (as encoded by
+// yaml.Marshal), the key is removed (along with the comment right above
+// it) if block is empty and added at the end if it is not there. The
+// list items get the indent of the file
+func patchKey(content string, key string, block string) string {
+	var lines = strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	var indent = ""
+	for _, line := range lines {
+		if trimmed := strings.TrimLeft(line, " "); strings.HasPrefix(trimmed, "- ") {
+			indent = line[:len(line)-len(trimmed)]
+			break
+		}
+	}
+	if block != "" {
+		var encoded = strings.SplitAfter(strings.TrimSuffix(block, "\n"), "\n")
+		for i := 1; i < len(encoded); i++ {
+			encoded[i] = indent + encoded[i]
+		}
+		block = strings.Join(encoded, "") + "\n"
+	}
+
+	// the key line and the lines of its value (indented, or list items),
+	// the blank lines and comments after them go with the next key
+	var start, end = -1, -1
+	for i, line := range lines {
+		if start < 0 {
+			if topLevelKey(line) == key {
+				start, end = i, i+1
+			}
+			continue
+		}
+		if topLevelKey(line) != "" {
+			break
+		}
+		if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(line, "#") {
+			end = i + 1
+		}
+	}
+
+	if start < 0 {
+		if block == "" {
+			return content
+		}
+		var out = strings.Join(lines, "")
+		if out != "" && !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		// the keys are apart, keep it that way
+		if strings.Contains(out, "\n\n") {
+			out += "\n"
+		}
+		return out + block
+	}
+	if !strings.HasSuffix(lines[end-1], "\n") && block != "" {
+		block = strings.TrimSuffix(block, "\n")
+	}
+	if block == "" {
+		for start > 0 && strings.HasPrefix(lines[start-1], "#") {
+			start--
+		}
+	}
+	var out = append([]string{}, lines[:start]...)
+	if block != "" {
+		out = append(out, block)
+	} else if start > 0 && end < len(lines) && strings.TrimSpace(lines[start-1]) == "" && strings.TrimSpace(lines[end]) == "" {
+		// one blank line between the keys around the removed one
+		end++
+	}
+	out = append(out, lines[end:]...)
+	// no blank lines left at the end by a removed key
+	for block == "" && end == len(lines) && len(out) > 0 && strings.TrimSpace(out[len(out)-1]) == "" {
+		out = out[:len(out)-1]
+	}
+	return strings.Join(out, "")
+}
+
+// the key of the line if it is a top level key (not indented, not a
+// list item or a comment), "" if not
+func topLevelKey(line string) string {
+	if line == "" || strings.ContainsAny(line[:1], " \t#-\n") {
+		return ""
+	}
+	var colon = strings.Index(line, ":")
+	if colon < 0 {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(line[:colon]), `"'`)
+}
+
+// all the keys and their values in the cluster config
+func yamlToMap(content []byte) (map[string][]string, error) {
+	var config = make(map[string][]string)
+	keys, err := yamlKeyLookup(content, "KEYS")
+	if err != nil {
+		return config, err
+	}
+	for _, key := range *keys {
+		values, err := yamlKeyLookup(content, key)
+		if err != nil {
+			return config, err
+		}
+		config[key] = *values
+	}
+	return config, nil
+}
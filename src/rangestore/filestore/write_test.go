@@ -0,0 +1,275 @@
+package filestore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"rangestore"
+	"testing"
+	"time"
+)
+
+// writes are done on a copy of the test store
+func writableStore(t *testing.T) *FileStore {
+	var dir = t.TempDir()
+	err := filepath.Walk("./t", func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel("./t", path)
+		if fi.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0755)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dir, rel), content, 0644)
+	})
+	if err != nil {
+		t.Fatal("Copying the Test Store ", err)
+	}
+	store, err := ConnectFileStore(dir, 3, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	return store
+}
+
+// Create, Rename and Delete of clusters
+func TestWriteCluster(t *testing.T) {
+	var store = writableStore(t)
+	var cluster = "ops-prod-vpc9-web"
+
+	if _, err := store.CreateCluster(cluster); err != nil {
+		t.Fatalf("Expected NO ERROR, Creating [%s] Got: %s", cluster, err)
+	}
+	if results, err := store.ClusterLookup(&[]string{"ops-prod-vpc9"}); err != nil || !compare(*results, []string{cluster}) {
+		t.Errorf("Expected [%s] in ops-prod-vpc9, Got: %v (Error: %s)", cluster, results, err)
+	}
+	if _, err := store.CreateCluster(cluster); !errors.Is(err, rangestore.ErrExists) {
+		t.Errorf("Expected ErrExists, Creating [%s] again, Got: %v", cluster, err)
+	}
+	// can't create under a leaf cluster
+	if _, err := store.CreateCluster(cluster + "-a"); !errors.Is(err, rangestore.ErrConflict) {
+		t.Errorf("Expected ErrConflict, Creating under a leaf, Got: %v", err)
+	}
+	if _, err := store.CreateCluster("ops-Prod"); !errors.Is(err, rangestore.ErrInvalidName) {
+		t.Errorf("Expected ErrInvalidName, Got: %v", err)
+	}
+
+	var to = "ops-prod-vpc9-app"
+	version, _ := store.ClusterVersion(cluster)
+	if _, err := store.RenameCluster(cluster, to, version); err != nil {
+		t.Fatalf("Expected NO ERROR, Renaming [%s] Got: %s", cluster, err)
+	}
+	if isLeaf, err := store.checkIsLeafNode(to); !isLeaf || err != nil {
+		t.Errorf("Expected [%s] to be a LeafNode, Got [bool:%v, error:%s]", to, isLeaf, err)
+	}
+	if _, err := store.checkIsLeafNode(cluster); err == nil {
+		t.Errorf("Expected [%s] to be gone after rename", cluster)
+	}
+
+	// non-leaf with children is not deleted
+	if err := store.DeleteCluster("ops-prod-vpc9", ""); !errors.Is(err, rangestore.ErrConflict) {
+		t.Errorf("Expected ErrConflict, Deleting a cluster with children, Got: %v", err)
+	}
+	if err := store.DeleteCluster(to, "bad-version"); !errors.Is(err, rangestore.ErrConflict) {
+		t.Errorf("Expected ErrConflict, Deleting with a stale version, Got: %v", err)
+	}
+	if err := store.DeleteCluster(to, version); err != nil {
+		t.Errorf("Expected NO ERROR, Deleting [%s] Got: %s", to, err)
+	}
+	if err := store.DeleteCluster("ops-prod-vpc9", ""); err != nil {
+		t.Errorf("Expected NO ERROR, Deleting empty ops-prod-vpc9 Got: %s", err)
+	}
+}
+
+// Set, Add, Remove and Delete of keys
+func TestWriteKey(t *testing.T) {
+	var store = writableStore(t)
+	var cluster = "ops-prod-vpc1-range"
+
+	if _, err := store.AddKeyValues(cluster, "NODES", []string{"range1004.ops.example.com", "range1001.ops.example.com"}, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, AddKeyValues Got: %s", err)
+	}
+	expected := []string{"range1001.ops.example.com", "range1002.ops.example.com", "range1003.ops.example.com", "range1004.ops.example.com"}
+	if results, err := store.KeyLookup(&[]string{cluster}, "NODES"); err != nil || !compare(*results, expected) {
+		t.Errorf("Expected %s, Got: %v (Error: %s)", expected, results, err)
+	}
+
+	if _, err := store.RemoveKeyValues(cluster, "NODES", []string{"range1001.ops.example.com"}, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, RemoveKeyValues Got: %s", err)
+	}
+	expected = expected[1:]
+	if results, err := store.KeyLookup(&[]string{cluster}, "NODES"); err != nil || !compare(*results, expected) {
+		t.Errorf("Expected %s, Got: %v (Error: %s)", expected, results, err)
+	}
+	// reverse lookup sees the edit
+	if results, err := store.KeyReverseLookup("range1004.ops.example.com"); err != nil || !compare(*results, []string{cluster}) {
+		t.Errorf("Expected [%s], Got: %v (Error: %s)", cluster, results, err)
+	}
+
+	if _, err := store.SetKey(cluster, "QAFOR", []string{"qa1", "qa2"}, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, SetKey Got: %s", err)
+	}
+	if results, err := store.KeyLookup(&[]string{cluster}, "QAFOR"); err != nil || !compare(*results, []string{"qa1", "qa2"}) {
+		t.Errorf("Expected [qa1 qa2], Got: %v (Error: %s)", results, err)
+	}
+	if _, err := store.SetKey(cluster, "bad", []string{"x"}, ""); !errors.Is(err, rangestore.ErrInvalidName) {
+		t.Errorf("Expected ErrInvalidName, Got: %v", err)
+	}
+
+	if _, err := store.DeleteKey(cluster, "QAFOR", ""); err != nil {
+		t.Fatalf("Expected NO ERROR, DeleteKey Got: %s", err)
+	}
+	if _, err := store.KeyLookup(&[]string{cluster}, "QAFOR"); err == nil {
+		t.Errorf("Expected ERROR, QAFOR was deleted")
+	}
+}
+
+// an edit rewrites only the keys it changes, the rest of a hand written
+// config stays as it was
+func TestWriteKeepsConfig(t *testing.T) {
+	var store = writableStore(t)
+	var cluster = "ops-prod-vpc1-range"
+	var path = filepath.Join(store.clusterToPath(cluster), _config)
+	var config = `# range servers of vpc1, owned by ops
+NODES:
+  - range1001.ops.example.com   # the first one
+  - range1002.ops.example.com
+
+# who to ask
+AUTHORS:
+  - Vigith Maurice
+`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		edit     func() (string, error)
+		expected string
+	}{
+		{func() (string, error) {
+			return store.AddKeyValues(cluster, "AUTHORS", []string{"Ops"}, "")
+		}, `# range servers of vpc1, owned by ops
+NODES:
+  - range1001.ops.example.com   # the first one
+  - range1002.ops.example.com
+
+# who to ask
+AUTHORS:
+  - Vigith Maurice
+  - Ops
+`},
+		{func() (string, error) {
+			return store.SetKey(cluster, "QAFOR", []string{"qa1"}, "")
+		}, `# range servers of vpc1, owned by ops
+NODES:
+  - range1001.ops.example.com   # the first one
+  - range1002.ops.example.com
+
+# who to ask
+AUTHORS:
+  - Vigith Maurice
+  - Ops
+
+QAFOR:
+  - qa1
+`},
+		{func() (string, error) {
+			return store.DeleteKey(cluster, "AUTHORS", "")
+		}, `# range servers of vpc1, owned by ops
+NODES:
+  - range1001.ops.example.com   # the first one
+  - range1002.ops.example.com
+
+QAFOR:
+  - qa1
+`},
+	}
+	for i, c := range cases {
+		if _, err := c.edit(); err != nil {
+			t.Fatalf("%d: Expected NO ERROR, Got: %s", i, err)
+		}
+		if content, _ := ioutil.ReadFile(path); string(content) != c.expected {
+			t.Errorf("%d: Expected the config\n%s\nGot:\n%s", i, c.expected, content)
+		}
+	}
+
+	// flow style can't be patched, it is written out whole
+	if err := ioutil.WriteFile(path, []byte("{NODES: [range1001.ops.example.com], AUTHORS: [Ops]}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddKeyValues(cluster, "NODES", []string{"range1002.ops.example.com"}, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, AddKeyValues Got: %s", err)
+	}
+	if results, err := store.KeyLookup(&[]string{cluster}, "NODES"); err != nil || !compare(*results, []string{"range1001.ops.example.com", "range1002.ops.example.com"}) {
+		t.Errorf("Expected both the nodes, Got: %v (Error: %v)", results, err)
+	}
+	if results, err := store.KeyLookup(&[]string{cluster}, "AUTHORS"); err != nil || !compare(*results, []string{"Ops"}) {
+		t.Errorf("Expected [Ops], Got: %v (Error: %v)", results, err)
+	}
+}
+
+// an edit based on an older version is refused
+func TestWriteConflict(t *testing.T) {
+	var store = writableStore(t)
+	var cluster = "ops-prod-vpc1-range"
+
+	version, err := store.ClusterVersion(cluster)
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, ClusterVersion Got: %s", err)
+	}
+	edited, err := store.SetKey(cluster, "QAFOR", []string{"qa1"}, version)
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, SetKey Got: %s", err)
+	}
+	// version has moved on
+	if _, err = store.SetKey(cluster, "QAFOR", []string{"qa2"}, version); !errors.Is(err, rangestore.ErrConflict) {
+		t.Errorf("Expected ErrConflict, SetKey with stale version, Got: %v", err)
+	}
+	if results, _ := store.KeyLookup(&[]string{cluster}, "QAFOR"); !compare(*results, []string{"qa1"}) {
+		t.Errorf("Expected [qa1], Got: %v", *results)
+	}
+	// the version the edit made, the next edit can be based on it
+	if current, _ := store.ClusterVersion(cluster); edited != current {
+		t.Errorf("Expected the version of the edit [%s], Got: %s", current, edited)
+	}
+	if _, err = store.SetKey(cluster, "QAFOR", []string{"qa2"}, edited); err != nil {
+		t.Errorf("Expected NO ERROR, SetKey on the version of the edit Got: %s", err)
+	}
+}
+
+// the changes of the files are told, the new directories too
+func TestNotify(t *testing.T) {
+	var f = writableStore(t)
+	var changed = make(chan bool, 100)
+	var stop = make(chan bool)
+	defer close(stop)
+	if err := f.Notify(func() { changed <- true }, stop); err != nil {
+		t.Fatalf("Expected NO ERROR, Notify Got: %s", err)
+	}
+	var wait = func(what string) {
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected a change, %s", what)
+		}
+		// the events of the same change
+		time.Sleep(50 * time.Millisecond)
+		for len(changed) > 0 {
+			<-changed
+		}
+	}
+
+	if _, err := f.CreateCluster("ops-prod-vpc9-web"); err != nil {
+		t.Fatalf("Expected NO ERROR, Creating Got: %s", err)
+	}
+	wait("Creating a cluster")
+	if _, err := f.SetKey("ops-prod-vpc9-web", "NODES", []string{"web9001.ops.example.com"}, ""); err != nil {
+		t.Fatalf("Expected NO ERROR, SetKey Got: %s", err)
+	}
+	wait("Setting a key in a new directory")
+}
@@ -0,0 +1,364 @@
+// Another yargeserver as the store, so that a server can answer for the
+// data of another (eg, a regional server for the other regions). The
+// lookups are range expressions sent to the JSON API of the upstream
+// server (GET /v1/range/list?<expr>&format=json):
+//   ClusterLookup        %cluster
+//   KeyLookup            %cluster:KEY
+//   KeyReverseLookup     *value
+//   KeyReverseLookupAttr *value;ATTR
+//   KeyReverseLookupHint *value;ATTR:hint
+// The grammar has no quoting, so the operands it can't have (eg, a,b) are
+// refused (ErrInvalidName) instead of being sent.
+// The upstream can have many endpoints, they are used in turns and a
+// failed request is tried on the next one. The responses are cached
+// for a while, as there is no way to know when the upstream changed.
+
+package httpstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"rangestore"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// error codes of the upstream (see rangeserver), and our errors for them
+var upstreamErrors = map[string]error{
+	"NOT_FOUND":      rangestore.ErrNotFound,
+	"INVALID_NAME":   rangestore.ErrInvalidName,
+	"UNAVAILABLE":    rangestore.ErrUnavailable,
+	"LIMIT_EXCEEDED": rangestore.ErrLimit,
+}
+
+// same as the grammar (expr.peg), the values of a reverse lookup are
+// letters, digits, '-', ' ' and '.'
+var reverseValue = regexp.MustCompile(`^[a-zA-Z0-9- .]+$`)
+
+// Options of the store, the zero values get the defaults
+type Options struct {
+	Timeout   time.Duration // of a request to an endpoint (default 5s)
+	Retries   int           // endpoints tried after the first one fails (default all of them, negative is none)
+	CacheTTL  time.Duration // how long the responses are cached, zero is no cache
+	CacheSize int           // responses cached, zero is no bound
+}
+
+type HTTPStore struct {
+	endpoints []string // http://host:port[/mount], without the trailing /
+	options   Options
+	client    *http.Client
+	next      uint32           // endpoint to start with, in turns
+	upstream  rangestore.Store // the lookups, without the cache
+	store     rangestore.Store // the lookups, with the cache (if any)
+	cache     *rangestore.CachingStore
+}
+
+// the response of the upstream (see rangeserver.Response)
+type response struct {
+	Results []string `json:"results"`
+	Errors  []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// Connect to the upstream, one of the endpoints has to be ready
+func ConnectHTTPStore(endpoints []string, options Options) (h *HTTPStore, err error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("No Endpoints for the HTTP Store")
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 5 * time.Second
+	}
+	if options.Retries == 0 || options.Retries > len(endpoints)-1 {
+		options.Retries = len(endpoints) - 1
+	} else if options.Retries < 0 {
+		options.Retries = 0
+	}
+	h = &HTTPStore{options: options}
+	for _, e := range endpoints {
+		if _, err = url.Parse(e); err != nil || !strings.HasPrefix(e, "http") {
+			return nil, fmt.Errorf("Endpoint [%s] is not a http(s) URL", e)
+		}
+		h.endpoints = append(h.endpoints, strings.TrimSuffix(e, "/"))
+	}
+	// the connections to the endpoints are kept and reused
+	h.client = &http.Client{
+		Timeout: options.Timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: options.Timeout, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 32,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	h.upstream = &upstream{h: h}
+	h.store = h.upstream
+	if options.CacheTTL > 0 {
+		h.cache = rangestore.NewCachingStore(h.upstream, options.CacheTTL, options.CacheSize)
+		h.store = h.cache
+	}
+	if err = h.Ping(); err != nil {
+		h.DisconnectHTTPStore()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *HTTPStore) DisconnectHTTPStore() {
+	if h.cache != nil {
+		h.cache.Close()
+	}
+	h.client.CloseIdleConnections()
+	return
+}
+
+func (h *HTTPStore) Close() {
+	h.DisconnectHTTPStore()
+}
+
+// one of the endpoints is ready
+func (h *HTTPStore) Ping() error {
+	_, err := h.request(context.Background(), "/readyz", func(r *http.Response) (interface{}, error) {
+		io.Copy(ioutil.Discard, r.Body)
+		if r.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Upstream is NOT READY (Status: %s), %w", r.Status, rangestore.ErrUnavailable)
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// what the upstream has
+func (h *HTTPStore) Status() (rangestore.StoreStatus, error) {
+	status, err := h.request(context.Background(), "/v1/status", func(r *http.Response) (interface{}, error) {
+		var status rangestore.StoreStatus
+		if r.StatusCode != http.StatusOK {
+			io.Copy(ioutil.Discard, r.Body)
+			return nil, fmt.Errorf("Upstream Status Failed (Status: %s), %w", r.Status, rangestore.ErrUnavailable)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			return nil, fmt.Errorf("Upstream Status is not valid (Error: %s)", err)
+		}
+		return status, nil
+	})
+	if err != nil {
+		return rangestore.StoreStatus{}, err
+	}
+	var s = status.(rangestore.StoreStatus)
+	s.Type = fmt.Sprintf("httpstore (%s)", s.Type)
+	return s, nil
+}
+
+// hits and misses of the response cache
+func (h *HTTPStore) CacheStats() rangestore.CacheStats {
+	if h.cache == nil {
+		return rangestore.CacheStats{}
+	}
+	return h.cache.CacheStats()
+}
+
+////////////////////
+// LOOKUP CLUSTER //
+////////////////////
+
+func (h *HTTPStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	return h.store.ClusterLookup(cluster)
+}
+
+func (h *HTTPStore) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	return h.store.KeyLookup(cluster, key)
+}
+
+////////////////////
+// LOOKUP REVERSE //
+////////////////////
+
+func (h *HTTPStore) KeyReverseLookup(key string) (*[]string, error) {
+	return h.store.KeyReverseLookup(key)
+}
+
+func (h *HTTPStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return h.store.KeyReverseLookupAttr(key, attr)
+}
+
+func (h *HTTPStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return h.store.KeyReverseLookupHint(key, attr, hint)
+}
+
+// Scope is the store doing the lookups of a query, the requests to the
+// upstream are given up at the deadline of the query
+func (h *HTTPStore) Scope(t rangestore.Tracker) rangestore.Store {
+	return rangestore.Scope(h.store, t)
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// the lookups as queries to the upstream, without the cache
+type upstream struct {
+	h       *HTTPStore
+	tracker rangestore.Tracker // the query the lookups are for, nil if none
+}
+
+func (u *upstream) Scope(t rangestore.Tracker) rangestore.Store {
+	return &upstream{h: u.h, tracker: t}
+}
+
+func (u *upstream) ClusterLookup(cluster *[]string) (*[]string, error) {
+	var results = make([]string, 0)
+	for _, elem := range *cluster {
+		if !validCluster(elem) {
+			return &[]string{}, fmt.Errorf("ClusterLookup for [%s] Failed (Error: not a name of the grammar, %w)", elem, rangestore.ErrInvalidName)
+		}
+		result, err := u.query("%" + elem)
+		if err != nil {
+			return &[]string{}, err
+		}
+		results = append(results, result...)
+	}
+	return &results, nil
+}
+
+func (u *upstream) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	var results = make([]string, 0)
+	for _, elem := range *cluster {
+		if !validCluster(elem) || !validKey(key) {
+			return &[]string{}, fmt.Errorf("KeyLookup for [%s:%s] Failed (Error: not a name of the grammar, %w)", elem, key, rangestore.ErrInvalidName)
+		}
+		result, err := u.query(fmt.Sprintf("%%%s:%s", elem, key))
+		if err != nil {
+			return &[]string{}, err
+		}
+		results = append(results, result...)
+	}
+	return &results, nil
+}
+
+func (u *upstream) KeyReverseLookup(key string) (*[]string, error) {
+	if !reverseValue.MatchString(key) {
+		return &[]string{}, fmt.Errorf("KeyReverseLookup for [%s] Failed (Error: not a value of the grammar, %w)", key, rangestore.ErrInvalidName)
+	}
+	return u.reverse("*" + key)
+}
+
+func (u *upstream) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	if !reverseValue.MatchString(key) || !validKey(attr) {
+		return &[]string{}, fmt.Errorf("KeyReverseLookupAttr for [%s;%s] Failed (Error: not a value of the grammar, %w)", key, attr, rangestore.ErrInvalidName)
+	}
+	return u.reverse(fmt.Sprintf("*%s;%s", key, attr))
+}
+
+func (u *upstream) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	if hint == "" {
+		return u.KeyReverseLookupAttr(key, attr)
+	}
+	if !reverseValue.MatchString(key) || !validKey(attr) || !rangestore.ValidClusterName(hint) {
+		return &[]string{}, fmt.Errorf("KeyReverseLookupHint for [%s;%s:%s] Failed (Error: not a value of the grammar, %w)", key, attr, hint, rangestore.ErrInvalidName)
+	}
+	return u.reverse(fmt.Sprintf("*%s;%s:%s", key, attr, hint))
+}
+
+// the cluster can be put in a query, RANGE is the top level
+func validCluster(cluster string) bool {
+	return cluster == "RANGE" || rangestore.ValidClusterName(cluster)
+}
+
+// the key can be put in a query, KEYS is the list of keys
+func validKey(key string) bool {
+	return key == "KEYS" || rangestore.ValidKeyName(key)
+}
+
+func (u *upstream) reverse(query string) (*[]string, error) {
+	results, err := u.query(query)
+	if err != nil {
+		return &[]string{}, err
+	}
+	return &results, nil
+}
+
+// the query on the upstream, given up at the deadline of the query it is
+// for (if any) with the limit it hit
+func (u *upstream) query(query string) ([]string, error) {
+	if u.tracker == nil || u.tracker.Deadline().IsZero() {
+		return u.h.query(context.Background(), query)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), u.tracker.Deadline())
+	defer cancel()
+	results, err := u.h.query(ctx, query)
+	if ctx.Err() != nil {
+		if limitErr := u.tracker.Visit(0); limitErr != nil {
+			return nil, limitErr
+		}
+	}
+	return results, err
+}
+
+// the results of the query on the upstream, the errors of the upstream
+// are told apart (not found, etc)
+func (h *HTTPStore) query(ctx context.Context, query string) ([]string, error) {
+	results, err := h.request(ctx, "/v1/range/list?"+url.QueryEscape(query)+"&format=json", func(r *http.Response) (interface{}, error) {
+		var body response
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			if r.StatusCode >= 500 {
+				return nil, fmt.Errorf("Upstream Failed (Status: %s), %w", r.Status, rangestore.ErrUnavailable)
+			}
+			return nil, fmt.Errorf("Upstream Response is not valid (Status: %s, Error: %s)", r.Status, err)
+		}
+		if len(body.Errors) == 0 {
+			return body.Results, nil
+		}
+		var e = body.Errors[0]
+		if sentinel, ok := upstreamErrors[e.Code]; ok {
+			return nil, fmt.Errorf("Upstream [%s] %s, %w", query, e.Message, sentinel)
+		}
+		return nil, fmt.Errorf("Upstream [%s] %s (Code: %s)", query, e.Message, e.Code)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results.([]string), nil
+}
+
+// the request on the endpoints, in turns, until one of them answers (or
+// ctx is done). An endpoint which can't be reached (or is unavailable) is
+// skipped
+func (h *HTTPStore) request(ctx context.Context, path string, read func(*http.Response) (interface{}, error)) (interface{}, error) {
+	var start = int(atomic.AddUint32(&h.next, 1)-1) % len(h.endpoints)
+	var err error
+	for i := 0; i <= h.options.Retries; i++ {
+		var endpoint = h.endpoints[(start+i)%len(h.endpoints)]
+		var r *http.Response
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, "GET", endpoint+path, nil); err == nil {
+			r, err = h.client.Do(req)
+		}
+		if err != nil {
+			err = fmt.Errorf("Endpoint [%s] Failed (Error: %s), %w", endpoint, err, rangestore.ErrUnavailable)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		var result interface{}
+		result, err = read(r)
+		r.Body.Close()
+		if errors.Is(err, rangestore.ErrUnavailable) {
+			err = fmt.Errorf("Endpoint [%s] %w", endpoint, err)
+			continue
+		}
+		return result, err
+	}
+	return nil, err
+}
@@ -0,0 +1,222 @@
+package httpstore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"rangeserver"
+	"rangestore"
+	"rangestore/filestore"
+	"rangestore/storetest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a yargeserver of the store, the way it answers the JSON queries
+// (see requestHandler), requests counts the requests
+func serve(t *testing.T, store rangestore.Store, requests *int32) *httptest.Server {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/v1/range/list", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		query, _, err := rangeserver.ParseQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, _ := rangeserver.Expand(query, store, false)
+		status, _ := rangeserver.Status(response.Errors)
+		rangeserver.WriteJSON(w, status, response)
+	})
+	mux.Handle(rangeserver.ReadyPath, rangeserver.HealthHandler())
+	mux.Handle(rangeserver.StatusPath, rangeserver.StatusHandler(store, rangeserver.NewReadiness(store, time.Minute)))
+	var server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func fixture(t *testing.T) rangestore.Store {
+	store, err := filestore.ConnectFileStore("../filestore/t", -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	return store
+}
+
+func sorted(results *[]string) string {
+	var s = append([]string{}, *results...)
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func TestHTTPStore(t *testing.T) {
+	var store = fixture(t)
+	var requests int32
+	h, err := ConnectHTTPStore([]string{serve(t, store, &requests).URL + "/"}, Options{})
+	if err != nil {
+		t.Fatal("ConnectHTTPStore ", err)
+	}
+	defer h.DisconnectHTTPStore()
+
+	// the answers are the ones of the store
+	var cases = []struct {
+		name   string
+		lookup func(rangestore.Store) (*[]string, error)
+	}{
+		{"cluster", func(s rangestore.Store) (*[]string, error) { return s.ClusterLookup(&[]string{"ops-prod", "data-qa"}) }},
+		{"leaf", func(s rangestore.Store) (*[]string, error) { return s.ClusterLookup(&[]string{"ops-prod-vpc1-mon"}) }},
+		{"range", func(s rangestore.Store) (*[]string, error) { return s.ClusterLookup(&[]string{"RANGE"}) }},
+		{"key", func(s rangestore.Store) (*[]string, error) {
+			return s.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "VERSION")
+		}},
+		{"keys", func(s rangestore.Store) (*[]string, error) {
+			return s.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "KEYS")
+		}},
+		{"reverse", func(s rangestore.Store) (*[]string, error) { return s.KeyReverseLookup("mon1001.ops.example.com") }},
+		{"attr", func(s rangestore.Store) (*[]string, error) { return s.KeyReverseLookupAttr("data", "QAFOR") }},
+		{"hint", func(s rangestore.Store) (*[]string, error) {
+			return s.KeyReverseLookupHint("ops", "AUTHORS", "ops-prod")
+		}},
+	}
+	for _, c := range cases {
+		expected, err := c.lookup(store)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		results, err := c.lookup(h)
+		if err != nil || sorted(results) != sorted(expected) {
+			t.Errorf("%s: Expected %v, Got: %v (Error: %v)", c.name, *expected, results, err)
+		}
+	}
+
+	// the errors of the upstream are ours
+	if _, err := h.ClusterLookup(&[]string{"nosuch"}); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, Got: %v", err)
+	}
+	if _, err := h.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "NOPE"); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, Got: %v", err)
+	}
+
+	expected, _ := store.(rangestore.StatusStore).Status()
+	status, err := h.Status()
+	if err != nil || status.Leaves != expected.Leaves || status.Type != "httpstore (filestore)" {
+		t.Errorf("Expected the status of the upstream, Got: %+v (Error: %v)", status, err)
+	}
+}
+
+func TestHTTPStoreRetries(t *testing.T) {
+	var requests int32
+	var good = serve(t, fixture(t), &requests)
+	var down = httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	// an upstream whose store is down
+	var unavailable = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var response = rangeserver.NewResponse(r.URL.RawQuery, nil, nil, 0)
+		response.Errors = append(response.Errors, rangeserver.QueryError{Code: rangeserver.CodeUnavailable, Message: "Store Unavailable"})
+		rangeserver.WriteJSON(w, http.StatusServiceUnavailable, response)
+	}))
+	defer unavailable.Close()
+
+	h, err := ConnectHTTPStore([]string{down.URL, unavailable.URL, good.URL}, Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal("ConnectHTTPStore ", err)
+	}
+	defer h.DisconnectHTTPStore()
+	// whichever endpoint it starts with, the good one answers
+	for i := 0; i < 6; i++ {
+		results, err := h.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "AUTHORS")
+		if err != nil || sorted(results) != "Ops" {
+			t.Errorf("Expected Ops, Got: %v (Error: %v)", results, err)
+		}
+	}
+	// a not found is not tried on the other endpoints
+	atomic.StoreInt32(&requests, 0)
+	if _, err := h.ClusterLookup(&[]string{"nosuch"}); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, Got: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected 1 request, Got: %d", requests)
+	}
+
+	// with no retries, the failed endpoint fails the lookup
+	h, err = ConnectHTTPStore([]string{good.URL, down.URL}, Options{Timeout: time.Second, Retries: -1})
+	if err != nil {
+		t.Fatal("ConnectHTTPStore ", err)
+	}
+	defer h.DisconnectHTTPStore()
+	if _, err := h.ClusterLookup(&[]string{"ops-prod"}); !errors.Is(err, rangestore.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, Got: %v", err)
+	}
+
+	if _, err := ConnectHTTPStore([]string{down.URL, unavailable.URL}, Options{Timeout: time.Second}); !errors.Is(err, rangestore.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, Got: %v", err)
+	}
+}
+
+// a query is not held past its timeout, even though the request's is
+// longer, nor is the cache of the others
+func TestHTTPStoreQueryDeadline(t *testing.T) {
+	var slow = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == rangeserver.ReadyPath {
+			return
+		}
+		time.Sleep(time.Second)
+		rangeserver.WriteJSON(w, http.StatusOK, rangeserver.NewResponse(r.URL.RawQuery, []string{"a"}, nil, 0))
+	}))
+	defer slow.Close()
+	h, err := ConnectHTTPStore([]string{slow.URL}, Options{Timeout: 5 * time.Second, CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal("ConnectHTTPStore ", err)
+	}
+	defer h.DisconnectHTTPStore()
+
+	var limited = rangestore.NewLimitedStore(h, rangestore.Limits{Timeout: 100 * time.Millisecond})
+	var t0 = time.Now()
+	var limitErr *rangestore.LimitError
+	if _, err := limited.ClusterLookup(&[]string{"ops"}); !errors.As(err, &limitErr) || limitErr.Limit != rangestore.LimitTimeout {
+		t.Errorf("Expected the timeout of the query, Got: %v", err)
+	}
+	if took := time.Since(t0); took > 500*time.Millisecond {
+		t.Errorf("Expected the request to be given up at the deadline, Took: %s", took)
+	}
+	if results, err := h.ClusterLookup(&[]string{"ops"}); err != nil || sorted(results) != "a" {
+		t.Errorf("Expected a, Got: %v (Error: %v)", results, err)
+	}
+}
+
+func TestHTTPStoreCache(t *testing.T) {
+	var requests int32
+	h, err := ConnectHTTPStore([]string{serve(t, fixture(t), &requests).URL}, Options{CacheTTL: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal("ConnectHTTPStore ", err)
+	}
+	defer h.DisconnectHTTPStore()
+
+	for i := 0; i < 3; i++ {
+		results, err := h.ClusterLookup(&[]string{"ops-prod"})
+		if err != nil || sorted(results) != "ops-prod-vpc1,ops-prod-vpc2" {
+			t.Fatalf("Expected ops-prod-vpc1,ops-prod-vpc2, Got: %v (Error: %v)", results, err)
+		}
+	}
+	if requests != 1 || h.CacheStats().Hits != 2 {
+		t.Errorf("Expected 1 request and 2 hits, Got: %d requests %+v", requests, h.CacheStats())
+	}
+	// expired
+	time.Sleep(300 * time.Millisecond)
+	h.ClusterLookup(&[]string{"ops-prod"})
+	if requests != 2 {
+		t.Errorf("Expected the response to expire, Got: %d requests", requests)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	var requests int32
+	h, err := ConnectHTTPStore([]string{serve(t, fixture(t), &requests).URL}, Options{})
+	if err != nil {
+		t.Fatal("ConnectHTTPStore ", err)
+	}
+	defer h.DisconnectHTTPStore()
+	storetest.Run(t, h)
+}
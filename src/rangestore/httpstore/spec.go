@@ -0,0 +1,39 @@
+package httpstore
+
+import (
+	"fmt"
+	"net/url"
+	"rangestore"
+	"strings"
+)
+
+// http://h1:9999,h2:9999/global?timeout=2s (or https), the path is the
+// mount of the store on the upstream servers
+//   timeout    of a request to an endpoint
+//   retries    endpoints tried after the first one fails
+//   cachettl   how long the responses are cached
+//   cachesize  responses cached
+func init() {
+	var factory = func(spec *url.URL) (rangestore.StoreCloser, error) {
+		if spec.Host == "" {
+			return nil, fmt.Errorf("Store spec [%s] has no hosts", spec)
+		}
+		var params = rangestore.NewParams(spec)
+		var options = Options{
+			Timeout:   params.Duration("timeout", 0),
+			Retries:   params.Int("retries", 0),
+			CacheTTL:  params.Duration("cachettl", 0),
+			CacheSize: params.Int("cachesize", 0),
+		}
+		if err := params.Err(); err != nil {
+			return nil, err
+		}
+		var endpoints = make([]string, 0)
+		for _, host := range strings.Split(spec.Host, ",") {
+			endpoints = append(endpoints, spec.Scheme+"://"+host+spec.Path)
+		}
+		return ConnectHTTPStore(endpoints, options)
+	}
+	rangestore.Register("http", factory)
+	rangestore.Register("https", factory)
+}
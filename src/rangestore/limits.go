@@ -0,0 +1,240 @@
+package rangestore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// names of the limits (as in the config of the server)
+const (
+	LimitResults    = "maxresults"
+	LimitCalls      = "maxcalls"
+	LimitTimeout    = "timeout"
+	LimitConcurrent = "maxconcurrent"
+)
+
+// Limits on the cost of a query, zero is no limit
+type Limits struct {
+	MaxResults int           // results of a lookup (or of a part of the query)
+	MaxCalls   int           // store calls made by the query (a lookup of n clusters is n calls, a reverse lookup is a call plus the clusters it walks)
+	Timeout    time.Duration // wall clock time of the query
+}
+
+// LimitError is a query going over a limit, it is an ErrLimit
+type LimitError struct {
+	Limit string // name of the limit
+	Value string // value of the limit
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("Query went over the limit [%s: %s], %s", e.Limit, e.Value, ErrLimit)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrLimit
+}
+
+// a store which has limits on the cost of a query, the evaluator
+// enforces them on each query (see LimitedStore)
+type LimitsStore interface {
+	Store
+	QueryLimits() Limits
+}
+
+// WithLimits is the store with the limits on the cost of the queries
+func WithLimits(store Store, limits Limits) LimitsStore {
+	return &limitsStore{Store: store, limits: limits}
+}
+
+type limitsStore struct {
+	Store
+	limits Limits
+}
+
+func (l *limitsStore) QueryLimits() Limits {
+	return l.limits
+}
+
+func (l *limitsStore) Scope(t Tracker) Store {
+	return &limitsStore{Store: Scope(l.Store, t), limits: l.limits}
+}
+
+////////////
+// SCOPES //
+////////////
+
+// Tracker is what a query keeps track of, a store doing a lookup for the
+// query tells it the clusters it walks (eg, the leaves of a reverse
+// lookup), gives up on the requests it makes at the deadline and tells
+// when it answers stale (see StaleStore). The error is the limit hit (an
+// ErrLimit), Visit(0) checks the limits
+type Tracker interface {
+	Visit(clusters int) error
+	Deadline() time.Time         // zero if none
+	MarkStale(age time.Duration) // age of the answer, since the store last answered
+}
+
+// a store which can do its lookups for a query (see Tracker)
+type Scoper interface {
+	Scope(t Tracker) Store
+}
+
+// Scope is the store doing its lookups for the query, the store as it is
+// if it can't (or if t is nil)
+func Scope(store Store, t Tracker) Store {
+	if s, ok := store.(Scoper); ok && t != nil {
+		return s.Scope(t)
+	}
+	return store
+}
+
+///////////////////
+// LIMITED STORE //
+///////////////////
+
+// LimitedStore is the store as seen by a query, the store calls are
+// counted and the results are checked against the limits. Once a limit
+// is hit, every call fails with the same LimitError (see Exceeded).
+// It is the Tracker of the query, the store is scoped to it
+type LimitedStore struct {
+	store    Store
+	limits   Limits
+	deadline time.Time // zero if no timeout
+
+	mu       sync.Mutex
+	calls    int
+	exceeded *LimitError
+	stale    bool          // some answers were stale
+	staleAge time.Duration // of the oldest of them
+}
+
+// the limits start now (the timeout, etc)
+func NewLimitedStore(store Store, limits Limits) *LimitedStore {
+	var l = &LimitedStore{limits: limits}
+	if limits.Timeout > 0 {
+		l.deadline = time.Now().Add(limits.Timeout)
+	}
+	l.store = Scope(store, l)
+	return l
+}
+
+// Visit counts the clusters walked by a store call
+func (l *LimitedStore) Visit(clusters int) error {
+	l.count(clusters)
+	return l.Exceeded()
+}
+
+func (l *LimitedStore) Deadline() time.Time {
+	return l.deadline
+}
+
+func (l *LimitedStore) MarkStale(age time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.stale || age > l.staleAge {
+		l.stale, l.staleAge = true, age
+	}
+}
+
+// Stale tells whether some of the answers of the query were stale, and
+// how old the oldest was
+func (l *LimitedStore) Stale() (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stale, l.staleAge
+}
+
+// Limits are the limits of the query
+func (l *LimitedStore) Limits() Limits {
+	return l.limits
+}
+
+// Exceeded is the limit hit by the query, nil if none was. The timeout is
+// checked too
+func (l *LimitedStore) Exceeded() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.exceeded == nil && !l.deadline.IsZero() && time.Now().After(l.deadline) {
+		l.exceeded = &LimitError{Limit: LimitTimeout, Value: l.limits.Timeout.String()}
+	}
+	if l.exceeded == nil {
+		return nil
+	}
+	return l.exceeded
+}
+
+// CheckResults is nil if the results are within the limit, else the limit
+// is hit
+func (l *LimitedStore) CheckResults(n int) error {
+	if l.limits.MaxResults > 0 && n > l.limits.MaxResults {
+		l.exceed(&LimitError{Limit: LimitResults, Value: fmt.Sprintf("%d", l.limits.MaxResults)})
+	}
+	return l.Exceeded()
+}
+
+////////////////////
+// LOOKUP CLUSTER //
+////////////////////
+
+func (l *LimitedStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	return l.call(len(*cluster), func() (*[]string, error) { return l.store.ClusterLookup(cluster) })
+}
+
+func (l *LimitedStore) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	return l.call(len(*cluster), func() (*[]string, error) { return l.store.KeyLookup(cluster, key) })
+}
+
+////////////////////
+// LOOKUP REVERSE //
+////////////////////
+
+func (l *LimitedStore) KeyReverseLookup(key string) (*[]string, error) {
+	return l.call(1, func() (*[]string, error) { return l.store.KeyReverseLookup(key) })
+}
+
+func (l *LimitedStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return l.call(1, func() (*[]string, error) { return l.store.KeyReverseLookupAttr(key, attr) })
+}
+
+func (l *LimitedStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return l.call(1, func() (*[]string, error) { return l.store.KeyReverseLookupHint(key, attr, hint) })
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// count the calls (the stores look up the clusters one by one) and check
+// the results, no call is made once a limit is hit
+func (l *LimitedStore) call(calls int, lookup func() (*[]string, error)) (*[]string, error) {
+	if err := l.Visit(calls); err != nil {
+		return &[]string{}, err
+	}
+	result, err := lookup()
+	if err != nil {
+		return result, err
+	}
+	if err := l.CheckResults(len(*result)); err != nil {
+		return &[]string{}, err
+	}
+	return result, nil
+}
+
+func (l *LimitedStore) count(calls int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls += calls
+	if l.limits.MaxCalls > 0 && l.calls > l.limits.MaxCalls && l.exceeded == nil {
+		l.exceeded = &LimitError{Limit: LimitCalls, Value: fmt.Sprintf("%d", l.limits.MaxCalls)}
+	}
+}
+
+// the first limit hit is the one reported
+func (l *LimitedStore) exceed(err *LimitError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.exceeded == nil {
+		l.exceeded = err
+	}
+}
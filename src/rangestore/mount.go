@@ -0,0 +1,173 @@
+package rangestore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// a store with other stores mounted as namespaces, the first part of the
+// cluster name is the namespace (the clusters of each store are a subtree,
+// same as a '-' is a level of the tree of a store, see clusterToPath).
+// %aws-prod is the cluster prod of the store mounted as aws, the clusters
+// in the results have the namespace and %RANGE lists the namespaces.
+// The reverse lookups are done on all the mounts at once, unless the hint
+// is in a namespace (eg, aws-ops is ops of aws only).
+type MountStore struct {
+	mounts map[string]Store
+	names  []string // namespaces, sorted
+}
+
+func NewMountStore(mounts map[string]Store) *MountStore {
+	var m = &MountStore{mounts: mounts, names: make([]string, 0)}
+	for name := range mounts {
+		m.names = append(m.names, name)
+	}
+	sort.Strings(m.names)
+	return m
+}
+
+// all the mounts can serve
+func (m *MountStore) Ping() error {
+	for _, namespace := range m.names {
+		if err := pingAll([]Store{m.mounts[namespace]}); err != nil {
+			return fmt.Errorf("Namespace [%s] is NOT READY (Error: %w)", namespace, err)
+		}
+	}
+	return nil
+}
+
+// Scope is the store as seen by a query, each mount is scoped to it
+func (m *MountStore) Scope(t Tracker) Store {
+	var scoped = &MountStore{mounts: make(map[string]Store), names: m.names}
+	for namespace, s := range m.mounts {
+		scoped.mounts[namespace] = Scope(s, t)
+	}
+	return scoped
+}
+
+////////////////////
+// LOOKUP CLUSTER //
+////////////////////
+
+// a leaf cluster has the nodes, the others have the clusters under them
+// (which get the namespace)
+func (m *MountStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	var results = make([]string, 0)
+	for _, elem := range *cluster {
+		if elem == "RANGE" {
+			results = append(results, m.names...)
+			continue
+		}
+		namespace, s, inner, err := m.resolve(elem)
+		if err != nil {
+			return &[]string{}, err
+		}
+		nodes, err := s.KeyLookup(&[]string{inner}, "NODES")
+		if err == nil {
+			results = append(results, *nodes...)
+			continue
+		} else if !errors.Is(err, ErrNotFound) {
+			return &[]string{}, err
+		}
+		children, err := s.ClusterLookup(&[]string{inner})
+		if err != nil {
+			return &[]string{}, err
+		}
+		results = append(results, withNamespace(namespace, *children)...)
+	}
+	return &results, nil
+}
+
+func (m *MountStore) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	var results = make([]string, 0)
+	for _, elem := range *cluster {
+		_, s, inner, err := m.resolve(elem)
+		if err != nil {
+			return &[]string{}, err
+		}
+		result, err := s.KeyLookup(&[]string{inner}, key)
+		if err != nil {
+			return &[]string{}, err
+		}
+		results = append(results, *result...)
+	}
+	return &results, nil
+}
+
+////////////////////
+// LOOKUP REVERSE //
+////////////////////
+
+// the lookups without a hint are the same lookups on the mounts, so that
+// they keep their fast paths (eg, the reverse index of an etcdstore)
+func (m *MountStore) KeyReverseLookup(key string) (*[]string, error) {
+	return m.reverse(m.names, func(s Store) (*[]string, error) { return s.KeyReverseLookup(key) })
+}
+
+func (m *MountStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return m.reverse(m.names, func(s Store) (*[]string, error) { return s.KeyReverseLookupAttr(key, attr) })
+}
+
+// the clusters of all the mounts having the key, a mount not having it
+// is not an error. A hint in a namespace is a lookup in its mount only,
+// without the namespace
+func (m *MountStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	if hint == "" {
+		return m.KeyReverseLookupAttr(key, attr)
+	}
+	namespace, _, inner, err := m.resolve(hint)
+	if err != nil {
+		return &[]string{}, err
+	}
+	if inner == "RANGE" {
+		return m.reverse([]string{namespace}, func(s Store) (*[]string, error) { return s.KeyReverseLookupAttr(key, attr) })
+	}
+	return m.reverse([]string{namespace}, func(s Store) (*[]string, error) { return s.KeyReverseLookupHint(key, attr, inner) })
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// the namespace, its store and the cluster in that store. The namespace
+// alone is the top (RANGE) of the store
+func (m *MountStore) resolve(cluster string) (string, Store, string, error) {
+	var namespace, inner = cluster, "RANGE"
+	if i := strings.Index(cluster, "-"); i >= 0 {
+		namespace, inner = cluster[:i], cluster[i+1:]
+	}
+	s, ok := m.mounts[namespace]
+	if !ok {
+		return namespace, nil, "", fmt.Errorf("No Such Namespace [%s] (Cluster: %s), %w", namespace, cluster, ErrNotFound)
+	}
+	return namespace, s, inner, nil
+}
+
+// the lookup on the mounts of the namespaces at once, the results get
+// the namespace
+func (m *MountStore) reverse(names []string, lookup func(Store) (*[]string, error)) (*[]string, error) {
+	var stores = make([]Store, 0, len(names))
+	for _, namespace := range names {
+		stores = append(stores, m.mounts[namespace])
+	}
+	var results = make([]string, 0)
+	for i, r := range fanOut(stores, lookup) {
+		if errors.Is(r.err, ErrNotFound) {
+			continue
+		} else if r.err != nil {
+			return &[]string{}, fmt.Errorf("Reverse Lookup in Namespace [%s] Failed (Error: %w)", names[i], r.err)
+		}
+		results = append(results, withNamespace(names[i], *r.result)...)
+	}
+	return &results, nil
+}
+
+func withNamespace(namespace string, clusters []string) []string {
+	var results = make([]string, 0, len(clusters))
+	for _, c := range clusters {
+		results = append(results, fmt.Sprintf("%s-%s", namespace, c))
+	}
+	return results
+}
@@ -0,0 +1,84 @@
+package rangestore_test
+
+import (
+	"errors"
+	"rangestore"
+	"testing"
+)
+
+// records the reverse lookups done on it
+type reverseStore struct {
+	rangestore.Store
+	calls []string
+}
+
+func (s *reverseStore) KeyReverseLookup(key string) (*[]string, error) {
+	s.calls = append(s.calls, "KeyReverseLookup")
+	return s.Store.KeyReverseLookup(key)
+}
+
+func (s *reverseStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	s.calls = append(s.calls, "KeyReverseLookupAttr")
+	return s.Store.KeyReverseLookupAttr(key, attr)
+}
+
+func (s *reverseStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	s.calls = append(s.calls, "KeyReverseLookupHint")
+	return s.Store.KeyReverseLookupHint(key, attr, hint)
+}
+
+func TestMountStore(t *testing.T) {
+	var m = rangestore.NewMountStore(map[string]rangestore.Store{"aws": fixture(t), "dc1": fixture(t)})
+	var cases = []struct {
+		lookup   func() (*[]string, error)
+		expected string
+	}{
+		{func() (*[]string, error) { return m.ClusterLookup(&[]string{"aws-ops-prod"}) }, "aws-ops-prod-vpc1,aws-ops-prod-vpc2"},
+		{func() (*[]string, error) { return m.ClusterLookup(&[]string{"dc1-ops-prod-vpc1-mon"}) }, "mon1001.ops.example.com"},
+		{func() (*[]string, error) { return m.ClusterLookup(&[]string{"aws"}) }, "aws-data,aws-ops"},
+		{func() (*[]string, error) { return m.KeyLookup(&[]string{"aws-ops-prod-vpc1-mon"}, "AUTHORS") }, "Ops"},
+		{func() (*[]string, error) { return m.KeyReverseLookup("mon1001.ops.example.com") }, "aws-ops-prod-vpc1-mon,dc1-ops-prod-vpc1-mon"},
+		{func() (*[]string, error) { return m.ClusterLookup(&[]string{"RANGE"}) }, "aws,dc1"},
+		// the hint picks the mount
+		{func() (*[]string, error) { return m.KeyReverseLookupHint("mon1001.ops.example.com", "NODES", "aws") }, "aws-ops-prod-vpc1-mon"},
+		{func() (*[]string, error) { return m.KeyReverseLookupHint("Ops", "AUTHORS", "dc1-ops-prod-vpc2") }, "dc1-ops-prod-vpc2-mon"},
+	}
+	for i, c := range cases {
+		if results, err := c.lookup(); err != nil || sorted(results) != c.expected {
+			t.Errorf("Case %d, Expected: %s, Got: %v (Error: %v)", i, c.expected, results, err)
+		}
+	}
+	if _, err := m.ClusterLookup(&[]string{"gcp-ops"}); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, No Such Namespace, Got: %v", err)
+	}
+	if _, err := m.KeyReverseLookupHint("mon1001.ops.example.com", "NODES", "gcp-ops"); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, Hint in No Such Namespace, Got: %v", err)
+	}
+}
+
+// without a hint (or with the namespace alone), the mounts get the same
+// lookup, not a hinted one
+func TestMountStoreReverse(t *testing.T) {
+	var store = &reverseStore{Store: fixture(t)}
+	var m = rangestore.NewMountStore(map[string]rangestore.Store{"aws": store})
+	var cases = []struct {
+		lookup   func() (*[]string, error)
+		expected string
+		call     string
+	}{
+		{func() (*[]string, error) { return m.KeyReverseLookup("mon1001.ops.example.com") }, "aws-ops-prod-vpc1-mon", "KeyReverseLookup"},
+		{func() (*[]string, error) { return m.KeyReverseLookupAttr("Ops", "AUTHORS") }, "aws-ops-prod-vpc1-mon,aws-ops-prod-vpc2-mon", "KeyReverseLookupAttr"},
+		{func() (*[]string, error) { return m.KeyReverseLookupHint("Ops", "AUTHORS", "") }, "aws-ops-prod-vpc1-mon,aws-ops-prod-vpc2-mon", "KeyReverseLookupAttr"},
+		{func() (*[]string, error) { return m.KeyReverseLookupHint("Ops", "AUTHORS", "aws") }, "aws-ops-prod-vpc1-mon,aws-ops-prod-vpc2-mon", "KeyReverseLookupAttr"},
+		{func() (*[]string, error) { return m.KeyReverseLookupHint("Ops", "AUTHORS", "aws-ops-prod-vpc2") }, "aws-ops-prod-vpc2-mon", "KeyReverseLookupHint"},
+	}
+	for i, c := range cases {
+		store.calls = nil
+		if results, err := c.lookup(); err != nil || sorted(results) != c.expected {
+			t.Errorf("Case %d, Expected: %s, Got: %v (Error: %v)", i, c.expected, results, err)
+		}
+		if len(store.calls) != 1 || store.calls[0] != c.call {
+			t.Errorf("Case %d, Expected the mount to get %s, Got: %v", i, c.call, store.calls)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+// A store served by a plugin, an executable speaking the protocol (see
+// protocol.go) on its stdin and stdout, so that a store (eg, an adapter
+// of an inventory) can be written in any language. The plugin is started
+// along with the store and restarted (with a backoff) whenever it exits.
+// While it is down, and when it doesn't answer within the timeout, the
+// lookups are unavailable.
+
+package pluginstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"rangestore"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long we wait before restarting the plugin, doubled on every restart
+// unless the plugin ran longer than the max
+const _restartMin = 500 * time.Millisecond
+const _restartMax = 30 * time.Second
+
+// how long the plugin has to exit once stdin is closed, before it is killed
+const _exitGrace = 5 * time.Second
+
+type PluginStore struct {
+	command []string
+	timeout time.Duration
+	stop    chan bool
+	done    chan bool
+
+	wmu sync.Mutex // the writes to stdin, one request at a time
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd // nil while the plugin is not running
+	stdin    *os.File
+	calls    map[uint64]chan *Response // the calls waiting for a response by id
+	next     uint64
+	restarts int
+}
+
+// Connect starts the plugin (command is the executable and its arguments),
+// a lookup not answered within timeout fails
+func ConnectPluginStore(command []string, timeout time.Duration) (*PluginStore, error) {
+	if len(command) == 0 {
+		return nil, errors.New("No Command for the Plugin Store")
+	}
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	var p = &PluginStore{command: command, timeout: timeout, stop: make(chan bool), done: make(chan bool), calls: make(map[uint64]chan *Response)}
+	stdout, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	go p.supervise(stdout)
+	return p, nil
+}
+
+// stop the plugin, it is killed if it doesn't exit on its own
+func (p *PluginStore) DisconnectPluginStore() {
+	close(p.stop)
+	p.mu.Lock()
+	if p.stdin != nil {
+		p.stdin.Close()
+	}
+	p.mu.Unlock()
+	select {
+	case <-p.done:
+	case <-time.After(_exitGrace):
+		p.mu.Lock()
+		if p.cmd != nil {
+			log.Printf("Plugin [%s] did not Exit, Killing it", p.name())
+			p.cmd.Process.Kill()
+		}
+		p.mu.Unlock()
+		<-p.done
+	}
+	return
+}
+
+func (p *PluginStore) Close() {
+	p.DisconnectPluginStore()
+}
+
+// the plugin is running
+func (p *PluginStore) Ping() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil {
+		return fmt.Errorf("Plugin [%s] is not Running, %w", p.name(), rangestore.ErrUnavailable)
+	}
+	return nil
+}
+
+// Restarts is how many times the plugin was restarted
+func (p *PluginStore) Restarts() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.restarts
+}
+
+////////////////////
+// LOOKUP CLUSTER //
+////////////////////
+
+func (p *PluginStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	return p.call(nil, "ClusterLookup", Params{Cluster: *cluster})
+}
+
+func (p *PluginStore) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	return p.call(nil, "KeyLookup", Params{Cluster: *cluster, Key: key})
+}
+
+////////////////////
+// LOOKUP REVERSE //
+////////////////////
+
+func (p *PluginStore) KeyReverseLookup(key string) (*[]string, error) {
+	return p.call(nil, "KeyReverseLookup", Params{Key: key})
+}
+
+func (p *PluginStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return p.call(nil, "KeyReverseLookupAttr", Params{Key: key, Attr: attr})
+}
+
+func (p *PluginStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return p.call(nil, "KeyReverseLookupHint", Params{Key: key, Attr: attr, Hint: hint})
+}
+
+// Scope is the store doing the lookups of a query, the responses are not
+// waited for past the deadline of the query
+func (p *PluginStore) Scope(t rangestore.Tracker) rangestore.Store {
+	return &scopedStore{p: p, tracker: t}
+}
+
+// the store as seen by a query
+type scopedStore struct {
+	p       *PluginStore
+	tracker rangestore.Tracker
+}
+
+func (s *scopedStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	return s.p.call(s.tracker, "ClusterLookup", Params{Cluster: *cluster})
+}
+
+func (s *scopedStore) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	return s.p.call(s.tracker, "KeyLookup", Params{Cluster: *cluster, Key: key})
+}
+
+func (s *scopedStore) KeyReverseLookup(key string) (*[]string, error) {
+	return s.p.call(s.tracker, "KeyReverseLookup", Params{Key: key})
+}
+
+func (s *scopedStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return s.p.call(s.tracker, "KeyReverseLookupAttr", Params{Key: key, Attr: attr})
+}
+
+func (s *scopedStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return s.p.call(s.tracker, "KeyReverseLookupHint", Params{Key: key, Attr: attr, Hint: hint})
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+func (p *PluginStore) name() string {
+	return strings.Join(p.command, " ")
+}
+
+// send the request and wait for the response, for the timeout at most
+// (or until the deadline of the query t, if any, the write has the whole
+// timeout so that a request is not cut short). The write is not done
+// holding mu, the responses are read meanwhile
+func (p *PluginStore) call(t rangestore.Tracker, method string, params Params) (*[]string, error) {
+	p.mu.Lock()
+	if p.cmd == nil {
+		p.mu.Unlock()
+		return &[]string{}, fmt.Errorf("Plugin [%s] is not Running, %w", p.name(), rangestore.ErrUnavailable)
+	}
+	p.next++
+	var id = p.next
+	var response = make(chan *Response, 1)
+	p.calls[id] = response
+	var cmd, stdin = p.cmd, p.stdin
+	p.mu.Unlock()
+
+	line, _ := json.Marshal(&Request{ID: id, Method: method, Params: params})
+	// a plugin not reading its stdin doesn't block us for ever
+	var deadline = time.Now().Add(p.timeout)
+	p.wmu.Lock()
+	stdin.SetWriteDeadline(deadline)
+	n, err := stdin.Write(append(line, '\n'))
+	p.wmu.Unlock()
+	if err != nil {
+		p.mu.Lock()
+		delete(p.calls, id)
+		// the plugin would read the rest of the request as the start of
+		// the next one, it is restarted
+		if n > 0 && p.cmd == cmd {
+			log.Printf("ERROR: Plugin [%s] got a Partial Request, Restarting it", p.name())
+			cmd.Process.Kill()
+		}
+		p.mu.Unlock()
+		return &[]string{}, fmt.Errorf("Plugin [%s] %s Failed (Error: %s), %w", p.name(), method, err, rangestore.ErrUnavailable)
+	}
+
+	var queryDeadline bool
+	if t != nil && !t.Deadline().IsZero() && t.Deadline().Before(deadline) {
+		deadline, queryDeadline = t.Deadline(), true
+	}
+	var timer = time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case r := <-response:
+		if r == nil {
+			return &[]string{}, fmt.Errorf("Plugin [%s] Exited during %s, %w", p.name(), method, rangestore.ErrUnavailable)
+		} else if r.Error != nil {
+			if e, ok := codeErrors[r.Error.Code]; ok {
+				return &[]string{}, fmt.Errorf("Plugin [%s] %s, %w", p.name(), r.Error.Message, e)
+			}
+			return &[]string{}, fmt.Errorf("Plugin [%s] %s (Code: %s)", p.name(), r.Error.Message, r.Error.Code)
+		}
+		var results = r.Result
+		if results == nil {
+			results = []string{}
+		}
+		return &results, nil
+	case <-timer.C:
+		p.mu.Lock()
+		delete(p.calls, id)
+		p.mu.Unlock()
+		if queryDeadline {
+			if err := t.Visit(0); err != nil {
+				return &[]string{}, err
+			}
+		}
+		return &[]string{}, fmt.Errorf("Plugin [%s] %s Timed Out (Timeout: %s), %w", p.name(), method, p.timeout, rangestore.ErrUnavailable)
+	}
+}
+
+// start the plugin, its stderr goes to the log
+func (p *PluginStore) start() (io.ReadCloser, error) {
+	var cmd = exec.Command(p.command[0], p.command[1:]...)
+	// our end of stdin is a pipe of our own, so that the writes can have
+	// a deadline
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin = stdin
+	cmd.Stderr = &logWriter{prefix: fmt.Sprintf("Plugin [%s] ", p.name())}
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	stdin.Close()
+	if err != nil {
+		w.Close()
+		return nil, fmt.Errorf("Starting the Plugin [%s] Failed (Error: %s)", p.name(), err)
+	}
+	p.mu.Lock()
+	p.cmd, p.stdin = cmd, w
+	p.mu.Unlock()
+	log.Printf("Plugin [%s] Started (PID: %d)", p.name(), cmd.Process.Pid)
+	return stdout, nil
+}
+
+// read the responses until the plugin exits, then restart it, until
+// stopped
+func (p *PluginStore) supervise(stdout io.ReadCloser) {
+	defer close(p.done)
+	var backoff = _restartMin
+	for {
+		var started = time.Now()
+		if stdout != nil {
+			p.read(stdout)
+			p.exited()
+		}
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		if time.Since(started) > _restartMax {
+			backoff = _restartMin
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > _restartMax {
+			backoff = _restartMax
+		}
+		var err error
+		if stdout, err = p.start(); err != nil {
+			log.Printf("ERROR: %s", err)
+			continue
+		}
+		p.mu.Lock()
+		p.restarts++
+		p.mu.Unlock()
+	}
+}
+
+// hand the responses to the calls waiting for them, until stdout is closed
+func (p *PluginStore) read(stdout io.Reader) {
+	var reader = bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var response Response
+			if err := json.Unmarshal(line, &response); err != nil {
+				log.Printf("ERROR: Plugin [%s] Response is not valid, Ignored (Error: %s)", p.name(), err)
+			} else {
+				p.mu.Lock()
+				if call, ok := p.calls[response.ID]; ok {
+					delete(p.calls, response.ID)
+					call <- &response
+				}
+				p.mu.Unlock()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// the plugin is gone, the calls waiting for it fail
+func (p *PluginStore) exited() {
+	p.mu.Lock()
+	var cmd = p.cmd
+	p.stdin.Close()
+	p.cmd, p.stdin = nil, nil
+	for id, call := range p.calls {
+		delete(p.calls, id)
+		call <- nil
+	}
+	p.mu.Unlock()
+	var err = cmd.Wait()
+	select {
+	case <-p.stop:
+		log.Printf("Plugin [%s] Stopped", p.name())
+	default:
+		log.Printf("ERROR: Plugin [%s] Exited, Restarting it (Error: %v)", p.name(), err)
+	}
+}
+
+// the lines written by the plugin go to the log
+type logWriter struct {
+	prefix string
+	buf    []byte
+}
+
+func (l *logWriter) Write(b []byte) (int, error) {
+	l.buf = append(l.buf, b...)
+	for {
+		var i = bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Printf("%s%s", l.prefix, l.buf[:i])
+		l.buf = l.buf[i+1:]
+	}
+	return len(b), nil
+}
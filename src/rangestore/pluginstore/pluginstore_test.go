@@ -0,0 +1,195 @@
+package pluginstore
+
+import (
+	"errors"
+	"os"
+	"rangestore"
+	"rangestore/filestore"
+	"rangestore/storetest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the test binary is the plugin too, when run with this set
+const _pluginEnv = "YARGE_TEST_PLUGIN"
+
+// the fixture, except that the cluster crash makes the plugin exit and
+// the cluster hang is answered after a second
+type testPlugin struct {
+	rangestore.Store
+}
+
+func (s *testPlugin) ClusterLookup(cluster *[]string) (*[]string, error) {
+	switch (*cluster)[0] {
+	case "crash":
+		os.Exit(3)
+	case "hang":
+		time.Sleep(time.Second)
+	}
+	return s.Store.ClusterLookup(cluster)
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(_pluginEnv) != "" {
+		store, err := filestore.ConnectFileStore("../filestore/t", -1, false)
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(1)
+		}
+		if err = Serve(&testPlugin{store}, os.Stdin, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Setenv(_pluginEnv, "1")
+	os.Exit(m.Run())
+}
+
+func sorted(results *[]string) string {
+	var s = append([]string{}, *results...)
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func connect(t *testing.T, timeout time.Duration) *PluginStore {
+	p, err := ConnectPluginStore([]string{os.Args[0], "-test.run=none"}, timeout)
+	if err != nil {
+		t.Fatal("ConnectPluginStore ", err)
+	}
+	t.Cleanup(p.DisconnectPluginStore)
+	return p
+}
+
+func TestPluginStore(t *testing.T) {
+	store, err := filestore.ConnectFileStore("../filestore/t", -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	var p = connect(t, 0)
+
+	// the answers are the ones of the store
+	var cases = []struct {
+		name   string
+		lookup func(rangestore.Store) (*[]string, error)
+	}{
+		{"cluster", func(s rangestore.Store) (*[]string, error) { return s.ClusterLookup(&[]string{"ops-prod", "data-qa"}) }},
+		{"range", func(s rangestore.Store) (*[]string, error) { return s.ClusterLookup(&[]string{"RANGE"}) }},
+		{"key", func(s rangestore.Store) (*[]string, error) {
+			return s.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "VERSION")
+		}},
+		{"reverse", func(s rangestore.Store) (*[]string, error) { return s.KeyReverseLookup("mon1001.ops.example.com") }},
+		{"attr", func(s rangestore.Store) (*[]string, error) { return s.KeyReverseLookupAttr("data", "QAFOR") }},
+		{"hint", func(s rangestore.Store) (*[]string, error) {
+			return s.KeyReverseLookupHint("ops", "AUTHORS", "ops-prod")
+		}},
+	}
+	for _, c := range cases {
+		expected, err := c.lookup(store)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		results, err := c.lookup(p)
+		if err != nil || sorted(results) != sorted(expected) {
+			t.Errorf("%s: Expected %v, Got: %v (Error: %v)", c.name, *expected, results, err)
+		}
+	}
+	if _, err := p.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "NOPE"); !errors.Is(err, rangestore.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, Got: %v", err)
+	}
+	if _, err := p.ClusterLookup(&[]string{"-bad"}); err == nil {
+		t.Errorf("Expected an Error, Got: nil")
+	}
+}
+
+func TestPluginStoreRestart(t *testing.T) {
+	var p = connect(t, 0)
+	if _, err := p.ClusterLookup(&[]string{"crash"}); !errors.Is(err, rangestore.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, Got: %v", err)
+	}
+	// back once restarted
+	var deadline = time.Now().Add(5 * time.Second)
+	for p.Ping() != nil && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	results, err := p.ClusterLookup(&[]string{"ops-prod"})
+	if err != nil || sorted(results) != "ops-prod-vpc1,ops-prod-vpc2" {
+		t.Errorf("Expected ops-prod-vpc1,ops-prod-vpc2, Got: %v (Error: %v)", results, err)
+	}
+	if p.Restarts() != 1 {
+		t.Errorf("Expected 1 restart, Got: %d", p.Restarts())
+	}
+}
+
+func TestPluginStoreTimeout(t *testing.T) {
+	var p = connect(t, 200*time.Millisecond)
+	var t0 = time.Now()
+	if _, err := p.ClusterLookup(&[]string{"hang"}); !errors.Is(err, rangestore.ErrUnavailable) || !strings.Contains(err.Error(), "Timed Out") {
+		t.Errorf("Expected the lookup to time out, Got: %v", err)
+	}
+	if took := time.Since(t0); took > time.Second {
+		t.Errorf("Expected the timeout, Took: %s", took)
+	}
+	// the other lookups are still answered
+	results, err := p.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "AUTHORS")
+	if err != nil || sorted(results) != "Ops" {
+		t.Errorf("Expected Ops, Got: %v (Error: %v)", results, err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, connect(t, 0))
+}
+
+// a plugin not reading its stdin times out the lookups without blocking
+// the others, and a request written in part restarts it
+func TestPluginStorePartialWrite(t *testing.T) {
+	p, err := ConnectPluginStore([]string{"sh", "-c", "sleep 1; exec cat >/dev/null"}, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal("ConnectPluginStore ", err)
+	}
+	t.Cleanup(p.DisconnectPluginStore)
+	// more than the pipe can hold
+	var cluster = make([]string, 0)
+	for i := 0; i < 20000; i++ {
+		cluster = append(cluster, "ops-prod-vpc1-mon")
+	}
+	var done = make(chan error, 1)
+	go func() {
+		_, err := p.ClusterLookup(&cluster)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	var t0 = time.Now()
+	if err = p.Ping(); err != nil {
+		t.Errorf("Expected the plugin to be running, Got: %v", err)
+	}
+	if took := time.Since(t0); took > 100*time.Millisecond {
+		t.Errorf("Expected Ping not to wait for the write, Took: %s", took)
+	}
+	if err = <-done; !errors.Is(err, rangestore.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, Got: %v", err)
+	}
+	var deadline = time.Now().Add(5 * time.Second)
+	for p.Restarts() == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if p.Restarts() != 1 {
+		t.Errorf("Expected 1 restart, Got: %d", p.Restarts())
+	}
+}
+
+// a query is not held past its timeout, even though the plugin's is longer
+func TestPluginStoreQueryDeadline(t *testing.T) {
+	var p = connect(t, 5*time.Second)
+	var limited = rangestore.NewLimitedStore(p, rangestore.Limits{Timeout: 100 * time.Millisecond})
+	var t0 = time.Now()
+	var limitErr *rangestore.LimitError
+	if _, err := limited.ClusterLookup(&[]string{"hang"}); !errors.As(err, &limitErr) || limitErr.Limit != rangestore.LimitTimeout {
+		t.Errorf("Expected the timeout of the query, Got: %v", err)
+	}
+	if took := time.Since(t0); took > 500*time.Millisecond {
+		t.Errorf("Expected the lookup to be given up at the deadline, Took: %s", took)
+	}
+}
@@ -0,0 +1,140 @@
+// The protocol between the PluginStore and a plugin, so that a store can
+// be written in any language. The plugin reads the requests from stdin and
+// writes the responses to stdout, one JSON object per line:
+//   {"id": 1, "method": "ClusterLookup", "params": {"cluster": ["ops-prod"]}}
+//   {"id": 2, "method": "KeyLookup", "params": {"cluster": ["ops-prod-vpc1-mon"], "key": "AUTHORS"}}
+//   {"id": 3, "method": "KeyReverseLookup", "params": {"key": "mon1001.ops.example.com"}}
+//   {"id": 4, "method": "KeyReverseLookupAttr", "params": {"key": "data", "attr": "QAFOR"}}
+//   {"id": 5, "method": "KeyReverseLookupHint", "params": {"key": "ops", "attr": "AUTHORS", "hint": "ops-prod"}}
+// and the responses are either the results or the error,
+//   {"id": 2, "result": ["Ops"]}
+//   {"id": 1, "error": {"code": "NOT_FOUND", "message": "no cluster ops-prod"}}
+// The codes are NOT_FOUND, INVALID_NAME and UNAVAILABLE (anything else is
+// a failed lookup). Requests can be sent before the previous ones are
+// answered, the responses are matched by id and can come in any order.
+// The plugin exits once stdin is closed, what it writes to stderr goes to
+// the log of the server.
+
+package pluginstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"rangestore"
+	"sync"
+)
+
+// error codes of the responses
+const (
+	CodeNotFound    = "NOT_FOUND"
+	CodeInvalidName = "INVALID_NAME"
+	CodeUnavailable = "UNAVAILABLE"
+)
+
+// our errors for the codes
+var codeErrors = map[string]error{
+	CodeNotFound:    rangestore.ErrNotFound,
+	CodeInvalidName: rangestore.ErrInvalidName,
+	CodeUnavailable: rangestore.ErrUnavailable,
+}
+
+// Request is a lookup sent to the plugin
+type Request struct {
+	ID     uint64 `json:"id"`
+	Method string `json:"method"`
+	Params Params `json:"params"`
+}
+
+// Params are the arguments of the lookup, the ones of the method are set
+type Params struct {
+	Cluster []string `json:"cluster,omitempty"`
+	Key     string   `json:"key,omitempty"`
+	Attr    string   `json:"attr,omitempty"`
+	Hint    string   `json:"hint,omitempty"`
+}
+
+// Response is the answer of the plugin, either Result or Error
+type Response struct {
+	ID     uint64   `json:"id"`
+	Result []string `json:"result"`
+	Error  *Error   `json:"error,omitempty"`
+}
+
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Serve answers the requests read from in with the store, until in is
+// closed. It is the plugin side of the protocol, for the plugins written
+// in Go. The requests are answered concurrently
+func Serve(store rangestore.Store, in io.Reader, out io.Writer) error {
+	var reader = bufio.NewReader(in)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var encoder = json.NewEncoder(out)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var request Request
+			if err := json.Unmarshal(line, &request); err != nil {
+				return fmt.Errorf("Request [%s] is not valid (Error: %s)", line, err)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var response = serve(store, request)
+				mu.Lock()
+				defer mu.Unlock()
+				encoder.Encode(response)
+			}()
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// the response of the store to the request
+func serve(store rangestore.Store, request Request) *Response {
+	var p = request.Params
+	var result *[]string
+	var err error
+	switch request.Method {
+	case "ClusterLookup":
+		result, err = store.ClusterLookup(&p.Cluster)
+	case "KeyLookup":
+		result, err = store.KeyLookup(&p.Cluster, p.Key)
+	case "KeyReverseLookup":
+		result, err = store.KeyReverseLookup(p.Key)
+	case "KeyReverseLookupAttr":
+		result, err = store.KeyReverseLookupAttr(p.Key, p.Attr)
+	case "KeyReverseLookupHint":
+		result, err = store.KeyReverseLookupHint(p.Key, p.Attr, p.Hint)
+	default:
+		err = fmt.Errorf("Unknown method [%s]", request.Method)
+	}
+	if err != nil {
+		return &Response{ID: request.ID, Error: &Error{Code: errorCode(err), Message: err.Error()}}
+	}
+	return &Response{ID: request.ID, Result: *result}
+}
+
+func errorCode(err error) string {
+	for code, e := range codeErrors {
+		if errors.Is(err, e) {
+			return code
+		}
+	}
+	return "LOOKUP_ERROR"
+}
@@ -0,0 +1,26 @@
+package pluginstore
+
+import (
+	"net/url"
+	"rangestore"
+)
+
+// plugin:///usr/local/bin/yarge-cmdb?arg=--region&arg=emea (or
+// plugin:yarge-cmdb, looked up in the PATH)
+//   arg      an argument of the plugin, in order
+//   timeout  of a lookup
+func init() {
+	rangestore.Register("plugin", func(spec *url.URL) (rangestore.StoreCloser, error) {
+		var command = []string{spec.Path}
+		if spec.Opaque != "" {
+			command[0] = spec.Opaque
+		}
+		var params = rangestore.NewParams(spec)
+		command = append(command, params.Values("arg")...)
+		var timeout = params.Duration("timeout", 0)
+		if err := params.Err(); err != nil {
+			return nil, err
+		}
+		return ConnectPluginStore(command, timeout)
+	})
+}
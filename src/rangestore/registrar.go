@@ -0,0 +1,136 @@
+package rangestore
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// a store where hosts can register themselves in the NODES of a leaf
+// cluster for a while (ttl). A registration is renewed by registering
+// again (heartbeat), if it is not renewed in time the node goes away
+// from NODES (and from the reverse lookups)
+type Registrar interface {
+	Register(string, string, time.Duration) error // cluster, node, ttl
+	Deregister(string, string) error              // cluster, node
+}
+
+/////////////
+// SWEEPER //
+/////////////
+
+// Sweeper gives registrations to a writable store which has no notion of
+// expiry. The registered nodes are added to NODES and an in-process
+// sweeper removes them once they expire.
+// NOTE: the expiries are kept only in memory, a node which stops its
+// heartbeat while the process is down stays in NODES
+type Sweeper struct {
+	sync.Mutex
+	store  WritableStore
+	expiry map[string]map[string]time.Time // cluster -> node -> expiry
+	stop   chan bool
+}
+
+// start sweeping the expired registrations every interval
+func NewSweeper(store WritableStore, interval time.Duration) *Sweeper {
+	s := &Sweeper{store: store, expiry: make(map[string]map[string]time.Time), stop: make(chan bool)}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case now := <-ticker.C:
+				s.sweep(now)
+			}
+		}
+	}()
+	return s
+}
+
+// stop sweeping, the registrations stay as they are
+func (s *Sweeper) Stop() {
+	close(s.stop)
+}
+
+// add the node to NODES of cluster (or renew it). A node which is already
+// in NODES by other means is left alone, it never expires
+func (s *Sweeper) Register(cluster string, node string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("Register [%s] in [%s] Failed (Error: ttl %v is not positive, %w)", node, cluster, ttl, ErrInvalidName)
+	}
+	if err := ValidKeyValues("NODES", []string{node}); err != nil {
+		return fmt.Errorf("Register [%s] in [%s] Failed (Error: %w)", node, cluster, err)
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	// heartbeat
+	if _, ok := s.expiry[cluster][node]; ok {
+		s.expiry[cluster][node] = time.Now().Add(ttl)
+		return nil
+	}
+
+	if _, err := s.store.ClusterVersion(cluster); err != nil {
+		return err
+	}
+	if nodes, err := s.store.KeyLookup(&[]string{cluster}, "NODES"); err == nil {
+		for _, n := range *nodes {
+			if n == node {
+				return nil
+			}
+		}
+	}
+	if _, err := s.store.AddKeyValues(cluster, "NODES", []string{node}, ""); err != nil {
+		return err
+	}
+	if s.expiry[cluster] == nil {
+		s.expiry[cluster] = make(map[string]time.Time)
+	}
+	s.expiry[cluster][node] = time.Now().Add(ttl)
+	return nil
+}
+
+// remove the registered node from NODES of cluster
+func (s *Sweeper) Deregister(cluster string, node string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.expiry[cluster][node]; !ok {
+		return fmt.Errorf("Deregister [%s] in [%s] Failed (Error: Node is NOT Registered, %w)", node, cluster, ErrNotFound)
+	}
+	if _, err := s.store.RemoveKeyValues(cluster, "NODES", []string{node}, ""); err != nil {
+		return err
+	}
+	delete(s.expiry[cluster], node)
+	return nil
+}
+
+// remove the expired nodes, the ones we fail to remove are tried again
+// in the next sweep
+func (s *Sweeper) sweep(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for cluster, nodes := range s.expiry {
+		var expired = make([]string, 0)
+		for node, expiry := range nodes {
+			if !expiry.After(now) {
+				expired = append(expired, node)
+			}
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		if _, err := s.store.RemoveKeyValues(cluster, "NODES", expired, ""); err != nil {
+			log.Printf("ERROR: Sweeping expired nodes %s of [%s] Failed (Error: %s)\n", expired, cluster, err)
+			continue
+		}
+		for _, node := range expired {
+			delete(nodes, node)
+		}
+		if len(nodes) == 0 {
+			delete(s.expiry, cluster)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package rangestore
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the stores are opened from a spec, a URL whose scheme is the kind of
+// store and whose query has the options of the store, eg,
+//   file:///var/yarge?fast=1
+//   etcd://h1:4001,h2:4001/yarge?roptimize=1&mirror=1
+// The store packages register a factory for their scheme (in init), the
+// programs import them (see rangestore/stores) and Open the specs.
+
+// a store opened from a spec, Close releases what it holds (connections,
+// watches, the plugin, etc)
+type StoreCloser interface {
+	Store
+	Close()
+}
+
+// Factory opens the store of the spec
+type Factory func(spec *url.URL) (StoreCloser, error)
+
+var factories = struct {
+	sync.RWMutex
+	m map[string]Factory
+}{m: make(map[string]Factory)}
+
+// Register makes the stores of the scheme available to Open, registering
+// a scheme twice is a bug
+func Register(scheme string, factory Factory) {
+	factories.Lock()
+	defer factories.Unlock()
+	if _, ok := factories.m[scheme]; ok {
+		panic(fmt.Sprintf("rangestore: Register called twice for scheme [%s]", scheme))
+	}
+	factories.m[scheme] = factory
+}
+
+// Schemes are the schemes registered, sorted
+func Schemes() []string {
+	factories.RLock()
+	defer factories.RUnlock()
+	var schemes = make([]string, 0, len(factories.m))
+	for scheme := range factories.m {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open the store of the spec
+func Open(spec string) (StoreCloser, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Store spec [%s] is not valid (Error: %s)", spec, err)
+	} else if u.Scheme == "" {
+		return nil, fmt.Errorf("Store spec [%s] has no scheme (eg, file:///var/yarge)", spec)
+	}
+	factories.RLock()
+	factory, ok := factories.m[u.Scheme]
+	factories.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Store spec [%s] is of unknown scheme [%s] (Supports only %q)", spec, u.Scheme, Schemes())
+	}
+	return factory(u)
+}
+
+//////////////////////
+// Params of a Spec //
+//////////////////////
+
+// Params are the options of a spec (its query) for the factories. The
+// first bad value is kept, Err tells it along with the options which
+// were never asked for (typos, options of another store)
+type Params struct {
+	values url.Values
+	asked  map[string]bool
+	err    error
+}
+
+func NewParams(spec *url.URL) *Params {
+	return &Params{values: spec.Query(), asked: make(map[string]bool)}
+}
+
+// Bool is true for 1, t, true, etc (see strconv.ParseBool), false if not set
+func (p *Params) Bool(name string) bool {
+	var v = p.get(name)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	p.fail(name, v, err)
+	return b
+}
+
+// String is the value, def if not set
+func (p *Params) String(name string, def string) string {
+	if v := p.get(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// Int is the value, def if not set
+func (p *Params) Int(name string, def int) int {
+	var v = p.get(name)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	p.fail(name, v, err)
+	return i
+}
+
+// Duration is the value (eg, 2s), def if not set
+func (p *Params) Duration(name string, def time.Duration) time.Duration {
+	var v = p.get(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	p.fail(name, v, err)
+	return d
+}
+
+// List are the values, either comma separated or the option repeated
+func (p *Params) List(name string) []string {
+	p.asked[name] = true
+	var list = make([]string, 0)
+	for _, v := range p.values[name] {
+		for _, elem := range strings.Split(v, ",") {
+			if elem != "" {
+				list = append(list, elem)
+			}
+		}
+	}
+	return list
+}
+
+// Values are the values as they are, the option repeated (eg, the
+// arguments of a plugin)
+func (p *Params) Values(name string) []string {
+	p.asked[name] = true
+	return p.values[name]
+}
+
+// Err is the first bad value, or the unknown options
+func (p *Params) Err() error {
+	if p.err != nil {
+		return p.err
+	}
+	var unknown = make([]string, 0)
+	for name := range p.values {
+		if !p.asked[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("Unknown options %q in the store spec", unknown)
+	}
+	return nil
+}
+
+func (p *Params) get(name string) string {
+	p.asked[name] = true
+	return p.values.Get(name)
+}
+
+func (p *Params) fail(name string, value string, err error) {
+	if err != nil && p.err == nil {
+		p.err = fmt.Errorf("Option [%s=%s] of the store spec is not valid (Error: %s)", name, value, err)
+	}
+}
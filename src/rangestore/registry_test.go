@@ -0,0 +1,71 @@
+package rangestore_test
+
+import (
+	"net/url"
+	"rangestore"
+	"rangestore/filestore"
+	_ "rangestore/stores"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpen(t *testing.T) {
+	for _, scheme := range []string{"etcd", "file", "http", "https", "plugin", "test"} {
+		if !strings.Contains(strings.Join(rangestore.Schemes(), ","), scheme) {
+			t.Errorf("Expected the scheme [%s] to be registered, Got: %v", scheme, rangestore.Schemes())
+		}
+	}
+
+	s, err := rangestore.Open("file:filestore/t?fast=1")
+	if err != nil {
+		t.Fatal("Open ", err)
+	}
+	defer s.Close()
+	if f, ok := s.(*filestore.FileStore); !ok || !f.FastLookup || f.StorePath != "filestore/t" {
+		t.Errorf("Expected the fast FileStore of filestore/t, Got: %#v", s)
+	}
+	results, err := s.KeyLookup(&[]string{"ops-prod-vpc1-mon"}, "AUTHORS")
+	if err != nil || sorted(results) != "Ops" {
+		t.Errorf("Expected Ops, Got: %v (Error: %v)", results, err)
+	}
+
+	var cases = []struct {
+		spec     string
+		expected string
+	}{
+		{"/var/yarge", "has no scheme"},
+		{"nosuch:///var/yarge", "unknown scheme [nosuch]"},
+		{"file:filestore/t?fats=1", `Unknown options ["fats"]`},
+		{"file:filestore/t?fast=yes", "[fast=yes]"},
+		{"file://host/var/yarge", "has a host"},
+		{"file:nosuch", "not a FileStore directory"},
+		{"etcd:///yarge", "has no hosts"},
+	}
+	for _, c := range cases {
+		if _, err := rangestore.Open(c.spec); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("Spec %s, Expected Error: %s, Got: %v", c.spec, c.expected, err)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	u, _ := url.Parse("x:y?fast=true&depth=3&timeout=2s&rindex=A,B&rindex=C&arg=-v&arg=a,b")
+	var p = rangestore.NewParams(u)
+	if !p.Bool("fast") || p.Bool("mirror") || p.Int("depth", -1) != 3 || p.Int("size", 7) != 7 {
+		t.Errorf("Expected fast, depth 3 and the defaults")
+	}
+	if p.Duration("timeout", 0) != 2*time.Second || p.String("root", "/") != "/" {
+		t.Errorf("Expected timeout 2s and the default root")
+	}
+	if l := p.List("rindex"); !reflect.DeepEqual(l, []string{"A", "B", "C"}) {
+		t.Errorf("Expected [A B C], Got: %v", l)
+	}
+	if v := p.Values("arg"); !reflect.DeepEqual(v, []string{"-v", "a,b"}) {
+		t.Errorf("Expected [-v a,b], Got: %v", v)
+	}
+	if err := p.Err(); err != nil {
+		t.Errorf("Expected no Error, Got: %v", err)
+	}
+}
@@ -0,0 +1,445 @@
+package rangestore
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a store which can serve stale answers, Stale tells whether it is doing
+// so and how old its answers are
+type Staler interface {
+	Stale() (stale bool, age time.Duration)
+}
+
+// a store wrapping another (eg, a cache), Unwrap is the store it wraps
+type Wrapper interface {
+	Unwrap() Store
+}
+
+// Backend is the store under the wrappers (caches, etc)
+func Backend(store Store) Store {
+	for {
+		w, ok := store.(Wrapper)
+		if !ok {
+			return store
+		}
+		store = w.Unwrap()
+	}
+}
+
+// StaleStore keeps the last good answer of each lookup and serves it when
+// the store is unavailable (ErrUnavailable), so that an outage of the
+// backend (eg, etcd) doesn't fail the queries which worked before it.
+// The answers are saved to a snapshot every interval (and on Close), a
+// server restarted while the store is down can serve the snapshot.
+// Only the answers found are kept, a not found is unavailable when the
+// store is. The answers kept are bounded (size), the least recently used
+// are dropped first, and the ones older than maxAge are not served (nor
+// saved), so the queries of the clients can't grow it without limit.
+type StaleStore struct {
+	store    Store
+	snapshot string        // file of the snapshot, "" if none
+	size     int           // answers kept, zero or less is no bound
+	maxAge   time.Duration // of the answers served, zero is no cutoff
+	stop     chan bool
+	done     chan bool
+
+	mu      sync.RWMutex
+	answers map[string]*list.Element // of *staleEntry, most recently used first
+	lru     *list.List
+	good    time.Time // when the store last answered
+	failing bool      // the store is unavailable as of the last lookup
+	dirty   bool      // answers not in the snapshot yet
+}
+
+type staleEntry struct {
+	key    string
+	answer staleAnswer
+}
+
+type staleAnswer struct {
+	Result []string  `json:"result"`
+	At     time.Time `json:"at"`
+}
+
+// what is in the snapshot
+type staleSnapshot struct {
+	Good    time.Time              `json:"good"`
+	Answers map[string]staleAnswer `json:"answers"`
+}
+
+// NewStaleStore serves the last good answers of the store when it is
+// unavailable, up to size answers (zero or less is no bound) no older
+// than maxAge (zero is no cutoff). The answers of the snapshot (if any)
+// are served until the store answers
+func NewStaleStore(store Store, snapshot string, interval time.Duration, size int, maxAge time.Duration) (*StaleStore, error) {
+	var s = &StaleStore{
+		store:    store,
+		snapshot: snapshot,
+		size:     size,
+		maxAge:   maxAge,
+		stop:     make(chan bool),
+		done:     make(chan bool),
+		answers:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+	if snapshot == "" {
+		close(s.done)
+		return s, nil
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.follow(interval)
+	return s, nil
+}
+
+// Close saves the snapshot (if any)
+func (s *StaleStore) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *StaleStore) Unwrap() Store {
+	return s.store
+}
+
+// Stale tells whether the answers are stale (the store is unavailable)
+// and how long ago the store last answered
+func (s *StaleStore) Stale() (bool, time.Duration) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.good.IsZero() {
+		return s.failing, 0
+	}
+	return s.failing, time.Since(s.good)
+}
+
+// Len is the count of the answers kept
+func (s *StaleStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lru.Len()
+}
+
+// the store can serve, or we can serve for it
+func (s *StaleStore) Ping() error {
+	var err = pingAll([]Store{s.store})
+	if err != nil && errors.Is(err, ErrUnavailable) && s.Len() > 0 {
+		return nil
+	}
+	return err
+}
+
+// Scope is the store as seen by a query, the lookups are done by the
+// store scoped to the query and the query is told of the stale answers
+// (see Tracker)
+func (s *StaleStore) Scope(t Tracker) Store {
+	return &staleView{stale: s, store: Scope(s.store, t), tracker: t}
+}
+
+////////////////////
+// LOOKUP CLUSTER //
+////////////////////
+
+func (s *StaleStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	return s.Scope(nil).ClusterLookup(cluster)
+}
+
+func (s *StaleStore) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	return s.Scope(nil).KeyLookup(cluster, key)
+}
+
+////////////////////
+// LOOKUP REVERSE //
+////////////////////
+
+func (s *StaleStore) KeyReverseLookup(key string) (*[]string, error) {
+	return s.Scope(nil).KeyReverseLookup(key)
+}
+
+func (s *StaleStore) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return s.Scope(nil).KeyReverseLookupAttr(key, attr)
+}
+
+func (s *StaleStore) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return s.Scope(nil).KeyReverseLookupHint(key, attr, hint)
+}
+
+////////////////
+// STALE VIEW //
+////////////////
+
+// the stale store as seen by a query, store is the one scoped to it
+type staleView struct {
+	stale   *StaleStore
+	store   Store
+	tracker Tracker // nil if not scoped to a query
+}
+
+func (v *staleView) ClusterLookup(cluster *[]string) (*[]string, error) {
+	return v.stale.do(v.tracker, lookupKey("C", *cluster...), func() (*[]string, error) {
+		return v.store.ClusterLookup(cluster)
+	})
+}
+
+func (v *staleView) KeyLookup(cluster *[]string, key string) (*[]string, error) {
+	return v.stale.do(v.tracker, lookupKey("K", append([]string{key}, *cluster...)...), func() (*[]string, error) {
+		return v.store.KeyLookup(cluster, key)
+	})
+}
+
+func (v *staleView) KeyReverseLookup(key string) (*[]string, error) {
+	return v.stale.do(v.tracker, lookupKey("R", key), func() (*[]string, error) {
+		return v.store.KeyReverseLookup(key)
+	})
+}
+
+func (v *staleView) KeyReverseLookupAttr(key string, attr string) (*[]string, error) {
+	return v.stale.do(v.tracker, lookupKey("A", key, attr), func() (*[]string, error) {
+		return v.store.KeyReverseLookupAttr(key, attr)
+	})
+}
+
+func (v *staleView) KeyReverseLookupHint(key string, attr string, hint string) (*[]string, error) {
+	return v.stale.do(v.tracker, lookupKey("H", key, attr, hint), func() (*[]string, error) {
+		return v.store.KeyReverseLookupHint(key, attr, hint)
+	})
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+// the lookup, the answer is kept if good and the kept one is served if
+// the store is unavailable (t is told so). A lookup over the limits of
+// its query tells nothing of the store
+func (s *StaleStore) do(t Tracker, key string, lookup func() (*[]string, error)) (*[]string, error) {
+	result, err := lookup()
+	if errors.Is(err, ErrLimit) {
+		return result, err
+	}
+	var now = time.Now()
+	if err == nil || !errors.Is(err, ErrUnavailable) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.failing {
+			log.Printf("Store is AVAILABLE again, stopped serving stale answers\n")
+		}
+		s.good, s.failing = now, false
+		if err == nil {
+			s.add(key, staleAnswer{Result: append([]string{}, *result...), At: now})
+			s.dirty = true
+		}
+		return result, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.failing {
+		log.Printf("ERROR: Store is UNAVAILABLE, serving stale answers (Error: %s)\n", err)
+	}
+	s.failing = true
+	e, ok := s.answers[key]
+	if !ok {
+		return result, err
+	}
+	var answer = e.Value.(*staleEntry).answer
+	if s.expired(answer, now) {
+		s.remove(e)
+		s.dirty = true
+		return result, err
+	}
+	s.lru.MoveToFront(e)
+	if t != nil {
+		var age time.Duration
+		if !s.good.IsZero() {
+			age = now.Sub(s.good)
+		}
+		t.MarkStale(age)
+	}
+	return copyResult(answer.Result), nil
+}
+
+////////////////////
+// STALE RECORDER //
+////////////////////
+
+// StaleRecorder is the Tracker of a lookup shared by many queries (eg,
+// by a cache), it records whether the lookup was answered stale so that
+// the queries sharing it can be told. The rest is up to the Tracker of
+// the query doing the lookup, if any
+type StaleRecorder struct {
+	Tracker Tracker
+
+	mu    sync.Mutex
+	stale bool
+	age   time.Duration
+}
+
+func (r *StaleRecorder) Visit(clusters int) error {
+	if r.Tracker == nil {
+		return nil
+	}
+	return r.Tracker.Visit(clusters)
+}
+
+func (r *StaleRecorder) Deadline() time.Time {
+	if r.Tracker == nil {
+		return time.Time{}
+	}
+	return r.Tracker.Deadline()
+}
+
+func (r *StaleRecorder) MarkStale(age time.Duration) {
+	r.mu.Lock()
+	if !r.stale || age > r.age {
+		r.stale, r.age = true, age
+	}
+	r.mu.Unlock()
+	if r.Tracker != nil {
+		r.Tracker.MarkStale(age)
+	}
+}
+
+// Stale tells whether the lookup was answered stale, and how old the
+// answer was
+func (r *StaleRecorder) Stale() (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stale, r.age
+}
+
+// keep the answer, the least recently used are dropped over the size
+func (s *StaleStore) add(key string, answer staleAnswer) {
+	if e, ok := s.answers[key]; ok {
+		e.Value.(*staleEntry).answer = answer
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.answers[key] = s.lru.PushFront(&staleEntry{key: key, answer: answer})
+	for s.size > 0 && s.lru.Len() > s.size {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *StaleStore) remove(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.answers, e.Value.(*staleEntry).key)
+}
+
+// the answer is too old to be served
+func (s *StaleStore) expired(answer staleAnswer, now time.Time) bool {
+	return s.maxAge > 0 && now.Sub(answer.At) > s.maxAge
+}
+
+// the lookup as a key (method and arguments)
+func lookupKey(method string, args ...string) string {
+	return method + "\x00" + strings.Join(args, "\x00")
+}
+
+// save the snapshot every interval, and once stopped
+func (s *StaleStore) follow(interval time.Duration) {
+	defer close(s.done)
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			s.save()
+			return
+		case <-ticker.C:
+			s.save()
+		}
+	}
+}
+
+// read the snapshot, a missing one is an empty one
+func (s *StaleStore) load() error {
+	content, err := ioutil.ReadFile(s.snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Reading the Snapshot [%s] Failed (Error: %s)", s.snapshot, err)
+	}
+	var snapshot staleSnapshot
+	if err = json.Unmarshal(content, &snapshot); err != nil {
+		return fmt.Errorf("Snapshot [%s] is not valid (Error: %s)", s.snapshot, err)
+	}
+	// the most recent answers are kept, up to the size
+	var keys = make([]string, 0, len(snapshot.Answers))
+	for key := range snapshot.Answers {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return snapshot.Answers[keys[i]].At.Before(snapshot.Answers[keys[j]].At) })
+	var now = time.Now()
+	for _, key := range keys {
+		if answer := snapshot.Answers[key]; !s.expired(answer, now) {
+			s.add(key, answer)
+		}
+	}
+	s.good = snapshot.Good
+	log.Printf("Snapshot [%s] Loaded (Answers: %d, Taken: %s)\n", s.snapshot, s.lru.Len(), s.good)
+	return nil
+}
+
+// write the snapshot if the answers changed (the ones too old are dropped),
+// to a temporary file first so that a crash doesn't leave half a snapshot
+func (s *StaleStore) save() {
+	s.mu.Lock()
+	var now = time.Now()
+	for e := s.lru.Front(); e != nil; {
+		var next = e.Next()
+		if s.expired(e.Value.(*staleEntry).answer, now) {
+			s.remove(e)
+			s.dirty = true
+		}
+		e = next
+	}
+	if !s.dirty {
+		s.mu.Unlock()
+		return
+	}
+	var answers = make(map[string]staleAnswer, s.lru.Len())
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		answers[e.Value.(*staleEntry).key] = e.Value.(*staleEntry).answer
+	}
+	content, err := json.Marshal(staleSnapshot{Good: s.good, Answers: answers})
+	s.dirty = false
+	s.mu.Unlock()
+	if err == nil {
+		err = writeFile(s.snapshot, content)
+	}
+	if err != nil {
+		log.Printf("ERROR: Writing the Snapshot [%s] Failed (Error: %s)\n", s.snapshot, err)
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+}
+
+func writeFile(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
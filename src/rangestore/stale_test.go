@@ -0,0 +1,155 @@
+package rangestore_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"rangestore"
+	"testing"
+	"time"
+)
+
+// fails all the lookups with ErrUnavailable while down
+type downStore struct {
+	rangestore.Store
+	down bool
+}
+
+func (s *downStore) ClusterLookup(cluster *[]string) (*[]string, error) {
+	if s.down {
+		return &[]string{}, fmt.Errorf("Store is down, %w", rangestore.ErrUnavailable)
+	}
+	return s.Store.ClusterLookup(cluster)
+}
+
+func TestStaleStore(t *testing.T) {
+	var snapshot = filepath.Join(t.TempDir(), "snapshot.json")
+	var store = &downStore{Store: fixture(t)}
+	s, err := rangestore.NewStaleStore(store, snapshot, time.Hour, 0, 0)
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, Got: %s", err)
+	}
+	if results, err := s.ClusterLookup(&[]string{"ops-prod"}); err != nil || sorted(results) != "ops-prod-vpc1,ops-prod-vpc2" {
+		t.Fatalf("Expected ops-prod-vpc1,ops-prod-vpc2, Got: %v (Error: %v)", results, err)
+	}
+
+	store.down = true
+	if results, err := s.ClusterLookup(&[]string{"ops-prod"}); err != nil || sorted(results) != "ops-prod-vpc1,ops-prod-vpc2" {
+		t.Errorf("Expected the stale answer, Got: %v (Error: %v)", results, err)
+	}
+	if stale, _ := s.Stale(); !stale {
+		t.Errorf("Expected the answers to be stale")
+	}
+	// never answered, nothing to serve
+	if _, err := s.ClusterLookup(&[]string{"ops-prod-vpc1"}); !errors.Is(err, rangestore.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, Got: %v", err)
+	}
+	s.Close()
+
+	// restarted while the store is down, the snapshot is served
+	s, err = rangestore.NewStaleStore(store, snapshot, time.Hour, 0, 0)
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, Got: %s", err)
+	}
+	defer s.Close()
+	if results, err := s.ClusterLookup(&[]string{"ops-prod"}); err != nil || sorted(results) != "ops-prod-vpc1,ops-prod-vpc2" {
+		t.Errorf("Expected the answer of the snapshot, Got: %v (Error: %v)", results, err)
+	}
+	if stale, age := s.Stale(); !stale || age <= 0 {
+		t.Errorf("Expected the answers to be stale with an age, Got: %v %s", stale, age)
+	}
+
+	store.down = false
+	s.ClusterLookup(&[]string{"ops-prod"})
+	if stale, _ := s.Stale(); stale {
+		t.Errorf("Expected the answers to be fresh once the store is back")
+	}
+}
+
+func TestStaleStoreScope(t *testing.T) {
+	var store = &downStore{Store: fixture(t)}
+	s, err := rangestore.NewStaleStore(store, filepath.Join(t.TempDir(), "snapshot.json"), time.Hour, 0, 0)
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, Got: %s", err)
+	}
+	defer s.Close()
+	// the cache is on top of the stale store, as in the server
+	var c = rangestore.NewCachingStore(s, time.Hour, 0)
+	var before = rangestore.NewLimitedStore(c, rangestore.Limits{})
+	before.ClusterLookup(&[]string{"ops-prod"})
+	c.Invalidate()
+
+	// only the query answered stale is told so
+	store.down = true
+	var query = rangestore.NewLimitedStore(c, rangestore.Limits{})
+	if results, err := query.ClusterLookup(&[]string{"ops-prod"}); err != nil || sorted(results) != "ops-prod-vpc1,ops-prod-vpc2" {
+		t.Errorf("Expected the stale answer, Got: %v (Error: %v)", results, err)
+	}
+	if stale, _ := query.Stale(); !stale {
+		t.Errorf("Expected the query to be told of the stale answer")
+	}
+	if stale, _ := before.Stale(); stale {
+		t.Errorf("Expected the query answered before the outage NOT to be stale")
+	}
+
+	// the stale answer is not cached, once the store is back the next
+	// query gets a fresh one
+	store.down = false
+	var after = rangestore.NewLimitedStore(c, rangestore.Limits{})
+	after.ClusterLookup(&[]string{"ops-prod"})
+	if stale, _ := after.Stale(); stale {
+		t.Errorf("Expected the query answered after the outage NOT to be stale")
+	}
+}
+
+// the answers kept stay at the size, the least recently used go first,
+// and the old ones are not served
+func TestStaleStoreBound(t *testing.T) {
+	var snapshot = filepath.Join(t.TempDir(), "snapshot.json")
+	var store = &downStore{Store: fixture(t)}
+	s, err := rangestore.NewStaleStore(store, snapshot, time.Hour, 2, 0)
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, Got: %s", err)
+	}
+	for _, cluster := range []string{"ops", "ops-prod", "ops-prod-vpc1", "ops-prod-vpc2", "data"} {
+		s.ClusterLookup(&[]string{cluster})
+	}
+	if s.Len() != 2 {
+		t.Errorf("Expected 2 answers kept, Got: %d", s.Len())
+	}
+	store.down = true
+	if _, err := s.ClusterLookup(&[]string{"ops"}); !errors.Is(err, rangestore.ErrUnavailable) {
+		t.Errorf("Expected the least recently used to be dropped, Got: %v", err)
+	}
+	if results, err := s.ClusterLookup(&[]string{"data"}); err != nil || sorted(results) != "data-prod,data-qa" {
+		t.Errorf("Expected the stale answer, Got: %v (Error: %v)", results, err)
+	}
+	s.Close()
+
+	// the snapshot has no more than the size either
+	s, err = rangestore.NewStaleStore(store, snapshot, time.Hour, 1, 0)
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, Got: %s", err)
+	}
+	if s.Len() != 1 {
+		t.Errorf("Expected 1 answer loaded, Got: %d", s.Len())
+	}
+	s.Close()
+
+	// too old to be served
+	s, err = rangestore.NewStaleStore(store, "", time.Hour, 0, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected NO ERROR, Got: %s", err)
+	}
+	defer s.Close()
+	store.down = false
+	s.ClusterLookup(&[]string{"ops"})
+	store.down = true
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.ClusterLookup(&[]string{"ops"}); !errors.Is(err, rangestore.ErrUnavailable) {
+		t.Errorf("Expected the old answer NOT to be served, Got: %v", err)
+	}
+	if s.Len() != 0 {
+		t.Errorf("Expected the old answer to be dropped, Got: %d", s.Len())
+	}
+}
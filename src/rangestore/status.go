@@ -0,0 +1,47 @@
+package rangestore
+
+// what a store has, for the status endpoint
+type StoreStatus struct {
+	Type     string `json:"type"`     // eg, filestore, etcdstore
+	Root     string `json:"root"`     // where the clusters are, path or etcd node
+	Clusters int    `json:"clusters"` // all the clusters, leaf or not
+	Leaves   int    `json:"leaves"`   // leaf clusters
+	Nodes    int    `json:"nodes"`    // distinct values of NODES of the leaves
+	Keys     int    `json:"keys"`     // keys of the leaves (NODES included)
+}
+
+// a store which can tell whether it can serve, Ping is cheap and is
+// called periodically for the readiness
+type Pinger interface {
+	Ping() error // nil if the store can serve lookups
+}
+
+// a store which can tell what it has too, Status walks the whole store
+type StatusStore interface {
+	Pinger
+	Status() (StoreStatus, error) // counts of the store
+}
+
+// the stores which can tell can serve
+func pingAll(stores []Store) error {
+	for _, s := range stores {
+		if p, ok := s.(Pinger); ok {
+			if err := p.Ping(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// counts the leaf, its keys and the nodes (seen is the nodes seen so far)
+func (s *StoreStatus) AddLeaf(keys map[string][]string, seen map[string]bool) {
+	s.Leaves++
+	s.Keys += len(keys)
+	for _, node := range keys["NODES"] {
+		if !seen[node] {
+			seen[node] = true
+			s.Nodes++
+		}
+	}
+}
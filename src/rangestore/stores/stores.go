@@ -0,0 +1,13 @@
+// All the stores, so that a program can open any of them from a spec
+// (see rangestore.Open) by importing this package,
+//   import _ "rangestore/stores"
+// A new store is added here, not in the programs.
+
+package stores
+
+import (
+	_ "rangestore/etcdstore"
+	_ "rangestore/filestore"
+	_ "rangestore/httpstore"
+	_ "rangestore/pluginstore"
+)
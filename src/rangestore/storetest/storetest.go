@@ -0,0 +1,227 @@
+// The conformance suite of the stores, every implementation runs it on the
+// fixture tree (rangestore/filestore/t, loaded as it is in the store) so
+// that the stores answer the same lookups the same way, eg,
+//   func TestConformance(t *testing.T) {
+//   	storetest.Run(t, store)
+//   }
+// The order of the results is not part of the contract, they are compared
+// as sets. The values looked up are ones the range expressions can have
+// (see rvalue in rangeexpr/expr.peg), so that a store behind a server
+// (eg, httpstore) can run it too.
+
+package storetest
+
+import (
+	"errors"
+	"path/filepath"
+	"rangestore"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+// Fixture is the directory of the fixture tree
+func Fixture() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "filestore", "t")
+}
+
+// a lookup and what it is expected to return
+type lookup struct {
+	name     string
+	do       func(rangestore.Store) (*[]string, error)
+	expected []string
+}
+
+func clusters(names ...string) func(rangestore.Store) (*[]string, error) {
+	return func(s rangestore.Store) (*[]string, error) { return s.ClusterLookup(&names) }
+}
+
+func key(cluster string, key string) func(rangestore.Store) (*[]string, error) {
+	return func(s rangestore.Store) (*[]string, error) { return s.KeyLookup(&[]string{cluster}, key) }
+}
+
+func reverse(key string, attr string, hint string) func(rangestore.Store) (*[]string, error) {
+	return func(s rangestore.Store) (*[]string, error) {
+		if attr == "" {
+			return s.KeyReverseLookup(key)
+		} else if hint == "" {
+			return s.KeyReverseLookupAttr(key, attr)
+		}
+		return s.KeyReverseLookupHint(key, attr, hint)
+	}
+}
+
+var _opsMon = []string{"ops-prod-vpc1-mon", "ops-prod-vpc2-mon"}
+
+// Run the suite on the store of the fixture tree
+func Run(t *testing.T, store rangestore.Store) {
+	t.Run("Cluster", func(t *testing.T) {
+		check(t, store, []lookup{
+			{"toplevel", clusters("ops"), []string{"ops-prod"}},
+			{"children", clusters("ops-prod"), []string{"ops-prod-vpc1", "ops-prod-vpc2"}},
+			{"leaf", clusters("ops-prod-vpc1-range"), []string{"range1001.ops.example.com", "range1002.ops.example.com", "range1003.ops.example.com"}},
+			{"many", clusters("ops-prod", "data-qa"), []string{"ops-prod-vpc1", "ops-prod-vpc2", "data-qa-vpc5"}},
+		})
+	})
+	t.Run("Key", func(t *testing.T) {
+		check(t, store, []lookup{
+			{"AUTHORS", key("ops-prod-vpc1-range", "AUTHORS"), []string{"Vigith Maurice"}},
+			{"VERSION", key("ops-prod-vpc1-mon", "VERSION"), []string{"1.0.0.1"}},
+			{"NODES", key("data-qa-vpc5-log", "NODES"), []string{"data5001.qa.example.com", "data5002.qa.example.com", "data5003.qa.example.com"}},
+			{"many", func(s rangestore.Store) (*[]string, error) {
+				return s.KeyLookup(&[]string{"ops-prod-vpc1-mon", "ops-prod-vpc2-mon"}, "NODES")
+			}, []string{"mon1001.ops.example.com", "mon2001.ops.example.com"}},
+		})
+	})
+	t.Run("KEYS", func(t *testing.T) {
+		check(t, store, []lookup{
+			{"qa", key("data-qa-vpc5-log", "KEYS"), []string{"AUTHORS", "NODES", "QAFOR"}},
+			{"mon", key("ops-prod-vpc1-mon", "KEYS"), []string{"AUTHORS", "NODES", "VERSION"}},
+		})
+	})
+	t.Run("RANGE", func(t *testing.T) {
+		check(t, store, []lookup{
+			{"toplevel", clusters("RANGE"), []string{"data", "ops"}},
+		})
+	})
+	t.Run("Reverse", func(t *testing.T) {
+		check(t, store, []lookup{
+			{"node", reverse("range1001.ops.example.com", "", ""), []string{"ops-prod-vpc1-range"}},
+			{"other", reverse("data5002.qa.example.com", "", ""), []string{"data-qa-vpc5-log"}},
+			{"missing", reverse("nosuch.example.com", "", ""), []string{}},
+		})
+	})
+	t.Run("Attr", func(t *testing.T) {
+		check(t, store, []lookup{
+			{"QAFOR", reverse("data", "QAFOR", ""), []string{"data-qa-vpc5-log"}},
+			{"AUTHORS", reverse("Ops", "AUTHORS", ""), _opsMon},
+			{"missing attr", reverse("data", "NOSUCH", ""), []string{}},
+		})
+	})
+	t.Run("Hint", func(t *testing.T) {
+		check(t, store, []lookup{
+			{"toplevel", reverse("Ops", "AUTHORS", "ops"), _opsMon},
+			{"scoped", reverse("Ops", "AUTHORS", "ops-prod-vpc2"), []string{"ops-prod-vpc2-mon"}},
+			{"leaf", reverse("Ops", "AUTHORS", "ops-prod-vpc1-mon"), []string{"ops-prod-vpc1-mon"}},
+			{"elsewhere", reverse("Ops", "AUTHORS", "data"), []string{}},
+			{"missing hint", reverse("Ops", "AUTHORS", "nosuch"), []string{}},
+		})
+	})
+	t.Run("Errors", func(t *testing.T) {
+		var cases = []struct {
+			name string
+			do   func(rangestore.Store) (*[]string, error)
+		}{
+			{"cluster", clusters("ops-prod-vpc1-nosuch")},
+			{"key", key("ops-prod-vpc1-range", "NOSUCH")},
+			{"key of missing cluster", key("ops-prod-vpc1-nosuch", "AUTHORS")},
+			{"NODES of non leaf", key("ops-prod-vpc1", "NODES")},
+			{"KEYS of non leaf", key("ops-prod", "KEYS")},
+		}
+		for _, c := range cases {
+			results, err := c.do(store)
+			if !errors.Is(err, rangestore.ErrNotFound) {
+				t.Errorf("%s: Expected ErrNotFound, Got: %v", c.name, err)
+			}
+			if results == nil {
+				t.Errorf("%s: Expected the results (even on an Error), Got: nil", c.name)
+			}
+		}
+	})
+	t.Run("Syntax", func(t *testing.T) {
+		// names and values with range syntax are not names of the
+		// tree, the store finds nothing or refuses them
+		var cases = []struct {
+			name string
+			do   func(rangestore.Store) (*[]string, error)
+		}{
+			{"cluster", clusters("ops-prod,data-qa")},
+			{"key", key("ops-prod-vpc1-range", "AUTHORS,NODES")},
+			{"key of cluster", key("ops-prod-vpc1-range:NODES", "AUTHORS")},
+			{"reverse", reverse("Ops,data", "", "")},
+			{"attr", reverse("Ops", "AUTHORS;QAFOR", "")},
+			{"value", reverse("Ops;AUTHORS", "AUTHORS", "")},
+			{"hint", reverse("Ops", "AUTHORS", "ops&data^x")},
+		}
+		for _, c := range cases {
+			results, err := c.do(store)
+			if err != nil && !errors.Is(err, rangestore.ErrNotFound) && !errors.Is(err, rangestore.ErrInvalidName) {
+				t.Errorf("%s: Expected ErrNotFound or ErrInvalidName, Got: %v", c.name, err)
+			}
+			if results == nil || len(*results) != 0 {
+				t.Errorf("%s: Expected no results, Got: %v", c.name, results)
+			}
+		}
+	})
+	t.Run("Arguments", func(t *testing.T) {
+		// the clusters given are not touched
+		var cluster = []string{"ops-prod", "RANGE"}
+		if _, err := store.ClusterLookup(&cluster); err != nil {
+			t.Fatal("ClusterLookup ", err)
+		}
+		if _, err := store.KeyLookup(&cluster, "NOSUCH"); err == nil {
+			t.Errorf("Expected an Error, Got: nil")
+		}
+		if !reflect.DeepEqual(cluster, []string{"ops-prod", "RANGE"}) {
+			t.Errorf("Expected the clusters not to be modified, Got: %v", cluster)
+		}
+	})
+}
+
+// RunFast runs the suite on the store of the fixture tree doing fast
+// lookups, a reverse lookup returns one of the matches (the first it sees)
+func RunFast(t *testing.T, store rangestore.Store) {
+	var cases = []lookup{
+		{"attr", reverse("Ops", "AUTHORS", ""), _opsMon},
+		{"hint", reverse("Ops", "AUTHORS", "ops-prod"), _opsMon},
+		{"node", reverse("mon2001.ops.example.com", "", ""), []string{"ops-prod-vpc2-mon"}},
+	}
+	for _, c := range cases {
+		results, err := c.do(store)
+		if err != nil {
+			t.Errorf("%s: Expected NO ERROR, Got: %s", c.name, err)
+		} else if len(*results) != 1 || !contains(c.expected, (*results)[0]) {
+			t.Errorf("%s: Expected one of %v, Got: %v", c.name, c.expected, *results)
+		}
+	}
+	// the lookups which are not reverse are complete
+	check(t, store, []lookup{
+		{"cluster", clusters("ops-prod"), []string{"ops-prod-vpc1", "ops-prod-vpc2"}},
+		{"key", key("data-prod-vpc2-log", "NODES"), []string{"data2001.data.example.com", "data2002.data.example.com", "data2003.data.example.com"}},
+	})
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+func check(t *testing.T, store rangestore.Store, lookups []lookup) {
+	t.Helper()
+	for _, l := range lookups {
+		results, err := l.do(store)
+		if err != nil {
+			t.Errorf("%s: Expected NO ERROR, Got: %s", l.name, err)
+		} else if results == nil {
+			t.Errorf("%s: Expected %v, Got: nil", l.name, l.expected)
+		} else if !reflect.DeepEqual(sorted(*results), sorted(l.expected)) {
+			t.Errorf("%s: Expected %v, Got: %v", l.name, l.expected, *results)
+		}
+	}
+}
+
+func sorted(s []string) []string {
+	var c = append([]string{}, s...)
+	sort.Strings(c)
+	return c
+}
+
+func contains(s []string, elem string) bool {
+	for _, i := range s {
+		if i == elem {
+			return true
+		}
+	}
+	return false
+}
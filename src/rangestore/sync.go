@@ -0,0 +1,222 @@
+package rangestore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// copying a store into another (see _main/yarge-sync.go). The trees of
+// both the stores are read, the changes which make the destination the
+// same as the source are worked out (Diff) and written (Apply), so a sync
+// on a destination already in sync writes nothing. The destination is
+// made the same as the source whatever its edits were, ie, the changes
+// are not based on the versions of the clusters.
+
+// Tree is the leaf clusters of a store with their keys and values
+type Tree map[string]map[string][]string
+
+// what a change does
+const (
+	ChangeCreate    = "create"     // creates the leaf cluster
+	ChangeSet       = "set"        // sets the values of the key
+	ChangeDeleteKey = "delete-key" // deletes the key
+	ChangeDelete    = "delete"     // deletes the leaf cluster
+)
+
+// Change is an edit of the destination
+type Change struct {
+	Action  string
+	Cluster string
+	Key     string   // set and delete-key
+	Values  []string // set, the new values
+	Old     []string // set and delete-key, the values in the destination
+}
+
+// eg, + ops-prod-vpc9-web, ~ ops-prod-vpc1-mon:NODES [a] -> [a b]
+func (c Change) String() string {
+	switch c.Action {
+	case ChangeCreate:
+		return fmt.Sprintf("+ %s", c.Cluster)
+	case ChangeSet:
+		if c.Old == nil {
+			return fmt.Sprintf("+ %s:%s %v", c.Cluster, c.Key, c.Values)
+		}
+		return fmt.Sprintf("~ %s:%s %v -> %v", c.Cluster, c.Key, c.Old, c.Values)
+	case ChangeDeleteKey:
+		return fmt.Sprintf("- %s:%s %v", c.Cluster, c.Key, c.Old)
+	}
+	return fmt.Sprintf("- %s", c.Cluster)
+}
+
+// ReadTree reads the leaf clusters of the store, at any depth (only the
+// leaf clusters have KEYS)
+func ReadTree(store Store) (Tree, error) {
+	var tree = make(Tree)
+	return tree, readTree(store, "RANGE", tree)
+}
+
+// Diff is the changes which make to the same as from. With prune, the
+// clusters and keys which are only in to are deleted, otherwise they stay.
+// The clusters are deleted first (a leaf of from could be a parent in
+// to), then the clusters are created and their keys set, in order.
+// The values are compared as sets.
+func Diff(from Tree, to Tree, prune bool) []Change {
+	var changes = make([]Change, 0)
+	if prune {
+		for _, cluster := range clusterNames(to) {
+			if _, ok := from[cluster]; !ok {
+				changes = append(changes, Change{Action: ChangeDelete, Cluster: cluster})
+			}
+		}
+	}
+	for _, cluster := range clusterNames(from) {
+		var keys, existing = from[cluster], to[cluster]
+		if existing == nil {
+			changes = append(changes, Change{Action: ChangeCreate, Cluster: cluster})
+		}
+		for _, key := range keyNames(keys) {
+			if old, ok := existing[key]; !ok {
+				changes = append(changes, Change{Action: ChangeSet, Cluster: cluster, Key: key, Values: keys[key]})
+			} else if !sameValues(old, keys[key]) {
+				changes = append(changes, Change{Action: ChangeSet, Cluster: cluster, Key: key, Values: keys[key], Old: old})
+			}
+		}
+		if !prune {
+			continue
+		}
+		for _, key := range keyNames(existing) {
+			if _, ok := keys[key]; !ok {
+				changes = append(changes, Change{Action: ChangeDeleteKey, Cluster: cluster, Key: key, Old: existing[key]})
+			}
+		}
+	}
+	return changes
+}
+
+// Apply writes the changes to the store, in order, up to the first which
+// fails. The parents left empty by a deleted cluster are deleted too
+func Apply(store WritableStore, changes []Change) error {
+	for _, c := range changes {
+		var err error
+		switch c.Action {
+		case ChangeCreate:
+			_, err = store.CreateCluster(c.Cluster)
+		case ChangeSet:
+			_, err = store.SetKey(c.Cluster, c.Key, c.Values, "")
+		case ChangeDeleteKey:
+			_, err = store.DeleteKey(c.Cluster, c.Key, "")
+		case ChangeDelete:
+			if err = store.DeleteCluster(c.Cluster, ""); err == nil {
+				err = deleteEmptyParents(store, c.Cluster)
+			}
+		default:
+			err = fmt.Errorf("unknown action [%s]", c.Action)
+		}
+		if err != nil {
+			return fmt.Errorf("Sync of [%s] Failed (Error: %w)", c, err)
+		}
+	}
+	return nil
+}
+
+// Sync makes to the same as from (see Diff), returns the changes. With
+// dryRun, the changes are not written
+func Sync(from Store, to WritableStore, prune bool, dryRun bool) ([]Change, error) {
+	source, err := ReadTree(from)
+	if err != nil {
+		return nil, fmt.Errorf("Reading the Source Failed (Error: %w)", err)
+	}
+	destination, err := ReadTree(to)
+	if err != nil {
+		return nil, fmt.Errorf("Reading the Destination Failed (Error: %w)", err)
+	}
+	var changes = Diff(source, destination, prune)
+	if dryRun {
+		return changes, nil
+	}
+	return changes, Apply(to, changes)
+}
+
+////////////////////////
+// Internal Functions //
+////////////////////////
+
+func readTree(store Store, cluster string, tree Tree) error {
+	children, err := store.ClusterLookup(&[]string{cluster})
+	if err != nil {
+		return fmt.Errorf("Reading [%s] Failed (Error: %w)", cluster, err)
+	}
+	for _, child := range *children {
+		keys, err := store.KeyLookup(&[]string{child}, "KEYS")
+		if errors.Is(err, ErrNotFound) {
+			if err = readTree(store, child, tree); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Reading [%s:KEYS] Failed (Error: %w)", child, err)
+		}
+		tree[child] = make(map[string][]string)
+		for _, key := range *keys {
+			values, err := store.KeyLookup(&[]string{child}, key)
+			if err != nil {
+				return fmt.Errorf("Reading [%s:%s] Failed (Error: %w)", child, key, err)
+			}
+			tree[child][key] = *values
+		}
+	}
+	return nil
+}
+
+// delete the parents of the cluster, from the closest, as long as they
+// have no clusters left
+func deleteEmptyParents(store WritableStore, cluster string) error {
+	var parts = strings.Split(cluster, "-")
+	for i := len(parts) - 1; i > 0; i-- {
+		var parent = strings.Join(parts[:i], "-")
+		children, err := store.ClusterLookup(&[]string{parent})
+		if err != nil || len(*children) > 0 {
+			return nil
+		}
+		if err = store.DeleteCluster(parent, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func clusterNames(tree Tree) []string {
+	var names = make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func keyNames(keys map[string][]string) []string {
+	var names = make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// same values, ignoring the order and the duplicates
+func sameValues(a []string, b []string) bool {
+	var set = make(map[string]bool)
+	for _, v := range a {
+		set[v] = true
+	}
+	var seen = make(map[string]bool)
+	for _, v := range b {
+		if !set[v] {
+			return false
+		}
+		seen[v] = true
+	}
+	return len(seen) == len(set)
+}
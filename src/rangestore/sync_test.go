@@ -0,0 +1,96 @@
+package rangestore_test
+
+import (
+	"os"
+	"path/filepath"
+	"rangestore"
+	"rangestore/filestore"
+	"rangestore/storetest"
+	"reflect"
+	"testing"
+)
+
+func changeStrings(changes []rangestore.Change) []string {
+	var s = make([]string, 0)
+	for _, c := range changes {
+		s = append(s, c.String())
+	}
+	return s
+}
+
+func TestDiff(t *testing.T) {
+	var from = rangestore.Tree{
+		"ops-prod-vpc1-mon": {"NODES": {"mon1001", "mon1002"}, "AUTHORS": {"Ops"}},
+		"ops-prod-vpc2-mon": {"NODES": {"mon2001"}},
+	}
+	var to = rangestore.Tree{
+		"ops-prod-vpc1-mon": {"NODES": {"mon1002", "mon1001", "mon1001"}, "AUTHORS": {"Other"}, "VERSION": {"1"}},
+		"ops-prod-vpc3-web": {"NODES": {"web3001"}},
+	}
+	var cases = []struct {
+		prune    bool
+		expected []string
+	}{
+		{false, []string{"~ ops-prod-vpc1-mon:AUTHORS [Other] -> [Ops]", "+ ops-prod-vpc2-mon", "+ ops-prod-vpc2-mon:NODES [mon2001]"}},
+		{true, []string{"- ops-prod-vpc3-web", "~ ops-prod-vpc1-mon:AUTHORS [Other] -> [Ops]", "- ops-prod-vpc1-mon:VERSION [1]", "+ ops-prod-vpc2-mon", "+ ops-prod-vpc2-mon:NODES [mon2001]"}},
+	}
+	for _, c := range cases {
+		if changes := changeStrings(rangestore.Diff(from, to, c.prune)); !reflect.DeepEqual(changes, c.expected) {
+			t.Errorf("Prune %t, Expected %q, Got: %q", c.prune, c.expected, changes)
+		}
+	}
+	if changes := rangestore.Diff(from, from, true); len(changes) != 0 {
+		t.Errorf("Expected no changes, Got: %v", changes)
+	}
+}
+
+func TestSync(t *testing.T) {
+	fixture, err := filestore.ConnectFileStore(storetest.Fixture(), -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+	var dir = t.TempDir()
+	store, err := filestore.ConnectFileStore(dir, -1, false)
+	if err != nil {
+		t.Fatal("ConnectFileStore ", err)
+	}
+
+	// a dry run writes nothing
+	changes, err := rangestore.Sync(fixture, store, false, true)
+	if err != nil || len(changes) != 7+16 {
+		t.Errorf("Expected the 7 clusters and their 16 keys to be created, Got: %d (Error: %v)", len(changes), err)
+	}
+	if tree, err := rangestore.ReadTree(store); err != nil || len(tree) != 0 {
+		t.Errorf("Expected the dry run to write nothing, Got: %v (Error: %v)", tree, err)
+	}
+	if _, err = rangestore.Sync(fixture, store, false, false); err != nil {
+		t.Fatal("Sync ", err)
+	}
+	storetest.Run(t, store)
+
+	// edits of the destination are undone, only the clusters and the keys
+	// changed are written
+	store.SetKey("ops-prod-vpc1-mon", "AUTHORS", []string{"Other"}, "")
+	store.DeleteKey("ops-prod-vpc1-mon", "VERSION", "")
+	store.CreateCluster("ops-prod-vpc9-web")
+	store.SetKey("ops-prod-vpc9-web", "NODES", []string{"web9001"}, "")
+	changes, err = rangestore.Sync(fixture, store, false, false)
+	var expected = []string{"~ ops-prod-vpc1-mon:AUTHORS [Other] -> [Ops]", "+ ops-prod-vpc1-mon:VERSION [1.0.0.1]"}
+	if err != nil || !reflect.DeepEqual(changeStrings(changes), expected) {
+		t.Errorf("Expected %q, Got: %q (Error: %v)", expected, changeStrings(changes), err)
+	}
+	// the clusters only in the destination stay, unless pruned (along with
+	// the parents left empty)
+	changes, err = rangestore.Sync(fixture, store, true, false)
+	expected = []string{"- ops-prod-vpc9-web"}
+	if err != nil || !reflect.DeepEqual(changeStrings(changes), expected) {
+		t.Errorf("Expected %q, Got: %q (Error: %v)", expected, changeStrings(changes), err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "ops", "prod", "vpc9")); !os.IsNotExist(err) {
+		t.Errorf("Expected ops-prod-vpc9 to be deleted, Got: %v", err)
+	}
+	storetest.Run(t, store)
+	if changes, err = rangestore.Sync(fixture, store, true, true); err != nil || len(changes) != 0 {
+		t.Errorf("Expected no changes, Got: %v (Error: %v)", changes, err)
+	}
+}
@@ -5,6 +5,7 @@ package rangestore
 
 import (
 	"errors"
+	"net/url"
 )
 
 // Test Range Structure
@@ -118,6 +119,20 @@ func (f *TestStore) DisconnectTestStore() {
 	return
 }
 
+func (f *TestStore) Close() {
+	f.DisconnectTestStore()
+}
+
+// test: (no options)
+func init() {
+	Register("test", func(spec *url.URL) (StoreCloser, error) {
+		if err := NewParams(spec).Err(); err != nil {
+			return nil, err
+		}
+		return ConnectTestStore("Test Store")
+	})
+}
+
 // query map
 func queryMap(cluster string, key string) (*[]string, error) {
 	switch cluster {
@@ -0,0 +1,76 @@
+package rangestore
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// a store which can be modified, on top of being looked up.
+// version is the version of the cluster (as returned by ClusterVersion)
+// the edit is based on. If the cluster has changed since, the edit is
+// refused with ErrConflict. An empty version means "don't care", but
+// the edit is still refused if a concurrent edit is seen while doing it.
+// Only leaf clusters have keys (and versions), the non-leaf clusters are
+// created on the way when a leaf cluster is created.
+// The edits return the version of the cluster they made, a version read
+// after the edit could already be of another edit.
+type WritableStore interface {
+	Store
+
+	ClusterVersion(string) (string, error) // version of a leaf cluster
+
+	// clusters
+	CreateCluster(string) (string, error)                 // creates an empty leaf cluster
+	DeleteCluster(string, string) error                   // leaf cluster, or an empty non-leaf cluster
+	RenameCluster(string, string, string) (string, error) // leaf cluster to a new name
+
+	// keys
+	SetKey(string, string, []string, string) (string, error)          // cluster, key, values, version
+	DeleteKey(string, string, string) (string, error)                 // cluster, key, version
+	AddKeyValues(string, string, []string, string) (string, error)    // appends to the values of key
+	RemoveKeyValues(string, string, []string, string) (string, error) // removes from the values of key
+}
+
+// a store keeping indexes derived from its clusters (eg, the reverse
+// indexes of the etcdstore), Reindex rebuilds them from the clusters, eg,
+// once the clusters are written in bulk (see Sync)
+type Reindexer interface {
+	Reindex() error
+}
+
+// same as the grammar (expr.peg), cluster names are [a-z0-9]+ separated
+// by '-' or '.', keys are [A-Z0-9]+
+var clusterName = regexp.MustCompile(`^[a-z0-9]+([-.][a-z0-9]+)*$`)
+var keyName = regexp.MustCompile(`^[A-Z0-9]+$`)
+
+// whether the name can be used for a cluster. RANGE is the top level
+// and can't be a cluster
+func ValidClusterName(name string) bool {
+	return name != "RANGE" && clusterName.MatchString(name)
+}
+
+// whether the name can be used for a key. KEYS is the list of keys
+// and can't be a key
+func ValidKeyName(name string) bool {
+	return name != "KEYS" && keyName.MatchString(name)
+}
+
+// whether the value can be stored, values can't be empty or have tabs
+// and newlines (they are used as separators by the stores)
+func ValidValue(value string) bool {
+	return value != "" && !strings.ContainsAny(value, "\t\n")
+}
+
+// whether the key and its values can be stored, the error is ErrInvalidName
+func ValidKeyValues(key string, values []string) error {
+	if !ValidKeyName(key) {
+		return fmt.Errorf("key [%s] is not valid, %w", key, ErrInvalidName)
+	}
+	for _, value := range values {
+		if !ValidValue(value) {
+			return fmt.Errorf("value [%s] is not valid, %w", value, ErrInvalidName)
+		}
+	}
+	return nil
+}